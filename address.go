@@ -30,9 +30,16 @@ func (m Mailbox) IsZero() bool {
 type ReversePath struct {
 	Mailbox Mailbox
 	Null    bool // True for the null reverse-path <>
+
+	// Raw is the path exactly as received by ParseReversePath, including
+	// angle brackets, quoting and any source route. It is empty for paths
+	// built in code. Since == compares Raw too, the same sender written
+	// two ways gives unequal paths: compare Mailbox and Null instead.
+	Raw string
 }
 
 // String returns the path formatted for the wire protocol (e.g., "<user@domain>" or "<>").
+// It is rebuilt from Mailbox; use Raw to forward the received form.
 func (rp ReversePath) String() string {
 	if rp.Null {
 		return "<>"
@@ -43,9 +50,15 @@ func (rp ReversePath) String() string {
 // ForwardPath represents the RCPT TO path (RFC 5321 §4.1.1.3).
 type ForwardPath struct {
 	Mailbox Mailbox
+
+	// Raw is the path exactly as received by ParseForwardPath, including
+	// angle brackets, quoting and any source route. It is empty for paths
+	// built in code. Since == compares Raw too, compare Mailbox instead.
+	Raw string
 }
 
 // String returns the path formatted for the wire protocol (e.g., "<user@domain>").
+// It is rebuilt from Mailbox; use Raw to forward the received form.
 func (fp ForwardPath) String() string {
 	return "<" + fp.Mailbox.String() + ">"
 }
@@ -85,11 +98,13 @@ func ParseMailbox(s string) (Mailbox, error) {
 
 // ParseReversePath parses a MAIL FROM path string.
 // It accepts "<>" (null reverse-path) or "<local@domain>" or "local@domain".
+// A source route ("<@relay.example:local@domain>") is validated and
+// ignored (RFC 5321 §4.1.2, Appendix C) but kept in Raw.
 func ParseReversePath(s string) (ReversePath, error) {
 	s = strings.TrimSpace(s)
 
 	if s == "<>" {
-		return ReversePath{Null: true}, nil
+		return ReversePath{Null: true, Raw: s}, nil
 	}
 
 	// Strip angle brackets if present.
@@ -99,18 +114,23 @@ func ParseReversePath(s string) (ReversePath, error) {
 	}
 
 	if inner == "" {
-		return ReversePath{Null: true}, nil
+		return ReversePath{Null: true, Raw: s}, nil
 	}
 
+	inner, err := stripSourceRoute(inner)
+	if err != nil {
+		return ReversePath{}, err
+	}
 	m, err := ParseMailbox(inner)
 	if err != nil {
 		return ReversePath{}, err
 	}
-	return ReversePath{Mailbox: m}, nil
+	return ReversePath{Mailbox: m, Raw: s}, nil
 }
 
 // ParseForwardPath parses a RCPT TO path string.
-// It accepts "<local@domain>" or "local@domain".
+// It accepts "<local@domain>" or "local@domain". A source route is
+// handled as in ParseReversePath.
 func ParseForwardPath(s string) (ForwardPath, error) {
 	s = strings.TrimSpace(s)
 
@@ -123,11 +143,36 @@ func ParseForwardPath(s string) (ForwardPath, error) {
 		return ForwardPath{}, errors.New("smtp: empty forward path")
 	}
 
+	inner, err := stripSourceRoute(inner)
+	if err != nil {
+		return ForwardPath{}, err
+	}
 	m, err := ParseMailbox(inner)
 	if err != nil {
 		return ForwardPath{}, err
 	}
-	return ForwardPath{Mailbox: m}, nil
+	return ForwardPath{Mailbox: m, Raw: s}, nil
+}
+
+// stripSourceRoute removes an A-d-l prefix, "@one.example,@two.example:",
+// from path after checking its domains (RFC 5321 §4.1.2).
+func stripSourceRoute(path string) (string, error) {
+	if !strings.HasPrefix(path, "@") {
+		return path, nil
+	}
+	route, rest, ok := strings.Cut(path, ":")
+	if !ok {
+		return "", errors.New("smtp: source route without colon")
+	}
+	for _, hop := range strings.Split(route, ",") {
+		if !strings.HasPrefix(hop, "@") {
+			return "", errors.New("smtp: invalid source route")
+		}
+		if err := validateDomain(hop[1:]); err != nil {
+			return "", err
+		}
+	}
+	return rest, nil
 }
 
 // validateLocalPart checks the local-part per RFC 5321 §4.1.2.
@@ -55,6 +55,8 @@ func TestParseReversePath(t *testing.T) {
 		{name: "normal path", input: "<user@example.com>", wantAddr: "user@example.com"},
 		{name: "without brackets", input: "user@example.com", wantAddr: "user@example.com"},
 		{name: "invalid address", input: "<invalid>", wantErr: true},
+		{name: "source route", input: "<@a.example,@b.example:user@example.com>", wantAddr: "user@example.com"},
+		{name: "bad source route", input: "<@a..example:user@example.com>", wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -87,6 +89,8 @@ func TestParseForwardPath(t *testing.T) {
 		{name: "without brackets", input: "user@example.com", want: "user@example.com"},
 		{name: "empty brackets", input: "<>", wantErr: true},
 		{name: "empty", input: "", wantErr: true},
+		{name: "source route", input: "<@relay.example:user@example.com>", want: "user@example.com"},
+		{name: "source route without colon", input: "<@relay.example>", wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -127,3 +131,25 @@ func TestForwardPath_String(t *testing.T) {
 		t.Errorf("ForwardPath.String() = %q, want \"<user@example.com>\"", got)
 	}
 }
+
+func TestPathRaw(t *testing.T) {
+	for _, raw := range []string{`<"john doe"@example.com>`, "<@relay.example:user@example.com>", "user@example.com"} {
+		fp, err := ParseForwardPath(" " + raw)
+		if err != nil {
+			t.Fatalf("ParseForwardPath(%q): %v", raw, err)
+		}
+		if fp.Raw != raw {
+			t.Errorf("ForwardPath.Raw = %q, want %q", fp.Raw, raw)
+		}
+		rp, err := ParseReversePath(raw)
+		if err != nil {
+			t.Fatalf("ParseReversePath(%q): %v", raw, err)
+		}
+		if rp.Raw != raw {
+			t.Errorf("ReversePath.Raw = %q, want %q", rp.Raw, raw)
+		}
+	}
+	if rp, _ := ParseReversePath("<>"); rp.Raw != "<>" {
+		t.Errorf("null path Raw = %q, want <>", rp.Raw)
+	}
+}
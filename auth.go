@@ -3,8 +3,15 @@ package smtp
 import (
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 // SASLMechanism defines a client-side SASL authentication mechanism.
@@ -99,3 +106,89 @@ func (a *cramMD5Auth) Next(challenge []byte) ([]byte, error) {
 	digest := hex.EncodeToString(mac.Sum(nil))
 	return []byte(a.username + " " + digest), nil
 }
+
+// ScramSHA256Auth returns a SASLMechanism implementing SASL SCRAM-SHA-256
+// (RFC 5802, RFC 7677) without channel binding. The password never crosses
+// the wire, and the server's final message is checked, so a server that
+// does not know the password cannot pretend to accept it.
+func ScramSHA256Auth(username, password string) SASLMechanism {
+	return &scramAuth{username: username, password: password}
+}
+
+type scramAuth struct {
+	username  string
+	password  string
+	nonce     string
+	bare      string // client-first-message-bare
+	signature []byte // Expected ServerSignature.
+	step      int
+}
+
+func (a *scramAuth) Name() string { return "SCRAM-SHA-256" }
+
+func (a *scramAuth) Start() ([]byte, error) {
+	a.nonce = rand.Text()
+	name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(a.username)
+	a.bare = "n=" + name + ",r=" + a.nonce
+	return []byte("n,," + a.bare), nil
+}
+
+func (a *scramAuth) Next(challenge []byte) ([]byte, error) {
+	a.step++
+	switch a.step {
+	case 1:
+		return a.clientFinal(string(challenge))
+	case 2:
+		// server-final-message = "v=" base64(ServerSignature)
+		v, ok := strings.CutPrefix(string(challenge), "v=")
+		got, err := base64.StdEncoding.DecodeString(v)
+		if !ok || err != nil || !hmac.Equal(got, a.signature) {
+			return nil, fmt.Errorf("smtp: SCRAM server signature mismatch")
+		}
+		return []byte{}, nil
+	default:
+		return nil, fmt.Errorf("smtp: unexpected SCRAM challenge at step %d", a.step)
+	}
+}
+
+// clientFinal answers the server-first-message "r=nonce,s=salt,i=count".
+func (a *scramAuth) clientFinal(serverFirst string) ([]byte, error) {
+	var nonce, salt string
+	iterations := 0
+	for attr := range strings.SplitSeq(serverFirst, ",") {
+		key, value, _ := strings.Cut(attr, "=")
+		switch key {
+		case "r":
+			nonce = value
+		case "s":
+			salt = value
+		case "i":
+			iterations, _ = strconv.Atoi(value)
+		case "m":
+			return nil, fmt.Errorf("smtp: unsupported SCRAM extension")
+		}
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || !strings.HasPrefix(nonce, a.nonce) || len(nonce) == len(a.nonce) || iterations <= 0 {
+		return nil, fmt.Errorf("smtp: invalid SCRAM server-first-message")
+	}
+
+	salted, err := pbkdf2.Key(sha256.New, a.password, saltBytes, iterations, sha256.Size)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: SCRAM key derivation: %w", err)
+	}
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce // "biws" is base64("n,,").
+	authMessage := a.bare + "," + serverFirst + "," + withoutProof
+	proof := make([]byte, len(clientKey))
+	subtle.XORBytes(proof, clientKey, scramHMAC(storedKey[:], authMessage))
+	a.signature = scramHMAC(scramHMAC(salted, "Server Key"), authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
@@ -107,3 +107,43 @@ func TestCramMD5Auth(t *testing.T) {
 func containsString(s, substr string) bool {
 	return len(s) >= len(substr) && s[:len(substr)] == substr
 }
+
+func TestScramSHA256Auth(t *testing.T) {
+	// Test vector from RFC 7677 §3.
+	auth := ScramSHA256Auth("user", "pencil")
+	if auth.Name() != "SCRAM-SHA-256" {
+		t.Errorf("Name() = %q, want SCRAM-SHA-256", auth.Name())
+	}
+	if _, err := auth.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	a := auth.(*scramAuth)
+	a.nonce = "rOprNGfwEbeRWgbNEkqO"
+	a.bare = "n=user,r=" + a.nonce
+
+	resp, err := auth.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil {
+		t.Fatalf("Next(server-first): %v", err)
+	}
+	want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if string(resp) != want {
+		t.Errorf("client-final-message = %q, want %q", resp, want)
+	}
+
+	if _, err := auth.Next([]byte("v=AAAA")); err == nil {
+		t.Error("Next accepted a wrong server signature")
+	}
+	a.step = 1
+	resp, err = auth.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+	if err != nil || len(resp) != 0 {
+		t.Errorf("Next(server-final) = %q, %v, want empty response", resp, err)
+	}
+}
+
+func TestScramSHA256Auth_BadNonce(t *testing.T) {
+	auth := ScramSHA256Auth("user", "pencil")
+	auth.Start()
+	if _, err := auth.Next([]byte("r=someoneelse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")); err == nil {
+		t.Error("Next accepted a nonce not extending the client's")
+	}
+}
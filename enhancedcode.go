@@ -24,20 +24,33 @@ var (
 	EnhancedCodeAmbiguousDest     = EnhancedCode{5, 1, 6} // Destination mailbox moved (no forwarding)
 	EnhancedCodeBadSenderSyntax   = EnhancedCode{5, 1, 7} // Bad sender's mailbox address syntax
 	EnhancedCodeBadSenderSystem   = EnhancedCode{5, 1, 8} // Bad sender's system address
+	EnhancedCodeTempSenderSystem  = EnhancedCode{4, 1, 8} // Bad sender's system address (transient)
 
+	EnhancedCodeTempMailbox       = EnhancedCode{4, 2, 1} // Mailbox not accepting messages, e.g. rate limited (transient)
 	EnhancedCodeMailboxFull       = EnhancedCode{5, 2, 2} // Mailbox full
+	EnhancedCodeTempSystem        = EnhancedCode{4, 3, 0} // Other or undefined mail system status (transient)
+	EnhancedCodeSystemFull        = EnhancedCode{4, 3, 1} // Mail system full (transient)
+	EnhancedCodeNotAccepting      = EnhancedCode{4, 3, 2} // System not accepting network messages (transient)
 	EnhancedCodeMsgTooLarge       = EnhancedCode{5, 3, 4} // Message too big for system
 
 	EnhancedCodeOtherNetwork      = EnhancedCode{4, 4, 0} // Other network/routing status (transient)
+	EnhancedCodeBadConnection     = EnhancedCode{4, 4, 2} // Bad connection, e.g. timed out (transient)
 	EnhancedCodeTempCongestion    = EnhancedCode{4, 4, 5} // System congestion (transient)
 
 	EnhancedCodeInvalidCommand    = EnhancedCode{5, 5, 1} // Invalid command
 	EnhancedCodeSyntaxError       = EnhancedCode{5, 5, 2} // Syntax error
 	EnhancedCodeTooManyRecipients = EnhancedCode{5, 5, 3} // Too many recipients
+	EnhancedCodeTempTooManyRecipients = EnhancedCode{4, 5, 3} // Too many recipients (transient)
 	EnhancedCodeInvalidParams     = EnhancedCode{5, 5, 4} // Invalid command arguments
+	EnhancedCodeAuthLineTooLong   = EnhancedCode{5, 5, 6} // Authentication exchange line is too long (RFC 4954)
 
+	EnhancedCodeInvalidContent    = EnhancedCode{5, 6, 0} // Other or undefined media error
+	EnhancedCodeNonASCII          = EnhancedCode{5, 6, 7} // Non-ASCII not permitted (RFC 6531)
+
+	EnhancedCodeAuthOK            = EnhancedCode{2, 7, 0} // Authentication succeeded (RFC 4954)
 	EnhancedCodeTempAuthFailure   = EnhancedCode{4, 7, 0} // Other security/policy status (transient)
 	EnhancedCodeAuthRequired      = EnhancedCode{5, 7, 0} // Other security/policy status (permanent)
+	EnhancedCodeNotAuthorized     = EnhancedCode{5, 7, 1} // Delivery not authorized, message refused
 	EnhancedCodeAuthCredentials   = EnhancedCode{5, 7, 8} // Authentication credentials invalid
 	EnhancedCodeEncryptRequired   = EnhancedCode{5, 7, 11} // Encryption required
 )
@@ -0,0 +1,147 @@
+package smtp
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Envelope is the SMTP envelope of a message with its transaction
+// parameters and trace information. Its JSON encoding is the canonical
+// schema for envelopes outside the SMTP session, such as webhook
+// payloads, spool metadata and audit logs:
+//
+//	{
+//	  "id": "4YB5TQ2ZCV7KD3MA",
+//	  "from": "sender@example.com",
+//	  "to": [{"address": "rcpt@example.org", "notify": ["FAILURE"], "orcpt": "rfc822;rcpt@example.org"}],
+//	  "size": 2048,
+//	  "body": "8BITMIME",
+//	  "smtputf8": true,
+//	  "ret": "HDRS",
+//	  "envid": "QQ314159",
+//	  "client": {"remote_addr": "192.0.2.1:52144", "helo": "mx.example.com", "tls": true, "auth": "alice", "session_id": "K2M4Q6S8U0W2Y4A6"},
+//	  "received": "2026-10-16T09:30:00Z"
+//	}
+//
+// Addresses appear without angle brackets and the null reverse-path as
+// ""; empty optional fields are omitted. Decoding validates the
+// addresses. New fields may be added; existing ones keep their names and
+// meaning.
+type Envelope struct {
+	ID       string      // Message or queue ID.
+	From     ReversePath // Reverse-path; null for bounces.
+	To       []Recipient // Accepted recipients.
+	Size     int64       // Message size in bytes.
+	Body     string      // BODY parameter: 7BIT, 8BITMIME or BINARYMIME.
+	SMTPUTF8 bool        // SMTPUTF8 parameter given.
+	DSNRet   string      // DSN RET parameter: FULL or HDRS.
+	DSNEnvID string      // DSN ENVID parameter, decoded.
+	Client   ClientInfo
+	Received time.Time
+}
+
+// IsBounce reports whether the envelope has the null reverse-path, as
+// bounces and other delivery notifications do.
+func (e Envelope) IsBounce() bool {
+	return e.From.Null
+}
+
+// Recipient is an envelope recipient with its DSN parameters (RFC 3461).
+type Recipient struct {
+	Address ForwardPath
+	Notify  []string // NEVER, or any of SUCCESS, FAILURE, DELAY.
+	ORcpt   string   // Original recipient, "addr-type;address", decoded.
+}
+
+// ClientInfo describes the SMTP client that submitted a message.
+type ClientInfo struct {
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	Helo       string `json:"helo,omitempty"` // EHLO/HELO identity.
+	TLS        bool   `json:"tls,omitempty"`
+	AuthUser   string `json:"auth,omitempty"` // Authenticated identity, if any.
+	SessionID  string `json:"session_id,omitempty"`
+}
+
+// envelopeJSON is Envelope with the reverse-path as a string.
+type envelopeJSON struct {
+	ID       string      `json:"id,omitempty"`
+	From     string      `json:"from"`
+	To       []Recipient `json:"to"`
+	Size     int64       `json:"size,omitempty"`
+	Body     string      `json:"body,omitempty"`
+	SMTPUTF8 bool        `json:"smtputf8,omitempty"`
+	DSNRet   string      `json:"ret,omitempty"`
+	DSNEnvID string      `json:"envid,omitempty"`
+	Client   ClientInfo  `json:"client"`
+	Received time.Time   `json:"received"`
+}
+
+// MarshalJSON encodes the envelope in the canonical schema.
+func (e Envelope) MarshalJSON() ([]byte, error) {
+	return json.Marshal(envelopeJSON{
+		ID:       e.ID,
+		From:     e.From.Mailbox.String(),
+		To:       e.To,
+		Size:     e.Size,
+		Body:     e.Body,
+		SMTPUTF8: e.SMTPUTF8,
+		DSNRet:   e.DSNRet,
+		DSNEnvID: e.DSNEnvID,
+		Client:   e.Client,
+		Received: e.Received,
+	})
+}
+
+// UnmarshalJSON decodes the canonical schema, validating the sender.
+func (e *Envelope) UnmarshalJSON(data []byte) error {
+	var ej envelopeJSON
+	if err := json.Unmarshal(data, &ej); err != nil {
+		return err
+	}
+	from, err := ParseReversePath(ej.From)
+	if err != nil {
+		return fmt.Errorf("smtp: envelope from: %w", err)
+	}
+	from.Raw = "" // The schema holds the address, not the received path.
+	*e = Envelope{
+		ID:       ej.ID,
+		From:     from,
+		To:       ej.To,
+		Size:     ej.Size,
+		Body:     ej.Body,
+		SMTPUTF8: ej.SMTPUTF8,
+		DSNRet:   ej.DSNRet,
+		DSNEnvID: ej.DSNEnvID,
+		Client:   ej.Client,
+		Received: ej.Received,
+	}
+	return nil
+}
+
+// recipientJSON is Recipient with the address as a string.
+type recipientJSON struct {
+	Address string   `json:"address"`
+	Notify  []string `json:"notify,omitempty"`
+	ORcpt   string   `json:"orcpt,omitempty"`
+}
+
+// MarshalJSON encodes the recipient in the canonical schema.
+func (r Recipient) MarshalJSON() ([]byte, error) {
+	return json.Marshal(recipientJSON{Address: r.Address.Mailbox.String(), Notify: r.Notify, ORcpt: r.ORcpt})
+}
+
+// UnmarshalJSON decodes the canonical schema, validating the address.
+func (r *Recipient) UnmarshalJSON(data []byte) error {
+	var rj recipientJSON
+	if err := json.Unmarshal(data, &rj); err != nil {
+		return err
+	}
+	addr, err := ParseForwardPath(rj.Address)
+	if err != nil {
+		return fmt.Errorf("smtp: envelope recipient: %w", err)
+	}
+	addr.Raw = "" // As for From.
+	*r = Recipient{Address: addr, Notify: rj.Notify, ORcpt: rj.ORcpt}
+	return nil
+}
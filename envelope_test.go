@@ -0,0 +1,60 @@
+package smtp
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeJSON(t *testing.T) {
+	env := Envelope{
+		ID:   "Q1",
+		From: ReversePath{Mailbox: Mailbox{LocalPart: "sender", Domain: "example.com"}},
+		To: []Recipient{
+			{Address: ForwardPath{Mailbox: Mailbox{LocalPart: "rcpt", Domain: "example.org"}}, Notify: []string{"FAILURE"}, ORcpt: "rfc822;rcpt@example.org"},
+			{Address: ForwardPath{Mailbox: Mailbox{LocalPart: "other", Domain: "example.org"}}},
+		},
+		Size:     2048,
+		Body:     "8BITMIME",
+		SMTPUTF8: true,
+		Client:   ClientInfo{RemoteAddr: "192.0.2.1:52144", Helo: "mx.example.com", TLS: true},
+		Received: time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC),
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"id":"Q1","from":"sender@example.com",` +
+		`"to":[{"address":"rcpt@example.org","notify":["FAILURE"],"orcpt":"rfc822;rcpt@example.org"},{"address":"other@example.org"}],` +
+		`"size":2048,"body":"8BITMIME","smtputf8":true,` +
+		`"client":{"remote_addr":"192.0.2.1:52144","helo":"mx.example.com","tls":true},` +
+		`"received":"2026-10-16T09:30:00Z"}`
+	if string(data) != want {
+		t.Errorf("JSON =\n%s\nwant\n%s", data, want)
+	}
+
+	var got Envelope
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, env) {
+		t.Errorf("round trip = %+v, want %+v", got, env)
+	}
+}
+
+func TestEnvelopeJSON_NullSenderAndInvalidPath(t *testing.T) {
+	var env Envelope
+	if err := json.Unmarshal([]byte(`{"from":"","to":[{"address":"a@example.com"}]}`), &env); err != nil {
+		t.Fatal(err)
+	}
+	if !env.From.Null || !env.IsBounce() {
+		t.Errorf("From = %+v, want the null path", env.From)
+	}
+
+	err := json.Unmarshal([]byte(`{"from":"","to":[{"address":"not an address"}]}`), &env)
+	if err == nil || !strings.Contains(err.Error(), "smtp:") {
+		t.Errorf("err = %v, want an address parse error", err)
+	}
+}
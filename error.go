@@ -2,7 +2,10 @@ package smtp
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // SMTPError represents an SMTP protocol error with a reply code,
@@ -26,6 +29,62 @@ func (e *SMTPError) Temporary() bool {
 	return e.Code.IsTransient()
 }
 
+// retryHint matches retry hints such as "try again in 5 minutes" or
+// "retry after 2 days". The number needs a unit, so that status codes
+// such as "(4.4.2)" and other bare numbers are not taken for delays.
+var retryHint = regexp.MustCompile(`(?i)\b(?:retry|try again|wait)\b\D{0,20}?(\d+)\s*(weeks?|w|days?|d|hours?|hrs?|h|minutes?|mins?|m|seconds?|secs?|s)\b`)
+
+// retryAfter matches a "Retry-After: 120" hint, in seconds as in the HTTP
+// header field.
+var retryAfter = regexp.MustCompile(`(?i)\bretry-after:\s*(\d+)\b`)
+
+// retryUnits maps the first letter of a retry hint's unit to its length.
+var retryUnits = map[byte]time.Duration{
+	'w': 7 * 24 * time.Hour,
+	'd': 24 * time.Hour,
+	'h': time.Hour,
+	'm': time.Minute,
+	's': time.Second,
+}
+
+const (
+	// greylistRetry is the usual delay after which greylisting servers
+	// accept a retried message.
+	greylistRetry = 5 * time.Minute
+
+	// maxRetryHint caps parsed hints.
+	maxRetryHint = 7 * 24 * time.Hour
+)
+
+// SuggestedRetry returns how long the server suggests waiting before
+// retrying after a transient failure: the delay given in the message, as
+// in "421 4.7.0 Too many connections, try again in 10 minutes", or for a
+// greylisting reply without one, 5 minutes. ok is false for permanent
+// failures and for replies that give no hint, which leaves the caller's
+// own backoff in charge.
+func (e *SMTPError) SuggestedRetry() (d time.Duration, ok bool) {
+	if !e.Temporary() {
+		return 0, false
+	}
+	n, unit := "", time.Second
+	if m := retryAfter.FindStringSubmatch(e.Message); m != nil {
+		n = m[1]
+	} else if m := retryHint.FindStringSubmatch(e.Message); m != nil {
+		n, unit = m[1], retryUnits[strings.ToLower(m[2])[0]]
+	}
+	if n, err := strconv.Atoi(n); err == nil && n > 0 {
+		if time.Duration(n) > maxRetryHint/unit {
+			return maxRetryHint, true
+		}
+		return time.Duration(n) * unit, true
+	}
+	msg := strings.ToLower(e.Message)
+	if strings.Contains(msg, "greylist") || strings.Contains(msg, "graylist") {
+		return greylistRetry, true
+	}
+	return 0, false
+}
+
 // WireLines returns the error formatted as SMTP wire-protocol reply lines.
 // Multi-line messages (containing newlines) are formatted with continuation
 // lines using the "code-SP" / "code-hyphen" convention (RFC 5321 §4.2).
@@ -1,6 +1,9 @@
 package smtp
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestSMTPError_Error(t *testing.T) {
 	tests := []struct {
@@ -37,6 +40,35 @@ func TestSMTPError_Temporary(t *testing.T) {
 	}
 }
 
+func TestSMTPError_SuggestedRetry(t *testing.T) {
+	tests := []struct {
+		code ReplyCode
+		msg  string
+		want time.Duration
+		ok   bool
+	}{
+		{421, "Too many connections, try again in 10 minutes", 10 * time.Minute, true},
+		{450, "Rate limited, retry after 300 seconds", 300 * time.Second, true},
+		{451, "Retry-After: 120", 2 * time.Minute, true},
+		{421, "Please try again later in 2h", 2 * time.Hour, true},
+		{450, "Recipient address rejected: Greylisted, see http://postgrey.schweikert.ch/", greylistRetry, true},
+		{450, "Try again in 99999 hours", 7 * 24 * time.Hour, true},
+		{421, "Too many messages, retry in 1 day", 24 * time.Hour, true},
+		{421, "Blocked, wait 2 weeks", 7 * 24 * time.Hour, true},
+		{450, "Mailbox busy, try again later (4.4.2)", 0, false},
+		{451, "Please retry at 10", 0, false},
+		{450, "Try again in 99999999999999999999 seconds", 0, false},
+		{451, "Temporary local problem, try again later", 0, false},
+		{550, "Blocked, do not retry for 10 minutes", 0, false},
+	}
+	for _, tt := range tests {
+		d, ok := (&SMTPError{Code: tt.code, Message: tt.msg}).SuggestedRetry()
+		if d != tt.want || ok != tt.ok {
+			t.Errorf("%d %q: SuggestedRetry() = %v, %v; want %v, %v", tt.code, tt.msg, d, ok, tt.want, tt.ok)
+		}
+	}
+}
+
 func TestSMTPError_WireLines(t *testing.T) {
 	tests := []struct {
 		name string
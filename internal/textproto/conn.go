@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // MaxCommandLineLen is the maximum length of an SMTP command line
@@ -23,31 +24,110 @@ const MaxCommandLineLen = 512
 // including CRLF (RFC 5322 §2.1.1).
 const MaxTextLineLen = 1000
 
+// ErrLineTooLong is returned by ReadLine for a line over the limit.
+var ErrLineTooLong = errors.New("smtp: line too long")
+
+// ErrStalled is returned by reads when no data arrived for the stall
+// timeout set with SetStallTimeout, before the read deadline.
+var ErrStalled = errors.New("smtp: transfer stalled")
+
+// MaxReplyLen is the maximum length of a reply line including the reply
+// code and CRLF (RFC 5321 §4.5.3.1.5). WriteReply wraps longer text.
+const MaxReplyLen = 512
+
 // MaxReplyLineLen is a generous limit for reply lines to prevent memory exhaustion.
 const MaxReplyLineLen = 2048
 
+// DefaultBufferSize is the size of the read and write buffers of a Conn
+// created by NewConn.
+const DefaultBufferSize = 4096
+
 // Conn wraps a net.Conn with buffered reading and writing for SMTP protocol I/O.
 type Conn struct {
 	conn net.Conn
 	r    *bufio.Reader
 	w    *bufio.Writer
+
+	readSize, writeSize int // Buffer sizes, kept for ReplaceConn.
+	maxReplyLine        int // Longest reply line ReadReply accepts.
+	lastReply           Reply
+	dw                  dotWriter // Reused by DotWriter, with its buffer.
+
+	limiter   *tokenBucket // Read rate limiter; nil means unlimited.
+	throttled bool         // True while reads are subject to limiter.
+
+	deadline time.Time     // Read deadline set by SetReadDeadline.
+	stall    time.Duration // Longest wait for data in one read; 0 means none.
 }
 
 // NewConn creates a new protocol Conn wrapping the given network connection.
 func NewConn(c net.Conn) *Conn {
-	return &Conn{
-		conn: c,
-		r:    bufio.NewReaderSize(c, 4096),
-		w:    bufio.NewWriterSize(c, 4096),
+	return NewConnSize(c, DefaultBufferSize, DefaultBufferSize)
+}
+
+// NewConnSize is like NewConn with the given read and write buffer
+// sizes. Zero or a negative size means DefaultBufferSize.
+func NewConnSize(c net.Conn, readSize, writeSize int) *Conn {
+	if readSize <= 0 {
+		readSize = DefaultBufferSize
 	}
+	if writeSize <= 0 {
+		writeSize = DefaultBufferSize
+	}
+	conn := &Conn{
+		conn:         c,
+		w:            bufio.NewWriterSize(c, writeSize),
+		readSize:     readSize,
+		writeSize:    writeSize,
+		maxReplyLine: MaxReplyLineLen,
+	}
+	conn.r = bufio.NewReaderSize(connReader{conn}, readSize)
+	return conn
 }
 
 // ReplaceConn replaces the underlying net.Conn (used after TLS upgrade)
 // and resets the buffered reader/writer.
 func (c *Conn) ReplaceConn(nc net.Conn) {
 	c.conn = nc
-	c.r = bufio.NewReaderSize(nc, 4096)
-	c.w = bufio.NewWriterSize(nc, 4096)
+	c.r = bufio.NewReaderSize(connReader{c}, c.readSize)
+	c.w = bufio.NewWriterSize(nc, c.writeSize)
+}
+
+// SetMaxReplyLineLen sets the longest reply line, including CRLF, that
+// ReadReply accepts. Zero or a negative value restores MaxReplyLineLen.
+func (c *Conn) SetMaxReplyLineLen(n int) {
+	if n <= 0 {
+		n = MaxReplyLineLen
+	}
+	c.maxReplyLine = n
+}
+
+// SetReadRate limits throttled reads to bytesPerSec using a token bucket.
+// The limit only applies while throttling is enabled with ThrottleReads.
+// Zero or a negative value removes the limit.
+func (c *Conn) SetReadRate(bytesPerSec int64) {
+	if bytesPerSec <= 0 {
+		c.limiter = nil
+		return
+	}
+	c.limiter = newTokenBucket(bytesPerSec)
+}
+
+// ThrottleReads enables or disables the read rate limit set by SetReadRate.
+// It is typically enabled only while a message body is being received.
+func (c *Conn) ThrottleReads(enabled bool) {
+	c.throttled = enabled
+}
+
+// SetStallTimeout makes reads fail with ErrStalled when no data arrives
+// for d, independently of the read deadline, which still bounds the whole
+// transfer. It is typically set only while a message body is being
+// received. Zero or a negative value removes the timeout.
+func (c *Conn) SetStallTimeout(d time.Duration) {
+	if d <= 0 && c.stall > 0 {
+		c.conn.SetReadDeadline(c.deadline)
+	}
+	c.stall = max(d, 0)
 }
 
 // NetConn returns the underlying net.Conn.
@@ -63,15 +143,14 @@ func (c *Conn) Close() error {
 // SetDeadlineFromContext sets the connection read/write deadline from a
 // context's deadline. If the context has no deadline, the deadline is cleared.
 func (c *Conn) SetDeadlineFromContext(ctx context.Context) {
-	if dl, ok := ctx.Deadline(); ok {
-		c.conn.SetDeadline(dl)
-	} else {
-		c.conn.SetDeadline(time.Time{})
-	}
+	dl, _ := ctx.Deadline()
+	c.deadline = dl
+	c.conn.SetDeadline(dl)
 }
 
 // SetReadDeadline sets the read deadline on the underlying connection.
 func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
 	return c.conn.SetReadDeadline(t)
 }
 
@@ -87,6 +166,13 @@ func (c *Conn) ReadLine(maxLen int) (string, error) {
 	var line []byte
 	for {
 		chunk, isPrefix, err := c.r.ReadLine()
+		if line == nil && !isPrefix && err == nil {
+			// The whole line was buffered: convert it without a copy.
+			if len(chunk) > maxLen-2 {
+				return "", fmt.Errorf("%w (%d bytes, max %d)", ErrLineTooLong, len(chunk)+2, maxLen)
+			}
+			return string(chunk), nil
+		}
 		line = append(line, chunk...)
 		if err != nil {
 			return "", err
@@ -103,11 +189,11 @@ func (c *Conn) ReadLine(maxLen int) (string, error) {
 					break
 				}
 			}
-			return "", fmt.Errorf("smtp: line too long (%d bytes, max %d)", len(line), maxLen)
+			return "", fmt.Errorf("%w (%d bytes, max %d)", ErrLineTooLong, len(line), maxLen)
 		}
 	}
 	if len(line) > maxLen-2 { // -2 for the \r\n we already consumed
-		return "", fmt.Errorf("smtp: line too long (%d bytes, max %d)", len(line)+2, maxLen)
+		return "", fmt.Errorf("%w (%d bytes, max %d)", ErrLineTooLong, len(line)+2, maxLen)
 	}
 	return string(line), nil
 }
@@ -123,6 +209,20 @@ func (c *Conn) WriteLine(line string) error {
 	return c.w.Flush()
 }
 
+// WriteCommand writes the concatenation of parts followed by \r\n and
+// flushes the buffer, without building the line in memory first.
+func (c *Conn) WriteCommand(parts ...string) error {
+	for _, part := range parts {
+		if _, err := c.w.WriteString(part); err != nil {
+			return err
+		}
+	}
+	if _, err := c.w.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
 // WriteLines writes multiple lines, each followed by \r\n, and flushes once.
 func (c *Conn) WriteLines(lines ...string) error {
 	for _, line := range lines {
@@ -147,7 +247,7 @@ type Reply struct {
 func (c *Conn) ReadReply() (Reply, error) {
 	var lines []string
 	for {
-		line, err := c.ReadLine(MaxReplyLineLen)
+		line, err := c.ReadLine(c.maxReplyLine)
 		if err != nil {
 			return Reply{}, fmt.Errorf("smtp: reading reply: %w", err)
 		}
@@ -164,7 +264,8 @@ func (c *Conn) ReadReply() (Reply, error) {
 		if len(line) == 3 {
 			// "250\r\n" with no text — final line.
 			lines = append(lines, "")
-			return Reply{Code: code, Lines: lines}, nil
+			c.lastReply = Reply{Code: code, Lines: lines}
+			return c.lastReply, nil
 		}
 
 		sep := line[3]
@@ -177,18 +278,31 @@ func (c *Conn) ReadReply() (Reply, error) {
 		case ' ':
 			// Final line.
 			lines = append(lines, text)
-			return Reply{Code: code, Lines: lines}, nil
+			c.lastReply = Reply{Code: code, Lines: lines}
+			return c.lastReply, nil
 		default:
 			return Reply{}, fmt.Errorf("smtp: invalid reply separator %q", sep)
 		}
 	}
 }
 
+// LastReply returns the reply most recently read by ReadReply.
+func (c *Conn) LastReply() Reply {
+	return c.lastReply
+}
+
 // WriteReply writes a single-line or multi-line reply to the connection.
+// Lines longer than MaxReplyLen are wrapped into several reply lines,
+// each repeating a leading enhanced status code (RFC 2034 §3).
 func (c *Conn) WriteReply(code int, lines ...string) error {
 	if len(lines) == 0 {
 		lines = []string{""}
 	}
+	var wrapped []string
+	for _, line := range lines {
+		wrapped = append(wrapped, wrapReplyLine(line)...)
+	}
+	lines = wrapped
 	for i, line := range lines {
 		var sep byte = ' '
 		if i < len(lines)-1 {
@@ -205,6 +319,34 @@ func (c *Conn) WriteReply(code int, lines ...string) error {
 	return c.w.Flush()
 }
 
+// wrapReplyLine splits reply text that does not fit in MaxReplyLen into
+// pieces that do, breaking at spaces where possible.
+func wrapReplyLine(line string) []string {
+	const maxText = MaxReplyLen - len("250 \r\n")
+	if len(line) <= maxText {
+		return []string{line}
+	}
+	prefix := ""
+	if class, _, _, rest := ParseEnhancedCode(line); class != 0 {
+		prefix = line[:len(line)-len(rest)]
+		line = rest
+	}
+	width := maxText - len(prefix)
+	var out []string
+	for len(line) > width {
+		cut := strings.LastIndexByte(line[:width+1], ' ')
+		if cut <= 0 {
+			cut = width
+			for cut > 1 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+		}
+		out = append(out, prefix+line[:cut])
+		line = strings.TrimLeft(line[cut:], " ")
+	}
+	return append(out, prefix+line)
+}
+
 // BufReader returns the underlying buffered reader. This is needed by the
 // DotReader to read from the buffered stream.
 func (c *Conn) BufReader() *bufio.Reader {
@@ -216,11 +358,10 @@ func (c *Conn) BufWriter() *bufio.Writer {
 	return c.w
 }
 
-// Cmd sends a command line and reads the reply. Convenience method for
-// simple command/response exchanges.
-func (c *Conn) Cmd(format string, args ...any) (Reply, error) {
-	cmd := fmt.Sprintf(format, args...)
-	if err := c.WriteLine(cmd); err != nil {
+// Cmd sends the command line made of parts, as WriteCommand, and reads
+// the reply. Convenience method for simple command/response exchanges.
+func (c *Conn) Cmd(parts ...string) (Reply, error) {
+	if err := c.WriteCommand(parts...); err != nil {
 		return Reply{}, err
 	}
 	return c.ReadReply()
@@ -235,9 +376,11 @@ func (c *Conn) DotReader() io.Reader {
 
 // DotWriter returns an io.WriteCloser that writes dot-stuffed DATA to
 // the connection. Calling Close writes the termination sequence "\r\n.\r\n"
-// and flushes the buffer (RFC 5321 §4.5.2).
+// and flushes the buffer (RFC 5321 §4.5.2). The writer and its copy
+// buffer are reused, so it must not be used after the next call.
 func (c *Conn) DotWriter() io.WriteCloser {
-	return newDotWriter(c.w)
+	c.dw = dotWriter{w: c.w, beginLine: true, buf: c.dw.buf}
+	return &c.dw
 }
 
 // ParseEnhancedCode attempts to parse an enhanced status code from the
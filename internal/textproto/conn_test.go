@@ -1,9 +1,11 @@
 package textproto
 
 import (
+	"io"
 	"net"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestReadLine(t *testing.T) {
@@ -78,6 +80,28 @@ func TestWriteLine(t *testing.T) {
 	}
 }
 
+func TestWriteCommand(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	conn := NewConn(server)
+
+	go func() {
+		conn.WriteCommand("MAIL FROM:<", "user@example.com", ">", " SIZE=100")
+	}()
+
+	buf := make([]byte, 64)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	want := "MAIL FROM:<user@example.com> SIZE=100\r\n"
+	if got := string(buf[:n]); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
 func TestReadReply_SingleLine(t *testing.T) {
 	server, client := net.Pipe()
 	defer server.Close()
@@ -249,3 +273,79 @@ func TestParseEnhancedCode(t *testing.T) {
 		})
 	}
 }
+
+func TestThrottleReads(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	conn := NewConn(server)
+	conn.SetReadRate(1000)
+	conn.ThrottleReads(true)
+
+	go func() {
+		client.Write([]byte(strings.Repeat("x", 1500)))
+	}()
+
+	start := time.Now()
+	buf := make([]byte, 1500)
+	if _, err := io.ReadFull(conn.BufReader(), buf); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	// The first 1000 bytes are the initial burst; the remaining 500 need ~0.5s.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("read took %v, want at least ~500ms at 1000 B/s", elapsed)
+	}
+}
+
+func TestThrottleReads_Disabled(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	conn := NewConn(server)
+	conn.SetReadRate(10)
+
+	go func() {
+		client.Write([]byte(strings.Repeat("x", 1000) + "\r\n"))
+	}()
+
+	start := time.Now()
+	if _, err := conn.ReadLine(MaxTextLineLen + 2); err != nil {
+		t.Fatalf("ReadLine: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("unthrottled read took %v", elapsed)
+	}
+}
+
+func TestWriteReply_Wrap(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	text := strings.Repeat("recipient@example.com ", 40) + strings.Repeat("x", 600)
+	go NewConn(server).WriteReply(550, "5.1.1 "+text)
+
+	reply, err := NewConn(client).ReadReply()
+	if err != nil {
+		t.Fatalf("ReadReply: %v", err)
+	}
+	if reply.Code != 550 || len(reply.Lines) < 3 {
+		t.Fatalf("reply = %d with %d lines, want a wrapped 550", reply.Code, len(reply.Lines))
+	}
+	var joined []string
+	for _, line := range reply.Lines {
+		if len("550 ")+len(line)+len("\r\n") > MaxReplyLen {
+			t.Errorf("line of %d bytes exceeds MaxReplyLen", len(line))
+		}
+		class, _, _, rest := ParseEnhancedCode(line)
+		if class != 5 {
+			t.Errorf("line %q lacks the enhanced code", line)
+		}
+		joined = append(joined, rest)
+	}
+	if got := strings.Join(joined, " "); strings.ReplaceAll(got, " ", "") != strings.ReplaceAll(text, " ", "") {
+		t.Errorf("wrapped text does not match the original")
+	}
+}
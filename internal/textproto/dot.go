@@ -2,6 +2,7 @@ package textproto
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 )
 
@@ -11,6 +12,7 @@ import (
 type dotReader struct {
 	r     *bufio.Reader
 	state int
+	err   error // Read error that ended the body, returned once data runs out.
 }
 
 const (
@@ -28,6 +30,9 @@ func newDotReader(r *bufio.Reader) *dotReader {
 
 func (d *dotReader) Read(p []byte) (int, error) {
 	if d.state == dotStateEOF {
+		if d.err != nil {
+			return 0, d.err
+		}
 		return 0, io.EOF
 	}
 
@@ -36,6 +41,7 @@ func (d *dotReader) Read(p []byte) (int, error) {
 		b, err := d.r.ReadByte()
 		if err != nil {
 			d.state = dotStateEOF
+			d.err = err
 			if n > 0 {
 				return n, nil
 			}
@@ -150,36 +156,68 @@ type dotWriter struct {
 	w         *bufio.Writer
 	beginLine bool
 	closed    bool
+	buf       []byte // ReadFrom buffer, allocated on first use.
 }
 
 func newDotWriter(w *bufio.Writer) *dotWriter {
 	return &dotWriter{w: w, beginLine: true}
 }
 
+// Write dot-stuffs p. It writes whole lines at a time, inserting the
+// extra dot only where a line starts with one.
 func (d *dotWriter) Write(p []byte) (int, error) {
 	if d.closed {
 		return 0, io.ErrClosedPipe
 	}
 
 	written := 0
-	for _, b := range p {
-		if d.beginLine && b == '.' {
+	for written < len(p) {
+		if d.beginLine && p[written] == '.' {
 			// Dot-stuff: add extra dot.
 			if err := d.w.WriteByte('.'); err != nil {
 				return written, err
 			}
 		}
 
-		if err := d.w.WriteByte(b); err != nil {
+		end := len(p)
+		if i := bytes.IndexByte(p[written:], '\n'); i >= 0 {
+			end = written + i + 1
+		}
+		n, err := d.w.Write(p[written:end])
+		written += n
+		if err != nil {
 			return written, err
 		}
-		written++
-
-		d.beginLine = (b == '\n')
+		d.beginLine = p[end-1] == '\n'
 	}
 	return written, nil
 }
 
+// ReadFrom dot-stuffs everything read from r, reading in large chunks
+// instead of going through io.Copy's intermediate buffer.
+func (d *dotWriter) ReadFrom(r io.Reader) (int64, error) {
+	if d.buf == nil {
+		d.buf = make([]byte, 64*1024)
+	}
+	buf := d.buf
+	var total int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := d.Write(buf[:n]); werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
 // Close writes the termination sequence and flushes the writer.
 // If the last data written did not end with \r\n, Close adds \r\n first.
 func (d *dotWriter) Close() error {
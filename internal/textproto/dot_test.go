@@ -6,6 +6,7 @@ import (
 	"io"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestDotWriter_Basic(t *testing.T) {
@@ -101,6 +102,35 @@ func TestDotWriter_MultipleDotsOnLine(t *testing.T) {
 	}
 }
 
+func TestDotWriter_SplitWrites(t *testing.T) {
+	msg := "a\r\n.b\r\n..c\r\n\r\n.\r\nd."
+	want := "a\r\n..b\r\n...c\r\n\r\n..\r\nd.\r\n.\r\n"
+
+	// Every split point, so line starts fall at chunk boundaries.
+	for i := range len(msg) + 1 {
+		var buf bytes.Buffer
+		w := newDotWriter(bufio.NewWriter(&buf))
+		w.Write([]byte(msg[:i]))
+		w.Write([]byte(msg[i:]))
+		w.Close()
+		if got := buf.String(); got != want {
+			t.Errorf("split at %d: got %q, want %q", i, got, want)
+		}
+	}
+
+	// ReadFrom, one byte per Read.
+	var buf bytes.Buffer
+	w := newDotWriter(bufio.NewWriter(&buf))
+	n, err := w.ReadFrom(iotest.OneByteReader(strings.NewReader(msg)))
+	if err != nil || n != int64(len(msg)) {
+		t.Fatalf("ReadFrom = %d, %v, want %d, nil", n, err, len(msg))
+	}
+	w.Close()
+	if got := buf.String(); got != want {
+		t.Errorf("ReadFrom: got %q, want %q", got, want)
+	}
+}
+
 func TestDotReader_Basic(t *testing.T) {
 	input := "Hello, World!\r\n.\r\n"
 	r := newDotReader(bufio.NewReader(strings.NewReader(input)))
@@ -213,3 +243,47 @@ func TestDotReader_SmallBuffer(t *testing.T) {
 		t.Errorf("got %q, want %q", result, want)
 	}
 }
+
+// benchMessage returns a 10 MB body of 78-byte lines, every tenth of
+// which starts with a dot.
+func benchMessage() []byte {
+	line := strings.Repeat("x", 76) + "\r\n"
+	var b bytes.Buffer
+	for i := 0; b.Len() < 10*1024*1024; i++ {
+		if i%10 == 0 {
+			b.WriteString("." + line[1:])
+		} else {
+			b.WriteString(line)
+		}
+	}
+	return b.Bytes()
+}
+
+func BenchmarkDotWriter(b *testing.B) {
+	msg := benchMessage()
+	b.SetBytes(int64(len(msg)))
+	for b.Loop() {
+		w := newDotWriter(bufio.NewWriter(io.Discard))
+		if _, err := w.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDotWriter_ReadFrom(b *testing.B) {
+	msg := benchMessage()
+	b.SetBytes(int64(len(msg)))
+	for b.Loop() {
+		w := newDotWriter(bufio.NewWriter(io.Discard))
+		// Hide WriterTo so io.Copy uses the destination's ReadFrom.
+		if _, err := io.Copy(w, struct{ io.Reader }{bytes.NewReader(msg)}); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package textproto
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// tokenBucket is a simple token-bucket rate limiter measured in bytes.
+// Tokens refill continuously at rate per second up to burst. Consuming
+// more tokens than are available puts the bucket into debt, and the
+// caller sleeps until the debt is repaid.
+type tokenBucket struct {
+	rate   float64 // Tokens added per second.
+	burst  float64 // Maximum number of tokens held.
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSec int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(bytesPerSec),
+		burst:  float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// maxRead returns the largest read size that should be issued at once,
+// so a single read cannot exceed one second's worth of bandwidth.
+func (b *tokenBucket) maxRead() int {
+	if b.burst < 1 {
+		return 1
+	}
+	return int(b.burst)
+}
+
+// take consumes n tokens, sleeping as long as needed to stay within the rate.
+func (b *tokenBucket) take(n int) {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens < 0 {
+		time.Sleep(time.Duration(-b.tokens / b.rate * float64(time.Second)))
+	}
+}
+
+// connReader feeds the buffered reader from the current underlying
+// connection, applying the read rate limit while throttling is enabled
+// and the stall timeout while one is set.
+type connReader struct {
+	c *Conn
+}
+
+func (r connReader) Read(p []byte) (int, error) {
+	c := r.c
+	if c.stall <= 0 {
+		return r.read(p)
+	}
+	// Wait at most the stall timeout for data, unless the read deadline
+	// comes first.
+	deadline := time.Now().Add(c.stall)
+	overall := !c.deadline.IsZero() && c.deadline.Before(deadline)
+	if overall {
+		deadline = c.deadline
+	}
+	c.conn.SetReadDeadline(deadline)
+	n, err := r.read(p)
+	if err != nil && !overall && errors.Is(err, os.ErrDeadlineExceeded) {
+		err = ErrStalled
+	}
+	return n, err
+}
+
+func (r connReader) read(p []byte) (int, error) {
+	c := r.c
+	if c.limiter == nil || !c.throttled {
+		return c.conn.Read(p)
+	}
+	if limit := c.limiter.maxRead(); len(p) > limit {
+		p = p[:limit]
+	}
+	n, err := c.conn.Read(p)
+	if n > 0 {
+		c.limiter.take(n)
+	}
+	return n, err
+}
@@ -0,0 +1,87 @@
+// Package ttlcache implements the expiring maps behind the caches and
+// rate limits of smtpclient and smtpserver.
+package ttlcache
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepEvery is how many additions pass between sweeps of expired
+// entries, which keep the map from growing without bound.
+const sweepEvery = 1024
+
+// Cache maps keys to values that expire. Times are passed in by the
+// caller. The zero value is ready to use, and a Cache is safe for
+// concurrent use.
+type Cache[V any] struct {
+	mu      sync.Mutex
+	entries map[string]entry[V]
+	adds    int
+}
+
+type entry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// Get returns the value for key if it has not expired at now.
+func (c *Cache[V]) Get(key string, now time.Time) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !now.Before(e.expires) {
+		var zero V
+		return zero, false
+	}
+	return e.value, true
+}
+
+// Set stores value for key until now plus ttl.
+func (c *Cache[V]) Set(key string, value V, now time.Time, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(key, value, now, ttl)
+}
+
+// Add stores value for key until now plus ttl unless key holds a value
+// that has not expired, and reports whether it did.
+func (c *Cache[V]) Add(key string, value V, now time.Time, ttl time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok && now.Before(e.expires) {
+		return false
+	}
+	c.set(key, value, now, ttl)
+	return true
+}
+
+// Delete removes key.
+func (c *Cache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// Len returns the number of entries held, including expired ones not yet
+// swept.
+func (c *Cache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+func (c *Cache[V]) set(key string, value V, now time.Time, ttl time.Duration) {
+	if c.entries == nil {
+		c.entries = make(map[string]entry[V])
+	}
+	c.entries[key] = entry[V]{value, now.Add(ttl)}
+	c.adds++
+	if c.adds%sweepEvery == 0 {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+}
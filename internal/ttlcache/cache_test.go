@@ -0,0 +1,44 @@
+package ttlcache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	var c Cache[int]
+	now := time.Now()
+	c.Set("a", 1, now, time.Minute)
+	if v, ok := c.Get("a", now); !ok || v != 1 {
+		t.Errorf("Get = %d, %v; want 1, true", v, ok)
+	}
+	if _, ok := c.Get("a", now.Add(time.Minute)); ok {
+		t.Error("Get returned an expired entry")
+	}
+	if c.Add("a", 2, now, time.Minute) {
+		t.Error("Add replaced a live entry")
+	}
+	if !c.Add("a", 3, now.Add(time.Minute), time.Minute) {
+		t.Error("Add did not replace an expired entry")
+	}
+	c.Delete("a")
+	if _, ok := c.Get("a", now); ok {
+		t.Error("Get returned a deleted entry")
+	}
+}
+
+func TestCacheSweep(t *testing.T) {
+	var c Cache[struct{}]
+	now := time.Now()
+	for i := range sweepEvery {
+		c.Set(fmt.Sprint(i), struct{}{}, now, time.Nanosecond)
+	}
+	c.Set("live", struct{}{}, now.Add(time.Second), time.Minute)
+	for i := range sweepEvery - 1 {
+		c.Set(fmt.Sprint("x", i), struct{}{}, now.Add(time.Second), time.Minute)
+	}
+	if n := c.Len(); n != sweepEvery {
+		t.Errorf("cache holds %d entries, want the %d live ones", n, sweepEvery)
+	}
+}
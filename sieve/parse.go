@@ -0,0 +1,371 @@
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokTag
+	tokNumber
+	tokString
+	tokPunct // One of ; , ( ) [ ] { }
+)
+
+type token struct {
+	kind tokenKind
+	text string // Identifier, tag name (without ':'), string value or punctuation.
+	num  int64
+	line int
+}
+
+// lexer splits a script into tokens (RFC 5228 §8.1).
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *lexer) errorf(format string, args ...any) error {
+	return fmt.Errorf("smtp: sieve: line %d: %s", l.line, fmt.Sprintf(format, args...))
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skipSpace(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, line: l.line}, nil
+	}
+	start, line := l.pos, l.line
+	c := l.src[l.pos]
+	switch {
+	case strings.IndexByte(";,()[]{}", c) >= 0:
+		l.pos++
+		return token{kind: tokPunct, text: string(c), line: line}, nil
+	case c == '"':
+		s, err := l.quoted()
+		return token{kind: tokString, text: s, line: line}, err
+	case c == ':':
+		l.pos++
+		id := l.ident()
+		if id == "" {
+			return token{}, l.errorf("expected tag name after ':'")
+		}
+		return token{kind: tokTag, text: strings.ToLower(id), line: line}, nil
+	case isDigit(c):
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+		n, err := strconv.ParseInt(l.src[start:l.pos], 10, 64)
+		if err != nil {
+			return token{}, l.errorf("invalid number %q", l.src[start:l.pos])
+		}
+		if l.pos < len(l.src) {
+			switch l.src[l.pos] {
+			case 'K', 'k':
+				n <<= 10
+				l.pos++
+			case 'M', 'm':
+				n <<= 20
+				l.pos++
+			case 'G', 'g':
+				n <<= 30
+				l.pos++
+			}
+		}
+		return token{kind: tokNumber, num: n, line: line}, nil
+	case isIdentStart(c):
+		id := l.ident()
+		if strings.EqualFold(id, "text") && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			s, err := l.multiline()
+			return token{kind: tokString, text: s, line: line}, err
+		}
+		return token{kind: tokIdent, text: strings.ToLower(id), line: line}, nil
+	}
+	return token{}, l.errorf("unexpected character %q", c)
+}
+
+func (l *lexer) skipSpace() error {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return l.errorf("unterminated comment")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) ident() string {
+	start := l.pos
+	for l.pos < len(l.src) && (isIdentStart(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+		l.pos++
+	}
+	return l.src[start:l.pos]
+}
+
+// quoted reads a quoted string. A backslash escapes the next character.
+func (l *lexer) quoted() (string, error) {
+	l.pos++ // Opening quote.
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if l.pos < len(l.src) {
+				c = l.src[l.pos]
+				l.pos++
+			}
+		case '\n':
+			l.line++
+		}
+		b.WriteByte(c)
+	}
+	return "", l.errorf("unterminated string")
+}
+
+// multiline reads a "text:" string: the rest of the line is ignored and
+// the string ends at a line holding a single dot. Leading dots are
+// unstuffed.
+func (l *lexer) multiline() (string, error) {
+	eol := strings.IndexByte(l.src[l.pos:], '\n')
+	if eol < 0 {
+		return "", l.errorf("unterminated multi-line string")
+	}
+	l.pos += eol + 1
+	l.line++
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		if end < 0 {
+			break
+		}
+		line := strings.TrimSuffix(l.src[l.pos:l.pos+end], "\r")
+		l.pos += end + 1
+		l.line++
+		if line == "." {
+			return b.String(), nil
+		}
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	return "", l.errorf("unterminated multi-line string")
+}
+
+func isDigit(c byte) bool      { return c >= '0' && c <= '9' }
+func isIdentStart(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' }
+
+// argument is a positional argument or tag of a command or test.
+type argument struct {
+	tag     string   // Set for tagged arguments.
+	strings []string // Set for strings and string lists.
+	num     int64
+	isNum   bool
+}
+
+type command struct {
+	name  string
+	line  int
+	args  []argument
+	tests []*test
+	block []*command // Nil if the command ends with ';'.
+	nodeArgs
+}
+
+type test struct {
+	name  string
+	line  int
+	args  []argument
+	tests []*test
+	nodeArgs
+}
+
+// parser builds the command tree (RFC 5228 §8.2).
+type parser struct {
+	lex lexer
+	tok token
+}
+
+func (p *parser) advance() error {
+	t, err := p.lex.next()
+	p.tok = t
+	return err
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("smtp: sieve: line %d: %s", p.tok.line, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) isPunct(s string) bool {
+	return p.tok.kind == tokPunct && p.tok.text == s
+}
+
+func (p *parser) commands(inBlock bool) ([]*command, error) {
+	var cmds []*command
+	for {
+		switch {
+		case p.tok.kind == tokEOF:
+			if inBlock {
+				return nil, p.errorf("missing '}'")
+			}
+			return cmds, nil
+		case inBlock && p.isPunct("}"):
+			return cmds, nil
+		case p.tok.kind != tokIdent:
+			return nil, p.errorf("expected command")
+		}
+
+		cmd := &command{name: p.tok.text, line: p.tok.line}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		args, tests, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		cmd.args, cmd.tests = args, tests
+
+		switch {
+		case p.isPunct(";"):
+		case p.isPunct("{"):
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			block, err := p.commands(true)
+			if err != nil {
+				return nil, err
+			}
+			cmd.block = append([]*command{}, block...)
+		default:
+			return nil, p.errorf("expected ';' or '{' after %s", cmd.name)
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+}
+
+// arguments parses arguments followed by an optional test or test list.
+func (p *parser) arguments() ([]argument, []*test, error) {
+	var args []argument
+	for {
+		switch {
+		case p.tok.kind == tokTag:
+			args = append(args, argument{tag: p.tok.text})
+		case p.tok.kind == tokNumber:
+			args = append(args, argument{num: p.tok.num, isNum: true})
+		case p.tok.kind == tokString:
+			args = append(args, argument{strings: []string{p.tok.text}})
+		case p.isPunct("["):
+			list, err := p.stringList()
+			if err != nil {
+				return nil, nil, err
+			}
+			args = append(args, argument{strings: list})
+		case p.tok.kind == tokIdent:
+			t, err := p.test()
+			return args, []*test{t}, err
+		case p.isPunct("("):
+			tests, err := p.testList()
+			return args, tests, err
+		default:
+			return args, nil, nil
+		}
+		if err := p.advance(); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// stringList parses "[" string *("," string) "]", leaving the closing
+// bracket as the current token.
+func (p *parser) stringList() ([]string, error) {
+	var list []string
+	for {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokString {
+			return nil, p.errorf("expected string in list")
+		}
+		list = append(list, p.tok.text)
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.isPunct("]") {
+			return list, nil
+		}
+		if !p.isPunct(",") {
+			return nil, p.errorf("expected ',' or ']' in string list")
+		}
+	}
+}
+
+// test parses a test; the current token is its name.
+func (p *parser) test() (*test, error) {
+	t := &test{name: p.tok.text, line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	args, tests, err := p.arguments()
+	if err != nil {
+		return nil, err
+	}
+	t.args, t.tests = args, tests
+	return t, nil
+}
+
+// testList parses "(" test *("," test) ")"; the current token is "(".
+// On return the current token is the token after ")".
+func (p *parser) testList() ([]*test, error) {
+	var tests []*test
+	for {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokIdent {
+			return nil, p.errorf("expected test")
+		}
+		t, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, t)
+		if p.isPunct(")") {
+			return tests, p.advance()
+		}
+		if !p.isPunct(",") {
+			return nil, p.errorf("expected ',' or ')' in test list")
+		}
+	}
+}
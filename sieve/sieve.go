@@ -0,0 +1,641 @@
+// Package sieve implements the Sieve mail filtering language (RFC 5228)
+// for per-recipient rules at delivery time.
+//
+// Supported extensions are fileinto, envelope (RFC 5228 §4.1, §5.4) and
+// vacation (RFC 5230); the i;octet and i;ascii-casemap comparators are
+// always available. A script is parsed once with Parse and executed for
+// each recipient with Execute, which returns the actions to perform. The
+// package only decides: storing, forwarding and replying are left to the
+// caller.
+package sieve
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Message is the input to a script: one message as delivered to one
+// recipient.
+type Message struct {
+	From   string      // Envelope sender; "" for the null reverse-path.
+	To     string      // Envelope recipient the script runs for.
+	Header mail.Header // Message header fields.
+	Size   int64       // Message size in octets.
+}
+
+// Action is an action produced by Execute: Keep, FileInto, Redirect or
+// Vacation.
+type Action interface {
+	action()
+}
+
+// Keep stores the message in the recipient's default mailbox.
+type Keep struct{}
+
+// FileInto stores the message in the named mailbox.
+type FileInto struct {
+	Mailbox string
+}
+
+// Redirect forwards the message, unchanged, to another address.
+type Redirect struct {
+	Address string
+}
+
+// Vacation sends an automatic reply to the sender (RFC 5230), subject to
+// the caller's suppression rules.
+type Vacation struct {
+	Days      int      // Minimum days between replies to one sender; default 7.
+	Subject   string   // Empty means the caller derives one from the original.
+	From      string   // Empty means the recipient's address.
+	Addresses []string // Other addresses of the recipient.
+	MIME      bool     // Reason is a MIME entity rather than plain text.
+	Handle    string   // Identifies the reply for rate limiting; may be empty.
+	Reason    string
+}
+
+func (Keep) action()     {}
+func (FileInto) action() {}
+func (Redirect) action() {}
+func (Vacation) action() {}
+
+// capabilities lists the extensions scripts may require.
+var capabilities = map[string]bool{
+	"fileinto":                   true,
+	"envelope":                   true,
+	"vacation":                   true,
+	"comparator-i;octet":         true,
+	"comparator-i;ascii-casemap": true,
+}
+
+// Script is a parsed Sieve script. It is safe for concurrent use.
+type Script struct {
+	cmds []*command
+}
+
+// Parse parses and validates a script. Unsupported commands, tests and
+// required extensions are errors.
+func Parse(src string) (*Script, error) {
+	p := &parser{lex: lexer{src: src, line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	cmds, err := p.commands(false)
+	if err != nil {
+		return nil, err
+	}
+	v := &validator{required: make(map[string]bool)}
+	if err := v.commands(cmds, true); err != nil {
+		return nil, err
+	}
+	return &Script{cmds: cmds}, nil
+}
+
+// Execute runs the script against msg and returns the resulting actions
+// in order, without duplicates. Unless the script files, redirects, keeps
+// or discards the message, the implicit Keep is included. An empty
+// result means the message is discarded.
+func (s *Script) Execute(msg *Message) []Action {
+	r := &runner{msg: msg, implicitKeep: true}
+	r.run(s.cmds)
+	if r.implicitKeep && !r.kept {
+		r.actions = append(r.actions, Keep{})
+	}
+	return r.actions
+}
+
+// validator checks a command tree and splits the arguments of each node
+// into tags and positional arguments.
+type validator struct {
+	required map[string]bool
+}
+
+func errorf(line int, format string, args ...any) error {
+	return fmt.Errorf("smtp: sieve: line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// valuedTags lists tags followed by a value.
+var valuedTags = map[string]bool{
+	"comparator": true, "days": true, "subject": true,
+	"from": true, "addresses": true, "handle": true,
+}
+
+// splitArgs separates tagged from positional arguments.
+func splitArgs(line int, args []argument) (map[string]argument, []argument, error) {
+	tags := make(map[string]argument)
+	var pos []argument
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a.tag == "" {
+			pos = append(pos, a)
+			continue
+		}
+		if _, dup := tags[a.tag]; dup {
+			return nil, nil, errorf(line, "duplicate :%s", a.tag)
+		}
+		name := a.tag
+		if valuedTags[name] {
+			if i+1 >= len(args) || args[i+1].tag != "" {
+				return nil, nil, errorf(line, ":%s needs a value", name)
+			}
+			i++
+			a = args[i]
+		}
+		tags[name] = a
+	}
+	return tags, pos, nil
+}
+
+// nodeArgs holds the validated arguments of a command or test.
+type nodeArgs struct {
+	tags map[string]argument
+	pos  []argument
+}
+
+// expect checks the tags and positional arguments of a node. allowed
+// lists the permitted tags; kinds gives each positional argument's type:
+// 's' for a string, 'l' for a string list, 'n' for a number.
+func expect(line int, name string, args []argument, allowed []string, kinds string) (nodeArgs, error) {
+	tags, pos, err := splitArgs(line, args)
+	if err != nil {
+		return nodeArgs{}, err
+	}
+	for tag := range tags {
+		ok := false
+		for _, a := range allowed {
+			ok = ok || a == tag
+		}
+		if !ok {
+			return nodeArgs{}, errorf(line, "%s: unexpected :%s", name, tag)
+		}
+	}
+	if len(pos) != len(kinds) {
+		return nodeArgs{}, errorf(line, "%s: expected %d arguments, got %d", name, len(kinds), len(pos))
+	}
+	for i, k := range kinds {
+		a := pos[i]
+		switch {
+		case k == 'n' && !a.isNum,
+			k == 's' && len(a.strings) != 1,
+			k == 'l' && a.strings == nil:
+			return nodeArgs{}, errorf(line, "%s: argument %d has the wrong type", name, i+1)
+		}
+	}
+	return nodeArgs{tags: tags, pos: pos}, nil
+}
+
+var (
+	matchTags = []string{"comparator", "is", "contains", "matches"}
+	addrTags  = append([]string{"all", "localpart", "domain"}, matchTags...)
+)
+
+func (v *validator) commands(cmds []*command, top bool) error {
+	prev := ""
+	for i, c := range cmds {
+		if c.name != "if" && c.name != "elsif" && c.name != "else" && c.block != nil {
+			return errorf(c.line, "%s does not take a block", c.name)
+		}
+		var err error
+		switch c.name {
+		case "require":
+			if !top || (i > 0 && prev != "require") {
+				return errorf(c.line, "require must come before other commands")
+			}
+			c.nodeArgs, err = expect(c.line, c.name, c.args, nil, "l")
+			if err == nil {
+				for _, ext := range c.pos[0].strings {
+					if !capabilities[strings.ToLower(ext)] {
+						return errorf(c.line, "unsupported extension %q", ext)
+					}
+					v.required[strings.ToLower(ext)] = true
+				}
+			}
+		case "if", "elsif", "else":
+			if c.name != "if" && prev != "if" && prev != "elsif" {
+				return errorf(c.line, "%s without if", c.name)
+			}
+			if c.block == nil {
+				return errorf(c.line, "%s needs a block", c.name)
+			}
+			wantTests := 1
+			if c.name == "else" {
+				wantTests = 0
+			}
+			if len(c.args) > 0 || len(c.tests) != wantTests {
+				return errorf(c.line, "%s: invalid arguments", c.name)
+			}
+			for _, t := range c.tests {
+				if err := v.test(t); err != nil {
+					return err
+				}
+			}
+			err = v.commands(c.block, false)
+		case "stop", "keep", "discard":
+			c.nodeArgs, err = expect(c.line, c.name, c.args, nil, "")
+		case "fileinto":
+			if err = v.need(c.line, "fileinto"); err == nil {
+				c.nodeArgs, err = expect(c.line, c.name, c.args, nil, "s")
+			}
+		case "redirect":
+			c.nodeArgs, err = expect(c.line, c.name, c.args, nil, "s")
+		case "vacation":
+			if err = v.need(c.line, "vacation"); err == nil {
+				c.nodeArgs, err = expect(c.line, c.name, c.args,
+					[]string{"days", "subject", "from", "addresses", "mime", "handle"}, "s")
+			}
+			if err == nil {
+				err = checkTagTypes(c.line, c.tags)
+			}
+		default:
+			return errorf(c.line, "unknown command %q", c.name)
+		}
+		if err != nil {
+			return err
+		}
+		if c.name != "if" && c.name != "elsif" && c.name != "else" && len(c.tests) > 0 {
+			return errorf(c.line, "%s does not take a test", c.name)
+		}
+		prev = c.name
+	}
+	return nil
+}
+
+// checkTagTypes checks the values of the vacation tags.
+func checkTagTypes(line int, tags map[string]argument) error {
+	for tag, a := range tags {
+		switch tag {
+		case "days":
+			if !a.isNum {
+				return errorf(line, ":days needs a number")
+			}
+		case "subject", "from", "handle":
+			if len(a.strings) != 1 {
+				return errorf(line, ":%s needs a string", tag)
+			}
+		case "addresses":
+			if a.strings == nil {
+				return errorf(line, ":addresses needs a string list")
+			}
+		}
+	}
+	return nil
+}
+
+func (v *validator) need(line int, ext string) error {
+	if !v.required[ext] {
+		return errorf(line, "%s used without require %q", ext, ext)
+	}
+	return nil
+}
+
+func (v *validator) test(t *test) error {
+	var err error
+	switch t.name {
+	case "address":
+		t.nodeArgs, err = expect(t.line, t.name, t.args, addrTags, "ll")
+	case "header":
+		t.nodeArgs, err = expect(t.line, t.name, t.args, matchTags, "ll")
+	case "envelope":
+		if err = v.need(t.line, "envelope"); err == nil {
+			t.nodeArgs, err = expect(t.line, t.name, t.args, addrTags, "ll")
+		}
+		if err == nil {
+			for _, part := range t.pos[0].strings {
+				if p := strings.ToLower(part); p != "from" && p != "to" {
+					return errorf(t.line, "envelope: unsupported part %q", part)
+				}
+			}
+		}
+	case "exists":
+		t.nodeArgs, err = expect(t.line, t.name, t.args, nil, "l")
+	case "size":
+		t.nodeArgs, err = expect(t.line, t.name, t.args, []string{"over", "under"}, "n")
+		if err == nil && len(t.tags) != 1 {
+			err = errorf(t.line, "size needs exactly one of :over or :under")
+		}
+	case "true", "false":
+		t.nodeArgs, err = expect(t.line, t.name, t.args, nil, "")
+	case "not", "allof", "anyof":
+		if len(t.args) > 0 || len(t.tests) == 0 || (t.name == "not" && len(t.tests) != 1) {
+			return errorf(t.line, "%s: invalid arguments", t.name)
+		}
+		for _, sub := range t.tests {
+			if err := v.test(sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return errorf(t.line, "unknown test %q", t.name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(t.tests) > 0 {
+		return errorf(t.line, "%s does not take a test", t.name)
+	}
+	if c, ok := t.tags["comparator"]; ok {
+		if len(c.strings) != 1 || (c.strings[0] != "i;octet" && c.strings[0] != "i;ascii-casemap") {
+			return errorf(t.line, "unsupported comparator")
+		}
+	}
+	if countTags(t.tags, "is", "contains", "matches") > 1 || countTags(t.tags, "all", "localpart", "domain") > 1 {
+		return errorf(t.line, "%s: conflicting tags", t.name)
+	}
+	return nil
+}
+
+func countTags(tags map[string]argument, names ...string) int {
+	n := 0
+	for _, name := range names {
+		if _, ok := tags[name]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+// runner executes a validated script.
+type runner struct {
+	msg          *Message
+	actions      []Action
+	implicitKeep bool
+	kept         bool
+	vacation     bool
+}
+
+// run executes cmds and reports whether stop was reached.
+func (r *runner) run(cmds []*command) bool {
+	taken := false // Whether a branch of the current if chain ran.
+	for _, c := range cmds {
+		switch c.name {
+		case "if", "elsif", "else":
+			if c.name == "if" {
+				taken = false
+			}
+			if taken || (c.name != "else" && !r.eval(c.tests[0])) {
+				continue
+			}
+			taken = true
+			if r.run(c.block) {
+				return true
+			}
+		case "stop":
+			return true
+		case "keep":
+			r.implicitKeep = false
+			if !r.kept {
+				r.kept = true
+				r.actions = append(r.actions, Keep{})
+			}
+		case "discard":
+			r.implicitKeep = false
+		case "fileinto":
+			r.implicitKeep = false
+			r.add(FileInto{Mailbox: c.pos[0].strings[0]})
+		case "redirect":
+			r.implicitKeep = false
+			r.add(Redirect{Address: c.pos[0].strings[0]})
+		case "vacation":
+			if r.vacation {
+				continue // RFC 5230 §4.7: at most one vacation per run.
+			}
+			r.vacation = true
+			vac := Vacation{Days: 7, Reason: c.pos[0].strings[0]}
+			if a, ok := c.tags["days"]; ok {
+				vac.Days = max(int(a.num), 1)
+			}
+			if a, ok := c.tags["subject"]; ok {
+				vac.Subject = a.strings[0]
+			}
+			if a, ok := c.tags["from"]; ok {
+				vac.From = a.strings[0]
+			}
+			if a, ok := c.tags["addresses"]; ok {
+				vac.Addresses = a.strings
+			}
+			if a, ok := c.tags["handle"]; ok {
+				vac.Handle = a.strings[0]
+			}
+			_, vac.MIME = c.tags["mime"]
+			r.actions = append(r.actions, vac)
+		}
+		if c.name != "if" && c.name != "elsif" && c.name != "else" {
+			taken = false
+		}
+	}
+	return false
+}
+
+// add appends a FileInto or Redirect action unless it is a duplicate.
+func (r *runner) add(a Action) {
+	for _, prev := range r.actions {
+		switch p := prev.(type) {
+		case FileInto:
+			if f, ok := a.(FileInto); ok && f.Mailbox == p.Mailbox {
+				return
+			}
+		case Redirect:
+			if rd, ok := a.(Redirect); ok && strings.EqualFold(rd.Address, p.Address) {
+				return
+			}
+		}
+	}
+	r.actions = append(r.actions, a)
+}
+
+func (r *runner) eval(t *test) bool {
+	switch t.name {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "not":
+		return !r.eval(t.tests[0])
+	case "allof":
+		for _, sub := range t.tests {
+			if !r.eval(sub) {
+				return false
+			}
+		}
+		return true
+	case "anyof":
+		for _, sub := range t.tests {
+			if r.eval(sub) {
+				return true
+			}
+		}
+		return false
+	case "exists":
+		for _, name := range t.pos[0].strings {
+			if len(r.headerValues(name)) == 0 {
+				return false
+			}
+		}
+		return true
+	case "size":
+		limit := t.pos[0].num
+		if _, over := t.tags["over"]; over {
+			return r.msg.Size > limit
+		}
+		return r.msg.Size < limit
+	case "header":
+		var values []string
+		for _, name := range t.pos[0].strings {
+			values = append(values, r.headerValues(name)...)
+		}
+		return t.match(values, t.pos[1].strings)
+	case "address":
+		var values []string
+		for _, name := range t.pos[0].strings {
+			for _, v := range r.headerValues(name) {
+				for _, addr := range parseAddresses(v) {
+					values = append(values, t.addressPart(addr))
+				}
+			}
+		}
+		return t.match(values, t.pos[1].strings)
+	case "envelope":
+		var values []string
+		for _, part := range t.pos[0].strings {
+			addr := r.msg.From
+			if strings.EqualFold(part, "to") {
+				addr = r.msg.To
+			}
+			values = append(values, t.addressPart(addr))
+		}
+		return t.match(values, t.pos[1].strings)
+	}
+	return false
+}
+
+// headerValues returns the decoded values of a header field.
+func (r *runner) headerValues(name string) []string {
+	raw := r.msg.Header[textproto.CanonicalMIMEHeaderKey(name)]
+	values := make([]string, len(raw))
+	dec := new(mime.WordDecoder)
+	for i, v := range raw {
+		if d, err := dec.DecodeHeader(v); err == nil {
+			v = d
+		}
+		values[i] = strings.TrimSpace(v)
+	}
+	return values
+}
+
+// parseAddresses extracts the addresses from a header value, falling back
+// to the raw value if it does not parse.
+func parseAddresses(v string) []string {
+	list, err := mail.ParseAddressList(v)
+	if err != nil {
+		return []string{v}
+	}
+	addrs := make([]string, len(list))
+	for i, a := range list {
+		addrs[i] = a.Address
+	}
+	return addrs
+}
+
+func (t *test) addressPart(addr string) string {
+	at := strings.LastIndexByte(addr, '@')
+	switch {
+	case t.tags["localpart"].tag != "":
+		if at < 0 {
+			return addr
+		}
+		return addr[:at]
+	case t.tags["domain"].tag != "":
+		if at < 0 {
+			return ""
+		}
+		return addr[at+1:]
+	}
+	return addr
+}
+
+// match reports whether any value matches any key under the test's
+// comparator and match type.
+func (t *test) match(values, keys []string) bool {
+	fold := true
+	if c, ok := t.tags["comparator"]; ok && c.strings[0] == "i;octet" {
+		fold = false
+	}
+	for _, v := range values {
+		if fold {
+			v = asciiLower(v)
+		}
+		for _, k := range keys {
+			if fold {
+				k = asciiLower(k)
+			}
+			var ok bool
+			switch {
+			case t.tags["contains"].tag != "":
+				ok = strings.Contains(v, k)
+			case t.tags["matches"].tag != "":
+				ok = wildcardMatch(k, v)
+			default:
+				ok = v == k
+			}
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+// wildcardMatch reports whether s matches pattern, where "*" matches any
+// sequence, "?" any single character and "\" escapes the next character.
+func wildcardMatch(pattern, s string) bool {
+	p := []rune(pattern)
+	str := []rune(s)
+	pi, si := 0, 0
+	starP, starS := -1, 0
+	for si < len(str) {
+		if pi < len(p) {
+			switch c := p[pi]; {
+			case c == '*':
+				starP, starS = pi, si
+				pi++
+				continue
+			case c == '?':
+				pi++
+				si++
+				continue
+			case c == '\\' && pi+1 < len(p):
+				if p[pi+1] == str[si] {
+					pi += 2
+					si++
+					continue
+				}
+			case c == str[si]:
+				pi++
+				si++
+				continue
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starS++
+		pi, si = starP+1, starS
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
@@ -0,0 +1,130 @@
+package sieve
+
+import (
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testMessage(header string, size int64) *Message {
+	msg, err := mail.ReadMessage(strings.NewReader(header + "\r\n\r\nbody\r\n"))
+	if err != nil {
+		panic(err)
+	}
+	return &Message{
+		From:   "sender@example.org",
+		To:     "user+lists@example.com",
+		Header: msg.Header,
+		Size:   size,
+	}
+}
+
+func TestExecute(t *testing.T) {
+	header := "From: \"List\" <golang-nuts@googlegroups.com>\r\n" +
+		"To: user@example.com, other@example.net\r\n" +
+		"Subject: =?UTF-8?Q?Caf=C3=A9?= meeting\r\n" +
+		"List-Id: <golang-nuts.googlegroups.com>"
+
+	tests := []struct {
+		name   string
+		script string
+		want   []Action
+	}{
+		{"empty", ``, []Action{Keep{}}},
+		{"discard", `discard;`, nil},
+		{"keep and discard", `keep; discard;`, []Action{Keep{}}},
+		{"fileinto", `require "fileinto"; fileinto "Lists";`, []Action{FileInto{"Lists"}}},
+		{"header contains", `require ["fileinto"];
+			if header :contains "list-id" "golang-nuts" { fileinto "Go"; stop; }
+			fileinto "Other";`,
+			[]Action{FileInto{"Go"}}},
+		{"encoded header", `require "fileinto"; if header :is "subject" "café MEETING" { fileinto "Cafe"; }`,
+			[]Action{FileInto{"Cafe"}}},
+		{"octet comparator", `require "fileinto"; if header :comparator "i;octet" :is "subject" "café MEETING" { fileinto "Cafe"; }`,
+			[]Action{Keep{}}},
+		{"matches", `require "fileinto"; if header :matches "subject" "Caf? *" { fileinto "M"; }`,
+			[]Action{FileInto{"M"}}},
+		{"address domain", `require "fileinto"; if address :domain :is "to" "example.net" { fileinto "Net"; }`,
+			[]Action{FileInto{"Net"}}},
+		{"address localpart", `if address :localpart :is "from" "golang-nuts" { redirect "go@example.com"; }`,
+			[]Action{Redirect{"go@example.com"}}},
+		{"envelope", `require ["envelope", "fileinto"]; if envelope :localpart :matches "to" "*+lists" { fileinto "Plus"; }`,
+			[]Action{FileInto{"Plus"}}},
+		{"elsif else", `require "fileinto";
+			if false { fileinto "A"; } elsif exists "x-missing" { fileinto "B"; } else { fileinto "C"; }`,
+			[]Action{FileInto{"C"}}},
+		{"if chain resets", `require "fileinto";
+			if true { fileinto "A"; }
+			if false { fileinto "B"; } else { fileinto "C"; }`,
+			[]Action{FileInto{"A"}, FileInto{"C"}}},
+		{"allof anyof not", `if allof(exists ["from", "to"], not size :over 1M, anyof(false, true)) { discard; }`, nil},
+		{"size", `if size :under 100 { discard; }`, []Action{Keep{}}},
+		{"duplicates", `redirect "a@example.com"; redirect "A@example.com"; keep; keep;`,
+			[]Action{Redirect{"a@example.com"}, Keep{}}},
+		{"vacation", `require "vacation";
+			vacation :days 3 :subject "Away" :addresses ["alias@example.com"] :handle "h1" text:
+I'm away.
+..signed
+.
+;`,
+			[]Action{Vacation{Days: 3, Subject: "Away", Addresses: []string{"alias@example.com"}, Handle: "h1", Reason: "I'm away.\r\n.signed\r\n"}, Keep{}}},
+		{"comments", "# hash\r\n/* block\r\ncomment */ discard;", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.script)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			got := s.Execute(testMessage(header, 4096))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Execute = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	scripts := []string{
+		`fileinto "x";`,             // Missing require.
+		`require "imap4flags";`,     // Unsupported extension.
+		`keep`,                      // Missing semicolon.
+		`frobnicate;`,               // Unknown command.
+		`if bogus { keep; }`,        // Unknown test.
+		`else { keep; }`,            // else without if.
+		`if true keep;`,             // Missing block.
+		`keep; require "fileinto";`, // require after commands.
+		`if header :is :contains "a" "b" { keep; }`, // Conflicting match types.
+		`if size 10 { keep; }`,                      // Missing :over/:under.
+		`redirect;`,                                 // Missing argument.
+		`if true { keep; `,                          // Unterminated block.
+		`redirect "a`,                               // Unterminated string.
+	}
+	for _, src := range scripts {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", src)
+		}
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"a*c", "abbbc", true},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"*@example.com", "user@example.com", true},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{"é?", "éx", true},
+	}
+	for _, tt := range tests {
+		if got := wildcardMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package smtpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// ErrNoAuthMechanism is returned by AuthAuto when the server advertises no
+// mechanism the client may use.
+var ErrNoAuthMechanism = errors.New("smtp: no acceptable AUTH mechanism")
+
+// Credentials are the username and password AuthAuto authenticates with.
+type Credentials struct {
+	Username string
+	Password string
+
+	// AllowPlaintext permits PLAIN and LOGIN, which send the password
+	// readable by anyone on the path, over a connection without TLS.
+	AllowPlaintext bool
+}
+
+// AuthAuto authenticates with the strongest mechanism both sides support,
+// in the order SCRAM-SHA-256, CRAM-MD5, PLAIN, LOGIN. PLAIN and LOGIN are
+// only used over TLS unless creds.AllowPlaintext is set. It returns an
+// error wrapping ErrNoAuthMechanism if no advertised mechanism qualifies.
+func (c *Client) AuthAuto(ctx context.Context, creds Credentials) error {
+	mech, err := chooseAuth(c.exts.Param(smtp.ExtAUTH), c.tls, creds)
+	if err != nil {
+		return err
+	}
+	return c.Auth(ctx, mech)
+}
+
+// chooseAuth picks the mechanism for AuthAuto from the advertised list.
+func chooseAuth(advertised string, tls bool, creds Credentials) (smtp.SASLMechanism, error) {
+	offered := strings.Fields(strings.ToUpper(advertised))
+	switch {
+	case slices.Contains(offered, "SCRAM-SHA-256"):
+		return smtp.ScramSHA256Auth(creds.Username, creds.Password), nil
+	case slices.Contains(offered, "CRAM-MD5"):
+		return smtp.CramMD5Auth(creds.Username, creds.Password), nil
+	}
+	plaintextOK := tls || creds.AllowPlaintext
+	switch {
+	case plaintextOK && slices.Contains(offered, "PLAIN"):
+		return smtp.PlainAuth("", creds.Username, creds.Password), nil
+	case plaintextOK && slices.Contains(offered, "LOGIN"):
+		return smtp.LoginAuth(creds.Username, creds.Password), nil
+	}
+	if len(offered) == 0 {
+		return nil, fmt.Errorf("%w: AUTH not advertised", ErrNoAuthMechanism)
+	}
+	if !plaintextOK {
+		return nil, fmt.Errorf("%w: server offers %s, which would send the password without TLS", ErrNoAuthMechanism, advertised)
+	}
+	return nil, fmt.Errorf("%w: server offers %s", ErrNoAuthMechanism, advertised)
+}
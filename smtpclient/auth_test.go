@@ -1,7 +1,11 @@
 package smtpclient
 
 import (
+	"bufio"
 	"context"
+	"encoding/base64"
+	"errors"
+	"net"
 	"strings"
 	"testing"
 	"time"
@@ -156,3 +160,132 @@ func TestAuth_NotAvailable(t *testing.T) {
 		t.Fatal("AUTH should not be advertised without handler")
 	}
 }
+
+func TestChooseAuth(t *testing.T) {
+	creds := Credentials{Username: "u", Password: "p"}
+	insecure := Credentials{Username: "u", Password: "p", AllowPlaintext: true}
+	tests := []struct {
+		advertised string
+		tls        bool
+		creds      Credentials
+		want       string // Mechanism name, or "" for ErrNoAuthMechanism.
+	}{
+		{"PLAIN LOGIN CRAM-MD5 SCRAM-SHA-256", false, creds, "SCRAM-SHA-256"},
+		{"PLAIN LOGIN CRAM-MD5", false, creds, "CRAM-MD5"},
+		{"login plain", true, creds, "PLAIN"},
+		{"LOGIN", true, creds, "LOGIN"},
+		{"PLAIN LOGIN", false, creds, ""},
+		{"PLAIN LOGIN", false, insecure, "PLAIN"},
+		{"XOAUTH2", true, creds, ""},
+		{"", true, creds, ""},
+	}
+	for _, tt := range tests {
+		mech, err := chooseAuth(tt.advertised, tt.tls, tt.creds)
+		switch {
+		case tt.want == "" && !errors.Is(err, ErrNoAuthMechanism):
+			t.Errorf("chooseAuth(%q, tls=%v) = %v, want ErrNoAuthMechanism", tt.advertised, tt.tls, err)
+		case tt.want != "" && (err != nil || mech.Name() != tt.want):
+			t.Errorf("chooseAuth(%q, tls=%v) = %v, %v, want %s", tt.advertised, tt.tls, mech, err, tt.want)
+		}
+	}
+}
+
+// secretAuthHandler lets the server verify SCRAM-SHA-256 and CRAM-MD5.
+type secretAuthHandler struct{ testAuthHandler }
+
+func (h *secretAuthHandler) Secret(_ context.Context, _, username string) (string, error) {
+	if username != "testuser" {
+		return "", &smtp.SMTPError{Code: smtp.ReplyAuthFailed, EnhancedCode: smtp.EnhancedCodeAuthCredentials, Message: "Bad credentials"}
+	}
+	return "testpass", nil
+}
+
+func TestAuthAuto(t *testing.T) {
+	addr, cleanup := startTestServer(t, smtpserver.WithAuthHandler(&secretAuthHandler{}))
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, tt := range []struct {
+		password string
+		ok       bool
+	}{{"wrong", false}, {"testpass", true}} {
+		c, err := Dial(ctx, addr, WithTimeout(5*time.Second))
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		err = c.AuthAuto(ctx, Credentials{Username: "testuser", Password: tt.password})
+		var smtpErr *smtp.SMTPError
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("AuthAuto: %v", err)
+		case !tt.ok && (!errors.As(err, &smtpErr) || smtpErr.Code != smtp.ReplyAuthFailed):
+			t.Errorf("AuthAuto with a wrong password = %v, want 535", err)
+		}
+		c.Close()
+	}
+}
+
+// tokenAuth is a SASL mechanism with a single initial response, like
+// XOAUTH2 with a bearer token.
+type tokenAuth string
+
+func (a tokenAuth) Name() string                { return "XOAUTH2" }
+func (a tokenAuth) Start() ([]byte, error)      { return []byte(a), nil }
+func (a tokenAuth) Next([]byte) ([]byte, error) { return nil, errors.New("unexpected challenge") }
+
+func TestAuth_LongInitialResponse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lines := make(chan string, 10)
+	go func() {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer nc.Close()
+		nc.Write([]byte("220 test ESMTP\r\n"))
+		r := bufio.NewReader(nc)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch {
+			case strings.HasPrefix(line, "EHLO"):
+				nc.Write([]byte("250-test\r\n250 AUTH XOAUTH2\r\n"))
+			case line == "AUTH XOAUTH2":
+				nc.Write([]byte("334 \r\n"))
+			default:
+				lines <- line
+				nc.Write([]byte("235 2.7.0 OK\r\n"))
+			}
+		}
+	}()
+
+	ctx := context.Background()
+	c, err := Dial(ctx, ln.Addr().String(), WithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	short := tokenAuth("token")
+	if err := c.Auth(ctx, short); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if got := <-lines; got != "AUTH XOAUTH2 "+base64.StdEncoding.EncodeToString([]byte(short)) {
+		t.Errorf("short token sent as %q, want it inline", got)
+	}
+
+	long := tokenAuth(strings.Repeat("t", 600))
+	if err := c.Auth(ctx, long); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if got := <-lines; got != base64.StdEncoding.EncodeToString([]byte(long)) {
+		t.Errorf("long token sent as %q, want it on the continuation line", got)
+	}
+}
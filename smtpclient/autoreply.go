@@ -0,0 +1,212 @@
+package smtpclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+	"github.com/alexisbouchez/smtp.go/internal/ttlcache"
+)
+
+// AutoReply describes one automatic reply, such as a vacation notice.
+type AutoReply struct {
+	Recipient string   // Address the original message was delivered to.
+	Addresses []string // Other addresses of the recipient.
+	From      string   // Reply author; empty means Recipient.
+	Subject   string   // Empty means "Auto: " and the original subject.
+	Body      string   // Plain-text reply.
+
+	// Interval is the minimum time between replies to one sender for the
+	// same Recipient and Handle. Zero means 7 days.
+	Interval time.Duration
+	Handle   string // Distinguishes unrelated auto-replies of one recipient.
+}
+
+// AutoResponder sends automatic replies through a relay while applying
+// the suppression rules of RFC 3834 and RFC 5230 §4.5. No reply is sent
+// when:
+//
+//   - the original has a null reverse-path, or its sender looks like a
+//     list or daemon address (owner-*, *-request, MAILER-DAEMON, ...);
+//   - the original is itself automatic (Auto-Submitted other than "no",
+//     Precedence bulk/list/junk) or comes from a mailing list (List-*);
+//   - no recipient address appears in To, Cc, Bcc or Resent-*, so the
+//     message reached the recipient indirectly, e.g. via a list or Bcc;
+//   - the sender was already answered within the reply's Interval.
+//
+// Replies are sent with a null reverse-path and Auto-Submitted:
+// auto-replied, so they never trigger further replies or bounces.
+//
+// Only Addr is required.
+type AutoResponder struct {
+	Addr    string             // Relay host:port.
+	Options []Option           // Dial options, e.g. WithTLSPolicy.
+	Auth    smtp.SASLMechanism // Optional authentication to the relay.
+
+	sent ttlcache.Cache[struct{}] // Rate-limit keys, until the end of their interval.
+}
+
+// Reply sends reply to sender, the envelope sender of an accepted message
+// with the given header, unless the suppression rules apply. It reports
+// whether a reply was sent.
+func (a *AutoResponder) Reply(ctx context.Context, sender string, header mail.Header, reply AutoReply) (bool, error) {
+	if suppressAutoReply(sender, header, reply) {
+		return false, nil
+	}
+
+	interval := reply.Interval
+	if interval == 0 {
+		interval = 7 * 24 * time.Hour
+	}
+	key := strings.ToLower(sender) + "\x00" + strings.ToLower(reply.Recipient) + "\x00" + reply.Handle
+	now := time.Now()
+	// Claiming the key before sending means concurrent calls for one
+	// sender send a single reply.
+	if !a.sent.Add(key, struct{}{}, now, interval) {
+		return false, nil
+	}
+
+	msg, err := buildAutoReply(sender, header, reply, now)
+	if err == nil {
+		err = a.send(ctx, sender, msg)
+	}
+	if err != nil {
+		// Nothing was sent: let a later call try again.
+		a.sent.Delete(key)
+		return false, err
+	}
+	return true, nil
+}
+
+func (a *AutoResponder) send(ctx context.Context, to string, msg []byte) error {
+	c, err := Dial(ctx, a.Addr, a.Options...)
+	if err != nil {
+		return fmt.Errorf("smtp: auto-reply: %w", err)
+	}
+	defer c.Close()
+	if a.Auth != nil {
+		if err := c.Auth(ctx, a.Auth); err != nil {
+			return fmt.Errorf("smtp: auto-reply: %w", err)
+		}
+	}
+	if err := c.SendMail(ctx, "", []string{to}, bytes.NewReader(msg)); err != nil {
+		return fmt.Errorf("smtp: auto-reply: %w", err)
+	}
+	return nil
+}
+
+// listSenderPrefixes and listSenderSuffixes match local parts of
+// senders that must not be answered (RFC 3834 §2).
+var (
+	listSenderPrefixes = []string{"owner-", "mailer-daemon", "listserv", "majordomo", "noreply", "no-reply"}
+	listSenderSuffixes = []string{"-request", "-owner", "-bounces"}
+)
+
+// suppressAutoReply reports whether the message must not be answered.
+func suppressAutoReply(sender string, header mail.Header, reply AutoReply) bool {
+	if sender == "" {
+		return true
+	}
+	local, _, _ := strings.Cut(strings.ToLower(sender), "@")
+	for _, p := range listSenderPrefixes {
+		if strings.HasPrefix(local, p) {
+			return true
+		}
+	}
+	for _, s := range listSenderSuffixes {
+		if strings.HasSuffix(local, s) {
+			return true
+		}
+	}
+
+	if v := strings.ToLower(strings.TrimSpace(header.Get("Auto-Submitted"))); v != "" && v != "no" {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return true
+	}
+	for name := range header {
+		if strings.HasPrefix(strings.ToLower(name), "list-") {
+			return true
+		}
+	}
+
+	own := map[string]bool{strings.ToLower(reply.Recipient): true}
+	for _, addr := range reply.Addresses {
+		own[strings.ToLower(addr)] = true
+	}
+	for _, field := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc", "Resent-Bcc"} {
+		list, err := header.AddressList(field)
+		if err != nil {
+			continue
+		}
+		for _, addr := range list {
+			if own[strings.ToLower(addr.Address)] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// buildAutoReply formats the reply message (RFC 3834 §3).
+func buildAutoReply(sender string, header mail.Header, reply AutoReply, now time.Time) ([]byte, error) {
+	from := reply.From
+	if from == "" {
+		from = reply.Recipient
+	}
+	subject := reply.Subject
+	if subject == "" {
+		orig, err := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+		if err != nil {
+			orig = header.Get("Subject")
+		}
+		subject = "Auto: " + orig
+	}
+
+	var id [12]byte
+	rand.Read(id[:])
+	domain := "localhost"
+	if _, d, ok := strings.Cut(from, "@"); ok {
+		domain = d
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", sender)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id[:]), domain)
+	if origID := strings.TrimSpace(header.Get("Message-Id")); origID != "" {
+		fmt.Fprintf(&b, "In-Reply-To: %s\r\n", origID)
+		refs := strings.TrimSpace(header.Get("References"))
+		if refs != "" {
+			refs += " "
+		}
+		fmt.Fprintf(&b, "References: %s\r\n", refs+origID)
+	}
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&b)
+	body := strings.ReplaceAll(reply.Body, "\r\n", "\n")
+	if _, err := qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	b.WriteString("\r\n")
+	return b.Bytes(), nil
+}
@@ -0,0 +1,122 @@
+package smtpclient
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go/smtpserver"
+)
+
+func parseHeader(t *testing.T, s string) mail.Header {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(s + "\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.Header
+}
+
+func TestAutoResponder(t *testing.T) {
+	handler := &testDataHandler{}
+	addr, cleanup := startTestServer(t, smtpserver.WithDataHandler(handler))
+	defer cleanup()
+
+	a := &AutoResponder{Addr: addr, Options: []Option{WithLocalName("test.local"), WithTimeout(5 * time.Second)}}
+	reply := AutoReply{Recipient: "me@example.com", Body: "I'm away.\nBack Monday."}
+	header := parseHeader(t, "From: bob@example.org\r\nTo: Me <me@example.com>\r\nSubject: Lunch?\r\nMessage-ID: <1@example.org>")
+	ctx := context.Background()
+
+	sent, err := a.Reply(ctx, "bob@example.org", header, reply)
+	if err != nil || !sent {
+		t.Fatalf("Reply = %v, %v; want sent", sent, err)
+	}
+	msg := handler.lastMessage()
+	if !msg.From.Null {
+		t.Errorf("reverse-path = %v, want null", msg.From)
+	}
+	if len(msg.To) != 1 || msg.To[0].Mailbox.String() != "bob@example.org" {
+		t.Errorf("recipients = %v", msg.To)
+	}
+	for _, want := range []string{
+		"From: me@example.com\r\n",
+		"Subject: Auto: Lunch?\r\n",
+		"In-Reply-To: <1@example.org>\r\n",
+		"Auto-Submitted: auto-replied\r\n",
+		"I'm away.\r\nBack Monday.",
+	} {
+		if !strings.Contains(msg.Body, want) {
+			t.Errorf("reply missing %q:\n%s", want, msg.Body)
+		}
+	}
+
+	// The same sender is not answered again within the interval.
+	sent, err = a.Reply(ctx, "BOB@example.org", header, reply)
+	if err != nil || sent {
+		t.Errorf("second Reply = %v, %v; want suppressed", sent, err)
+	}
+	// A different handle is a different auto-reply.
+	reply.Handle = "other"
+	if sent, err = a.Reply(ctx, "bob@example.org", header, reply); err != nil || !sent {
+		t.Errorf("Reply with new handle = %v, %v; want sent", sent, err)
+	}
+}
+
+func TestAutoResponderConcurrent(t *testing.T) {
+	handler := &testDataHandler{}
+	addr, cleanup := startTestServer(t, smtpserver.WithDataHandler(handler))
+	defer cleanup()
+
+	a := &AutoResponder{Addr: addr, Options: []Option{WithTimeout(5 * time.Second)}}
+	reply := AutoReply{Recipient: "me@example.com", Body: "Away."}
+	header := parseHeader(t, "From: bob@example.org\r\nTo: me@example.com\r\nSubject: Hi")
+
+	var wg sync.WaitGroup
+	var replies atomic.Int32
+	for range 8 {
+		wg.Go(func() {
+			if sent, err := a.Reply(context.Background(), "bob@example.org", header, reply); err != nil {
+				t.Error(err)
+			} else if sent {
+				replies.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	if n := replies.Load(); n != 1 {
+		t.Errorf("%d replies sent, want 1", n)
+	}
+}
+
+func TestSuppressAutoReply(t *testing.T) {
+	reply := AutoReply{Recipient: "me@example.com", Addresses: []string{"alias@example.com"}}
+	tests := []struct {
+		name     string
+		sender   string
+		header   string
+		suppress bool
+	}{
+		{"direct", "bob@example.org", "To: me@example.com", false},
+		{"alias in cc", "bob@example.org", "To: x@example.net\r\nCc: Alias <alias@example.com>", false},
+		{"auto-submitted no", "bob@example.org", "To: me@example.com\r\nAuto-Submitted: no", false},
+		{"null sender", "", "To: me@example.com", true},
+		{"list request", "golang-nuts-request@example.org", "To: me@example.com", true},
+		{"owner", "owner-list@example.org", "To: me@example.com", true},
+		{"mailer-daemon", "MAILER-DAEMON@example.org", "To: me@example.com", true},
+		{"auto-submitted", "bob@example.org", "To: me@example.com\r\nAuto-Submitted: auto-replied", true},
+		{"precedence bulk", "bob@example.org", "To: me@example.com\r\nPrecedence: bulk", true},
+		{"list header", "bob@example.org", "To: me@example.com\r\nList-Id: <l.example.org>", true},
+		{"not addressed", "bob@example.org", "To: list@example.org", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := suppressAutoReply(tt.sender, parseHeader(t, tt.header), reply); got != tt.suppress {
+				t.Errorf("suppressAutoReply = %v, want %v", got, tt.suppress)
+			}
+		})
+	}
+}
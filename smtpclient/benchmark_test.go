@@ -261,3 +261,76 @@ func (h *discardDataHandler) OnData(_ context.Context, _ smtp.ReversePath, _ []s
 	io.Copy(io.Discard, r)
 	return nil
 }
+
+// replayConn is a net.Conn that discards writes and answers reads with
+// script over and over, so that benchmarks measure the client alone.
+type replayConn struct {
+	script []byte
+	off    int
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	n := copy(p, c.script[c.off:])
+	c.off = (c.off + n) % len(c.script)
+	return n, nil
+}
+
+func (c *replayConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (c *replayConn) Close() error                     { return nil }
+func (c *replayConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c *replayConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (c *replayConn) SetDeadline(time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(time.Time) error { return nil }
+
+// newReplayClient returns a client past EHLO whose server accepts every
+// SendMail with one recipient.
+func newReplayClient(tb testing.TB) *Client {
+	tb.Helper()
+	nc := &replayConn{script: []byte("220 mx.example.com ESMTP\r\n250-mx.example.com\r\n250 PIPELINING\r\n")}
+	c, err := NewClient(nc, "client.example.com")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	nc.script = []byte("250 2.1.0 OK\r\n250 2.1.5 OK\r\n354 Go ahead\r\n250 2.0.0 Queued\r\n")
+	nc.off = 0
+	return c
+}
+
+const smallBody = "Subject: Benchmark\r\n\r\nBenchmark message body."
+
+// sendMailAllocBudget is the most allocations SendMail may make for a
+// small message to one recipient. Today it makes 8: the text and line
+// slice of each of the four replies.
+const sendMailAllocBudget = 10
+
+func BenchmarkSendMailClient(b *testing.B) {
+	c := newReplayClient(b)
+	ctx := context.Background()
+	body := strings.NewReader(smallBody)
+	b.ReportAllocs()
+	for b.Loop() {
+		body.Reset(smallBody)
+		if err := c.SendMail(ctx, "sender@example.com", []string{"user@example.com"}, body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestSendMailAllocs guards the relay hot path against allocation
+// regressions; run BenchmarkSendMailClient with -benchmem to see where
+// they come from.
+func TestSendMailAllocs(t *testing.T) {
+	c := newReplayClient(t)
+	ctx := context.Background()
+	body := strings.NewReader(smallBody)
+	allocs := testing.AllocsPerRun(100, func() {
+		body.Reset(smallBody)
+		if err := c.SendMail(ctx, "sender@example.com", []string{"user@example.com"}, body); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > sendMailAllocBudget {
+		t.Errorf("SendMail made %v allocations per message, budget %d", allocs, sendMailAllocBudget)
+	}
+}
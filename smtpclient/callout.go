@@ -0,0 +1,207 @@
+package smtpclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+	"github.com/alexisbouchez/smtp.go/internal/ttlcache"
+)
+
+// MXResolver looks up MX records. *net.Resolver satisfies it.
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// CalloutVerifier checks that a sender address can receive mail by
+// connecting to its domain's MX and issuing MAIL FROM:<> and RCPT TO for
+// the address (a "callout"), then quitting without sending a message.
+//
+// Verify returns nil for deliverable addresses and an *smtp.SMTPError
+// suitable for replying to MAIL FROM otherwise, so it can be called
+// directly from a MailHandler. Results are cached, and the number of
+// concurrent callouts is bounded so a flood of forged senders cannot
+// turn the server into a connection amplifier.
+//
+// The zero value is ready to use.
+type CalloutVerifier struct {
+	Resolver      MXResolver    // Nil means net.DefaultResolver.
+	LocalName     string        // EHLO name; empty means "localhost".
+	Timeout       time.Duration // Per callout, across all MX hosts; zero means 30s.
+	MaxHosts      int           // MX hosts tried; zero means 2.
+	MaxConcurrent int           // Simultaneous callouts; zero means 10.
+	CacheTTL      time.Duration // Zero means 1 hour; negative disables caching.
+	Port          string        // Zero means "25".
+
+	mu    sync.Mutex
+	sem   chan struct{}
+	cache ttlcache.Cache[*smtp.SMTPError] // Nil for a deliverable address.
+}
+
+// Verify performs a callout for address, a mailbox such as
+// "user@example.com".
+func (v *CalloutVerifier) Verify(ctx context.Context, address string) error {
+	mb, err := smtp.ParseMailbox(address)
+	if err != nil {
+		return smtp.Errorf(smtp.ReplySyntaxParamError, smtp.EnhancedCodeBadSenderSyntax, "Invalid sender address")
+	}
+	key := strings.ToLower(mb.String())
+
+	ttl := v.CacheTTL
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	v.mu.Lock()
+	if v.sem == nil {
+		n := v.MaxConcurrent
+		if n <= 0 {
+			n = 10
+		}
+		v.sem = make(chan struct{}, n)
+	}
+	sem := v.sem
+	v.mu.Unlock()
+	if r, cached := v.cache.Get(key, time.Now()); cached {
+		if r == nil {
+			return nil
+		}
+		return r
+	}
+
+	select {
+	case sem <- struct{}{}:
+		defer func() { <-sem }()
+	default:
+		return smtp.Errorf(smtp.ReplyMailboxBusy, smtp.EnhancedCodeTempSenderSystem, "Sender verification busy, try again later")
+	}
+
+	result := v.callout(ctx, mb)
+	if ttl > 0 && (result == nil || result.Code.IsPermanent()) {
+		v.cache.Set(key, result, time.Now(), ttl)
+	}
+	if result == nil {
+		return nil
+	}
+	return result
+}
+
+// callout resolves the MX hosts of mb's domain and tries them in
+// preference order until one gives a definitive answer.
+func (v *CalloutVerifier) callout(ctx context.Context, mb smtp.Mailbox) *smtp.SMTPError {
+	timeout := v.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	hosts, err := v.mxHosts(ctx, mb.Domain)
+	if err != nil {
+		return err
+	}
+
+	var last *smtp.SMTPError
+	for _, host := range hosts {
+		last = v.try(ctx, host, mb)
+		if last == nil || last.Code.IsPermanent() {
+			return last
+		}
+	}
+	return last
+}
+
+// mxHosts returns up to MaxHosts exchangers for domain, falling back to
+// the domain itself when it has no MX records (RFC 5321 §5.1).
+func (v *CalloutVerifier) mxHosts(ctx context.Context, domain string) ([]string, *smtp.SMTPError) {
+	limit := v.MaxHosts
+	if limit <= 0 {
+		limit = 2
+	}
+	hosts, err := lookupExchangers(ctx, v.Resolver, domain, limit)
+	switch {
+	case errors.Is(err, errNoMail):
+		return nil, smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeBadSenderSystem, "Sender domain does not accept mail")
+	case err != nil:
+		return nil, smtp.Errorf(smtp.ReplyMailboxBusy, smtp.EnhancedCodeTempSenderSystem, "Sender domain lookup failed, try again later")
+	}
+	return hosts, nil
+}
+
+// errNoMail is returned by lookupExchangers for a domain with a null MX
+// record (RFC 7505).
+var errNoMail = errors.New("smtp: domain does not accept mail")
+
+// lookupExchangers returns up to limit exchangers for domain in
+// preference order, falling back to the domain itself when it has no MX
+// records (RFC 5321 §5.1). A nil resolver means net.DefaultResolver.
+func lookupExchangers(ctx context.Context, resolver MXResolver, domain string, limit int) ([]string, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	mxs, err := resolver.LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return []string{domain}, nil
+		}
+		return nil, err
+	}
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, errNoMail
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+
+	var hosts []string
+	for _, mx := range mxs {
+		if len(hosts) == limit {
+			break
+		}
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hosts, nil
+}
+
+// try performs the callout against a single host. Connection failures and
+// rejections other than a 5xx reply to RCPT yield a 450 4.1.8 result.
+func (v *CalloutVerifier) try(ctx context.Context, host string, mb smtp.Mailbox) *smtp.SMTPError {
+	port := v.Port
+	if port == "" {
+		port = "25"
+	}
+	localName := v.LocalName
+	if localName == "" {
+		localName = "localhost"
+	}
+	unverified := smtp.Errorf(smtp.ReplyMailboxBusy, smtp.EnhancedCodeTempSenderSystem,
+		"Sender address could not be verified, try again later")
+
+	c, err := Dial(ctx, net.JoinHostPort(host, port), WithLocalName(localName))
+	if err != nil {
+		return unverified
+	}
+	defer c.Close()
+
+	if err := c.Mail(ctx, ""); err != nil {
+		return unverified
+	}
+	if err := c.Rcpt(ctx, mb.String()); err != nil {
+		// Only a permanent rejection of the address itself is definitive.
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) && smtpErr.Code.IsPermanent() {
+			return smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeBadSenderSystem,
+				"Sender address rejected by its domain: %s", firstLine(smtpErr.Message))
+		}
+		return unverified
+	}
+	return nil
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
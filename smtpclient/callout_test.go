@@ -0,0 +1,93 @@
+package smtpclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alexisbouchez/smtp.go"
+	"github.com/alexisbouchez/smtp.go/smtpserver"
+)
+
+// calloutServer accepts RCPT for "known@" addresses and counts callouts.
+type calloutServer struct {
+	rcpts  atomic.Int32
+	sender atomic.Value // Reverse path of the last MAIL FROM.
+}
+
+func (h *calloutServer) OnMail(_ context.Context, from smtp.ReversePath) error {
+	h.sender.Store(from)
+	return nil
+}
+
+func (h *calloutServer) OnRcpt(_ context.Context, to smtp.ForwardPath) error {
+	h.rcpts.Add(1)
+	if to.Mailbox.LocalPart != "known" {
+		return smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeBadDest, "No such user")
+	}
+	return nil
+}
+
+type staticMX map[string][]*net.MX
+
+func (r staticMX) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if mx, ok := r[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestCalloutVerifier(t *testing.T) {
+	h := &calloutServer{}
+	addr, cleanup := startTestServer(t, smtpserver.WithMailHandler(h), smtpserver.WithRcptHandler(h))
+	defer cleanup()
+	host, port, _ := net.SplitHostPort(addr)
+
+	v := &CalloutVerifier{
+		Resolver: staticMX{"example.com": {{Host: host + ".", Pref: 10}}},
+		Port:     port,
+	}
+	ctx := context.Background()
+
+	if err := v.Verify(ctx, "known@example.com"); err != nil {
+		t.Fatalf("Verify(known) = %v, want nil", err)
+	}
+	if from := h.sender.Load().(smtp.ReversePath); !from.Null {
+		t.Errorf("callout MAIL FROM = %v, want null sender", from)
+	}
+
+	err := v.Verify(ctx, "unknown@example.com")
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != smtp.ReplyMailboxNotFound || smtpErr.EnhancedCode != smtp.EnhancedCodeBadSenderSystem {
+		t.Fatalf("Verify(unknown) = %v, want 550 5.1.8", err)
+	}
+
+	// Both results are cached.
+	v.Verify(ctx, "known@example.com")
+	v.Verify(ctx, "UNKNOWN@example.com")
+	if n := h.rcpts.Load(); n != 2 {
+		t.Errorf("callouts = %d, want 2", n)
+	}
+}
+
+func TestCalloutVerifier_Unreachable(t *testing.T) {
+	// Reserve a port with nothing listening on it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	v := &CalloutVerifier{
+		Resolver: staticMX{"example.com": {{Host: "127.0.0.1.", Pref: 10}}},
+		Port:     port,
+	}
+	err = v.Verify(context.Background(), "user@example.com")
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || !smtpErr.Temporary() {
+		t.Fatalf("Verify = %v, want temporary failure", err)
+	}
+}
@@ -2,9 +2,11 @@
 package smtpclient
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -25,6 +27,12 @@ type Client struct {
 	exts      smtp.Extensions
 	logger    *slog.Logger
 	tls       bool
+	tlsErr    error // STARTTLS failure that caused a cleartext fallback.
+	closing   error // 421 reply that ended the session.
+	pins      pinSet
+	stream    streamReader // Reused by streamFrom.
+
+	writeTimeout time.Duration // Per-chunk limit for message data; 0 means the default.
 }
 
 // Option configures a Client.
@@ -35,7 +43,14 @@ type options struct {
 	timeout   time.Duration
 	localName string
 	tlsConfig *tls.Config
+	tlsPolicy TLSPolicy
+	tlsMust   bool // Set by WithTLSMandatory.
+	pins      pinSet
 	logger    *slog.Logger
+
+	writeTimeout              time.Duration
+	readBufSize, writeBufSize int
+	maxReplyLine              int
 }
 
 // WithDialer sets a custom net.Dialer for the connection.
@@ -63,8 +78,23 @@ func WithLogger(l *slog.Logger) Option {
 	return func(o *options) { o.logger = l }
 }
 
+// WithBufferSizes sets the connection's read and write buffer sizes. The
+// default is 4096 bytes each; bulk senders benefit from 64 KB. Zero keeps
+// the default.
+func WithBufferSizes(read, write int) Option {
+	return func(o *options) { o.readBufSize, o.writeBufSize = read, write }
+}
+
+// WithMaxReplyLineLength sets the longest reply line accepted from the
+// server, including CRLF. The default is 2048; raise it for servers that
+// send longer EHLO lines.
+func WithMaxReplyLineLength(n int) Option {
+	return func(o *options) { o.maxReplyLine = n }
+}
+
 // Dial connects to the SMTP server at addr, reads the greeting, and sends EHLO.
-// It falls back to HELO if EHLO is rejected.
+// It falls back to HELO if EHLO is rejected. STARTTLS is then negotiated
+// according to the WithTLSPolicy option.
 func Dial(ctx context.Context, addr string, opts ...Option) (*Client, error) {
 	o := &options{
 		dialer:    &net.Dialer{},
@@ -76,21 +106,35 @@ func Dial(ctx context.Context, addr string, opts ...Option) (*Client, error) {
 		opt(o)
 	}
 
-	// Apply timeout to the entire dial+greeting+EHLO sequence.
+	// Apply timeout to the entire dial+greeting+EHLO+STARTTLS sequence.
 	ctx, cancel := context.WithTimeout(ctx, o.timeout)
 	defer cancel()
 
+	c, err := dialPlain(ctx, addr, o)
+	if err != nil {
+		return nil, err
+	}
+	return applyTLSPolicy(ctx, c, addr, o)
+}
+
+// dialPlain connects to addr and completes the greeting and EHLO exchange
+// without negotiating TLS.
+func dialPlain(ctx context.Context, addr string, o *options) (*Client, error) {
 	nc, err := o.dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("smtp: dial %s: %w", addr, err)
 	}
 
 	c := &Client{
-		conn:      textproto.NewConn(nc),
+		conn:      textproto.NewConnSize(nc, o.readBufSize, o.writeBufSize),
 		netConn:   nc,
 		localName: o.localName,
 		logger:    o.logger,
+		pins:      o.pins,
+
+		writeTimeout: o.writeTimeout,
 	}
+	c.conn.SetMaxReplyLineLen(o.maxReplyLine)
 
 	c.conn.SetDeadlineFromContext(ctx)
 
@@ -102,7 +146,7 @@ func Dial(ctx context.Context, addr string, opts ...Option) (*Client, error) {
 	}
 	if reply.Code != int(smtp.ReplyServiceReady) {
 		nc.Close()
-		return nil, replyToError(reply)
+		return nil, c.replyError(reply)
 	}
 
 	if len(reply.Lines) > 0 {
@@ -135,7 +179,7 @@ func NewClient(nc net.Conn, localName string) (*Client, error) {
 		return nil, fmt.Errorf("smtp: reading greeting: %w", err)
 	}
 	if reply.Code != int(smtp.ReplyServiceReady) {
-		return nil, replyToError(reply)
+		return nil, c.replyError(reply)
 	}
 
 	if len(reply.Lines) > 0 {
@@ -152,9 +196,11 @@ func NewClient(nc net.Conn, localName string) (*Client, error) {
 
 // ehlo sends EHLO and falls back to HELO if rejected (RFC 5321 §4.1.1.1).
 func (c *Client) ehlo(ctx context.Context) error {
-	c.conn.SetDeadlineFromContext(ctx)
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
 
-	reply, err := c.conn.Cmd("EHLO %s", c.localName)
+	reply, err := c.conn.Cmd("EHLO ", c.localName)
 	if err != nil {
 		return fmt.Errorf("smtp: EHLO: %w", err)
 	}
@@ -166,18 +212,38 @@ func (c *Client) ehlo(ctx context.Context) error {
 
 	// EHLO rejected — try HELO.
 	if reply.Code == int(smtp.ReplySyntaxError) || reply.Code == int(smtp.ReplyCommandNotImpl) {
-		reply, err = c.conn.Cmd("HELO %s", c.localName)
+		reply, err = c.conn.Cmd("HELO ", c.localName)
 		if err != nil {
 			return fmt.Errorf("smtp: HELO: %w", err)
 		}
 		if reply.Code != int(smtp.ReplyOK) {
-			return replyToError(reply)
+			return c.replyError(reply)
 		}
 		c.exts = nil // No extensions with HELO.
 		return nil
 	}
 
-	return replyToError(reply)
+	return c.replyError(reply)
+}
+
+// Hello sends EHLO again, falling back to HELO, and refreshes the
+// extension list. A non-empty localName replaces the identity given with
+// WithLocalName for this and later greetings. The server resets any
+// transaction in progress (RFC 5321 §4.1.4).
+func (c *Client) Hello(ctx context.Context, localName string) error {
+	if strings.ContainsAny(localName, "\r\n") {
+		return errors.New("smtp: EHLO: name must not contain CR or LF")
+	}
+	if localName != "" {
+		c.localName = localName
+	}
+	return c.ehlo(ctx)
+}
+
+// LocalName returns the identity the client last announced in EHLO or
+// HELO.
+func (c *Client) LocalName() string {
+	return c.localName
 }
 
 // Extensions returns the extensions advertised by the server in the last
@@ -187,33 +253,41 @@ func (c *Client) Extensions() smtp.Extensions {
 }
 
 // Mail sends the MAIL FROM command with optional extension parameters
-// (RFC 5321 §4.1.1.2, RFC 1870 SIZE, RFC 6152 8BITMIME, RFC 6531 SMTPUTF8, RFC 3461 DSN).
+// (RFC 5321 §4.1.1.2, RFC 1870 SIZE, RFC 6152 8BITMIME, RFC 6531 SMTPUTF8, RFC 3461 DSN,
+// RFC 8689 REQUIRETLS, RFC 2852 BY, RFC 6710 MT-PRIORITY, RFC 4954 AUTH).
 func (c *Client) Mail(ctx context.Context, from string, opts ...MailOption) error {
-	c.conn.SetDeadlineFromContext(ctx)
-
-	cmd := fmt.Sprintf("MAIL FROM:<%s>", from)
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
 
 	var mo mailOptions
-	for _, opt := range opts {
-		opt(&mo)
+	if len(opts) > 0 {
+		mo = applyMailOptions(opts)
 	}
-	if mo.size > 0 {
-		cmd += fmt.Sprintf(" SIZE=%d", mo.size)
+	if mo.ehloName != "" && mo.ehloName != c.localName {
+		if err := c.Hello(ctx, mo.ehloName); err != nil {
+			return err
+		}
 	}
-	if mo.body != "" {
-		cmd += fmt.Sprintf(" BODY=%s", mo.body)
+	if mo.smtpUTF8 && !c.exts.Has(smtp.ExtSMTPUTF8) {
+		return errNoSMTPUTF8("the message")
 	}
-	if mo.smtpUTF8 {
-		cmd += " SMTPUTF8"
+	if mo.requireTLS && !c.tls {
+		// RFC 8689 §4.2.1: never send a REQUIRETLS message in cleartext.
+		if c.tlsErr != nil {
+			return fmt.Errorf("smtp: MAIL FROM: %w after STARTTLS failed: %v", ErrRequireTLS, c.tlsErr)
+		}
+		return fmt.Errorf("smtp: MAIL FROM: %w", ErrRequireTLS)
 	}
-	if mo.dsnRet != "" {
-		cmd += fmt.Sprintf(" RET=%s", mo.dsnRet)
+	from, err := c.wirePath(from)
+	if err != nil {
+		return err
 	}
-	if mo.dsnEnvID != "" {
-		cmd += fmt.Sprintf(" ENVID=%s", mo.dsnEnvID)
+	params, err := mo.params()
+	if err != nil {
+		return fmt.Errorf("smtp: MAIL FROM: %w", err)
 	}
-
-	if err := c.conn.WriteLine(cmd); err != nil {
+	if err := c.conn.WriteCommand("MAIL FROM:<", from, ">", params); err != nil {
 		return fmt.Errorf("smtp: MAIL FROM: %w", err)
 	}
 	reply, err := c.conn.ReadReply()
@@ -221,7 +295,7 @@ func (c *Client) Mail(ctx context.Context, from string, opts ...MailOption) erro
 		return fmt.Errorf("smtp: MAIL FROM: %w", err)
 	}
 	if reply.Code != int(smtp.ReplyOK) {
-		return replyToError(reply)
+		return c.replyError(reply)
 	}
 	return nil
 }
@@ -229,22 +303,23 @@ func (c *Client) Mail(ctx context.Context, from string, opts ...MailOption) erro
 // Rcpt sends the RCPT TO command with optional extension parameters
 // (RFC 5321 §4.1.1.3, RFC 3461 DSN).
 func (c *Client) Rcpt(ctx context.Context, to string, opts ...RcptOption) error {
-	c.conn.SetDeadlineFromContext(ctx)
-
-	cmd := fmt.Sprintf("RCPT TO:<%s>", to)
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
 
-	var ro rcptOptions
-	for _, opt := range opts {
-		opt(&ro)
+	to, err := c.wirePath(to)
+	if err != nil {
+		return err
 	}
-	if ro.dsnNotify != "" {
-		cmd += fmt.Sprintf(" NOTIFY=%s", ro.dsnNotify)
+	var ro rcptOptions
+	if len(opts) > 0 {
+		ro = applyRcptOptions(opts)
 	}
-	if ro.dsnOrcpt != "" {
-		cmd += fmt.Sprintf(" ORCPT=%s", ro.dsnOrcpt)
+	params, err := ro.params()
+	if err != nil {
+		return fmt.Errorf("smtp: RCPT TO: %w", err)
 	}
-
-	if err := c.conn.WriteLine(cmd); err != nil {
+	if err := c.conn.WriteCommand("RCPT TO:<", to, ">", params); err != nil {
 		return fmt.Errorf("smtp: RCPT TO: %w", err)
 	}
 	reply, err := c.conn.ReadReply()
@@ -252,7 +327,7 @@ func (c *Client) Rcpt(ctx context.Context, to string, opts ...RcptOption) error
 		return fmt.Errorf("smtp: RCPT TO: %w", err)
 	}
 	if reply.Code != int(smtp.ReplyOK) {
-		return replyToError(reply)
+		return c.replyError(reply)
 	}
 	return nil
 }
@@ -275,24 +350,29 @@ func (c *Client) ServerMaxSize() int64 {
 // Data sends the DATA command and streams the message body from r.
 // The body is dot-stuffed automatically (RFC 5321 §4.1.1.4).
 func (c *Client) Data(ctx context.Context, r io.Reader) error {
-	c.conn.SetDeadlineFromContext(ctx)
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
 
 	reply, err := c.conn.Cmd("DATA")
 	if err != nil {
 		return fmt.Errorf("smtp: DATA: %w", err)
 	}
 	if reply.Code != int(smtp.ReplyStartMailInput) {
-		return replyToError(reply)
+		return c.replyError(reply)
 	}
 
 	// Stream body through dot writer.
+	stop := c.abortOnCancel(ctx)
+	defer stop()
 	dw := c.conn.DotWriter()
-	if _, err := io.Copy(dw, r); err != nil {
+	if _, err := io.Copy(dw, c.streamFrom(ctx, r)); err != nil {
 		dw.Close()
-		return fmt.Errorf("smtp: writing DATA body: %w", err)
+		return fmt.Errorf("smtp: writing DATA body: %w", streamError(ctx, err))
 	}
+	c.refreshWriteDeadline(ctx)
 	if err := dw.Close(); err != nil {
-		return fmt.Errorf("smtp: closing DATA body: %w", err)
+		return fmt.Errorf("smtp: closing DATA body: %w", streamError(ctx, err))
 	}
 
 	// Read final reply.
@@ -301,14 +381,16 @@ func (c *Client) Data(ctx context.Context, r io.Reader) error {
 		return fmt.Errorf("smtp: reading DATA reply: %w", err)
 	}
 	if reply.Code != int(smtp.ReplyOK) {
-		return replyToError(reply)
+		return c.replyError(reply)
 	}
 	return nil
 }
 
 // Bdat sends a BDAT chunk (RFC 3030). Set last=true for the final chunk.
 func (c *Client) Bdat(ctx context.Context, data []byte, last bool) error {
-	c.conn.SetDeadlineFromContext(ctx)
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
 
 	cmd := fmt.Sprintf("BDAT %d", len(data))
 	if last {
@@ -319,12 +401,15 @@ func (c *Client) Bdat(ctx context.Context, data []byte, last bool) error {
 	}
 
 	// Write the raw data (no dot-stuffing for BDAT).
+	stop := c.abortOnCancel(ctx)
+	defer stop()
 	bw := c.conn.BufWriter()
-	if _, err := bw.Write(data); err != nil {
-		return fmt.Errorf("smtp: BDAT write: %w", err)
+	if _, err := io.Copy(bw, c.streamFrom(ctx, bytes.NewReader(data))); err != nil {
+		return fmt.Errorf("smtp: BDAT write: %w", streamError(ctx, err))
 	}
+	c.refreshWriteDeadline(ctx)
 	if err := bw.Flush(); err != nil {
-		return fmt.Errorf("smtp: BDAT flush: %w", err)
+		return fmt.Errorf("smtp: BDAT flush: %w", streamError(ctx, err))
 	}
 
 	// Read reply.
@@ -333,28 +418,41 @@ func (c *Client) Bdat(ctx context.Context, data []byte, last bool) error {
 		return fmt.Errorf("smtp: BDAT reply: %w", err)
 	}
 	if reply.Code != int(smtp.ReplyOK) {
-		return replyToError(reply)
+		return c.replyError(reply)
 	}
 	return nil
 }
 
 // StartTLS sends the STARTTLS command and upgrades the connection to TLS
 // (RFC 3207). After a successful upgrade, it re-issues EHLO to refresh
-// the server's extension list.
+// the server's extension list. If the server certificate fails
+// verification, the returned error wraps a *TLSVerificationError. A failed
+// handshake closes the connection. Pins set with WithPinnedCertificates
+// or WithPinnedSPKI are enforced on top of config.
 func (c *Client) StartTLS(ctx context.Context, config *tls.Config) error {
-	c.conn.SetDeadlineFromContext(ctx)
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
 
 	reply, err := c.conn.Cmd("STARTTLS")
 	if err != nil {
 		return fmt.Errorf("smtp: STARTTLS: %w", err)
 	}
 	if reply.Code != int(smtp.ReplyServiceReady) {
-		return replyToError(reply)
+		return c.replyError(reply)
 	}
 
 	// Upgrade to TLS.
+	if !c.pins.empty() {
+		config = c.pins.apply(config)
+	}
 	tlsConn := tls.Client(c.netConn, config)
 	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		// The stream is no longer in sync; the session cannot continue.
+		c.netConn.Close()
+		if verr := newTLSVerificationError(config.ServerName, err); verr != nil {
+			return fmt.Errorf("smtp: TLS handshake: %w", verr)
+		}
 		return fmt.Errorf("smtp: TLS handshake: %w", err)
 	}
 
@@ -372,8 +470,13 @@ func (c *Client) IsTLS() bool {
 }
 
 // Auth performs SASL authentication using the given mechanism (RFC 4954).
+// An initial response that would make the AUTH command longer than the
+// 512-octet command line limit, such as a long OAuth token, is sent on a
+// continuation line after the server's empty challenge instead.
 func (c *Client) Auth(ctx context.Context, mech smtp.SASLMechanism) error {
-	c.conn.SetDeadlineFromContext(ctx)
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
 
 	// Start the mechanism.
 	initialResp, err := mech.Start()
@@ -381,12 +484,20 @@ func (c *Client) Auth(ctx context.Context, mech smtp.SASLMechanism) error {
 		return fmt.Errorf("smtp: auth start: %w", err)
 	}
 
-	// Send AUTH command with optional initial response.
-	var cmd string
+	// Send AUTH command with optional initial response. An empty one is
+	// sent as "=" (RFC 4954 §4).
+	cmd := "AUTH " + mech.Name()
+	var pending []byte // Initial response deferred to the first challenge.
 	if initialResp != nil {
-		cmd = fmt.Sprintf("AUTH %s %s", mech.Name(), base64.StdEncoding.EncodeToString(initialResp))
-	} else {
-		cmd = fmt.Sprintf("AUTH %s", mech.Name())
+		encoded := base64.StdEncoding.EncodeToString(initialResp)
+		if encoded == "" {
+			encoded = "="
+		}
+		if len(cmd)+len(" ")+len(encoded)+len("\r\n") <= textproto.MaxCommandLineLen {
+			cmd += " " + encoded
+		} else {
+			pending = initialResp
+		}
 	}
 	if err := c.conn.WriteLine(cmd); err != nil {
 		return fmt.Errorf("smtp: auth write: %w", err)
@@ -404,7 +515,16 @@ func (c *Client) Auth(ctx context.Context, mech smtp.SASLMechanism) error {
 		}
 
 		if reply.Code != int(smtp.ReplyAuthContinue) {
-			return replyToError(reply)
+			return c.replyError(reply)
+		}
+
+		if pending != nil {
+			encoded := base64.StdEncoding.EncodeToString(pending)
+			pending = nil
+			if err := c.conn.WriteLine(encoded); err != nil {
+				return fmt.Errorf("smtp: auth response: %w", err)
+			}
+			continue
 		}
 
 		// Decode the server challenge.
@@ -470,38 +590,134 @@ func (c *Client) SendMail(ctx context.Context, from string, to []string, r io.Re
 
 // Reset sends the RSET command to abort the current transaction (RFC 5321 §4.1.1.5).
 func (c *Client) Reset(ctx context.Context) error {
-	c.conn.SetDeadlineFromContext(ctx)
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
 
 	reply, err := c.conn.Cmd("RSET")
 	if err != nil {
 		return fmt.Errorf("smtp: RSET: %w", err)
 	}
 	if reply.Code != int(smtp.ReplyOK) {
-		return replyToError(reply)
+		return c.replyError(reply)
 	}
 	return nil
 }
 
 // Noop sends a NOOP command as a keepalive (RFC 5321 §4.1.1.9).
 func (c *Client) Noop(ctx context.Context) error {
-	c.conn.SetDeadlineFromContext(ctx)
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
 
 	reply, err := c.conn.Cmd("NOOP")
 	if err != nil {
 		return fmt.Errorf("smtp: NOOP: %w", err)
 	}
 	if reply.Code != int(smtp.ReplyOK) {
-		return replyToError(reply)
+		return c.replyError(reply)
 	}
 	return nil
 }
 
+// Help sends HELP, with topic as its argument if non-empty, and returns
+// the lines of the 211 or 214 reply (RFC 5321 §4.1.1.8).
+func (c *Client) Help(ctx context.Context, topic string) ([]string, error) {
+	if err := c.begin(ctx); err != nil {
+		return nil, err
+	}
+
+	cmd := "HELP"
+	if topic != "" {
+		if strings.ContainsAny(topic, "\r\n") {
+			return nil, errors.New("smtp: HELP: topic must not contain CR or LF")
+		}
+		cmd += " " + topic
+	}
+	reply, err := c.conn.Cmd(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: HELP: %w", err)
+	}
+	if reply.Code != int(smtp.ReplyHelpMessage) && reply.Code != int(smtp.ReplySystemStatus) {
+		return nil, c.replyError(reply)
+	}
+	return parseReply(reply).Lines, nil
+}
+
+// Reply is a reply received from the server.
+type Reply struct {
+	Code         smtp.ReplyCode
+	EnhancedCode smtp.EnhancedCode // Zero if the reply has none (RFC 2034).
+	Lines        []string          // Reply text, without the enhanced code.
+}
+
+// LastReply returns the server's reply to the most recent command,
+// whether it succeeded or not, for logging and diagnostics. After Dial
+// it holds the EHLO (or HELO) reply.
+func (c *Client) LastReply() Reply {
+	return parseReply(c.conn.LastReply())
+}
+
+// parseReply splits the enhanced status code off the lines of reply.
+func parseReply(reply textproto.Reply) Reply {
+	r := Reply{Code: smtp.ReplyCode(reply.Code), Lines: make([]string, len(reply.Lines))}
+	for i, line := range reply.Lines {
+		cl, su, de, rest := textproto.ParseEnhancedCode(line)
+		if cl != 0 {
+			if i == 0 {
+				r.EnhancedCode = smtp.EnhancedCode{Class: cl, Subject: su, Detail: de}
+			}
+			line = rest
+		}
+		r.Lines[i] = line
+	}
+	return r
+}
+
 // Close sends QUIT and closes the connection (RFC 5321 §4.1.1.10).
 func (c *Client) Close() error {
+	if c.closing != nil {
+		return nil // The connection is already closed.
+	}
 	c.conn.Cmd("QUIT") // Best effort; ignore errors.
 	return c.netConn.Close()
 }
 
+// ErrServerClosing matches the error returned when the server replies 421,
+// announcing that it is closing the connection (RFC 5321 §3.8). The client
+// then closes its end, and every later command fails with the same error
+// without being sent: dial a new connection to go on. The error also
+// unwraps to the *smtp.SMTPError holding the reply.
+var ErrServerClosing = errors.New("smtp: server closing connection")
+
+// closingError is the error for a 421 reply.
+type closingError struct{ *smtp.SMTPError }
+
+func (e closingError) Is(target error) bool { return target == ErrServerClosing }
+func (e closingError) Unwrap() error        { return e.SMTPError }
+
+// begin prepares the connection for a command bounded by ctx. It fails,
+// without sending anything, once the server has closed the session.
+func (c *Client) begin(ctx context.Context) error {
+	if c.closing != nil {
+		return c.closing
+	}
+	c.conn.SetDeadlineFromContext(ctx)
+	return nil
+}
+
+// replyError converts a failure reply to an error. A 421 reply also marks
+// the session as closed and closes the connection.
+func (c *Client) replyError(reply textproto.Reply) error {
+	smtpErr := replyToError(reply)
+	if smtpErr.Code != smtp.ReplyServiceNotAvailable {
+		return smtpErr
+	}
+	c.closing = closingError{smtpErr}
+	c.netConn.Close()
+	return c.closing
+}
+
 // replyToError converts a textproto.Reply to an SMTPError.
 func replyToError(reply textproto.Reply) *smtp.SMTPError {
 	msg := strings.Join(reply.Lines, "\n")
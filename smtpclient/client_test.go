@@ -1,9 +1,12 @@
 package smtpclient
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"io"
 	"net"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
@@ -291,6 +294,37 @@ func TestRcptRejected(t *testing.T) {
 	}
 }
 
+func TestServerClosing(t *testing.T) {
+	// The list test's handler answers the second MAIL of a session with 421.
+	addr, cleanup := startTestServer(t, smtpserver.WithMailHandler(&oneMailPerSession{seen: make(map[string]bool)}))
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := Dial(ctx, addr, WithLocalName("test.local"))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Mail(ctx, "sender@example.com"); err != nil {
+		t.Fatalf("first Mail: %v", err)
+	}
+	if err := c.Reset(ctx); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	err = c.Mail(ctx, "sender@example.com")
+	var smtpErr *smtp.SMTPError
+	if !errors.Is(err, ErrServerClosing) || !errors.As(err, &smtpErr) || smtpErr.Code != smtp.ReplyServiceNotAvailable {
+		t.Fatalf("Mail after 421 = %v, want ErrServerClosing with the reply", err)
+	}
+	if err := c.Noop(ctx); !errors.Is(err, ErrServerClosing) {
+		t.Errorf("Noop on a closed session = %v, want ErrServerClosing", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close = %v", err)
+	}
+}
+
 type rejectRcptHandler struct {
 	reject string
 }
@@ -409,3 +443,192 @@ func TestHELO_Fallback(t *testing.T) {
 
 	c.Close()
 }
+
+func TestMaxReplyLineLength(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// A server whose greeting line is 3000 bytes long.
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer nc.Close()
+				nc.Write([]byte("220 " + strings.Repeat("x", 3000) + "\r\n"))
+				r := bufio.NewReader(nc)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if strings.HasPrefix(line, "QUIT") {
+						nc.Write([]byte("221 Bye\r\n"))
+						return
+					}
+					nc.Write([]byte("250 test.example.com\r\n"))
+				}
+			}()
+		}
+	}()
+
+	ctx := context.Background()
+	if _, err := Dial(ctx, ln.Addr().String(), WithTimeout(2*time.Second)); err == nil {
+		t.Fatal("Dial with the default limit succeeded, want line too long")
+	}
+	c, err := Dial(ctx, ln.Addr().String(), WithTimeout(2*time.Second),
+		WithMaxReplyLineLength(4096), WithBufferSizes(64*1024, 64*1024))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	c.Close()
+}
+
+func TestHelpAndLastReply(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer nc.Close()
+		nc.Write([]byte("220 test.example.com ESMTP\r\n"))
+		r := bufio.NewReader(nc)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "HELP MAIL"):
+				nc.Write([]byte("214-2.0.0 MAIL FROM:<sender> [parameters]\r\n214 2.0.0 End of HELP info\r\n"))
+			case strings.HasPrefix(line, "HELP"):
+				nc.Write([]byte("502 5.5.1 HELP not available\r\n"))
+			case strings.HasPrefix(line, "QUIT"):
+				nc.Write([]byte("221 Bye\r\n"))
+				return
+			default:
+				nc.Write([]byte("250 test.example.com\r\n"))
+			}
+		}
+	}()
+
+	ctx := context.Background()
+	c, err := Dial(ctx, ln.Addr().String(), WithTimeout(2*time.Second))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	if r := c.LastReply(); r.Code != smtp.ReplyOK || r.Lines[0] != "test.example.com" {
+		t.Errorf("LastReply after Dial = %+v", r)
+	}
+
+	lines, err := c.Help(ctx, "MAIL")
+	if err != nil {
+		t.Fatalf("Help: %v", err)
+	}
+	want := []string{"MAIL FROM:<sender> [parameters]", "End of HELP info"}
+	if !slices.Equal(lines, want) {
+		t.Errorf("Help = %q, want %q", lines, want)
+	}
+
+	if _, err := c.Help(ctx, ""); err == nil {
+		t.Fatal("Help without topic succeeded, want 502")
+	}
+	r := c.LastReply()
+	if r.Code != smtp.ReplyCommandNotImpl || r.EnhancedCode != (smtp.EnhancedCode{Class: 5, Subject: 5, Detail: 1}) ||
+		r.Lines[0] != "HELP not available" {
+		t.Errorf("LastReply after failed HELP = %+v", r)
+	}
+}
+
+type heloRecorder struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (h *heloRecorder) OnHelo(_ context.Context, hostname string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.names = append(h.names, hostname)
+	return nil
+}
+
+func TestHello(t *testing.T) {
+	helo := &heloRecorder{}
+	addr, cleanup := startTestServer(t, smtpserver.WithHeloHandler(helo))
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := Dial(ctx, addr, WithLocalName("first.example.com"))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Hello(ctx, "second.example.com"); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	if err := c.Hello(ctx, ""); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	if c.Extensions() == nil {
+		t.Error("Extensions() = nil after Hello")
+	}
+	if err := c.Hello(ctx, "bad\r\nRSET"); err == nil {
+		t.Error("Hello accepted a name with CRLF")
+	}
+
+	helo.mu.Lock()
+	defer helo.mu.Unlock()
+	want := []string{"first.example.com", "second.example.com", "second.example.com"}
+	if !slices.Equal(helo.names, want) {
+		t.Errorf("EHLO names = %q, want %q", helo.names, want)
+	}
+}
+
+func TestMail_EHLOName(t *testing.T) {
+	helo := &heloRecorder{}
+	addr, cleanup := startTestServer(t, smtpserver.WithHeloHandler(helo))
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := Dial(ctx, addr, WithLocalName("mx.example.net"))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	for _, name := range []string{"mx.tenant-a.example", "mx.tenant-a.example", "mx.tenant-b.example"} {
+		if err := c.Mail(ctx, "sender@example.com", WithEHLOName(name)); err != nil {
+			t.Fatalf("Mail as %s: %v", name, err)
+		}
+		if got := c.LocalName(); got != name {
+			t.Errorf("LocalName() = %q, want %q", got, name)
+		}
+		if err := c.Reset(ctx); err != nil {
+			t.Fatalf("Reset: %v", err)
+		}
+	}
+	if err := c.Mail(ctx, "sender@example.com", WithEHLOName("bad\r\nRSET")); err == nil {
+		t.Error("Mail accepted an EHLO name with CRLF")
+	}
+
+	helo.mu.Lock()
+	defer helo.mu.Unlock()
+	want := []string{"mx.example.net", "mx.tenant-a.example", "mx.tenant-b.example"}
+	if !slices.Equal(helo.names, want) {
+		t.Errorf("EHLO names = %q, want %q", helo.names, want)
+	}
+}
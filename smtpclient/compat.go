@@ -0,0 +1,96 @@
+package smtpclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	netsmtp "net/smtp"
+	"strings"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// SendMailSimple connects to the server at addr, switches to TLS if
+// possible, authenticates with a if it is non-nil, and sends msg from
+// from to every address in to. It mirrors net/smtp.SendMail, so
+// migrating is a change of package name:
+//
+//	err := smtpclient.SendMailSimple("mail.example.com:25", auth, from, to, msg)
+//
+// auth is a net/smtp Auth, such as one returned by net/smtp.PlainAuth.
+// Like net/smtp, SendMailSimple has no timeout beyond the 30-second
+// connection timeout of Dial; use Dial and SendMail with a context to
+// bound the whole transaction.
+func SendMailSimple(addr string, a netsmtp.Auth, from string, to []string, msg []byte) error {
+	for _, s := range append([]string{from}, to...) {
+		if strings.ContainsAny(s, "\r\n") {
+			return errors.New("smtp: a line must not contain CR or LF")
+		}
+	}
+
+	ctx := context.Background()
+	c, err := Dial(ctx, addr, WithTLSPolicy(TLSOpportunistic))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if a != nil {
+		if !c.Extensions().Has(smtp.ExtAUTH) {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		if err := c.Auth(ctx, NetSMTPAuth(a, c.ServerInfo(host))); err != nil {
+			return err
+		}
+	}
+	return c.SendMail(ctx, from, to, bytes.NewReader(msg))
+}
+
+// ServerInfo describes the connection in the form net/smtp Auth
+// implementations expect. name is the host name the caller dialed; the
+// stdlib PlainAuth, for instance, only sends credentials when name
+// matches its host and the connection uses TLS or name is localhost.
+func (c *Client) ServerInfo(name string) *netsmtp.ServerInfo {
+	return &netsmtp.ServerInfo{
+		Name: name,
+		TLS:  c.tls,
+		Auth: strings.Fields(c.exts.Param(smtp.ExtAUTH)),
+	}
+}
+
+// NetSMTPAuth adapts a net/smtp Auth to smtp.SASLMechanism, so existing
+// Auth implementations work with Client.Auth. info is passed to a.Start;
+// see Client.ServerInfo.
+func NetSMTPAuth(a netsmtp.Auth, info *netsmtp.ServerInfo) smtp.SASLMechanism {
+	return &netSMTPAuth{auth: a, info: info}
+}
+
+type netSMTPAuth struct {
+	auth  netsmtp.Auth
+	info  *netsmtp.ServerInfo
+	proto string // Mechanism name returned by Start.
+}
+
+// Name returns the mechanism chosen by the wrapped Auth. It is only known
+// once Start has run, which Client.Auth does first.
+func (m *netSMTPAuth) Name() string { return m.proto }
+
+func (m *netSMTPAuth) Start() ([]byte, error) {
+	proto, resp, err := m.auth.Start(m.info)
+	if err != nil {
+		return nil, err
+	}
+	m.proto = proto
+	return resp, nil
+}
+
+func (m *netSMTPAuth) Next(challenge []byte) ([]byte, error) {
+	resp, err := m.auth.Next(challenge, true)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: %w", err)
+	}
+	return resp, nil
+}
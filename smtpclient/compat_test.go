@@ -0,0 +1,62 @@
+package smtpclient
+
+import (
+	"context"
+	"net"
+	netsmtp "net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go/smtpserver"
+)
+
+func TestSendMailSimple(t *testing.T) {
+	handler := &testDataHandler{}
+	addr, cleanup := startTestServer(t,
+		smtpserver.WithAuthHandler(&testAuthHandler{}),
+		smtpserver.WithDataHandler(handler),
+	)
+	defer cleanup()
+	host, _, _ := net.SplitHostPort(addr)
+
+	// net/smtp.PlainAuth allows cleartext to 127.0.0.1.
+	auth := netsmtp.PlainAuth("", "testuser", "testpass", host)
+	msg := []byte("Subject: compat\r\n\r\nHello\r\n")
+	if err := SendMailSimple(addr, auth, "sender@example.com", []string{"a@example.com", "b@example.com"}, msg); err != nil {
+		t.Fatalf("SendMailSimple: %v", err)
+	}
+	got := handler.lastMessage()
+	if len(got.To) != 2 || !strings.Contains(got.Body, "Hello") {
+		t.Errorf("delivered %+v", got)
+	}
+
+	bad := netsmtp.PlainAuth("", "testuser", "wrong", host)
+	if err := SendMailSimple(addr, bad, "sender@example.com", []string{"a@example.com"}, msg); err == nil {
+		t.Error("expected authentication failure")
+	}
+	if err := SendMailSimple(addr, nil, "sender@example.com\r\nRCPT TO:<x@example.com>", []string{"a@example.com"}, msg); err == nil {
+		t.Error("expected error for CR/LF in address")
+	}
+}
+
+func TestNetSMTPAuth_Challenge(t *testing.T) {
+	addr, cleanup := startTestServer(t, smtpserver.WithAuthHandler(&testAuthHandler{}))
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := Dial(ctx, addr, WithLocalName("test.local"), WithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	host, _, _ := net.SplitHostPort(addr)
+	info := c.ServerInfo(host)
+	if info.TLS || len(info.Auth) == 0 {
+		t.Errorf("ServerInfo = %+v", info)
+	}
+	if err := c.Auth(ctx, NetSMTPAuth(netsmtp.CRAMMD5Auth("testuser", "secret"), info)); err != nil {
+		t.Fatalf("Auth CRAM-MD5 via adapter: %v", err)
+	}
+}
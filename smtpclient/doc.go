@@ -28,10 +28,14 @@
 //
 // Call [Client.StartTLS] to upgrade an existing connection to TLS.
 // After a successful upgrade, the client re-issues EHLO automatically.
+// Alternatively, [WithTLSPolicy] makes [Dial] negotiate STARTTLS and decide
+// whether a failed upgrade aborts or falls back to cleartext.
 //
 // # Authentication
 //
-// Call [Client.Auth] with any [smtp.SASLMechanism] (PLAIN, LOGIN, CRAM-MD5).
+// Call [Client.Auth] with any [smtp.SASLMechanism] (PLAIN, LOGIN, CRAM-MD5,
+// SCRAM-SHA-256), or [Client.AuthAuto] to use the strongest mechanism the
+// server advertises.
 //
 // # CHUNKING (RFC 3030)
 //
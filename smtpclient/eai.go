@@ -0,0 +1,275 @@
+package smtpclient
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// errNoSMTPUTF8 returns the error for something that needs SMTPUTF8.
+func errNoSMTPUTF8(what string) *smtp.SMTPError {
+	return smtp.Errorf(smtp.ReplyMailboxNameError, smtp.EnhancedCodeNonASCII,
+		"%s requires SMTPUTF8, which the server does not support", what)
+}
+
+// wirePath returns addr as it can be sent to the server: unchanged if it
+// is ASCII or the server supports SMTPUTF8, with a punycoded domain
+// otherwise.
+func (c *Client) wirePath(addr string) (string, error) {
+	if isASCII(addr) || c.exts.Has(smtp.ExtSMTPUTF8) {
+		return addr, nil
+	}
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 || !isASCII(addr[:at]) {
+		return "", errNoSMTPUTF8("address " + addr)
+	}
+	domain, err := domainToASCII(addr[at+1:])
+	if err != nil {
+		return "", err
+	}
+	return addr[:at+1] + domain, nil
+}
+
+// Downgrade rewrites the header of msg, an internationalized message, so
+// it can be relayed to a server without SMTPUTF8 (RFC 6857 §3):
+//
+//   - domains in address fields are converted to punycode;
+//   - non-ASCII display names and unstructured fields such as Subject
+//     become MIME encoded-words (RFC 2047);
+//   - an address with a non-ASCII local part, which has no ASCII form,
+//     becomes an empty group named after the encoded address;
+//   - any other field with non-ASCII content is renamed Downgraded-<name>
+//     and its value encoded.
+//
+// ASCII fields and the body are left untouched, so a message with an
+// 8-bit body still needs 8BITMIME. MIME part headers inside the body are
+// not rewritten. Downgrade returns msg unchanged if its header is ASCII.
+//
+// Envelope addresses are handled by Mail and Rcpt: on a server without
+// SMTPUTF8 they send an address whose only non-ASCII part is the domain
+// with the domain in punycode, and fail locally with a permanent 553
+// 5.6.7 error, suitable for a non-delivery report, for a non-ASCII local
+// part or WithSMTPUTF8.
+func Downgrade(msg []byte) ([]byte, error) {
+	headerEnd := bytes.Index(msg, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return nil, errors.New("smtp: downgrade: message has no header")
+	}
+	header, body := msg[:headerEnd+2], msg[headerEnd+2:]
+	if isASCII(string(header)) {
+		return msg, nil
+	}
+
+	var out bytes.Buffer
+	for _, field := range splitFields(string(header)) {
+		if isASCII(field) {
+			out.WriteString(field)
+			continue
+		}
+		name, value, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil, errors.New("smtp: downgrade: malformed header field")
+		}
+		value = strings.TrimSpace(unfold(value))
+		lname := strings.ToLower(name)
+		switch {
+		case addressFields[lname]:
+			if addrs, err := downgradeAddressList(value); err == nil {
+				out.WriteString(name + ": " + addrs + "\r\n")
+				continue
+			}
+			out.WriteString("Downgraded-" + name + ": " + encodeWord(value) + "\r\n")
+		case unstructuredFields[lname]:
+			out.WriteString(name + ": " + encodeWord(value) + "\r\n")
+		default:
+			out.WriteString("Downgraded-" + name + ": " + encodeWord(value) + "\r\n")
+		}
+	}
+	out.Write(body)
+	return out.Bytes(), nil
+}
+
+// addressFields and unstructuredFields are the header fields Downgrade
+// rewrites in place (RFC 6857 §3.1).
+var (
+	addressFields = map[string]bool{
+		"from": true, "sender": true, "reply-to": true, "to": true, "cc": true, "bcc": true,
+		"resent-from": true, "resent-sender": true, "resent-to": true, "resent-cc": true, "resent-bcc": true,
+	}
+	unstructuredFields = map[string]bool{"subject": true, "comments": true, "content-description": true}
+)
+
+// splitFields splits header into fields, each with its folded lines and
+// trailing CRLF.
+func splitFields(header string) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// unfold removes the CRLFs of folded header lines (RFC 5322 §2.2.3).
+func unfold(value string) string {
+	return strings.ReplaceAll(value, "\r\n", "")
+}
+
+// encodeWord encodes s as UTF-8 encoded-words (RFC 2047).
+func encodeWord(s string) string {
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+// downgradeAddressList rewrites an address list field value.
+func downgradeAddressList(value string) (string, error) {
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		return "", err
+	}
+	out := make([]string, len(list))
+	for i, a := range list {
+		at := strings.LastIndexByte(a.Address, '@')
+		if at < 0 || !isASCII(a.Address[:at]) {
+			// No ASCII form exists; keep the address readable as an empty
+			// group (RFC 6857 §3.1.5).
+			out[i] = encodeWord(a.String()) + " :;"
+			continue
+		}
+		domain, err := domainToASCII(a.Address[at+1:])
+		if err != nil {
+			return "", err
+		}
+		a.Address = a.Address[:at+1] + domain
+		out[i] = a.String() // Encodes a non-ASCII display name.
+	}
+	return strings.Join(out, ", "), nil
+}
+
+// domainToASCII converts each non-ASCII label of domain to its punycode
+// A-label ("xn--..."). Labels are lowercased first; the full IDNA mapping
+// (UTS #46) is not applied.
+func domainToASCII(domain string) (string, error) {
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		if !utf8.ValidString(label) {
+			return "", errors.New("smtp: invalid UTF-8 in domain " + domain)
+		}
+		encoded, err := punycode(strings.ToLower(label))
+		if err != nil {
+			return "", err
+		}
+		labels[i] = "xn--" + encoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Punycode parameters (RFC 3492 §5).
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// punycode encodes s with the Punycode algorithm (RFC 3492 §6.3).
+func punycode(s string) (string, error) {
+	runes := []rune(s)
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for h := basic; h < len(runes); {
+		m := rune(utf8.MaxRune + 1)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		if int(m-n) > (1<<31-1-delta)/(h+1) {
+			return "", errors.New("smtp: punycode overflow")
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := min(max(k-bias, punyTMin), punyTMax)
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// punyAdapt is the bias adaptation function (RFC 3492 §6.1).
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
@@ -0,0 +1,158 @@
+package smtpclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+func TestPunycode(t *testing.T) {
+	// Vectors from RFC 3492 §7.1 and common IDN examples.
+	tests := map[string]string{
+		"bücher":    "bcher-kva",
+		"münchen":   "mnchen-3ya",
+		"例え":        "r8jz45g",
+		"ü":         "tda",
+		"他们为什么不说中文": "ihqwcrb4cv8a8dqg056pqjye",
+	}
+	for in, want := range tests {
+		got, err := punycode(in)
+		if err != nil || got != want {
+			t.Errorf("punycode(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+
+	got, err := domainToASCII("Bücher.example")
+	if err != nil || got != "xn--bcher-kva.example" {
+		t.Errorf("domainToASCII = %q, %v", got, err)
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	msg := "From: Jörg <joerg@bücher.example>\r\n" +
+		"To: ascii@example.com, 用户@例え.jp\r\n" +
+		"Subject: Grüße\r\n" +
+		" aus Berlin\r\n" +
+		"Message-ID: <abc@example.com>\r\n" +
+		"X-Note: café\r\n" +
+		"\r\n" +
+		"Body stays as is: ü\r\n"
+
+	out, err := Downgrade([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(out)
+	header, body, _ := strings.Cut(got, "\r\n\r\n")
+	if !isASCII(header) {
+		t.Errorf("header is not ASCII:\n%s", header)
+	}
+	for _, want := range []string{
+		"From: =?utf-8?q?J=C3=B6rg?= <joerg@xn--bcher-kva.example>\r\n",
+		"To: <ascii@example.com>, =?utf-8?q?",
+		" :;\r\n",
+		"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe_aus_Berlin?=\r\n",
+		"Message-ID: <abc@example.com>\r\n",
+		"Downgraded-X-Note: =?utf-8?q?caf=C3=A9?=\r\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("downgraded message lacks %q:\n%s", want, got)
+		}
+	}
+	if body != "Body stays as is: ü\r\n" {
+		t.Errorf("body = %q", body)
+	}
+
+	ascii := []byte("Subject: hi\r\n\r\nbody\r\n")
+	if out, _ := Downgrade(ascii); string(out) != string(ascii) {
+		t.Errorf("ASCII message changed: %q", out)
+	}
+}
+
+// startLegacyServer runs a server that does not advertise SMTPUTF8 and
+// records the commands it receives.
+func startLegacyServer(t *testing.T) (addr string, commands func() []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	var lines []string
+	go func() {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer nc.Close()
+		nc.Write([]byte("220 legacy.example.com ESMTP\r\n"))
+		r := bufio.NewReader(nc)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			lines = append(lines, strings.TrimRight(line, "\r\n"))
+			mu.Unlock()
+			switch {
+			case strings.HasPrefix(line, "EHLO"):
+				nc.Write([]byte("250-legacy.example.com\r\n250 8BITMIME\r\n"))
+			case strings.HasPrefix(line, "QUIT"):
+				nc.Write([]byte("221 Bye\r\n"))
+				return
+			default:
+				nc.Write([]byte("250 OK\r\n"))
+			}
+		}
+	}()
+	return ln.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), lines...)
+	}
+}
+
+func TestMailWithoutSMTPUTF8(t *testing.T) {
+	addr, commands := startLegacyServer(t)
+	ctx := context.Background()
+	c, err := Dial(ctx, addr, WithTimeout(2*time.Second))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	var smtpErr *smtp.SMTPError
+	err = c.Mail(ctx, "sender@example.com", WithSMTPUTF8())
+	if !errors.As(err, &smtpErr) || smtpErr.Code != smtp.ReplyMailboxNameError || smtpErr.EnhancedCode != smtp.EnhancedCodeNonASCII {
+		t.Fatalf("Mail with SMTPUTF8 = %v, want 553 5.6.7", err)
+	}
+	if err := c.Mail(ctx, "sender@bücher.example"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := c.Rcpt(ctx, "用户@example.com"); !errors.As(err, &smtpErr) || smtpErr.EnhancedCode != smtp.EnhancedCodeNonASCII {
+		t.Fatalf("Rcpt with non-ASCII local part = %v, want 5.6.7", err)
+	}
+	if err := c.Rcpt(ctx, "rcpt@münchen.example"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+
+	got := strings.Join(commands(), "\n")
+	for _, want := range []string{"MAIL FROM:<sender@xn--bcher-kva.example>", "RCPT TO:<rcpt@xn--mnchen-3ya.example>"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("server did not receive %q; got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "SMTPUTF8") || strings.Contains(got, "用户") {
+		t.Errorf("server received a command that needs SMTPUTF8:\n%s", got)
+	}
+}
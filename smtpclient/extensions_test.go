@@ -262,3 +262,105 @@ func TestEHLO_AdvertisesAllExtensions(t *testing.T) {
 		}
 	}
 }
+
+func TestMailParams(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []MailOption
+		want string
+	}{
+		{"none", nil, ""},
+		{"requiretls", []MailOption{WithRequireTLSParam()}, " REQUIRETLS"},
+		{"deliver by", []MailOption{WithDeliverBy(time.Hour, "R")}, " BY=3600;R"},
+		{"deliver by trace", []MailOption{WithDeliverBy(90*time.Second, "NT")}, " BY=90;NT"},
+		{"mt-priority", []MailOption{WithMTPriority(-3)}, " MT-PRIORITY=-3"},
+		{"auth", []MailOption{WithAuthParam("user@example.com")}, " AUTH=user@example.com"},
+		{"auth xtext", []MailOption{WithAuthParam("a+b=c d")}, " AUTH=a+2Bb+3Dc+20d"},
+		{"auth empty", []MailOption{WithAuthParam("")}, " AUTH=<>"},
+		{"envid xtext", []MailOption{WithDSNEnvelopeID("id=1 +x")}, " ENVID=id+3D1+20+2Bx"},
+		{"combined", []MailOption{WithSize(100), WithRequireTLSParam(), WithMTPriority(2)}, " SIZE=100 REQUIRETLS MT-PRIORITY=2"},
+		{"raw", []MailOption{WithMailParam("HOLDFOR=60"), WithMailParam("XFLAG")}, " HOLDFOR=60 XFLAG"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mo mailOptions
+			for _, opt := range tt.opts {
+				opt(&mo)
+			}
+			got, err := mo.params()
+			if err != nil {
+				t.Fatalf("params: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("params() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRcptParams(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []RcptOption
+		want string
+	}{
+		{"none", nil, ""},
+		{"orcpt", []RcptOption{WithDSNOriginalRecipient("rfc822;user@example.com")}, " ORCPT=rfc822;user@example.com"},
+		{"orcpt xtext", []RcptOption{WithDSNOriginalRecipient("rfc822;a+b=c@example.com")}, " ORCPT=rfc822;a+2Bb+3Dc@example.com"},
+		{"orcpt no type", []RcptOption{WithDSNOriginalRecipient("user@example.com")}, " ORCPT=rfc822;user@example.com"},
+		{"notify and orcpt", []RcptOption{WithDSNNotify("FAILURE"), WithDSNOriginalRecipient("rfc822;u@example.com")}, " NOTIFY=FAILURE ORCPT=rfc822;u@example.com"},
+		{"raw", []RcptOption{WithRcptParam("RRVS=2026-01-01T00:00:00Z")}, " RRVS=2026-01-01T00:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ro rcptOptions
+			for _, opt := range tt.opts {
+				opt(&ro)
+			}
+			got, err := ro.params()
+			if err != nil {
+				t.Fatalf("params: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("params() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDSNParamLengthLimits(t *testing.T) {
+	// 34 spaces encode to 102 characters, over the ENVID limit.
+	mo := mailOptions{dsnEnvID: strings.Repeat(" ", 34)}
+	if _, err := mo.params(); err == nil {
+		t.Error("expected error for oversized ENVID")
+	}
+	mo = mailOptions{dsnEnvID: strings.Repeat("x", 100)}
+	if _, err := mo.params(); err != nil {
+		t.Errorf("100-character ENVID: %v", err)
+	}
+
+	ro := rcptOptions{dsnOrcpt: "rfc822;" + strings.Repeat("a", 494)}
+	if _, err := ro.params(); err == nil {
+		t.Error("expected error for oversized ORCPT")
+	}
+
+	handler := &testDataHandler{}
+	addr, cleanup := startTestServer(t, smtpserver.WithDataHandler(handler))
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := Dial(ctx, addr, WithLocalName("test.local"), WithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	// The oversized parameter is rejected before anything is sent, so
+	// the session stays usable.
+	if err := c.Mail(ctx, "sender@example.com", WithDSNEnvelopeID(strings.Repeat("+", 40))); err == nil {
+		t.Fatal("expected Mail to reject oversized ENVID")
+	}
+	if err := c.Mail(ctx, "sender@example.com", WithDSNEnvelopeID("ok")); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package smtpclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// ErrMailLoop is returned by ListExpander.Expand for a message that has
+// already passed through the list.
+var ErrMailLoop = errors.New("smtp: mailing list: message already distributed by this list")
+
+// MailingList is a distribution list served by a ListExpander.
+type MailingList struct {
+	Address       string   // List address, e.g. "team@example.com".
+	Members       []string // Member addresses.
+	SubjectPrefix string   // Empty means "[<list local part>]"; "-" disables it.
+}
+
+// ListExpander distributes messages sent to a MailingList to its
+// members through a relay. Each member gets a separate transaction with
+// a VERP envelope sender, list-bounces+member=domain@listdomain, so a
+// bounce identifies the failing member. The message gets a subject
+// prefix, List-Id and List-Post headers (RFC 2919, RFC 2369), Precedence:
+// list and an X-Loop header that stops it from being distributed twice.
+//
+// Only Addr is required.
+type ListExpander struct {
+	Addr    string             // Relay host:port.
+	Options []Option           // Dial options, e.g. WithTLSPolicy.
+	Auth    smtp.SASLMechanism // Optional authentication to the relay.
+}
+
+// Expand sends msg, a message received for list, to every member. It
+// returns the member deliveries that failed, joined with errors.Join; the
+// other members still receive the message. If the relay closes the
+// session with 421, Expand dials again and carries on.
+func (e *ListExpander) Expand(ctx context.Context, list *MailingList, msg []byte) error {
+	local, domain, ok := strings.Cut(list.Address, "@")
+	if !ok {
+		return fmt.Errorf("smtp: mailing list: invalid address %q", list.Address)
+	}
+	out, err := rewriteListMessage(list, local, domain, msg)
+	if err != nil {
+		return err
+	}
+
+	c, err := e.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { c.Close() }()
+
+	var errs []error
+	for _, member := range list.Members {
+		send := func() error {
+			return c.SendMail(ctx, verpAddress(local, domain, member), []string{member}, bytes.NewReader(out))
+		}
+		err := send()
+		if errors.Is(err, ErrServerClosing) {
+			// The relay ended the session: go on over a new one.
+			next, derr := e.dial(ctx)
+			if derr != nil {
+				errs = append(errs, fmt.Errorf("smtp: mailing list: %s: %w", member, err), derr)
+				break
+			}
+			c = next
+			err = send()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("smtp: mailing list: %s: %w", member, err))
+			if errors.Is(err, ErrServerClosing) {
+				break
+			}
+			if rerr := c.Reset(ctx); rerr != nil {
+				errs = append(errs, fmt.Errorf("smtp: mailing list: %w", rerr))
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dial connects and authenticates to the relay.
+func (e *ListExpander) dial(ctx context.Context) (*Client, error) {
+	c, err := Dial(ctx, e.Addr, e.Options...)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: mailing list: %w", err)
+	}
+	if e.Auth != nil {
+		if err := c.Auth(ctx, e.Auth); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("smtp: mailing list: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// verpAddress returns the VERP envelope sender for member.
+func verpAddress(local, domain, member string) string {
+	return local + "-bounces+" + strings.Replace(member, "@", "=", 1) + "@" + domain
+}
+
+// listHeaders are replaced by rewriteListMessage.
+var listHeaders = []string{"list-id", "list-post", "precedence"}
+
+// rewriteListMessage adds the list headers and subject prefix to msg.
+func rewriteListMessage(list *MailingList, local, domain string, msg []byte) ([]byte, error) {
+	headerEnd := bytes.Index(msg, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return nil, errors.New("smtp: mailing list: message has no header")
+	}
+	header, body := string(msg[:headerEnd+2]), msg[headerEnd+2:]
+
+	prefix := list.SubjectPrefix
+	if prefix == "" {
+		prefix = "[" + local + "]"
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "List-Id: <%s.%s>\r\n", local, domain)
+	fmt.Fprintf(&out, "List-Post: <mailto:%s>\r\n", list.Address)
+	out.WriteString("Precedence: list\r\n")
+	fmt.Fprintf(&out, "X-Loop: %s\r\n", list.Address)
+
+	skip := false // Inside a replaced field, including its folded lines.
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if !skip {
+				out.WriteString(line)
+			}
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		lname := strings.ToLower(strings.TrimSpace(name))
+		if lname == "x-loop" && strings.EqualFold(strings.TrimSpace(value), list.Address) {
+			return nil, ErrMailLoop
+		}
+		skip = false
+		for _, h := range listHeaders {
+			skip = skip || lname == h
+		}
+		if skip {
+			continue
+		}
+		if lname == "subject" && prefix != "-" && !strings.Contains(value, prefix) {
+			line = name + ": " + prefix + " " + strings.TrimLeft(value, " \t")
+		}
+		out.WriteString(line)
+	}
+	out.Write(body)
+	return out.Bytes(), nil
+}
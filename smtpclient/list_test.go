@@ -0,0 +1,100 @@
+package smtpclient
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+	"github.com/alexisbouchez/smtp.go/smtpserver"
+)
+
+func TestListExpander(t *testing.T) {
+	handler := &testDataHandler{}
+	addr, cleanup := startTestServer(t, smtpserver.WithDataHandler(handler))
+	defer cleanup()
+
+	e := &ListExpander{Addr: addr, Options: []Option{WithLocalName("test.local"), WithTimeout(5 * time.Second)}}
+	list := &MailingList{Address: "team@example.com", Members: []string{"a@example.org", "b@example.net"}}
+	msg := "From: boss@example.com\r\n" +
+		"To: team@example.com\r\n" +
+		"Subject: Offsite\r\n" +
+		"Precedence: bulk\r\n" +
+		"List-Id: <old\r\n list.example>\r\n" +
+		"\r\n" +
+		"Friday.\r\n"
+
+	if err := e.Expand(context.Background(), list, []byte(msg)); err != nil {
+		t.Fatalf("Expand: %v", err)
+	}
+	if len(handler.messages) != 2 {
+		t.Fatalf("delivered %d messages, want 2", len(handler.messages))
+	}
+	first := handler.messages[0]
+	if got := first.From.Mailbox.String(); got != "team-bounces+a=example.org@example.com" {
+		t.Errorf("envelope sender = %q", got)
+	}
+	if len(first.To) != 1 || first.To[0].Mailbox.String() != "a@example.org" {
+		t.Errorf("recipients = %v", first.To)
+	}
+	for _, want := range []string{
+		"List-Id: <team.example.com>\r\n",
+		"List-Post: <mailto:team@example.com>\r\n",
+		"Precedence: list\r\n",
+		"X-Loop: team@example.com\r\n",
+		"Subject: [team] Offsite\r\n",
+		"\r\n\r\nFriday.\r\n",
+	} {
+		if !strings.Contains(first.Body, want) {
+			t.Errorf("message missing %q:\n%s", want, first.Body)
+		}
+	}
+	for _, unwanted := range []string{"bulk", "old", "list.example"} {
+		if strings.Contains(first.Body, unwanted) {
+			t.Errorf("message still contains %q:\n%s", unwanted, first.Body)
+		}
+	}
+
+	// The distributed copy is not distributed again.
+	if err := e.Expand(context.Background(), list, []byte(first.Body)); !errors.Is(err, ErrMailLoop) {
+		t.Errorf("second Expand = %v, want ErrMailLoop", err)
+	}
+}
+
+// oneMailPerSession ends every session at its second MAIL FROM with 421.
+type oneMailPerSession struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (h *oneMailPerSession) OnMail(ctx context.Context, _ smtp.ReversePath) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id := smtpserver.SessionID(ctx)
+	if h.seen[id] {
+		return smtp.Errorf(smtp.ReplyServiceNotAvailable, smtp.EnhancedCodeTempCongestion, "Too many messages, closing connection")
+	}
+	h.seen[id] = true
+	return nil
+}
+
+func TestListExpander_Redial(t *testing.T) {
+	handler := &testDataHandler{}
+	addr, cleanup := startTestServer(t,
+		smtpserver.WithMailHandler(&oneMailPerSession{seen: make(map[string]bool)}),
+		smtpserver.WithDataHandler(handler),
+	)
+	defer cleanup()
+
+	e := &ListExpander{Addr: addr, Options: []Option{WithTimeout(5 * time.Second)}}
+	list := &MailingList{Address: "team@example.com", Members: []string{"a@example.org", "b@example.org", "c@example.org"}}
+	if err := e.Expand(context.Background(), list, []byte("Subject: Hi\r\n\r\nHello.\r\n")); err != nil {
+		t.Fatalf("Expand: %v", err)
+	}
+	if len(handler.messages) != 3 {
+		t.Errorf("delivered %d messages, want 3", len(handler.messages))
+	}
+}
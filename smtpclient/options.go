@@ -1,5 +1,12 @@
 package smtpclient
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // MailOption configures the MAIL FROM command.
 type MailOption func(*mailOptions)
 
@@ -9,6 +16,13 @@ type mailOptions struct {
 	smtpUTF8 bool
 	dsnRet   string // "FULL" or "HDRS"
 	dsnEnvID string
+
+	requireTLS bool
+	deliverBy  string // Encoded BY= value, e.g. "3600;R".
+	mtPriority *int
+	auth       *string // Authorization identity; "" means AUTH=<>.
+	ehloName   string  // Identity to greet with before this transaction.
+	extra      []string
 }
 
 // WithSize sets the SIZE parameter (RFC 1870).
@@ -31,17 +45,140 @@ func WithDSNReturn(ret string) MailOption {
 	return func(o *mailOptions) { o.dsnRet = ret }
 }
 
-// WithDSNEnvelopeID sets the ENVID parameter for DSN (RFC 3461).
+// WithDSNEnvelopeID sets the ENVID parameter for DSN (RFC 3461). The
+// value is xtext-encoded on the wire and must not exceed 100 characters
+// once encoded.
 func WithDSNEnvelopeID(envid string) MailOption {
 	return func(o *mailOptions) { o.dsnEnvID = envid }
 }
 
+// WithRequireTLSParam sets the REQUIRETLS parameter (RFC 8689), asking
+// every hop to relay the message only over verified TLS.
+func WithRequireTLSParam() MailOption {
+	return func(o *mailOptions) { o.requireTLS = true }
+}
+
+// WithDeliverBy sets the BY parameter (RFC 2852): the message should be
+// delivered within d. Mode is "R" (return the message if the deadline
+// passes) or "N" (notify only), optionally followed by "T" to request
+// trace information.
+func WithDeliverBy(d time.Duration, mode string) MailOption {
+	return func(o *mailOptions) { o.deliverBy = fmt.Sprintf("%d;%s", int64(d/time.Second), mode) }
+}
+
+// WithMTPriority sets the MT-PRIORITY parameter (RFC 6710), from -9
+// (lowest) to 9 (highest).
+func WithMTPriority(p int) MailOption {
+	return func(o *mailOptions) { o.mtPriority = &p }
+}
+
+// WithAuthParam sets the AUTH parameter (RFC 4954 §5): the identity that
+// submitted the message. An empty identity sends AUTH=<>, meaning the
+// submitter is unknown or not trusted. The value is xtext-encoded.
+func WithAuthParam(identity string) MailOption {
+	return func(o *mailOptions) { o.auth = &identity }
+}
+
+// WithEHLOName makes Mail greet the server again with EHLO name before
+// MAIL FROM if the client last announced a different name, so that one
+// connection can carry deliveries for several tenants, each announcing
+// the hostname that matches its sending IP's PTR record. The new name
+// sticks for later transactions, and the extension list is refreshed.
+func WithEHLOName(name string) MailOption {
+	return func(o *mailOptions) { o.ehloName = name }
+}
+
+// WithMailParam adds a MAIL FROM parameter as is, "KEYWORD" or
+// "KEYWORD=value", for extensions without a MailOption or to relay the
+// parameters a server received. The value must already be encoded as the
+// extension requires, such as xtext, and Mail does not check that the
+// server advertised the extension.
+func WithMailParam(param string) MailOption {
+	return func(o *mailOptions) { o.extra = append(o.extra, param) }
+}
+
+// applyMailOptions returns the options set by opts. Mail calls it only
+// when there are options, so that a plain MAIL FROM allocates none.
+func applyMailOptions(opts []MailOption) mailOptions {
+	o := new(mailOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return *o
+}
+
+// Length limits on encoded DSN parameters (RFC 3461 §4.2, §4.4).
+const (
+	maxEnvIDLen = 100
+	maxOrcptLen = 500
+)
+
+// params returns the MAIL FROM parameters, each preceded by a space.
+func (o *mailOptions) params() (string, error) {
+	var b strings.Builder
+	if o.size > 0 {
+		b.WriteString(" SIZE=" + strconv.FormatInt(o.size, 10))
+	}
+	if o.body != "" {
+		b.WriteString(" BODY=" + o.body)
+	}
+	if o.smtpUTF8 {
+		b.WriteString(" SMTPUTF8")
+	}
+	if o.dsnRet != "" {
+		b.WriteString(" RET=" + o.dsnRet)
+	}
+	if o.dsnEnvID != "" {
+		envid := encodeXtext(o.dsnEnvID)
+		if len(envid) > maxEnvIDLen {
+			return "", fmt.Errorf("ENVID exceeds %d characters", maxEnvIDLen)
+		}
+		b.WriteString(" ENVID=" + envid)
+	}
+	if o.requireTLS {
+		b.WriteString(" REQUIRETLS")
+	}
+	if o.deliverBy != "" {
+		b.WriteString(" BY=" + o.deliverBy)
+	}
+	if o.mtPriority != nil {
+		b.WriteString(" MT-PRIORITY=" + strconv.Itoa(*o.mtPriority))
+	}
+	if o.auth != nil {
+		if *o.auth == "" {
+			b.WriteString(" AUTH=<>")
+		} else {
+			b.WriteString(" AUTH=" + encodeXtext(*o.auth))
+		}
+	}
+	for _, param := range o.extra {
+		b.WriteString(" " + param)
+	}
+	return b.String(), nil
+}
+
+// encodeXtext encodes s as xtext (RFC 3461 §4): characters outside
+// '!'..'~', '+' and '=' become "+XX" hex escapes.
+func encodeXtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
 // RcptOption configures the RCPT TO command.
 type RcptOption func(*rcptOptions)
 
 type rcptOptions struct {
 	dsnNotify string // e.g., "SUCCESS,FAILURE,DELAY" or "NEVER"
 	dsnOrcpt  string // Original recipient, e.g., "rfc822;user@example.com"
+	extra     []string
 }
 
 // WithDSNNotify sets the NOTIFY parameter for DSN (RFC 3461).
@@ -49,7 +186,48 @@ func WithDSNNotify(notify string) RcptOption {
 	return func(o *rcptOptions) { o.dsnNotify = notify }
 }
 
-// WithDSNOriginalRecipient sets the ORCPT parameter for DSN (RFC 3461).
+// WithDSNOriginalRecipient sets the ORCPT parameter for DSN (RFC 3461),
+// in the form "addr-type;address", e.g. "rfc822;user@example.com". A
+// value without an address type is treated as rfc822. The address is
+// xtext-encoded on the wire; the whole parameter must not exceed 500
+// characters once encoded.
 func WithDSNOriginalRecipient(orcpt string) RcptOption {
 	return func(o *rcptOptions) { o.dsnOrcpt = orcpt }
 }
+
+// WithRcptParam adds a RCPT TO parameter as is, like WithMailParam.
+func WithRcptParam(param string) RcptOption {
+	return func(o *rcptOptions) { o.extra = append(o.extra, param) }
+}
+
+// applyRcptOptions is applyMailOptions for RCPT TO.
+func applyRcptOptions(opts []RcptOption) rcptOptions {
+	o := new(rcptOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return *o
+}
+
+// params returns the RCPT TO parameters, each preceded by a space.
+func (o *rcptOptions) params() (string, error) {
+	var b strings.Builder
+	if o.dsnNotify != "" {
+		b.WriteString(" NOTIFY=" + o.dsnNotify)
+	}
+	if o.dsnOrcpt != "" {
+		addrType, addr, ok := strings.Cut(o.dsnOrcpt, ";")
+		if !ok {
+			addrType, addr = "rfc822", o.dsnOrcpt
+		}
+		orcpt := addrType + ";" + encodeXtext(addr)
+		if len(orcpt) > maxOrcptLen {
+			return "", fmt.Errorf("ORCPT exceeds %d characters", maxOrcptLen)
+		}
+		b.WriteString(" ORCPT=" + orcpt)
+	}
+	for _, param := range o.extra {
+		b.WriteString(" " + param)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,237 @@
+package smtpclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// Outgoing is a message for SendToMany. Data is the whole message,
+// header and body; it is sent once per destination domain.
+type Outgoing struct {
+	From string   // Envelope sender; empty for the null sender.
+	To   []string // Envelope recipients, in any number of domains.
+	Data []byte
+}
+
+// SendOptions configures SendToMany. The zero value is ready to use.
+type SendOptions struct {
+	Resolver    MXResolver // Nil means net.DefaultResolver.
+	Concurrency int        // Simultaneous connections; zero means 10.
+	MaxHosts    int        // MX hosts tried per domain; zero means 3.
+	Port        string     // Zero means "25".
+	Options     []Option   // Dial options, e.g. WithLocalName, WithTLSPolicy.
+}
+
+// SendResult reports the delivery of one Outgoing message.
+type SendResult struct {
+	Recipients []RecipientResult // One per address in To, in order.
+}
+
+// RecipientResult reports the delivery of a message to one recipient.
+type RecipientResult struct {
+	Address string
+	Host    string // MX host that answered; empty if none did.
+
+	// Err is nil if Host accepted the message for Address. Otherwise it
+	// is an *smtp.SMTPError with the server's reply, or a synthesized one
+	// for an address or domain that cannot receive mail, or the network
+	// error that prevented delivery. Errors that are not an
+	// *smtp.SMTPError, and replies with a 4xx code, are worth retrying
+	// later.
+	Err error
+}
+
+// Failed reports whether any recipient of the message was not delivered.
+func (r SendResult) Failed() bool {
+	for _, rcpt := range r.Recipients {
+		if rcpt.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Errors returned in RecipientResult.Err for undeliverable addresses.
+var (
+	errBadRecipient = smtp.Errorf(smtp.ReplySyntaxParamError, smtp.EnhancedCodeBadDestSyntax, "Invalid recipient address")
+	errNullMX       = smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeBadDestSystem, "Domain does not accept mail")
+	errMXLookup     = smtp.Errorf(smtp.ReplyLocalError, smtp.EnhancedCodeOtherNetwork, "Domain lookup failed, try again later")
+)
+
+// SendToMany delivers messages directly to the mail exchangers of their
+// recipients' domains. Recipients are grouped by domain, each domain's MX
+// hosts are tried in preference order (its A/AAAA record when it has no
+// MX, RFC 5321 §5.1), and every message for a domain goes over one
+// connection, with up to opts.Concurrency domains delivered in parallel.
+// When a host cannot be reached or drops the connection, the messages
+// not yet delivered move on to the next host; a reply, even a temporary
+// one, is final for the recipients it concerns.
+//
+// The results are in the order of messages, and report every recipient.
+// SendToMany does not retry or queue: the caller retries the recipients
+// whose results are temporary. It dials each host itself with Dial and
+// does not reuse connections across calls.
+func SendToMany(ctx context.Context, messages []Outgoing, opts SendOptions) []SendResult {
+	results := make([]SendResult, len(messages))
+	domains := make(map[string][]delivery)
+	var order []string
+	for i, msg := range messages {
+		results[i].Recipients = make([]RecipientResult, len(msg.To))
+		for j, to := range msg.To {
+			res := &results[i].Recipients[j]
+			res.Address = to
+			at := strings.LastIndexByte(to, '@')
+			if at <= 0 || at == len(to)-1 {
+				res.Err = errBadRecipient
+				continue
+			}
+			domain := strings.ToLower(to[at+1:])
+			group := domains[domain]
+			if n := len(group); n > 0 && group[n-1].msg == &messages[i] {
+				group[n-1].rcpts = append(group[n-1].rcpts, res)
+			} else {
+				if group == nil {
+					order = append(order, domain)
+				}
+				group = append(group, delivery{msg: &messages[i], rcpts: []*RecipientResult{res}})
+			}
+			domains[domain] = group
+		}
+	}
+
+	limit := opts.Concurrency
+	if limit <= 0 {
+		limit = 10
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for _, domain := range order {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			opts.deliverDomain(ctx, domain, domains[domain])
+		})
+	}
+	wg.Wait()
+	return results
+}
+
+// delivery is a message with the results of its recipients in one
+// domain, which SendToMany fills in.
+type delivery struct {
+	msg   *Outgoing
+	rcpts []*RecipientResult
+}
+
+// deliverDomain delivers the messages for domain, moving on to the next
+// MX host when one cannot be reached or drops the connection.
+func (o *SendOptions) deliverDomain(ctx context.Context, domain string, pending []delivery) {
+	hosts, lookupErr := o.mxHosts(ctx, domain)
+	if lookupErr != nil {
+		fail(pending, lookupErr)
+		return
+	}
+	port := o.Port
+	if port == "" {
+		port = "25"
+	}
+	var err error
+	for _, host := range hosts {
+		var c *Client
+		c, err = Dial(ctx, net.JoinHostPort(host, port), o.Options...)
+		if err != nil {
+			continue
+		}
+		for len(pending) > 0 {
+			if err = sendDelivery(ctx, c, host, pending[0]); err != nil {
+				break
+			}
+			pending = pending[1:]
+		}
+		c.Close()
+		if len(pending) == 0 {
+			return
+		}
+	}
+	fail(pending, err)
+}
+
+// fail records err for every recipient of pending.
+func fail(pending []delivery, err error) {
+	for _, d := range pending {
+		for _, res := range d.rcpts {
+			res.Host, res.Err = "", err
+		}
+	}
+}
+
+// sendDelivery sends d over c, recording the replies in its results. It
+// returns an error only when the connection can no longer be used.
+func sendDelivery(ctx context.Context, c *Client, host string, d delivery) error {
+	for _, res := range d.rcpts {
+		res.Host, res.Err = host, nil
+	}
+	if err := c.Mail(ctx, d.msg.From); err != nil {
+		if connectionLost(err) {
+			return err
+		}
+		for _, res := range d.rcpts {
+			res.Err = err
+		}
+		return c.Reset(ctx)
+	}
+	var accepted []*RecipientResult
+	for _, res := range d.rcpts {
+		if err := c.Rcpt(ctx, res.Address); err != nil {
+			if connectionLost(err) {
+				return err
+			}
+			res.Err = err
+			continue
+		}
+		accepted = append(accepted, res)
+	}
+	if len(accepted) == 0 {
+		return c.Reset(ctx)
+	}
+	if err := c.Data(ctx, bytes.NewReader(d.msg.Data)); err != nil {
+		if connectionLost(err) {
+			return err
+		}
+		for _, res := range accepted {
+			res.Err = err
+		}
+	}
+	return nil
+}
+
+// connectionLost reports whether err ended the session, rather than
+// being the server's reply to one command.
+func connectionLost(err error) bool {
+	var smtpErr *smtp.SMTPError
+	return !errors.As(err, &smtpErr) || errors.Is(err, ErrServerClosing)
+}
+
+// mxHosts returns up to MaxHosts exchangers for domain in preference
+// order, or the domain itself when it has no MX records.
+func (o *SendOptions) mxHosts(ctx context.Context, domain string) ([]string, *smtp.SMTPError) {
+	limit := o.MaxHosts
+	if limit <= 0 {
+		limit = 3
+	}
+	hosts, err := lookupExchangers(ctx, o.Resolver, domain, limit)
+	switch {
+	case errors.Is(err, errNoMail):
+		return nil, errNullMX
+	case err != nil, len(hosts) == 0:
+		// A resolver may answer with no records and no error.
+		return nil, errMXLookup
+	}
+	return hosts, nil
+}
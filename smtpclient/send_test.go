@@ -0,0 +1,102 @@
+package smtpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/alexisbouchez/smtp.go"
+	"github.com/alexisbouchez/smtp.go/smtpserver"
+)
+
+func TestSendToMany(t *testing.T) {
+	h := &calloutServer{}
+	data := &testDataHandler{}
+	addr, cleanup := startTestServer(t, smtpserver.WithRcptHandler(h), smtpserver.WithDataHandler(data))
+	defer cleanup()
+	_, port, _ := net.SplitHostPort(addr)
+
+	resolver := staticMX{
+		// The preferred exchanger refuses connections: nothing listens on
+		// 127.0.0.2.
+		"a.example":    {{Host: "127.0.0.1.", Pref: 20}, {Host: "127.0.0.2.", Pref: 10}},
+		"b.example":    {{Host: "127.0.0.1.", Pref: 10}},
+		"null.example": {{Host: ".", Pref: 0}},
+		"none.example": {},
+	}
+	messages := []Outgoing{
+		{From: "sender@example.com", To: []string{"known@a.example", "known@b.example", "unknown@a.example"}, Data: []byte("Subject: one\r\n\r\nOne")},
+		{From: "", To: []string{"known@null.example", "not-an-address", "known@A.EXAMPLE", "known@none.example"}, Data: []byte("Subject: two\r\n\r\nTwo")},
+	}
+	results := SendToMany(context.Background(), messages, SendOptions{Resolver: resolver, Port: port, Concurrency: 1})
+
+	if len(results) != 2 || len(results[0].Recipients) != 3 || len(results[1].Recipients) != 4 {
+		t.Fatalf("results = %+v", results)
+	}
+	for _, res := range []RecipientResult{results[0].Recipients[0], results[0].Recipients[1], results[1].Recipients[2]} {
+		if res.Err != nil || res.Host != "127.0.0.1" {
+			t.Errorf("%s: host %q, err %v", res.Address, res.Host, res.Err)
+		}
+	}
+	var smtpErr *smtp.SMTPError
+	if res := results[0].Recipients[2]; !errors.As(res.Err, &smtpErr) || smtpErr.Code != smtp.ReplyMailboxNotFound {
+		t.Errorf("%s: err %v, want 550 from the server", res.Address, res.Err)
+	}
+	if res := results[1].Recipients[0]; !errors.As(res.Err, &smtpErr) || smtpErr.EnhancedCode != smtp.EnhancedCodeBadDestSystem {
+		t.Errorf("%s: err %v, want 5.1.2 for a null MX", res.Address, res.Err)
+	}
+	if res := results[1].Recipients[1]; !errors.As(res.Err, &smtpErr) || smtpErr.EnhancedCode != smtp.EnhancedCodeBadDestSyntax {
+		t.Errorf("%s: err %v, want 5.1.3", res.Address, res.Err)
+	}
+	if res := results[1].Recipients[3]; !errors.As(res.Err, &smtpErr) || smtpErr.Code != smtp.ReplyLocalError {
+		t.Errorf("%s: err %v, want 451 for a domain without MX records", res.Address, res.Err)
+	}
+	if !results[0].Failed() || !results[1].Failed() {
+		t.Error("Failed() = false for messages with undelivered recipients")
+	}
+	if (SendResult{Recipients: results[0].Recipients[:2]}).Failed() {
+		t.Error("Failed() = true for delivered recipients")
+	}
+
+	// One transaction per message and domain: a.example gets both
+	// messages, b.example the first.
+	data.mu.Lock()
+	defer data.mu.Unlock()
+	if len(data.messages) != 3 {
+		t.Fatalf("server received %d messages, want 3", len(data.messages))
+	}
+	for _, msg := range data.messages {
+		if len(msg.To) != 1 {
+			t.Errorf("transaction to %v, want one accepted recipient", msg.To)
+		}
+	}
+}
+
+func TestSendToManyConcurrent(t *testing.T) {
+	data := &testDataHandler{}
+	addr, cleanup := startTestServer(t, smtpserver.WithDataHandler(data))
+	defer cleanup()
+	_, port, _ := net.SplitHostPort(addr)
+
+	resolver := staticMX{}
+	var messages []Outgoing
+	for i := range 8 {
+		domain := fmt.Sprintf("d%d.example", i)
+		resolver[domain] = []*net.MX{{Host: "127.0.0.1.", Pref: 10}}
+		messages = append(messages, Outgoing{From: "sender@example.com", To: []string{"user@" + domain}, Data: []byte("Subject: hi\r\n\r\nHi")})
+	}
+	results := SendToMany(context.Background(), messages, SendOptions{Resolver: resolver, Port: port, Concurrency: 4})
+
+	for _, res := range results {
+		if res.Failed() {
+			t.Errorf("%s: %v", res.Recipients[0].Address, res.Recipients[0].Err)
+		}
+	}
+	data.mu.Lock()
+	defer data.mu.Unlock()
+	if len(data.messages) != len(messages) {
+		t.Errorf("server received %d messages, want %d", len(data.messages), len(messages))
+	}
+}
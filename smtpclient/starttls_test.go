@@ -8,9 +8,11 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
 	"math/big"
 	"net"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,6 +23,13 @@ import (
 // generateTestCert creates a self-signed TLS certificate for testing.
 func generateTestCert(t *testing.T) tls.Certificate {
 	t.Helper()
+	return generateTestCertValidity(t, time.Now(), time.Now().Add(time.Hour))
+}
+
+// generateTestCertValidity creates a self-signed TLS certificate valid
+// between notBefore and notAfter.
+func generateTestCertValidity(t *testing.T, notBefore, notAfter time.Time) tls.Certificate {
+	t.Helper()
 
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
@@ -30,8 +39,8 @@ func generateTestCert(t *testing.T) tls.Certificate {
 	template := &x509.Certificate{
 		SerialNumber: big.NewInt(1),
 		Subject:      pkix.Name{CommonName: "test.example.com"},
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(time.Hour),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
 		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		DNSNames:     []string{"test.example.com", "localhost"},
@@ -158,3 +167,268 @@ func TestSTARTTLS_AlreadyTLS(t *testing.T) {
 		t.Fatal("expected second STARTTLS to fail")
 	}
 }
+
+func TestTLSPolicy_Opportunistic(t *testing.T) {
+	cert := generateTestCert(t)
+	addr, cleanup := startTestServer(t,
+		smtpserver.WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	)
+	defer cleanup()
+
+	c, err := Dial(context.Background(), addr,
+		WithTLSPolicy(TLSOpportunistic),
+		WithTLSConfig(&tls.Config{InsecureSkipVerify: true}),
+	)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	if !c.IsTLS() {
+		t.Error("expected TLS after opportunistic STARTTLS")
+	}
+	if c.TLSDowngraded() {
+		t.Error("TLSDowngraded = true, want false")
+	}
+}
+
+func TestTLSPolicy_HandshakeFailure(t *testing.T) {
+	cert := generateTestCert(t)
+	addr, cleanup := startTestServer(t,
+		smtpserver.WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		smtpserver.WithDataHandler(&testDataHandler{}),
+	)
+	defer cleanup()
+
+	// The self-signed certificate fails verification against the system roots.
+	_, err := Dial(context.Background(), addr, WithTLSPolicy(TLSOpportunistic))
+	if err == nil {
+		t.Fatal("expected Dial to fail under TLSOpportunistic")
+	}
+
+	// A policy forbidding cleartext rules out the fallback.
+	_, err = Dial(context.Background(), addr, WithTLSPolicy(TLSOpportunisticFallback), WithTLSMandatory())
+	if err == nil {
+		t.Fatal("expected Dial to fail with WithTLSMandatory")
+	}
+
+	fallbacks := TLSFallbacks()
+	c, err := Dial(context.Background(), addr, WithTLSPolicy(TLSOpportunisticFallback))
+	if err != nil {
+		t.Fatalf("Dial with fallback: %v", err)
+	}
+	defer c.Close()
+
+	if c.IsTLS() {
+		t.Error("expected cleartext connection after fallback")
+	}
+	if !c.TLSDowngraded() || c.TLSError() == nil {
+		t.Errorf("TLSDowngraded = %v, TLSError = %v; want true and non-nil", c.TLSDowngraded(), c.TLSError())
+	}
+	if n := TLSFallbacks() - fallbacks; n != 1 {
+		t.Errorf("TLSFallbacks grew by %d, want 1", n)
+	}
+
+	// A message that requires TLS is not sent in cleartext.
+	if err := c.Mail(context.Background(), "sender@example.com", WithRequireTLSParam()); !errors.Is(err, ErrRequireTLS) {
+		t.Fatalf("Mail with REQUIRETLS after fallback: err = %v, want ErrRequireTLS", err)
+	}
+
+	// The fresh connection must be usable.
+	err = c.SendMail(context.Background(), "sender@example.com", []string{"user@example.com"}, strings.NewReader("Hello"))
+	if err != nil {
+		t.Fatalf("SendMail after fallback: %v", err)
+	}
+}
+
+func TestTLSPolicy_Required(t *testing.T) {
+	addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	_, err := Dial(context.Background(), addr, WithTLSPolicy(TLSRequired))
+	if !errors.Is(err, ErrTLSUnavailable) {
+		t.Fatalf("err = %v, want ErrTLSUnavailable", err)
+	}
+
+	_, err = Dial(context.Background(), addr, WithTLSPolicy(TLSOpportunistic), WithTLSMandatory())
+	if !errors.Is(err, ErrTLSUnavailable) {
+		t.Fatalf("err = %v, want ErrTLSUnavailable with WithTLSMandatory", err)
+	}
+
+	// Opportunistic modes accept a server without STARTTLS.
+	c, err := Dial(context.Background(), addr, WithTLSPolicy(TLSOpportunisticFallback))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	if c.TLSDowngraded() {
+		t.Error("TLSDowngraded = true without STARTTLS advertised")
+	}
+}
+
+func TestStartTLS_VerificationError(t *testing.T) {
+	valid := generateTestCert(t)
+	expired := generateTestCertValidity(t, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+
+	trusted := func(cert tls.Certificate) *x509.CertPool {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(leaf)
+		return pool
+	}
+
+	tests := []struct {
+		name       string
+		serverCert tls.Certificate
+		clientTLS  *tls.Config
+		result     string
+	}{
+		{"untrusted", valid, &tls.Config{ServerName: "test.example.com"}, TLSResultNotTrusted},
+		{"host mismatch", valid, &tls.Config{ServerName: "other.example.com", RootCAs: trusted(valid)}, TLSResultHostMismatch},
+		{"expired", expired, &tls.Config{ServerName: "test.example.com", RootCAs: trusted(expired)}, TLSResultExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, cleanup := startTestServer(t,
+				smtpserver.WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{tt.serverCert}}),
+			)
+			defer cleanup()
+
+			c, err := Dial(context.Background(), addr)
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer c.Close()
+
+			err = c.StartTLS(context.Background(), tt.clientTLS)
+			var verr *TLSVerificationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("err = %v, want *TLSVerificationError", err)
+			}
+			if got := verr.Result(); got != tt.result {
+				t.Errorf("Result() = %q, want %q", got, tt.result)
+			}
+			if !verr.SelfSigned {
+				t.Error("SelfSigned = false, want true")
+			}
+			if len(verr.Chain) != 1 || len(verr.Names) == 0 || verr.ServerName != tt.clientTLS.ServerName {
+				t.Errorf("chain/names/server = %d/%v/%q", len(verr.Chain), verr.Names, verr.ServerName)
+			}
+		})
+	}
+}
+
+func TestStartTLS_Pinning(t *testing.T) {
+	cert := generateTestCert(t)
+	other := generateTestCert(t)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	otherLeaf, _ := x509.ParseCertificate(other.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	addr, cleanup := startTestServer(t,
+		smtpserver.WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	)
+	defer cleanup()
+
+	tests := []struct {
+		name    string
+		pin     Option
+		config  *tls.Config
+		wantErr bool
+	}{
+		{"certificate", WithPinnedCertificates(leaf), &tls.Config{InsecureSkipVerify: true}, false},
+		{"spki", WithPinnedSPKI(SPKIHash(leaf)), &tls.Config{ServerName: "test.example.com", RootCAs: roots}, false},
+		{"wrong certificate", WithPinnedCertificates(otherLeaf), &tls.Config{InsecureSkipVerify: true}, true},
+		{"wrong spki", WithPinnedSPKI(SPKIHash(otherLeaf)), &tls.Config{ServerName: "test.example.com", RootCAs: roots}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Dial(context.Background(), addr, tt.pin)
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer c.Close()
+
+			err = c.StartTLS(context.Background(), tt.config)
+			if tt.wantErr {
+				if !errors.Is(err, ErrPinMismatch) {
+					t.Fatalf("err = %v, want ErrPinMismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("StartTLS: %v", err)
+			}
+			if !c.IsTLS() {
+				t.Error("expected TLS after pinned STARTTLS")
+			}
+		})
+	}
+}
+
+func TestPinSetVerifyKeepsPeerCertificates(t *testing.T) {
+	leaf, _ := x509.ParseCertificate(generateTestCert(t).Certificate[0])
+	intermediate, _ := x509.ParseCertificate(generateTestCert(t).Certificate[0])
+	root, _ := x509.ParseCertificate(generateTestCert(t).Certificate[0])
+
+	peers := []*x509.Certificate{leaf, intermediate}
+	cs := tls.ConnectionState{
+		PeerCertificates: peers,
+		VerifiedChains:   [][]*x509.Certificate{{leaf, root}},
+	}
+	p := pinSet{certs: []*x509.Certificate{root}}
+	if err := p.verify(cs); err != nil {
+		t.Fatalf("verify = %v, want a match on the verified chain", err)
+	}
+	if peers[0] != leaf || peers[1] != intermediate {
+		t.Error("verify modified PeerCertificates")
+	}
+}
+
+// commandRecorder records the command lines a server receives.
+type commandRecorder struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (r *commandRecorder) OnCommand(_ context.Context, line string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, line)
+	return nil
+}
+
+func TestRequireTLSWithoutTLS(t *testing.T) {
+	rec := &commandRecorder{}
+	addr, cleanup := startTestServer(t, smtpserver.WithCommandHandler(rec))
+	defer cleanup()
+
+	c, err := Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	err = c.Mail(context.Background(), "sender@example.com", WithRequireTLSParam())
+	if !errors.Is(err, ErrRequireTLS) {
+		t.Fatalf("Mail: err = %v, want ErrRequireTLS", err)
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		t.Errorf("Mail: err = %v, want a local error", err)
+	}
+	if err := c.Noop(context.Background()); err != nil {
+		t.Fatalf("Noop: %v", err)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for _, line := range rec.lines {
+		if strings.HasPrefix(line, "MAIL") {
+			t.Errorf("server received %q", line)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package smtpclient
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// defaultWriteTimeout bounds each chunk of message data, following the
+// DATA block timeout of RFC 5321 §4.5.3.2.5.
+const defaultWriteTimeout = 3 * time.Minute
+
+// WithWriteTimeout sets how long each chunk of message data may take to
+// write during Data and Bdat. The deadline is refreshed for every chunk,
+// so a long upload is bounded by its progress rather than by a single
+// deadline for the whole transfer; a context deadline still applies. The
+// default is 3 minutes.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(o *options) { o.writeTimeout = d }
+}
+
+// streamReader feeds message data to the connection, refreshing the write
+// deadline for each chunk and stopping once ctx is done.
+type streamReader struct {
+	ctx context.Context
+	c   *Client
+	r   io.Reader
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	if err := s.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := s.r.Read(p)
+	s.c.refreshWriteDeadline(s.ctx)
+	return n, err
+}
+
+// streamFrom returns the client's streamReader set to feed r, reused
+// across messages. It must not be used after the next call.
+func (c *Client) streamFrom(ctx context.Context, r io.Reader) *streamReader {
+	c.stream = streamReader{ctx: ctx, c: c, r: r}
+	return &c.stream
+}
+
+// refreshWriteDeadline sets the write deadline for the next chunk of
+// message data: the write timeout from now, or the context deadline if
+// that comes first.
+func (c *Client) refreshWriteDeadline(ctx context.Context) {
+	d := c.writeTimeout
+	if d <= 0 {
+		d = defaultWriteTimeout
+	}
+	deadline := time.Now().Add(d)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	c.conn.SetWriteDeadline(deadline)
+}
+
+// abortOnCancel unblocks any read or write on the connection as soon as
+// ctx is cancelled, so aborting an upload does not wait for a deadline.
+// The connection is unusable afterwards. Call stop when the transfer ends.
+func (c *Client) abortOnCancel(ctx context.Context) (stop func() bool) {
+	if ctx.Done() == nil {
+		return neverCanceled // Nothing to watch, and nothing to allocate.
+	}
+	return context.AfterFunc(ctx, func() {
+		c.conn.NetConn().SetDeadline(time.Now())
+	})
+}
+
+func neverCanceled() bool { return false }
+
+// streamError returns the context's error if ctx ended the transfer, or
+// err otherwise.
+func streamError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
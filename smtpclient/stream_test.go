@@ -0,0 +1,84 @@
+package smtpclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startStuckServer runs a server that accepts DATA and then stops reading,
+// so the client's writes block once the socket buffers are full.
+func startStuckServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { nc.Close() })
+		nc.Write([]byte("220 stuck.example.com ESMTP\r\n"))
+		r := bufio.NewReader(nc)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "EHLO"):
+				nc.Write([]byte("250 stuck.example.com\r\n"))
+			case strings.HasPrefix(line, "DATA"):
+				nc.Write([]byte("354 Go ahead\r\n"))
+				return // Never read the body.
+			default:
+				nc.Write([]byte("250 OK\r\n"))
+			}
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDataCancel(t *testing.T) {
+	c, err := Dial(context.Background(), startStuckServer(t), WithTimeout(2*time.Second))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	if err := c.Mail(context.Background(), "sender@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt(context.Background(), "rcpt@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A long deadline: the upload must stop on cancel, not at the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	body := io.LimitReader(zeroReader{}, 1<<30)
+	err = c.Data(ctx, body)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Data = %v, want context.Canceled", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Data returned %v after cancel", d)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
@@ -0,0 +1,309 @@
+package smtpclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// ErrTLSUnavailable is returned by Dial under TLSRequired or
+// WithTLSMandatory when the server does not advertise STARTTLS.
+var ErrTLSUnavailable = errors.New("STARTTLS not advertised")
+
+// ErrRequireTLS is returned by Mail, before sending anything, for a
+// message sent WithRequireTLSParam over a connection without TLS, for
+// example after Dial fell back to cleartext (RFC 8689 §4.2.1).
+var ErrRequireTLS = errors.New("REQUIRETLS message without TLS")
+
+// ErrPinMismatch is returned by StartTLS when pins are configured and no
+// certificate presented by the server matches them.
+var ErrPinMismatch = errors.New("server certificate does not match any pin")
+
+// TLS failure result types from the TLSRPT report format (RFC 8460 §4.3).
+const (
+	TLSResultHostMismatch     = "certificate-host-mismatch"
+	TLSResultExpired          = "certificate-expired"
+	TLSResultNotTrusted       = "certificate-not-trusted"
+	TLSResultValidationFailed = "validation-failure"
+)
+
+// TLSVerificationError describes a server certificate that failed
+// verification during StartTLS. It is wrapped in the error returned by
+// StartTLS and Dial; retrieve it with errors.As.
+type TLSVerificationError struct {
+	ServerName string              // Name the certificate was verified against.
+	Chain      []*x509.Certificate // Certificates presented by the server, leaf first.
+	Names      []string            // DNS names in the leaf certificate.
+	NotBefore  time.Time           // Leaf validity period.
+	NotAfter   time.Time
+	Expired    bool  // Leaf is outside its validity period.
+	SelfSigned bool  // Leaf is signed by its own key.
+	Err        error // Underlying x509 error.
+}
+
+func (e *TLSVerificationError) Error() string {
+	return fmt.Sprintf("certificate verification failed for %s (%s): %v", e.ServerName, e.Result(), e.Err)
+}
+
+func (e *TLSVerificationError) Unwrap() error {
+	return e.Err
+}
+
+// Result classifies the failure as a TLSRPT result type, for example
+// TLSResultHostMismatch.
+func (e *TLSVerificationError) Result() string {
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var authErr x509.UnknownAuthorityError
+	switch {
+	case errors.As(e.Err, &hostErr):
+		return TLSResultHostMismatch
+	case e.Expired, errors.As(e.Err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return TLSResultExpired
+	case e.SelfSigned, errors.As(e.Err, &authErr):
+		return TLSResultNotTrusted
+	}
+	return TLSResultValidationFailed
+}
+
+// newTLSVerificationError builds a TLSVerificationError from a failed
+// handshake, or returns nil if err is not a certificate verification error.
+func newTLSVerificationError(serverName string, err error) *TLSVerificationError {
+	var certErr *tls.CertificateVerificationError
+	if !errors.As(err, &certErr) {
+		return nil
+	}
+	e := &TLSVerificationError{
+		ServerName: serverName,
+		Chain:      certErr.UnverifiedCertificates,
+		Err:        certErr.Err,
+	}
+	if len(e.Chain) > 0 {
+		leaf := e.Chain[0]
+		now := time.Now()
+		e.Names = leaf.DNSNames
+		e.NotBefore = leaf.NotBefore
+		e.NotAfter = leaf.NotAfter
+		e.Expired = now.Before(leaf.NotBefore) || now.After(leaf.NotAfter)
+		e.SelfSigned = bytes.Equal(leaf.RawIssuer, leaf.RawSubject) &&
+			leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature) == nil
+	}
+	return e
+}
+
+// WithPinnedCertificates pins the server to the given certificates: the
+// STARTTLS handshake fails with ErrPinMismatch unless the server's leaf
+// certificate, or a certificate of a verified chain, is one of them. Pins
+// are checked in addition to normal verification. Combine pins with
+// TLSRequired so a mismatch cannot fall back to cleartext.
+func WithPinnedCertificates(certs ...*x509.Certificate) Option {
+	return func(o *options) { o.pins.certs = append(o.pins.certs, certs...) }
+}
+
+// WithPinnedSPKI pins the server to public keys, given as SHA-256 hashes
+// of the DER-encoded SubjectPublicKeyInfo (see SPKIHash). It matches the
+// same certificates as WithPinnedCertificates but survives re-issuance
+// with the same key.
+func WithPinnedSPKI(hashes ...[]byte) Option {
+	return func(o *options) { o.pins.spki = append(o.pins.spki, hashes...) }
+}
+
+// SPKIHash returns the SHA-256 hash of the certificate's
+// SubjectPublicKeyInfo, the value expected by WithPinnedSPKI.
+func SPKIHash(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// pinSet holds the certificate and public-key pins of a client.
+type pinSet struct {
+	certs []*x509.Certificate
+	spki  [][]byte
+}
+
+func (p pinSet) empty() bool {
+	return len(p.certs) == 0 && len(p.spki) == 0
+}
+
+// apply returns a copy of config that also enforces the pins.
+func (p pinSet) apply(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	next := config.VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if next != nil {
+			if err := next(cs); err != nil {
+				return err
+			}
+		}
+		return p.verify(cs)
+	}
+	return config
+}
+
+// verify checks the leaf and, when normal verification ran, the verified
+// chains. Intermediates are only trusted once verified: without a verified
+// chain the server proves ownership of the leaf key alone.
+func (p pinSet) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return ErrPinMismatch
+	}
+	// A new slice: appending to PeerCertificates[:1] would overwrite the
+	// rest of the connection's chain.
+	candidates := []*x509.Certificate{cs.PeerCertificates[0]}
+	for _, chain := range cs.VerifiedChains {
+		candidates = append(candidates, chain...)
+	}
+	for _, cert := range candidates {
+		for _, pinned := range p.certs {
+			if cert.Equal(pinned) {
+				return nil
+			}
+		}
+		hash := SPKIHash(cert)
+		for _, pinned := range p.spki {
+			if bytes.Equal(hash, pinned) {
+				return nil
+			}
+		}
+	}
+	return ErrPinMismatch
+}
+
+// TLSPolicy controls whether Dial negotiates STARTTLS and what happens
+// when the upgrade fails.
+type TLSPolicy int
+
+const (
+	// TLSManual leaves STARTTLS to the caller (see Client.StartTLS).
+	TLSManual TLSPolicy = iota
+
+	// TLSOpportunistic upgrades when the server advertises STARTTLS and
+	// fails Dial if the upgrade fails.
+	TLSOpportunistic
+
+	// TLSOpportunisticFallback upgrades when the server advertises
+	// STARTTLS. If the upgrade fails, the delivery continues in cleartext:
+	// on the same connection when the server refused STARTTLS, otherwise
+	// on a fresh connection. Client.TLSDowngraded reports the fallback,
+	// and TLSFallbacks counts them. WithTLSMandatory disables the fallback,
+	// and Mail refuses a message sent WithRequireTLSParam after one.
+	TLSOpportunisticFallback
+
+	// TLSRequired fails Dial unless STARTTLS is advertised and succeeds.
+	TLSRequired
+)
+
+// String returns the policy name.
+func (p TLSPolicy) String() string {
+	switch p {
+	case TLSManual:
+		return "manual"
+	case TLSOpportunistic:
+		return "opportunistic"
+	case TLSOpportunisticFallback:
+		return "opportunistic-fallback"
+	case TLSRequired:
+		return "required"
+	}
+	return "unknown"
+}
+
+// WithTLSPolicy sets the STARTTLS policy applied by Dial. The default is
+// TLSManual. The upgrade uses the WithTLSConfig configuration, or one with
+// ServerName set to the dialed host.
+func WithTLSPolicy(p TLSPolicy) Option {
+	return func(o *options) { o.tlsPolicy = p }
+}
+
+// WithTLSMandatory declares that a policy forbids cleartext delivery to
+// the destination, such as an MTA-STS policy in enforce mode (RFC 8461)
+// or usable DANE TLSA records (RFC 7672). Dial then fails unless STARTTLS
+// succeeds, as under TLSRequired, whatever the TLSPolicy other than
+// TLSManual.
+func WithTLSMandatory() Option {
+	return func(o *options) { o.tlsMust = true }
+}
+
+// tlsFallbacks counts cleartext fallbacks, for TLSFallbacks.
+var tlsFallbacks atomic.Uint64
+
+// TLSFallbacks returns the number of times Dial fell back to cleartext
+// after a failed STARTTLS under TLSOpportunisticFallback, across all
+// clients since the program started.
+func TLSFallbacks() uint64 {
+	return tlsFallbacks.Load()
+}
+
+// TLSDowngraded reports whether Dial fell back to cleartext after a failed
+// STARTTLS under TLSOpportunisticFallback.
+func (c *Client) TLSDowngraded() bool {
+	return c.tlsErr != nil
+}
+
+// TLSError returns the STARTTLS failure that caused a cleartext fallback,
+// or nil if none occurred.
+func (c *Client) TLSError() error {
+	return c.tlsErr
+}
+
+// applyTLSPolicy performs STARTTLS on a freshly dialed client according to
+// o.tlsPolicy. It returns the client to use, which is a new connection if
+// the policy fell back to cleartext after a failed handshake.
+func applyTLSPolicy(ctx context.Context, c *Client, addr string, o *options) (*Client, error) {
+	if o.tlsPolicy == TLSManual || c.tls {
+		return c, nil
+	}
+	required := o.tlsPolicy == TLSRequired || o.tlsMust
+	if !c.exts.Has(smtp.ExtSTARTTLS) {
+		if required {
+			c.Close()
+			return nil, fmt.Errorf("smtp: dial %s: %w", addr, ErrTLSUnavailable)
+		}
+		return c, nil
+	}
+
+	config := o.tlsConfig
+	if config == nil {
+		host, _, _ := net.SplitHostPort(addr)
+		config = &tls.Config{ServerName: host}
+	}
+	tlsErr := c.StartTLS(ctx, config)
+	if tlsErr == nil {
+		return c, nil
+	}
+	if o.tlsPolicy != TLSOpportunisticFallback || required || c.tls {
+		c.netConn.Close()
+		return nil, tlsErr
+	}
+
+	tlsFallbacks.Add(1)
+	o.logger.Warn("STARTTLS failed, continuing in cleartext", "addr", addr, "err", tlsErr)
+
+	// The server refused STARTTLS with a reply: the session is intact.
+	var smtpErr *smtp.SMTPError
+	if errors.As(tlsErr, &smtpErr) {
+		c.tlsErr = tlsErr
+		return c, nil
+	}
+
+	// The handshake failed mid-stream: start over on a new connection.
+	c, err := dialPlain(ctx, addr, o)
+	if err != nil {
+		return nil, err
+	}
+	c.tlsErr = tlsErr
+	return c, nil
+}
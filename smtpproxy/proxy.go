@@ -0,0 +1,269 @@
+// Package smtpproxy relays SMTP sessions to an upstream server command by
+// command, for filtering gateways that must answer clients exactly as the
+// upstream server does.
+//
+// A Proxy is an smtpserver.Backend: each client connection gets its own
+// upstream connection, and EHLO/HELO, MAIL, RCPT, the message and RSET are
+// passed on as they arrive, each optionally rewritten or filtered first.
+// A command the upstream server refuses is refused to the client with the
+// upstream reply code, enhanced status code and text, including
+// multi-line replies:
+//
+//	proxy := &smtpproxy.Proxy{
+//		Dial: func(ctx context.Context) (*smtpclient.Client, error) {
+//			return smtpclient.Dial(ctx, "mx-internal.example.com:25")
+//		},
+//		Filter: scanner.Filter,
+//	}
+//	srv := smtpserver.NewServer(smtpserver.WithBackend(proxy))
+//
+// MAIL, RCPT and the message are answered with the upstream reply when it
+// accepts them too, and carry the parameters the client sent for the
+// extensions the upstream server advertises. Paths are relayed as the
+// client sent them unless rewritten. The proxy's own server still
+// enforces its options, such as size and recipient limits, TLS and
+// authentication, before anything is relayed, and answers EHLO with its
+// own extensions.
+package smtpproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/alexisbouchez/smtp.go"
+	"github.com/alexisbouchez/smtp.go/smtpclient"
+	"github.com/alexisbouchez/smtp.go/smtpserver"
+)
+
+// errUpstream is the reply when the upstream server cannot be reached or
+// the connection to it fails.
+var errUpstream = smtp.Errorf(smtp.ReplyLocalError, smtp.EnhancedCodeOtherNetwork, "Upstream server unavailable, try again later")
+
+// Proxy relays client sessions to an upstream server. Dial must be set;
+// the other fields are optional. A Proxy is safe for concurrent use once
+// configured.
+type Proxy struct {
+	// Dial connects to the upstream server for a new client connection,
+	// typically with smtpclient.Dial. It is called before the client is
+	// greeted; if it fails, the client is refused with the upstream
+	// server's reply, or with 421 if there was none.
+	Dial func(ctx context.Context) (*smtpclient.Client, error)
+
+	// RewriteHelo, RewriteMail and RewriteRcpt change the EHLO/HELO
+	// name, sender and recipients before they are relayed. A path
+	// returned unchanged is relayed as the client sent it, a changed one
+	// as formatted by its String method. An error refuses the command
+	// with it, without relaying it.
+	RewriteHelo func(ctx context.Context, hostname string) (string, error)
+	RewriteMail func(ctx context.Context, from smtp.ReversePath) (smtp.ReversePath, error)
+	RewriteRcpt func(ctx context.Context, to smtp.ForwardPath) (smtp.ForwardPath, error)
+
+	// Filter returns the message to relay in place of r, such as r with
+	// a header added, or an error to refuse the message without relaying
+	// it. The returned reader is read to the end.
+	Filter func(ctx context.Context, from smtp.ReversePath, to []smtp.ForwardPath, r io.Reader) (io.Reader, error)
+}
+
+// NewSession implements smtpserver.Backend by connecting to the upstream
+// server.
+func (p *Proxy) NewSession(ctx context.Context, _ net.Addr) (smtpserver.Session, error) {
+	client, err := p.Dial(ctx)
+	if err != nil {
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) {
+			return nil, smtpErr
+		}
+		return nil, smtp.Errorf(smtp.ReplyServiceNotAvailable, smtp.EnhancedCodeOtherNetwork, "Upstream server unavailable, try again later")
+	}
+	return &session{proxy: p, client: client}, nil
+}
+
+// session relays one client connection.
+type session struct {
+	proxy         *Proxy
+	client        *smtpclient.Client
+	inTransaction bool // The upstream server has accepted MAIL.
+}
+
+// upstreamError converts an error from the upstream client into the reply
+// for the client: the upstream reply when there was one.
+func (s *session) upstreamError(err error) error {
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return errUpstream
+	}
+	// LastReply has the enhanced code split off every line.
+	if r := s.client.LastReply(); r.Code == smtpErr.Code {
+		return &smtp.SMTPError{Code: r.Code, EnhancedCode: r.EnhancedCode, Message: strings.Join(r.Lines, "\n")}
+	}
+	return smtpErr
+}
+
+// relayReply makes the upstream reply to the last command, which accepted
+// it, the reply to the client.
+func (s *session) relayReply(ctx context.Context) {
+	r := s.client.LastReply()
+	smtpserver.SetReply(ctx, r.Code, r.EnhancedCode, strings.Join(r.Lines, "\n"))
+}
+
+// OnHelo implements smtpserver.HeloHandler.
+func (s *session) OnHelo(ctx context.Context, hostname string) error {
+	if s.proxy.RewriteHelo != nil {
+		var err error
+		if hostname, err = s.proxy.RewriteHelo(ctx, hostname); err != nil {
+			return err
+		}
+	}
+	s.inTransaction = false // EHLO resets any transaction.
+	if err := s.client.Hello(ctx, hostname); err != nil {
+		return s.upstreamError(err)
+	}
+	return nil
+}
+
+// OnMail implements smtpserver.MailHandler.
+func (s *session) OnMail(ctx context.Context, from smtp.ReversePath) error {
+	path := from.Raw
+	if s.proxy.RewriteMail != nil {
+		rewritten, err := s.proxy.RewriteMail(ctx, from)
+		if err != nil {
+			return err
+		}
+		if rewritten != from {
+			path = rewritten.String()
+		}
+	}
+	if path == "" {
+		path = from.String()
+	}
+	var opts []smtpclient.MailOption
+	for _, param := range s.params(ctx) {
+		switch keyword, _, _ := strings.Cut(param, "="); strings.ToUpper(keyword) {
+		case "SMTPUTF8":
+			opts = append(opts, smtpclient.WithSMTPUTF8())
+		case "REQUIRETLS":
+			// Checked against the upstream connection by Mail.
+			opts = append(opts, smtpclient.WithRequireTLSParam())
+		default:
+			opts = append(opts, smtpclient.WithMailParam(param))
+		}
+	}
+	if err := s.client.Mail(ctx, unbracket(path), opts...); err != nil {
+		return s.upstreamError(err)
+	}
+	s.inTransaction = true
+	s.relayReply(ctx)
+	return nil
+}
+
+// OnRcpt implements smtpserver.RcptHandler.
+func (s *session) OnRcpt(ctx context.Context, to smtp.ForwardPath) error {
+	path := to.Raw
+	if s.proxy.RewriteRcpt != nil {
+		rewritten, err := s.proxy.RewriteRcpt(ctx, to)
+		if err != nil {
+			return err
+		}
+		if rewritten != to {
+			path = rewritten.String()
+		}
+	}
+	if path == "" {
+		path = to.String()
+	}
+	var opts []smtpclient.RcptOption
+	for _, param := range s.params(ctx) {
+		opts = append(opts, smtpclient.WithRcptParam(param))
+	}
+	if err := s.client.Rcpt(ctx, unbracket(path), opts...); err != nil {
+		return s.upstreamError(err)
+	}
+	s.relayReply(ctx)
+	return nil
+}
+
+// params returns the parameters of the MAIL or RCPT command being handled
+// whose extension the upstream server advertises, as the client sent them.
+func (s *session) params(ctx context.Context) []string {
+	// The path ends at the first space after the colon, as the server
+	// parses it.
+	_, rest, _ := strings.Cut(smtpserver.CommandLine(ctx), ":")
+	_, rest, _ = strings.Cut(strings.TrimLeft(rest, " "), " ")
+	var params []string
+	for _, param := range strings.Fields(rest) {
+		keyword, value, _ := strings.Cut(param, "=")
+		if s.client.Extensions().Has(paramExtension(strings.ToUpper(keyword), value)) {
+			params = append(params, param)
+		}
+	}
+	return params
+}
+
+// paramExtension returns the extension that defines a MAIL or RCPT
+// parameter: the one named after it unless listed here.
+func paramExtension(keyword, value string) smtp.Extension {
+	switch keyword {
+	case "BODY":
+		if strings.EqualFold(value, "BINARYMIME") {
+			return "BINARYMIME"
+		}
+		return smtp.Ext8BITMIME
+	case "RET", "ENVID", "NOTIFY", "ORCPT":
+		return smtp.ExtDSN
+	case "BY":
+		return "DELIVERBY"
+	}
+	return smtp.Extension(keyword)
+}
+
+// unbracket strips the angle brackets off path, which Mail and Rcpt add
+// back.
+func unbracket(path string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(path, "<"), ">")
+}
+
+// OnData implements smtpserver.DataHandler. A BINARYMIME message is
+// relayed with BDAT, anything else with DATA.
+func (s *session) OnData(ctx context.Context, from smtp.ReversePath, to []smtp.ForwardPath, r io.Reader) error {
+	if s.proxy.Filter != nil {
+		filtered, err := s.proxy.Filter(ctx, from, to, r)
+		if err != nil {
+			return err
+		}
+		r = filtered
+	}
+	var err error
+	if smtpserver.Negotiated(ctx).Body == "BINARYMIME" {
+		var data []byte
+		if data, err = io.ReadAll(r); err != nil {
+			return err
+		}
+		err = s.client.Bdat(ctx, data, true)
+	} else {
+		err = s.client.Data(ctx, r)
+	}
+	s.inTransaction = false
+	if err != nil {
+		return s.upstreamError(err)
+	}
+	s.relayReply(ctx)
+	return nil
+}
+
+// OnReset implements smtpserver.ResetHandler, resetting an upstream
+// transaction that the client abandoned.
+func (s *session) OnReset(ctx context.Context) {
+	if s.inTransaction {
+		s.client.Reset(ctx)
+		s.inTransaction = false
+	}
+}
+
+// Logout implements smtpserver.Session by closing the upstream
+// connection.
+func (s *session) Logout(context.Context) {
+	s.client.Close()
+}
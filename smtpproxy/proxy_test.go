@@ -0,0 +1,212 @@
+package smtpproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+	"github.com/alexisbouchez/smtp.go/smtpclient"
+	"github.com/alexisbouchez/smtp.go/smtpserver"
+)
+
+// upstream records the messages the upstream server accepts and refuses
+// recipients named "unknown" with a multi-line reply.
+type upstream struct {
+	mu       sync.Mutex
+	helo     string
+	commands []string
+	messages []string
+	queueIDs []string
+	to       [][]smtp.ForwardPath
+}
+
+func (u *upstream) OnCommand(_ context.Context, line string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.commands = append(u.commands, line)
+	return nil
+}
+
+func (u *upstream) OnHelo(_ context.Context, hostname string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.helo = hostname
+	return nil
+}
+
+func (u *upstream) OnRcpt(_ context.Context, to smtp.ForwardPath) error {
+	if to.Mailbox.LocalPart == "unknown" {
+		return smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeBadDest, "No such user here\nTry the directory")
+	}
+	return nil
+}
+
+func (u *upstream) OnData(ctx context.Context, _ smtp.ReversePath, to []smtp.ForwardPath, r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.messages = append(u.messages, string(body))
+	u.queueIDs = append(u.queueIDs, smtpserver.MessageID(ctx))
+	u.to = append(u.to, to)
+	return nil
+}
+
+// serve runs srv on a local listener and returns its address.
+func serve(t *testing.T, srv *smtpserver.Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestProxy(t *testing.T) {
+	up := &upstream{}
+	upAddr := serve(t, smtpserver.NewServer(
+		smtpserver.WithHostname("upstream.example.com"),
+		smtpserver.WithHeloHandler(up),
+		smtpserver.WithRcptHandler(up),
+		smtpserver.WithDataHandler(up),
+	))
+
+	proxy := &Proxy{
+		Dial: func(ctx context.Context) (*smtpclient.Client, error) {
+			return smtpclient.Dial(ctx, upAddr, smtpclient.WithLocalName("gateway.example.com"))
+		},
+		RewriteRcpt: func(_ context.Context, to smtp.ForwardPath) (smtp.ForwardPath, error) {
+			if to.Mailbox.Domain == "old.example.com" {
+				to.Mailbox.Domain = "example.com"
+			}
+			return to, nil
+		},
+		Filter: func(_ context.Context, _ smtp.ReversePath, _ []smtp.ForwardPath, r io.Reader) (io.Reader, error) {
+			return io.MultiReader(strings.NewReader("X-Scanned: clean\r\n"), r), nil
+		},
+	}
+	proxyAddr := serve(t, smtpserver.NewServer(smtpserver.WithHostname("gateway.example.com"), smtpserver.WithBackend(proxy)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := smtpclient.Dial(ctx, proxyAddr, smtpclient.WithLocalName("client.example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail(ctx, "sender@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Rcpt(ctx, "unknown@example.com")
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != smtp.ReplyMailboxNotFound {
+		t.Fatalf("RCPT unknown: %v", err)
+	}
+	if r := c.LastReply(); r.EnhancedCode != smtp.EnhancedCodeBadDest || strings.Join(r.Lines, "|") != "No such user here|Try the directory" {
+		t.Errorf("upstream reply relayed as %+v", r)
+	}
+	if err := c.Rcpt(ctx, "user@old.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Data(ctx, strings.NewReader("Subject: hello\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.helo != "client.example.org" {
+		t.Errorf("upstream EHLO name = %q, want the client's", up.helo)
+	}
+	if r := c.LastReply(); len(up.queueIDs) != 1 || r.Lines[0] != "Ok: queued as "+up.queueIDs[0] {
+		t.Errorf("reply to DATA = %+v, want the upstream's", r)
+	}
+	if len(up.messages) != 1 {
+		t.Fatalf("upstream received %d messages", len(up.messages))
+	}
+	if !strings.HasPrefix(up.messages[0], "X-Scanned: clean\r\nSubject: hello\r\n") {
+		t.Errorf("upstream message = %q", up.messages[0])
+	}
+	if to := up.to[0]; len(to) != 1 || to[0].Mailbox.String() != "user@example.com" {
+		t.Errorf("upstream recipients = %v", to)
+	}
+}
+
+func TestProxyUpstreamDown(t *testing.T) {
+	proxy := &Proxy{
+		Dial: func(ctx context.Context) (*smtpclient.Client, error) {
+			return nil, errors.New("connection refused")
+		},
+	}
+	proxyAddr := serve(t, smtpserver.NewServer(smtpserver.WithBackend(proxy)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := smtpclient.Dial(ctx, proxyAddr)
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != smtp.ReplyServiceNotAvailable {
+		t.Errorf("Dial through a proxy without upstream: %v", err)
+	}
+}
+
+func TestProxyRelaysParamsAndPaths(t *testing.T) {
+	up := &upstream{}
+	upAddr := serve(t, smtpserver.NewServer(
+		smtpserver.WithCommandHandler(up),
+		smtpserver.WithRcptHandler(up),
+		smtpserver.WithDataHandler(up),
+		smtpserver.WithMaxMessageSize(1<<20),
+	))
+	proxy := &Proxy{
+		Dial: func(ctx context.Context) (*smtpclient.Client, error) {
+			return smtpclient.Dial(ctx, upAddr)
+		},
+	}
+	proxyAddr := serve(t, smtpserver.NewServer(smtpserver.WithBackend(proxy), smtpserver.WithMaxMessageSize(1<<20)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := smtpclient.Dial(ctx, proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail(ctx, "@relay.example.org:sender@example.org", smtpclient.WithSize(42),
+		smtpclient.WithDSNReturn("HDRS"), smtpclient.WithDSNEnvelopeID("env 1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt(ctx, "user@example.com", smtpclient.WithDSNNotify("FAILURE,DELAY"),
+		smtpclient.WithDSNOriginalRecipient("rfc822;user+tag@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reset(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	want := []string{
+		"MAIL FROM:<@relay.example.org:sender@example.org> SIZE=42 RET=HDRS ENVID=env+201",
+		"RCPT TO:<user@example.com> NOTIFY=FAILURE,DELAY ORCPT=rfc822;user+2Btag@example.com",
+	}
+	var got []string
+	for _, line := range up.commands {
+		if strings.HasPrefix(line, "MAIL") || strings.HasPrefix(line, "RCPT") {
+			got = append(got, line)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("upstream received %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,319 @@
+package smtpserver
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// AccessListConfig names the list files of an AccessList and the replies
+// used to reject matches. Any file may be left empty.
+//
+// Client lists hold one IP address or CIDR prefix per line. Sender and
+// recipient lists hold one entry per line: a full address
+// ("user@example.com"), a domain ("example.com") or a domain with its
+// subdomains (".example.com"). Blank lines and lines starting with '#'
+// are ignored, and matching is case-insensitive.
+//
+// An entry on an allow list exempts the client or address from the
+// corresponding block list.
+type AccessListConfig struct {
+	ClientAllow    string // Checked when a client connects.
+	ClientBlock    string
+	SenderAllow    string // Checked at MAIL FROM; the null sender is never blocked.
+	SenderBlock    string
+	RecipientAllow string // Checked at RCPT TO.
+	RecipientBlock string
+
+	// Replies sent for blocked clients, senders and recipients. Defaults are
+	// 554 5.7.1, 550 5.7.1 and 550 5.7.1.
+	ClientReply    *smtp.SMTPError
+	SenderReply    *smtp.SMTPError
+	RecipientReply *smtp.SMTPError
+
+	// CheckInterval is how often the files are checked for changes during
+	// lookups. Zero means 10 seconds; negative disables the checks.
+	CheckInterval time.Duration
+
+	// Logger receives reload messages. Nil means slog.Default().
+	Logger *slog.Logger
+}
+
+// AccessList enforces IP, sender and recipient allow and block lists loaded
+// from files. Modified files are reloaded automatically; a file that fails
+// to load leaves the previous lists in place. It is safe for concurrent use.
+type AccessList struct {
+	cfg AccessListConfig
+
+	mu        sync.Mutex
+	lists     accessLists
+	mods      map[string]time.Time
+	lastCheck time.Time
+}
+
+type accessLists struct {
+	clientAllow, clientBlock       []netip.Prefix
+	senderAllow, senderBlock       addressSet
+	recipientAllow, recipientBlock addressSet
+}
+
+// addressSet matches mailboxes by address, domain or parent domain.
+type addressSet struct {
+	addresses map[string]bool
+	domains   map[string]bool
+	parents   []string // Entries from ".example.com" lines, without the dot.
+}
+
+func (a addressSet) match(mb smtp.Mailbox) bool {
+	domain := strings.ToLower(mb.Domain)
+	if a.addresses[strings.ToLower(mb.LocalPart)+"@"+domain] || a.domains[domain] {
+		return true
+	}
+	for _, parent := range a.parents {
+		if domain == parent || strings.HasSuffix(domain, "."+parent) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadAccessList reads the lists named in cfg.
+func LoadAccessList(cfg AccessListConfig) (*AccessList, error) {
+	if cfg.ClientReply == nil {
+		cfg.ClientReply = smtp.Errorf(smtp.ReplyTransactionFailed, smtp.EnhancedCodeNotAuthorized, "Access denied")
+	}
+	if cfg.SenderReply == nil {
+		cfg.SenderReply = smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeNotAuthorized, "Sender rejected")
+	}
+	if cfg.RecipientReply == nil {
+		cfg.RecipientReply = smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeNotAuthorized, "Recipient rejected")
+	}
+	if cfg.CheckInterval == 0 {
+		cfg.CheckInterval = 10 * time.Second
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	a := &AccessList{cfg: cfg}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// WithAccessList enforces a at connect, MAIL FROM and RCPT TO, before the
+// corresponding handlers run.
+func WithAccessList(a *AccessList) Option {
+	return func(s *Server) { s.accessList = a }
+}
+
+// Reload re-reads all list files. On error the current lists stay in use.
+func (a *AccessList) Reload() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.loadLocked()
+}
+
+// files returns the configured list files.
+func (a *AccessList) files() []string {
+	c := a.cfg
+	var files []string
+	for _, f := range []string{c.ClientAllow, c.ClientBlock, c.SenderAllow, c.SenderBlock, c.RecipientAllow, c.RecipientBlock} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// loadLocked parses every list file. The caller must hold a.mu.
+func (a *AccessList) loadLocked() error {
+	mods := make(map[string]time.Time)
+	for _, f := range a.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return fmt.Errorf("smtp: loading access list: %w", err)
+		}
+		mods[f] = info.ModTime()
+	}
+
+	var l accessLists
+	var err error
+	if l.clientAllow, err = loadPrefixes(a.cfg.ClientAllow); err != nil {
+		return err
+	}
+	if l.clientBlock, err = loadPrefixes(a.cfg.ClientBlock); err != nil {
+		return err
+	}
+	if l.senderAllow, err = loadAddresses(a.cfg.SenderAllow); err != nil {
+		return err
+	}
+	if l.senderBlock, err = loadAddresses(a.cfg.SenderBlock); err != nil {
+		return err
+	}
+	if l.recipientAllow, err = loadAddresses(a.cfg.RecipientAllow); err != nil {
+		return err
+	}
+	if l.recipientBlock, err = loadAddresses(a.cfg.RecipientBlock); err != nil {
+		return err
+	}
+
+	a.lists = l
+	a.mods = mods
+	a.lastCheck = time.Now()
+	return nil
+}
+
+// current returns the lists, reloading them first if a file changed.
+func (a *AccessList) current() accessLists {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.cfg.CheckInterval < 0 || time.Since(a.lastCheck) < a.cfg.CheckInterval {
+		return a.lists
+	}
+	a.lastCheck = time.Now()
+	for _, f := range a.files() {
+		info, err := os.Stat(f)
+		if err != nil || !info.ModTime().Equal(a.mods[f]) {
+			if err := a.loadLocked(); err != nil {
+				a.cfg.Logger.Error("reloading access list, keeping previous", "err", err)
+			} else {
+				a.cfg.Logger.Info("access list reloaded")
+			}
+			break
+		}
+	}
+	return a.lists
+}
+
+// checkClient returns the client reply if addr is blocked.
+func (a *AccessList) checkClient(addr net.Addr) *smtp.SMTPError {
+	ip, ok := clientIP(addr)
+	if !ok {
+		return nil
+	}
+	l := a.current()
+	if containsAddr(l.clientAllow, ip) || !containsAddr(l.clientBlock, ip) {
+		return nil
+	}
+	return a.cfg.ClientReply
+}
+
+// checkSender returns the sender reply if from is blocked.
+func (a *AccessList) checkSender(from smtp.ReversePath) *smtp.SMTPError {
+	if from.Null {
+		return nil
+	}
+	l := a.current()
+	if l.senderAllow.match(from.Mailbox) || !l.senderBlock.match(from.Mailbox) {
+		return nil
+	}
+	return a.cfg.SenderReply
+}
+
+// checkRecipient returns the recipient reply if to is blocked.
+func (a *AccessList) checkRecipient(to smtp.ForwardPath) *smtp.SMTPError {
+	l := a.current()
+	if l.recipientAllow.match(to.Mailbox) || !l.recipientBlock.match(to.Mailbox) {
+		return nil
+	}
+	return a.cfg.RecipientReply
+}
+
+// clientIP returns the IP address of a TCP client. It reports false for
+// other connections, such as pipes and Unix sockets.
+func clientIP(addr net.Addr) (netip.Addr, bool) {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
+
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readEntries calls fn for each entry of a list file. An empty path
+// yields no entries.
+func readEntries(path string, fn func(entry string) error) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("smtp: loading access list: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		entry := strings.TrimSpace(sc.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if err := fn(entry); err != nil {
+			return fmt.Errorf("smtp: loading access list: %s:%d: %w", path, n, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("smtp: loading access list: %w", err)
+	}
+	return nil
+}
+
+func loadPrefixes(path string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	err := readEntries(path, func(entry string) error {
+		if strings.Contains(entry, "/") {
+			p, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return err
+			}
+			prefixes = append(prefixes, p.Masked())
+			return nil
+		}
+		ip, err := netip.ParseAddr(entry)
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+		return nil
+	})
+	return prefixes, err
+}
+
+func loadAddresses(path string) (addressSet, error) {
+	set := addressSet{addresses: map[string]bool{}, domains: map[string]bool{}}
+	err := readEntries(path, func(entry string) error {
+		entry = strings.ToLower(entry)
+		switch {
+		case strings.Contains(entry, "@"):
+			mb, err := smtp.ParseMailbox(entry)
+			if err != nil {
+				return err
+			}
+			set.addresses[mb.LocalPart+"@"+mb.Domain] = true
+		case strings.HasPrefix(entry, "."):
+			set.parents = append(set.parents, entry[1:])
+		default:
+			set.domains[entry] = true
+		}
+		return nil
+	})
+	return set, err
+}
@@ -0,0 +1,121 @@
+package smtpserver
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+func writeList(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAccessList_Client(t *testing.T) {
+	dir := t.TempDir()
+	block := filepath.Join(dir, "client-block")
+	allow := filepath.Join(dir, "client-allow")
+	writeList(t, block, "# spam network\n192.0.2.0/24\n2001:db8::1\n")
+	writeList(t, allow, "192.0.2.10\n")
+
+	a, err := LoadAccessList(AccessListConfig{ClientBlock: block, ClientAllow: allow})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"192.0.2.55", true},
+		{"192.0.2.10", false}, // Allow list wins.
+		{"198.51.100.1", false},
+		{"2001:db8::1", true},
+		{"::ffff:192.0.2.55", true}, // IPv4-mapped.
+	}
+	for _, tt := range tests {
+		addr := &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 25}
+		if got := a.checkClient(addr) != nil; got != tt.blocked {
+			t.Errorf("checkClient(%s) blocked = %v, want %v", tt.ip, got, tt.blocked)
+		}
+	}
+}
+
+func TestAccessList_SenderRecipient(t *testing.T) {
+	dir := t.TempDir()
+	senders := filepath.Join(dir, "sender-block")
+	recipients := filepath.Join(dir, "recipient-block")
+	writeList(t, senders, "spammer@example.com\n.bad.example\n")
+	writeList(t, recipients, "closed.example.com\n")
+
+	a, err := LoadAccessList(AccessListConfig{
+		SenderBlock:    senders,
+		RecipientBlock: recipients,
+		RecipientReply: smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeBadDest, "Mailbox closed"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn, _ := startTestServer(t, WithAccessList(a))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+
+	c.send("MAIL FROM:<Spammer@Example.com>")
+	c.expectCode(550)
+	c.send("MAIL FROM:<someone@mx.bad.example>")
+	c.expectCode(550)
+	c.send("MAIL FROM:<>")
+	c.expectCode(250)
+
+	c.send("RCPT TO:<user@closed.example.com>")
+	if lines := c.expectCode(550); lines[0] != "5.1.1 Mailbox closed" {
+		t.Errorf("reply = %q, want configured recipient reply", lines[0])
+	}
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+
+	// Edit the block list: the change applies once the check interval passes.
+	writeList(t, recipients, "")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(recipients, future, future)
+	a.mu.Lock()
+	a.cfg.CheckInterval = time.Nanosecond
+	a.mu.Unlock()
+
+	c.send("RCPT TO:<user@closed.example.com>")
+	c.expectCode(250)
+}
+
+func TestAccessList_InvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	block := filepath.Join(dir, "client-block")
+	writeList(t, block, "192.0.2.0/24\n")
+
+	a, err := LoadAccessList(AccessListConfig{ClientBlock: block})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A broken edit is rejected and the previous list stays in force.
+	writeList(t, block, "not-an-ip\n")
+	if err := a.Reload(); err == nil {
+		t.Fatal("Reload accepted an invalid entry")
+	}
+	if a.checkClient(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}) == nil {
+		t.Error("previous list not kept after failed reload")
+	}
+
+	if _, err := LoadAccessList(AccessListConfig{ClientBlock: filepath.Join(dir, "missing")}); err == nil {
+		t.Error("LoadAccessList accepted a missing file")
+	}
+}
@@ -0,0 +1,99 @@
+package smtpserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+)
+
+// acmeTLSALPNProto is the ALPN protocol of the ACME TLS-ALPN-01
+// challenge (RFC 8737).
+const acmeTLSALPNProto = "acme-tls/1"
+
+// CertificateManager supplies certificates on demand during TLS
+// handshakes. *autocert.Manager from golang.org/x/crypto/acme/autocert
+// satisfies it, including answering TLS-ALPN-01 challenges.
+type CertificateManager interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// WithCertificateManager obtains STARTTLS certificates from m and enables
+// STARTTLS. Other TLS settings can be given with WithTLSConfig, in any
+// order. It takes precedence over WithCertificateFiles.
+func WithCertificateManager(m CertificateManager) Option {
+	return func(s *Server) { s.certManager = m }
+}
+
+// WithACMEChallengeAddr makes Serve also listen on addr (normally ":443")
+// and answer ACME TLS-ALPN-01 challenges there through the
+// CertificateManager, so certificates can be issued without a separate
+// HTTPS server. See ServeACMEChallenges.
+func WithACMEChallengeAddr(addr string) Option {
+	return func(s *Server) { s.acmeAddr = addr }
+}
+
+// ServeACMEChallenges answers ACME TLS-ALPN-01 challenge handshakes on ln
+// using the CertificateManager. Connections that do not negotiate the
+// acme-tls/1 protocol are refused. It returns when the server is closed.
+func (s *Server) ServeACMEChallenges(ln net.Listener) error {
+	if s.certManager == nil {
+		ln.Close()
+		return errors.New("smtp: ACME challenges: no certificate manager configured")
+	}
+	config := &tls.Config{
+		NextProtos: []string{acmeTLSALPNProto},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if !slices.Contains(hello.SupportedProtos, acmeTLSALPNProto) {
+				return nil, fmt.Errorf("smtp: ACME challenges: client did not offer %s", acmeTLSALPNProto)
+			}
+			return s.certManager.GetCertificate(hello)
+		},
+	}
+
+	go func() {
+		<-s.quit
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return nil
+			default:
+			}
+			return fmt.Errorf("smtp: ACME challenges: %w", err)
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(s.cfg.Load().readTimeout))
+			// The validation is complete once the handshake has presented
+			// the challenge certificate.
+			if err := tls.Server(conn, config).Handshake(); err != nil {
+				s.logger.Debug("ACME challenge handshake failed", "remote", conn.RemoteAddr(), "err", err)
+			}
+		}()
+	}
+}
+
+// startACMEChallenges starts the TLS-ALPN-01 listener configured with
+// WithACMEChallengeAddr, if any.
+func (s *Server) startACMEChallenges() error {
+	if s.acmeAddr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", s.acmeAddr)
+	if err != nil {
+		return fmt.Errorf("smtp: ACME challenges: %w", err)
+	}
+	go func() {
+		if err := s.ServeACMEChallenges(ln); err != nil {
+			s.logger.Error("ACME challenge listener stopped", "err", err)
+		}
+	}()
+	return nil
+}
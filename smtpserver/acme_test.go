@@ -0,0 +1,71 @@
+package smtpserver
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+type testCertManager struct {
+	cert  tls.Certificate
+	calls atomic.Int32
+}
+
+func (m *testCertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.calls.Add(1)
+	return &m.cert, nil
+}
+
+func TestCertificateManager_STARTTLS(t *testing.T) {
+	m := &testCertManager{cert: generateTestCertServer(t)}
+	clientConn, _ := startTestServer(t, WithCertificateManager(m))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("STARTTLS")
+	c.expectCode(220)
+
+	tlsConn := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake: %v", err)
+	}
+	defer tlsConn.Close()
+	if m.calls.Load() != 1 {
+		t.Errorf("GetCertificate calls = %d, want 1", m.calls.Load())
+	}
+}
+
+func TestServeACMEChallenges(t *testing.T) {
+	m := &testCertManager{cert: generateTestCertServer(t)}
+	srv := NewServer(WithCertificateManager(m))
+	defer srv.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeACMEChallenges(ln)
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"acme-tls/1"},
+	})
+	if err != nil {
+		t.Fatalf("challenge handshake: %v", err)
+	}
+	if p := conn.ConnectionState().NegotiatedProtocol; p != "acme-tls/1" {
+		t.Errorf("NegotiatedProtocol = %q, want acme-tls/1", p)
+	}
+	conn.Close()
+
+	// Ordinary TLS clients are refused.
+	conn, err = tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		conn.Close()
+		t.Fatal("handshake without acme-tls/1 succeeded")
+	}
+}
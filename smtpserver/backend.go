@@ -0,0 +1,63 @@
+package smtpserver
+
+import (
+	"context"
+	"net"
+)
+
+// Backend is an alternative to registering individual handlers: it
+// creates a Session for each connection, so per-connection state lives in
+// the Session value instead of being keyed by SessionID in shared
+// handlers. Register it with WithBackend.
+type Backend interface {
+	// NewSession is called when a connection is accepted, after any
+	// ConnectionHandler and before the greeting. Return a non-nil error
+	// to reject the connection, as with ConnectionHandler.
+	NewSession(ctx context.Context, remoteAddr net.Addr) (Session, error)
+}
+
+// Session handles the commands of one connection. Its methods are called
+// from the connection's goroutine only, so they need no locking for
+// session-local state. OnReset is called whenever a transaction ends —
+// after each message, on RSET and on a repeated EHLO/HELO — so it is the
+// place to clear per-message state.
+//
+// A Session that also implements AuthHandler, VrfyHandler or ExpnHandler
+// handles AUTH, VRFY or EXPN for its connection; otherwise the server-wide
+// handlers set with WithAuthHandler, WithVrfyHandler and WithExpnHandler
+// apply.
+type Session interface {
+	HeloHandler
+	MailHandler
+	RcptHandler
+	DataHandler
+	ResetHandler
+
+	// Logout is called once when the connection ends, for any reason.
+	Logout(ctx context.Context)
+}
+
+// WithBackend sets a Backend whose sessions handle EHLO/HELO, MAIL, RCPT,
+// DATA/BDAT and resets. It takes precedence over WithHeloHandler,
+// WithMailHandler, WithRcptHandler, WithDataHandler and WithResetHandler.
+func WithBackend(b Backend) Option {
+	return func(s *Server) { s.backend = b }
+}
+
+// useSession installs bs as the handlers of the session.
+func (s *session) useSession(bs Session) {
+	s.heloHandler = bs
+	s.mailHandler = bs
+	s.rcptHandler = bs
+	s.dataHandler = bs
+	s.resetHandler = bs
+	if h, ok := bs.(AuthHandler); ok {
+		s.authHandler = h
+	}
+	if h, ok := bs.(VrfyHandler); ok {
+		s.vrfyHandler = h
+	}
+	if h, ok := bs.(ExpnHandler); ok {
+		s.expnHandler = h
+	}
+}
@@ -0,0 +1,154 @@
+package smtpserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// testBackend records the sessions it creates.
+type testBackend struct {
+	mu       sync.Mutex
+	sessions []*testSession
+	reject   bool
+}
+
+func (b *testBackend) NewSession(_ context.Context, _ net.Addr) (Session, error) {
+	if b.reject {
+		return nil, smtp.Errorf(smtp.ReplyServiceNotAvailable, smtp.EnhancedCode{}, "Go away")
+	}
+	sess := &testSession{}
+	b.mu.Lock()
+	b.sessions = append(b.sessions, sess)
+	b.mu.Unlock()
+	return sess, nil
+}
+
+// testSession keeps the transaction in its own fields and accepts
+// testuser/testpass.
+type testSession struct {
+	mu        sync.Mutex
+	helo      string
+	from      string
+	rcpts     []string
+	bodies    []string
+	resets    int
+	user      string
+	loggedOut bool
+}
+
+func (s *testSession) OnHelo(_ context.Context, hostname string) error {
+	s.helo = hostname
+	return nil
+}
+
+func (s *testSession) OnMail(_ context.Context, from smtp.ReversePath) error {
+	s.from = from.Mailbox.String()
+	return nil
+}
+
+func (s *testSession) OnRcpt(_ context.Context, to smtp.ForwardPath) error {
+	if to.Mailbox.LocalPart == "nobody" {
+		return smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeBadDest, "No such user")
+	}
+	s.rcpts = append(s.rcpts, to.Mailbox.String())
+	return nil
+}
+
+func (s *testSession) OnData(_ context.Context, _ smtp.ReversePath, _ []smtp.ForwardPath, r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.bodies = append(s.bodies, string(body))
+	return nil
+}
+
+func (s *testSession) OnReset(context.Context) {
+	s.from, s.rcpts = "", nil
+	s.resets++
+}
+
+func (s *testSession) Authenticate(_ context.Context, _, username, password string) error {
+	if username != "testuser" || password != "testpass" {
+		return smtp.Errorf(smtp.ReplyAuthFailed, smtp.EnhancedCodeAuthCredentials, "Bad credentials")
+	}
+	s.user = username
+	return nil
+}
+
+func (s *testSession) Logout(context.Context) {
+	s.mu.Lock()
+	s.loggedOut = true
+	s.mu.Unlock()
+}
+
+func (s *testSession) isLoggedOut() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loggedOut
+}
+
+func TestBackend(t *testing.T) {
+	backend := &testBackend{}
+	clientConn, _ := startTestServer(t, WithBackend(backend))
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	lines := c.expectCode(250)
+	if !slices.Contains(lines, "AUTH PLAIN LOGIN CRAM-MD5") {
+		t.Errorf("EHLO = %q, want AUTH advertised for a Session implementing AuthHandler", lines)
+	}
+	c.send("AUTH PLAIN AHRlc3R1c2VyAHRlc3RwYXNz")
+	c.expectCode(235)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<nobody@example.com>")
+	c.expectCode(550)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+
+	sess := backend.sessions[0]
+	if sess.helo != "client.example.com" || sess.user != "testuser" || sess.from != "sender@example.com" {
+		t.Errorf("session = %+v, want helo, user and sender recorded", sess)
+	}
+	if len(sess.rcpts) != 1 || sess.rcpts[0] != "user@example.com" {
+		t.Errorf("rcpts = %v, want [user@example.com]", sess.rcpts)
+	}
+
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Subject: Backend\r\n\r\nHello")
+	c.expectCode(250)
+	c.send("QUIT")
+	c.expectCode(221)
+	if len(sess.bodies) != 1 || sess.from != "" || sess.resets == 0 {
+		t.Errorf("after DATA: bodies = %d, from = %q, resets = %d, want one body and a reset", len(sess.bodies), sess.from, sess.resets)
+	}
+	clientConn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !sess.isLoggedOut() {
+		if time.Now().After(deadline) {
+			t.Fatal("Logout was not called")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackend_Reject(t *testing.T) {
+	clientConn, _ := startTestServer(t, WithBackend(&testBackend{reject: true}))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	if lines := c.expectCode(421); lines[0] != "Go away" {
+		t.Errorf("greeting = %q, want the backend's rejection", lines[0])
+	}
+}
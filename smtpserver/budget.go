@@ -0,0 +1,174 @@
+package smtpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// errHandlerBudget is the reply to a command whose handler ran out of the
+// transaction's handler budget.
+var errHandlerBudget = smtp.Errorf(smtp.ReplyLocalError, smtp.EnhancedCodeTempSystem, "Transaction time limit exceeded, try again later")
+
+// errHandlerAbandoned is returned to a DataHandler reading the message
+// after the server stopped waiting for it.
+var errHandlerAbandoned = errors.New("smtp: handler budget exceeded")
+
+// WithHandlerBudget bounds the total time the MailHandler, RcptHandler and
+// DataHandler may take over one transaction, so that a slow dependency
+// such as a DNSBL or virus scanner cannot hold a session indefinitely,
+// even when its own client has no timeout. Each handler's context is
+// canceled when the budget runs out. The server then stops waiting and
+// replies 451 4.3.0; a handler still running carries on in the background
+// and its result is discarded. Its reads of the message fail, except for
+// a body received whole, with WithSpool or WithJournal, which is kept
+// until the handler returns. Handlers are still never called
+// concurrently: the session makes no further handler or Session call,
+// including the OnReset that ends the transaction, until the abandoned
+// one has returned, so handlers should give up once their context is
+// canceled. Time OnData spends waiting for the client to send the message
+// does not count. Zero, the default, disables the budget.
+func WithHandlerBudget(d time.Duration) Option {
+	return func(s *Server) { s.handlerBudget = d }
+}
+
+// handlerResult is what a handler run by callHandler returned, or the
+// value it panicked with.
+type handlerResult struct {
+	err   error
+	panic any
+}
+
+// callHandler runs fn with the handler context, within what is left of
+// the transaction's handler budget, and returns its error, or
+// errHandlerBudget if the budget ran out first. Time spent in reads of
+// body, which may be nil, is not charged to the budget.
+func (s *session) callHandler(fn func(ctx context.Context) error, body *handlerBody) error {
+	s.awaitAbandoned()
+	budget := s.server.handlerBudget
+	if budget <= 0 {
+		return fn(s.context())
+	}
+	remaining := budget - s.handlerTime
+	if remaining <= 0 {
+		return errHandlerBudget
+	}
+
+	ctx, cancel := context.WithCancel(s.context())
+	defer cancel()
+	start := time.Now()
+	done := make(chan handlerResult, 1)
+	go func() {
+		var res handlerResult
+		defer func() {
+			if res.panic = recover(); res.panic != nil {
+				done <- res
+			}
+		}()
+		res.err = fn(ctx)
+		done <- res
+	}()
+
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	for {
+		select {
+		case res := <-done:
+			if res.panic != nil {
+				panic(res.panic) // For recoverPanic, on the session goroutine.
+			}
+			s.handlerTime += time.Since(start) - body.waited()
+			return res.err
+		case <-timer.C:
+			if used := time.Since(start) - body.waited(); used < remaining {
+				timer.Reset(remaining - used)
+				continue
+			}
+			s.handlerTime = budget
+			body.detach()
+			s.logger.Warn("handler budget exceeded", "message", s.msgID, "budget", budget)
+			abandoned := make(chan struct{})
+			s.abandoned = abandoned
+			go func() {
+				if res := <-done; res.panic != nil {
+					s.logger.Error("panic in abandoned handler", "err", fmt.Sprint(res.panic))
+				}
+				close(abandoned)
+			}()
+			return errHandlerBudget
+		}
+	}
+}
+
+// awaitAbandoned waits for the handler call that callHandler last gave up
+// on, if any, to return. The session calls it before any other handler or
+// Session method, so that these are never called concurrently.
+func (s *session) awaitAbandoned() {
+	if s.abandoned != nil {
+		<-s.abandoned
+		s.abandoned = nil
+	}
+}
+
+// handlerBody is the message body handed to a DataHandler under a handler
+// budget. It times the handler's reads, which wait for the client, and can
+// be detached from the connection when the server stops waiting for the
+// handler, so that the session can drain the rest itself.
+type handlerBody struct {
+	r io.Reader
+
+	mu       sync.Mutex // Held during reads; detach waits for them.
+	detached bool
+
+	timeMu    sync.Mutex
+	readStart time.Time // Start of the read in progress, or zero.
+	readTotal time.Duration
+}
+
+func (b *handlerBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.detached {
+		return 0, errHandlerAbandoned
+	}
+	b.timeMu.Lock()
+	b.readStart = time.Now()
+	b.timeMu.Unlock()
+	n, err := b.r.Read(p)
+	b.timeMu.Lock()
+	b.readTotal += time.Since(b.readStart)
+	b.readStart = time.Time{}
+	b.timeMu.Unlock()
+	return n, err
+}
+
+// waited returns the time spent in reads so far, including one in
+// progress.
+func (b *handlerBody) waited() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.timeMu.Lock()
+	defer b.timeMu.Unlock()
+	d := b.readTotal
+	if !b.readStart.IsZero() {
+		d += time.Since(b.readStart)
+	}
+	return d
+}
+
+// detach makes further reads fail, once the read in progress, if any, has
+// returned.
+func (b *handlerBody) detach() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.detached = true
+	b.mu.Unlock()
+}
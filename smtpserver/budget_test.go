@@ -0,0 +1,239 @@
+package smtpserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// stallingHandler blocks on recipients named "stall" and on messages
+// containing "stall" until its context is canceled, recording that.
+type stallingHandler struct {
+	canceled chan string
+}
+
+func (h *stallingHandler) OnRcpt(ctx context.Context, to smtp.ForwardPath) error {
+	if to.Mailbox.LocalPart == "stall" {
+		<-ctx.Done()
+		h.canceled <- "rcpt"
+	}
+	return nil
+}
+
+func (h *stallingHandler) OnData(ctx context.Context, _ smtp.ReversePath, _ []smtp.ForwardPath, r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(body), "stall") {
+		<-ctx.Done()
+		h.canceled <- "data"
+		// The server no longer waits, and the body is gone.
+		if _, err := r.Read(make([]byte, 1)); err == nil {
+			h.canceled <- "read after abandonment succeeded"
+		}
+	}
+	return nil
+}
+
+func TestHandlerBudget(t *testing.T) {
+	const budget = 100 * time.Millisecond
+	h := &stallingHandler{canceled: make(chan string, 4)}
+	clientConn, _ := startTestServer(t, WithRcptHandler(h), WithDataHandler(h), WithHandlerBudget(budget))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+
+	start := time.Now()
+	c.send("RCPT TO:<stall@example.com>")
+	if lines := c.expectCode(451); lines[0] != "4.3.0 Transaction time limit exceeded, try again later" {
+		t.Errorf("reply = %q", lines[0])
+	}
+	if d := time.Since(start); d > 2*budget {
+		t.Errorf("budget of %v enforced after %v", budget, d)
+	}
+	if got := <-h.canceled; got != "rcpt" {
+		t.Errorf("handler reported %q", got)
+	}
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(503) // The transaction was reset.
+
+	// A slow client does not use up the budget.
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	for _, line := range []string{"Subject: slow", "", "line 1", "line 2"} {
+		time.Sleep(budget / 2)
+		c.send(line)
+	}
+	c.send(".")
+	c.expectCode(250)
+
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Subject: stall\r\n\r\nstall")
+	c.expectCode(451)
+	if got := <-h.canceled; got != "data" {
+		t.Errorf("handler reported %q", got)
+	}
+	c.send("NOOP")
+	c.expectCode(250)
+	select {
+	case got := <-h.canceled:
+		t.Error(got)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// lingeringSession is a Backend and Session whose OnRcpt outlives its
+// context for recipients named "stall", and which counts the methods
+// called while that is still running.
+type lingeringSession struct {
+	busy      atomic.Bool
+	overlaps  atomic.Int32
+	loggedOut chan struct{}
+}
+
+func (s *lingeringSession) NewSession(context.Context, net.Addr) (Session, error) { return s, nil }
+
+func (s *lingeringSession) check() {
+	if s.busy.Load() {
+		s.overlaps.Add(1)
+	}
+}
+
+func (s *lingeringSession) OnHelo(context.Context, string) error { s.check(); return nil }
+
+func (s *lingeringSession) OnMail(context.Context, smtp.ReversePath) error { s.check(); return nil }
+
+func (s *lingeringSession) OnRcpt(ctx context.Context, to smtp.ForwardPath) error {
+	s.check()
+	if to.Mailbox.LocalPart == "stall" {
+		s.busy.Store(true)
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		s.busy.Store(false)
+	}
+	return nil
+}
+
+func (s *lingeringSession) OnData(context.Context, smtp.ReversePath, []smtp.ForwardPath, io.Reader) error {
+	s.check()
+	return nil
+}
+
+func (s *lingeringSession) OnReset(context.Context) { s.check() }
+
+func (s *lingeringSession) Logout(context.Context) {
+	s.check()
+	close(s.loggedOut)
+}
+
+func TestHandlerBudgetSerializesSession(t *testing.T) {
+	bs := &lingeringSession{loggedOut: make(chan struct{})}
+	clientConn, _ := startTestServer(t, WithBackend(bs), WithHandlerBudget(20*time.Millisecond))
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<stall@example.com>")
+	c.expectCode(451)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<stall@example.com>")
+	c.expectCode(451)
+	clientConn.Close()
+
+	<-bs.loggedOut
+	if n := bs.overlaps.Load(); n != 0 {
+		t.Errorf("%d Session calls while an abandoned one was running", n)
+	}
+}
+
+// lateReader reads the first byte of the message, waits for its context
+// to be canceled and a little longer, so that the session has moved on,
+// and then reads the rest, reporting how much it got.
+type lateReader struct {
+	done chan lateRead
+}
+
+type lateRead struct {
+	n   int64
+	err error
+}
+
+func (h *lateReader) OnData(ctx context.Context, _ smtp.ReversePath, _ []smtp.ForwardPath, r io.Reader) error {
+	n, err := io.ReadFull(r, make([]byte, 1))
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	time.Sleep(20 * time.Millisecond)
+	rest, err := io.Copy(io.Discard, r)
+	h.done <- lateRead{int64(n) + rest, err}
+	return nil
+}
+
+func TestHandlerBudgetBDATReadsAfterAbandonment(t *testing.T) {
+	body := strings.Repeat("x", 100<<10)
+	for _, tc := range []struct {
+		name  string
+		spool bool
+		// A streamed body is detached from the abandoned handler; a
+		// spooled one is kept until it returns.
+		want lateRead
+	}{
+		{"streamed", false, lateRead{1, errHandlerAbandoned}},
+		{"spooled", true, lateRead{int64(len(body)), nil}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &lateReader{done: make(chan lateRead, 1)}
+			opts := []Option{WithDataHandler(h), WithHandlerBudget(20 * time.Millisecond)}
+			if tc.spool {
+				opts = append(opts, WithSpool(t.TempDir(), 0))
+			}
+			clientConn, _ := startTestServer(t, opts...)
+			defer clientConn.Close()
+
+			c := newConversation(t, clientConn)
+			c.expectCode(220)
+			c.send("EHLO client.example.com")
+			c.expectCode(250)
+			c.send("MAIL FROM:<sender@example.com>")
+			c.expectCode(250)
+			c.send("RCPT TO:<user@example.com>")
+			c.expectCode(250)
+			c.sendChunk(body, true)
+			c.expectCode(451)
+			c.send("NOOP")
+			c.expectCode(250)
+
+			if got := <-h.done; got != tc.want {
+				t.Errorf("handler read %d bytes, err %v; want %d, %v", got.n, got.err, tc.want.n, tc.want.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package smtpserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes during handshakes.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves a certificate loaded from disk and reloads it when
+// the files change, so rotated certificates take effect without a restart.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	interval time.Duration
+	logger   *slog.Logger
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+}
+
+// WithCertificateFiles loads the TLS certificate and key from PEM files
+// and enables STARTTLS. The files are checked for changes at most every
+// 10 seconds during handshakes and reloaded when modified; call
+// Server.ReloadCertificates to reload immediately (for example on SIGHUP).
+// Sessions already using TLS keep their certificate. If a reload fails,
+// the previous certificate stays in use. Other TLS settings can be given
+// with WithTLSConfig, in any order; its certificates are ignored.
+func WithCertificateFiles(certPath, keyPath string) Option {
+	return func(s *Server) {
+		s.certs = &certReloader{certPath: certPath, keyPath: keyPath, interval: certCheckInterval}
+	}
+}
+
+// ReloadCertificates reloads the files set with WithCertificateFiles.
+// On error the current certificate stays in use.
+func (s *Server) ReloadCertificates() error {
+	if s.certs == nil {
+		return errors.New("smtp: reload certificates: no certificate files configured")
+	}
+	s.certs.mu.Lock()
+	defer s.certs.mu.Unlock()
+	return s.certs.loadLocked()
+}
+
+// setupCertificates wires the certificate manager or reloader into the
+// TLS config and performs the initial load.
+func (s *Server) setupCertificates() {
+	if s.certManager == nil && s.certs == nil {
+		return
+	}
+	config := &tls.Config{}
+	if s.tlsConfig != nil {
+		config = s.tlsConfig.Clone()
+		config.Certificates = nil
+	}
+	s.tlsConfig = config
+
+	if s.certManager != nil {
+		config.GetCertificate = s.certManager.GetCertificate
+		s.certs = nil
+		return
+	}
+	s.certs.logger = s.logger
+	config.GetCertificate = s.certs.getCertificate
+	if err := s.ReloadCertificates(); err != nil {
+		s.logger.Error("loading certificate", "err", err)
+	}
+}
+
+// loadLocked reads the certificate pair from disk. The caller must hold r.mu.
+func (r *certReloader) loadLocked() error {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return fmt.Errorf("smtp: loading certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return fmt.Errorf("smtp: loading certificate: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("smtp: loading certificate: %w", err)
+	}
+	r.cert = &cert
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+	r.lastCheck = time.Now()
+	return nil
+}
+
+// changedLocked reports whether either file has a different modification
+// time than the loaded pair. The caller must hold r.mu.
+func (r *certReloader) changedLocked() bool {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(r.certMod) || !keyInfo.ModTime().Equal(r.keyMod)
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cert == nil || time.Since(r.lastCheck) >= r.interval {
+		r.lastCheck = time.Now()
+		if r.cert == nil || r.changedLocked() {
+			if err := r.loadLocked(); err != nil {
+				if r.cert == nil {
+					return nil, err
+				}
+				r.logger.Error("reloading certificate, keeping previous", "err", err)
+			} else {
+				r.logger.Info("certificate loaded", "cert", r.certPath)
+			}
+		}
+	}
+	return r.cert, nil
+}
@@ -0,0 +1,113 @@
+package smtpserver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertFiles writes a fresh self-signed certificate and key as PEM
+// files and returns the DER certificate.
+func writeCertFiles(t *testing.T, certPath, keyPath string) []byte {
+	t.Helper()
+	cert := generateTestCertServer(t)
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certPath, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return cert.Certificate[0]
+}
+
+func TestCertificateFiles_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	first := writeCertFiles(t, certPath, keyPath)
+
+	srv := NewServer(WithCertificateFiles(certPath, keyPath))
+	if srv.tlsConfig == nil {
+		t.Fatal("WithCertificateFiles did not enable TLS")
+	}
+	current := func() []byte {
+		t.Helper()
+		cert, err := srv.tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Certificate[0]
+	}
+	if !bytes.Equal(current(), first) {
+		t.Fatal("initial certificate not served")
+	}
+
+	// A rotated certificate is picked up once the check interval passes.
+	second := writeCertFiles(t, certPath, keyPath)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, future, future)
+	if !bytes.Equal(current(), first) {
+		t.Error("certificate reloaded before the check interval")
+	}
+	srv.certs.interval = 0
+	if !bytes.Equal(current(), second) {
+		t.Error("rotated certificate not served")
+	}
+
+	// A broken file keeps the previous certificate.
+	os.WriteFile(certPath, []byte("garbage"), 0o600)
+	if err := srv.ReloadCertificates(); err == nil {
+		t.Error("ReloadCertificates succeeded with a corrupt certificate")
+	}
+	if !bytes.Equal(current(), second) {
+		t.Error("previous certificate not kept after failed reload")
+	}
+
+	// An explicit reload applies immediately.
+	srv.certs.interval = time.Hour
+	third := writeCertFiles(t, certPath, keyPath)
+	if err := srv.ReloadCertificates(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(current(), third) {
+		t.Error("ReloadCertificates did not apply the new certificate")
+	}
+}
+
+func TestCertificateFiles_STARTTLS(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	writeCertFiles(t, certPath, keyPath)
+
+	clientConn, _ := startTestServer(t,
+		WithTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}),
+		WithCertificateFiles(certPath, keyPath),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("STARTTLS")
+	c.expectCode(220)
+
+	tlsConn := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake: %v", err)
+	}
+	defer tlsConn.Close()
+}
@@ -0,0 +1,116 @@
+package smtpserver
+
+import (
+	"errors"
+	"io"
+	"unicode/utf8"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// ErrInvalidContent is returned by the message reader passed to
+// DataHandler.OnData when the body contains a byte rejected by
+// WithRejectNUL or WithRejectControlChars, or a header that is not valid
+// UTF-8 under WithValidateUTF8Headers. The server answers such messages
+// with 554 5.6.0 (5.6.7 for UTF-8) regardless of what the handler returns.
+var ErrInvalidContent = errors.New("smtp: message contains invalid characters")
+
+// contentChecker scans a message body for bytes rejected by the server's
+// content policy. After the first offending byte it stops passing data
+// through and every Read returns ErrInvalidContent.
+type contentChecker struct {
+	r             io.Reader
+	rejectNUL     bool
+	rejectControl bool // Reject control characters other than CR, LF and TAB.
+	invalid       bool
+
+	checkUTF8   bool    // Validate UTF-8 until the end of the header section.
+	invalidUTF8 bool    // The header section is not valid UTF-8.
+	lineLen     int     // Bytes other than CR since the last LF.
+	pending     []byte  // Incomplete UTF-8 sequence carried between reads.
+	runeBuf     [4]byte // Backing array for pending.
+}
+
+func (s *session) newContentChecker(r io.Reader) *contentChecker {
+	c := &contentChecker{
+		r:             r,
+		rejectNUL:     s.server.rejectNUL,
+		rejectControl: s.server.rejectControlChars,
+		checkUTF8:     s.server.validateUTF8 && s.smtpUTF8,
+	}
+	c.pending = c.runeBuf[:0]
+	return c
+}
+
+func (c *contentChecker) Read(p []byte) (int, error) {
+	if c.invalid {
+		return 0, ErrInvalidContent
+	}
+	n, err := c.r.Read(p)
+	if !c.rejectNUL && !c.rejectControl && !c.checkUTF8 {
+		return n, err
+	}
+	for i, b := range p[:n] {
+		if c.rejects(b) || (c.checkUTF8 && !c.headerByte(b)) {
+			c.invalid = true
+			return i, ErrInvalidContent
+		}
+	}
+	if err == io.EOF && c.checkUTF8 && len(c.pending) > 0 {
+		// The message ended inside a multi-byte sequence.
+		c.invalid, c.invalidUTF8 = true, true
+		return n, ErrInvalidContent
+	}
+	return n, err
+}
+
+func (c *contentChecker) rejects(b byte) bool {
+	if b == 0 {
+		return c.rejectNUL || c.rejectControl
+	}
+	if !c.rejectControl {
+		return false
+	}
+	switch b {
+	case '\r', '\n', '\t':
+		return false
+	}
+	return b < 0x20 || b == 0x7f
+}
+
+// headerByte feeds one byte of the header section to the UTF-8 check and
+// reports whether the header is still valid. The check ends at the empty
+// line that separates header and body.
+func (c *contentChecker) headerByte(b byte) bool {
+	if len(c.pending) > 0 || b >= utf8.RuneSelf {
+		c.pending = append(c.pending, b)
+		if !utf8.FullRune(c.pending) {
+			return true
+		}
+		r, size := utf8.DecodeRune(c.pending)
+		if r == utf8.RuneError && size <= 1 {
+			c.invalidUTF8 = true
+			return false
+		}
+		c.pending = c.pending[:0]
+	}
+	switch b {
+	case '\n':
+		if c.lineLen == 0 {
+			c.checkUTF8 = false
+		}
+		c.lineLen = 0
+	case '\r':
+	default:
+		c.lineLen++
+	}
+	return true
+}
+
+// rejection returns the reply for a message the checker found invalid.
+func (c *contentChecker) rejection() error {
+	if c.invalidUTF8 {
+		return smtp.Errorf(smtp.ReplyTransactionFailed, smtp.EnhancedCodeNonASCII, "Message header is not valid UTF-8")
+	}
+	return smtp.Errorf(smtp.ReplyTransactionFailed, smtp.EnhancedCodeInvalidContent, "Invalid message content")
+}
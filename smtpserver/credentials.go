@@ -0,0 +1,117 @@
+package smtpserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	mrand "math/rand/v2"
+	"net/netip"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// errAuthFailed is the uniform reply to failed credentials. Handlers may
+// reject an unknown user and a wrong password with different messages;
+// sending both the same way keeps clients from probing which users exist.
+var errAuthFailed = smtp.Errorf(smtp.ReplyAuthFailed, smtp.EnhancedCodeAuthCredentials, "Authentication credentials invalid")
+
+// EqualSecrets reports whether the secrets a and b are equal, in time that
+// depends on neither their contents nor their lengths. Use it in an
+// AuthHandler to compare a client's password with the stored one.
+func EqualSecrets(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// WithAuthFailureDelay delays every failed AUTH reply until at least d
+// after the client's last credentials arrived, plus a random jitter of up
+// to d/2, so that response times reveal neither whether the user exists
+// nor how far the backend got in checking the password. It also slows
+// down password guessing. Zero, the default, disables it.
+func WithAuthFailureDelay(d time.Duration) Option {
+	return func(s *Server) { s.authFailureDelay = d }
+}
+
+// delayAuthFailure waits out the failure delay since the credentials
+// arrived at start, returning early if the server shuts down.
+func (s *session) delayAuthFailure(start time.Time) {
+	d := s.server.authFailureDelay
+	if d <= 0 {
+		return
+	}
+	d += mrand.N(d/2 + 1)
+	t := time.NewTimer(time.Until(start.Add(d)))
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.server.quit:
+	}
+}
+
+// AuthFailure describes a failed AUTH attempt, for banning tools.
+type AuthFailure struct {
+	IP        netip.Addr // Client address; invalid if the connection has none.
+	Username  string     // Authentication identity the client claimed.
+	Mechanism string     // SASL mechanism.
+	Failures  int        // Failed attempts on this connection so far.
+	Err       error      // The AuthHandler's error.
+}
+
+// WithAuthFailureHandler sets a function called for every AUTH attempt
+// rejected with 535, for fail2ban-style tooling that bans addresses
+// guessing passwords. Independently of it, each such failure is logged at
+// warning level with the stable message "authentication failed" and the
+// attributes ip, username, mechanism and failures. The function is called
+// synchronously from the session goroutine, so it must return quickly.
+func WithAuthFailureHandler(fn func(ctx context.Context, f AuthFailure)) Option {
+	return func(s *Server) { s.authFailureHandler = fn }
+}
+
+// reportAuthFailure logs a rejected AUTH attempt and passes it to the
+// auth failure handler, if one is configured.
+func (s *session) reportAuthFailure(mechanism, username string, err error) {
+	addr := s.conn.NetConn().RemoteAddr()
+	ip, ok := clientIP(addr)
+	logged := ip.String()
+	if !ok {
+		logged = addr.String()
+	}
+	s.logger.Warn("authentication failed", "ip", logged, "username", username,
+		"mechanism", mechanism, "failures", s.authFailures)
+	if fn := s.server.authFailureHandler; fn != nil {
+		fn(s.context(), AuthFailure{IP: ip, Username: username, Mechanism: mechanism, Failures: s.authFailures, Err: err})
+	}
+}
+
+// WithCRAMMD5Challenge sets the function generating CRAM-MD5 challenges,
+// for deployments whose clients expect a particular format. Each
+// challenge must be unique and unpredictable, or recorded responses can
+// be replayed. The default is an RFC 2195 msg-id of 130 random bits, a
+// timestamp and the server hostname, such as
+// "<MFRGGZDFMZTWQ2LKNNWG23TPOBYXE.1760659200@mx.example.com>".
+func WithCRAMMD5Challenge(fn func() string) Option {
+	return func(s *Server) { s.cramChallengeFunc = fn }
+}
+
+// cramChallenge returns a new CRAM-MD5 challenge from a server known to
+// the client as hostname.
+func (s *Server) cramChallenge(hostname string) string {
+	if s.cramChallengeFunc != nil {
+		return s.cramChallengeFunc()
+	}
+	return fmt.Sprintf("<%s.%d@%s>", rand.Text(), time.Now().Unix(), hostname)
+}
+
+// fakeSalt returns a salt for username that is stable for the life of the
+// server but unpredictable, used where the backend supplies none. Unknown
+// users thus get the same salt on every attempt, like known ones.
+func (s *Server) fakeSalt(username string) []byte {
+	s.saltKeyOnce.Do(func() { rand.Read(s.saltKey[:]) })
+	mac := hmac.New(sha256.New, s.saltKey[:])
+	mac.Write([]byte(username))
+	return mac.Sum(nil)[:16]
+}
@@ -0,0 +1,196 @@
+package smtpserver
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+func TestEqualSecrets(t *testing.T) {
+	if !EqualSecrets("hunter2", "hunter2") {
+		t.Error("equal secrets compare unequal")
+	}
+	for _, other := range []string{"hunter3", "hunter", "hunter22", ""} {
+		if EqualSecrets("hunter2", other) {
+			t.Errorf("EqualSecrets(hunter2, %q) = true", other)
+		}
+	}
+}
+
+// leakyAuthHandler tells unknown users from wrong passwords, and fails
+// with 454 while its backend is down.
+type leakyAuthHandler struct{}
+
+func (leakyAuthHandler) Authenticate(_ context.Context, _, username, password string) error {
+	switch {
+	case username == "down":
+		return smtp.Errorf(smtp.ReplyTempAuthFailure, smtp.EnhancedCodeTempAuthFailure, "Backend unavailable")
+	case username != "testuser":
+		return smtp.Errorf(smtp.ReplyAuthFailed, smtp.EnhancedCodeAuthCredentials, "No such user")
+	case !EqualSecrets(password, "testpass"):
+		return smtp.Errorf(smtp.ReplyAuthFailed, smtp.EnhancedCodeAuthCredentials, "Wrong password")
+	}
+	return nil
+}
+
+func TestAuthFailure_Uniform(t *testing.T) {
+	const delay = 40 * time.Millisecond
+	clientConn, _ := startTestServer(t,
+		WithAuthHandler(leakyAuthHandler{}),
+		WithAuthFailureDelay(delay),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO test")
+	c.expectCode(250)
+
+	var replies []string
+	for _, creds := range []string{"\x00nobody\x00testpass", "\x00testuser\x00wrong"} {
+		start := time.Now()
+		c.send("AUTH PLAIN " + b64(creds))
+		replies = append(replies, c.expectCode(535)[0])
+		if d := time.Since(start); d < delay || d > 2*delay {
+			t.Errorf("failure reply after %v, want between %v and %v", d, delay, 2*delay)
+		}
+	}
+	if replies[0] != replies[1] || strings.Contains(replies[0], "user") || strings.Contains(replies[0], "password") {
+		t.Errorf("failure replies differ or leak the cause: %q", replies)
+	}
+
+	c.send("AUTH PLAIN " + b64("\x00down\x00testpass"))
+	if lines := c.expectCode(454); !strings.Contains(lines[0], "Backend unavailable") {
+		t.Errorf("temporary failure reply = %q, want the handler's message", lines[0])
+	}
+
+	start := time.Now()
+	c.send("AUTH PLAIN " + b64("\x00testuser\x00testpass"))
+	c.expectCode(235)
+	if d := time.Since(start); d >= delay {
+		t.Errorf("successful AUTH delayed by %v", d)
+	}
+}
+
+func TestFakeSalt(t *testing.T) {
+	srv := NewServer()
+	a, b := srv.fakeSalt("nobody"), srv.fakeSalt("nobody")
+	if len(a) != 16 || !bytes.Equal(a, b) {
+		t.Errorf("fakeSalt is not stable: %x, %x", a, b)
+	}
+	if bytes.Equal(a, srv.fakeSalt("somebody")) {
+		t.Error("fakeSalt is the same for different users")
+	}
+	if bytes.Equal(a, NewServer().fakeSalt("nobody")) {
+		t.Error("fakeSalt is the same on different servers")
+	}
+}
+
+func TestMaxAuthFailures(t *testing.T) {
+	clientConn, _ := startTestServer(t,
+		WithAuthHandler(leakyAuthHandler{}),
+		WithMaxAuthFailures(3),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO test")
+	c.expectCode(250)
+
+	// A backend outage is not the client's failure.
+	c.send("AUTH PLAIN " + b64("\x00down\x00testpass"))
+	c.expectCode(454)
+	for range 2 {
+		c.send("AUTH PLAIN " + b64("\x00testuser\x00wrong"))
+		c.expectCode(535)
+	}
+	c.send("AUTH PLAIN " + b64("\x00testuser\x00wrong"))
+	if lines := c.expectCode(421); lines[0] != "4.7.0 Too many authentication failures" {
+		t.Errorf("reply = %q", lines[0])
+	}
+	if _, err := c.reader.ReadString('\n'); err == nil {
+		t.Error("connection still open after 421")
+	}
+}
+
+func TestAuthFailureReport(t *testing.T) {
+	var logs bytes.Buffer
+	var failures []AuthFailure
+	clientConn, _ := startTestServer(t,
+		WithAuthHandler(leakyAuthHandler{}),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+		WithAuthFailureHandler(func(_ context.Context, f AuthFailure) {
+			failures = append(failures, f)
+		}),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO test")
+	c.expectCode(250)
+	c.send("AUTH PLAIN " + b64("\x00down\x00testpass"))
+	c.expectCode(454)
+	c.send("AUTH PLAIN " + b64("\x00mallory\x00guess"))
+	c.expectCode(535)
+
+	if len(failures) != 1 {
+		t.Fatalf("handler called %d times, want once for the 535", len(failures))
+	}
+	f := failures[0]
+	if f.Username != "mallory" || f.Mechanism != "PLAIN" || f.Failures != 1 || f.Err == nil {
+		t.Errorf("failure = %+v", f)
+	}
+	for _, want := range []string{`msg="authentication failed"`, "ip=pipe username=mallory mechanism=PLAIN failures=1"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log lacks %q:\n%s", want, logs.String())
+		}
+	}
+}
+
+func TestAUTH_PLAIN_Validation(t *testing.T) {
+	clientConn, _ := startTestServer(t, WithAuthHandler(&testAuthHandler{}))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO test")
+	c.expectCode(250)
+
+	for name, creds := range map[string]string{
+		"extra NUL":      "\x00testuser\x00test\x00pass",
+		"invalid UTF-8":  "\x00testuser\x00\xff\xfe",
+		"empty password": "\x00testuser\x00",
+		"empty username": "\x00\x00testpass",
+		"long password":  "\x00testuser\x00" + strings.Repeat("p", 256),
+	} {
+		c.send("AUTH PLAIN " + b64(creds))
+		if lines := c.expectCode(501); !strings.HasPrefix(lines[0], "5.5.2 ") {
+			t.Errorf("%s: reply %q, want 5.5.2", name, lines[0])
+		}
+	}
+
+	// Oversized responses are refused before decoding, and a line beyond
+	// the RFC 4954 limit is drained without ending the session.
+	c.send("AUTH PLAIN")
+	c.expectCode(334)
+	c.send(b64(strings.Repeat("x", maxPlainLen+1)))
+	if lines := c.expectCode(500); !strings.HasPrefix(lines[0], "5.5.6 ") {
+		t.Errorf("oversized PLAIN data: reply %q, want 5.5.6", lines[0])
+	}
+	c.send("AUTH PLAIN")
+	c.expectCode(334)
+	c.send(strings.Repeat("A", maxAuthLineLen+10))
+	c.expectCode(500)
+	c.send("NOOP")
+	c.expectCode(250)
+
+	c.send("AUTH PLAIN " + b64("\x00testuser\x00testpass"))
+	c.expectCode(235)
+}
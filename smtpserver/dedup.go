@@ -0,0 +1,142 @@
+package smtpserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+	"github.com/alexisbouchez/smtp.go/internal/ttlcache"
+)
+
+// DedupKey selects how Dedup identifies a message.
+type DedupKey int
+
+const (
+	// DedupMessageID keys on the Message-ID header, falling back to a
+	// content hash for messages without one.
+	DedupMessageID DedupKey = iota
+	// DedupContentHash keys on a SHA-256 hash of the message body.
+	DedupContentHash
+)
+
+// DedupStore records which (message, recipient) keys have been delivered.
+// Implementations must be safe for concurrent use. A shared store lets
+// several servers suppress each other's duplicates.
+type DedupStore interface {
+	// Contains reports whether key was added and has not expired.
+	Contains(ctx context.Context, key string) (bool, error)
+	// Add records key for ttl.
+	Add(ctx context.Context, key string, ttl time.Duration) error
+}
+
+// Dedup is a DataHandler that suppresses duplicate deliveries, such as
+// the retry storms of an upstream that never sees our 250 reply. A
+// message is a duplicate for a recipient when the same message (per Key)
+// was already accepted for that recipient within TTL. Duplicate
+// recipients are dropped before calling Next; if every recipient is a
+// duplicate, the message is discarded with a 250 reply, or rejected with
+// 554 5.6.0 when Reject is set.
+//
+// Messages are only recorded once Next accepts them, so a message Next
+// rejects temporarily is delivered normally when the client retries.
+// The whole body is buffered in memory to find the key.
+//
+// The zero value is ready to use. Next must be set.
+type Dedup struct {
+	Key    DedupKey
+	TTL    time.Duration // Zero means 24 hours.
+	Reject bool          // Reject duplicates with 554 instead of discarding them.
+	Store  DedupStore    // Nil means an in-memory store.
+	Next   DataHandler
+
+	mem memoryDedupStore
+}
+
+var errDuplicateMessage = smtp.Errorf(smtp.ReplyTransactionFailed, smtp.EnhancedCodeInvalidContent, "Duplicate message")
+
+// OnData implements DataHandler.
+func (d *Dedup) OnData(ctx context.Context, from smtp.ReversePath, to []smtp.ForwardPath, r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	store := d.store()
+	id := d.messageKey(body)
+
+	fresh := make([]smtp.ForwardPath, 0, len(to))
+	for _, rcpt := range to {
+		seen, err := store.Contains(ctx, dedupKey(id, rcpt))
+		if err != nil {
+			return err
+		}
+		if !seen {
+			fresh = append(fresh, rcpt)
+		}
+	}
+	if len(fresh) == 0 {
+		if d.Reject {
+			return errDuplicateMessage
+		}
+		return nil
+	}
+
+	if err := d.Next.OnData(ctx, from, fresh, bytes.NewReader(body)); err != nil {
+		return err
+	}
+
+	ttl := d.TTL
+	if ttl == 0 {
+		ttl = 24 * time.Hour
+	}
+	for _, rcpt := range fresh {
+		if err := store.Add(ctx, dedupKey(id, rcpt), ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Dedup) store() DedupStore {
+	if d.Store != nil {
+		return d.Store
+	}
+	return &d.mem
+}
+
+// messageKey returns the identifier of the message in body.
+func (d *Dedup) messageKey(body []byte) string {
+	if d.Key == DedupMessageID {
+		if msg, err := mail.ReadMessage(bytes.NewReader(body)); err == nil {
+			if id := strings.TrimSpace(msg.Header.Get("Message-Id")); id != "" {
+				return "id:" + id
+			}
+		}
+	}
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func dedupKey(id string, rcpt smtp.ForwardPath) string {
+	return id + "\x00" + strings.ToLower(rcpt.Mailbox.String())
+}
+
+// memoryDedupStore is the default DedupStore.
+type memoryDedupStore struct {
+	entries ttlcache.Cache[struct{}]
+}
+
+func (m *memoryDedupStore) Contains(_ context.Context, key string) (bool, error) {
+	_, ok := m.entries.Get(key, time.Now())
+	return ok, nil
+}
+
+func (m *memoryDedupStore) Add(_ context.Context, key string, ttl time.Duration) error {
+	m.entries.Set(key, struct{}{}, time.Now(), ttl)
+	return nil
+}
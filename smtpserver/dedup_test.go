@@ -0,0 +1,102 @@
+package smtpserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+func rcpts(addrs ...string) []smtp.ForwardPath {
+	var to []smtp.ForwardPath
+	for _, a := range addrs {
+		local, domain, _ := strings.Cut(a, "@")
+		to = append(to, smtp.ForwardPath{Mailbox: smtp.Mailbox{LocalPart: local, Domain: domain}})
+	}
+	return to
+}
+
+func TestDedup(t *testing.T) {
+	next := &testDataHandler{}
+	d := &Dedup{Next: next}
+	ctx := context.Background()
+	from := smtp.ReversePath{Mailbox: smtp.Mailbox{LocalPart: "a", Domain: "example.com"}}
+	msg := "Message-ID: <1@example.com>\r\nSubject: hi\r\n\r\nbody\r\n"
+
+	if err := d.OnData(ctx, from, rcpts("x@example.com", "y@example.com"), strings.NewReader(msg)); err != nil {
+		t.Fatalf("first delivery: %v", err)
+	}
+	// Retry with one new recipient: only that one is delivered.
+	if err := d.OnData(ctx, from, rcpts("X@example.com", "z@example.com"), strings.NewReader(msg)); err != nil {
+		t.Fatalf("second delivery: %v", err)
+	}
+	if len(next.messages) != 2 {
+		t.Fatalf("deliveries = %d, want 2", len(next.messages))
+	}
+	if to := next.messages[1].To; len(to) != 1 || to[0].Mailbox.LocalPart != "z" {
+		t.Errorf("second delivery recipients = %v, want [z@example.com]", to)
+	}
+
+	// Full duplicate: discarded silently.
+	if err := d.OnData(ctx, from, rcpts("y@example.com"), strings.NewReader(msg)); err != nil {
+		t.Fatalf("duplicate: %v", err)
+	}
+	if len(next.messages) != 2 {
+		t.Errorf("duplicate was delivered")
+	}
+
+	// Same content with a different Message-ID is a new message.
+	other := strings.Replace(msg, "<1@", "<2@", 1)
+	if err := d.OnData(ctx, from, rcpts("y@example.com"), strings.NewReader(other)); err != nil {
+		t.Fatalf("new message: %v", err)
+	}
+	if len(next.messages) != 3 {
+		t.Errorf("new Message-ID was not delivered")
+	}
+}
+
+func TestDedupReject(t *testing.T) {
+	d := &Dedup{Key: DedupContentHash, Reject: true, Next: &testDataHandler{}}
+	ctx := context.Background()
+	to := rcpts("x@example.com")
+
+	if err := d.OnData(ctx, smtp.ReversePath{Null: true}, to, strings.NewReader("no headers\r\n")); err != nil {
+		t.Fatalf("first delivery: %v", err)
+	}
+	err := d.OnData(ctx, smtp.ReversePath{Null: true}, to, strings.NewReader("no headers\r\n"))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != smtp.ReplyTransactionFailed {
+		t.Errorf("duplicate error = %v, want 554", err)
+	}
+}
+
+type failingDataHandler struct{ calls int }
+
+func (h *failingDataHandler) OnData(_ context.Context, _ smtp.ReversePath, _ []smtp.ForwardPath, r io.Reader) error {
+	h.calls++
+	if h.calls == 1 {
+		return smtp.Errorf(smtp.ReplyLocalError, smtp.EnhancedCodeOtherNetwork, "Try again")
+	}
+	return nil
+}
+
+func TestDedupRecordsOnlyAccepted(t *testing.T) {
+	next := &failingDataHandler{}
+	d := &Dedup{Next: next}
+	ctx := context.Background()
+	to := rcpts("x@example.com")
+	msg := "Message-ID: <retry@example.com>\r\n\r\nbody\r\n"
+
+	if err := d.OnData(ctx, smtp.ReversePath{Null: true}, to, strings.NewReader(msg)); err == nil {
+		t.Fatal("expected first delivery to fail")
+	}
+	if err := d.OnData(ctx, smtp.ReversePath{Null: true}, to, strings.NewReader(msg)); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if next.calls != 2 {
+		t.Errorf("Next called %d times, want 2", next.calls)
+	}
+}
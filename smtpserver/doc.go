@@ -24,11 +24,17 @@
 //   - [DataHandler] — message body delivery
 //   - [ResetHandler] — RSET or implicit transaction reset
 //   - [VrfyHandler] — VRFY commands
+//   - [ExpnHandler] — EXPN commands (mailing list expansion)
 //   - [AuthHandler] — SASL authentication
 //
 // All handlers are optional. Return an [smtp.SMTPError] from any handler
 // to send a custom reply code and message to the client.
 //
+// The context passed to handlers belongs to the session: it is canceled
+// when the connection ends or the server is shut down or closed, so a
+// handler can pass it to DNS lookups, database queries and outgoing
+// requests. It also carries the session's values; see [SessionID].
+//
 // # Extensions
 //
 // The server automatically advertises: PIPELINING, 8BITMIME,
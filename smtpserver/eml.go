@@ -0,0 +1,83 @@
+package smtpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// SidecarPath returns the envelope sidecar path for the message file
+// path: the same name with a .json extension instead of .eml.
+func SidecarPath(path string) string {
+	return strings.TrimSuffix(path, ".eml") + ".json"
+}
+
+// WriteEML writes body to path, conventionally ending in .eml, and env
+// to SidecarPath(path) in the JSON schema of smtp.Envelope. This is the
+// on-disk format of FileStore and suits spools and test fixtures. Each
+// file is written to a temporary name and renamed, and the sidecar is
+// written last, so a reader that looks for sidecars never sees a partial
+// message.
+func WriteEML(path string, env *smtp.Envelope, body io.Reader) error {
+	meta, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return fmt.Errorf("smtp: eml: %w", err)
+	}
+
+	if err := writeFileAtomic(path, body); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(SidecarPath(path), strings.NewReader(string(meta)+"\n")); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// ReadEML loads a message written by WriteEML. The caller must close the
+// body. Errors for missing files match fs.ErrNotExist.
+func ReadEML(path string) (*smtp.Envelope, io.ReadCloser, error) {
+	meta, err := os.ReadFile(SidecarPath(path))
+	if err != nil {
+		return nil, nil, fmt.Errorf("smtp: eml: %w", err)
+	}
+	env := new(smtp.Envelope)
+	if err := json.Unmarshal(meta, env); err != nil {
+		return nil, nil, fmt.Errorf("smtp: eml: %s: %w", SidecarPath(path), err)
+	}
+
+	body, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("smtp: eml: %w", err)
+	}
+	return env, body, nil
+}
+
+// writeFileAtomic writes r to a temporary file next to path, syncs it and
+// renames it to path.
+func writeFileAtomic(path string, r io.Reader) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("smtp: eml: %w", err)
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("smtp: eml: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package smtpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime/debug"
+
+	"github.com/alexisbouchez/smtp.go"
+	"github.com/alexisbouchez/smtp.go/internal/textproto"
+)
+
+// Operations reported in SessionError.Op.
+const (
+	OpRead  = "read"  // Reading a command or message data failed.
+	OpWrite = "write" // Sending a reply failed.
+	OpTLS   = "tls"   // The STARTTLS handshake failed.
+	OpPanic = "panic" // A handler panicked; the connection was closed.
+	OpInput = "input" // The client sent a malformed or unknown command.
+)
+
+// SessionError is passed to the function set with WithErrorHandler.
+type SessionError struct {
+	Op  string // One of the Op constants.
+	Err error
+}
+
+func (e *SessionError) Error() string { return "smtp: " + e.Op + ": " + e.Err.Error() }
+
+// Unwrap returns the underlying error.
+func (e *SessionError) Unwrap() error { return e.Err }
+
+// WithErrorHandler sets a function called for failures that are not
+// handler replies: read and write errors, TLS handshake failures, handler
+// panics and malformed input. err is a *SessionError and info describes
+// the session at the time. A client closing the connection is not
+// reported. The function is called synchronously from the session
+// goroutine, so it must return quickly; it suits counting and alerting.
+func WithErrorHandler(fn func(ctx context.Context, err error, info SessionSummary)) Option {
+	return func(s *Server) { s.errorHandler = fn }
+}
+
+// reportError passes err to the error handler, if one is configured.
+// Write errors are reported once per session: after the first, every
+// further reply would fail the same way.
+func (s *session) reportError(op string, err error) {
+	if s.server.errorHandler == nil {
+		return
+	}
+	if op == OpWrite {
+		if s.writeFailed {
+			return
+		}
+		s.writeFailed = true
+	}
+	s.server.errorHandler(s.context(), &SessionError{Op: op, Err: err}, *s.summary.Load())
+}
+
+// reportReadError reports err unless it is the client closing the
+// connection. Over-long lines are reported as malformed input.
+func (s *session) reportReadError(err error) {
+	switch {
+	case errors.Is(err, io.EOF):
+	case errors.Is(err, textproto.ErrLineTooLong):
+		s.reportError(OpInput, err)
+	default:
+		s.reportError(OpRead, err)
+	}
+}
+
+// recoverPanic recovers a panicking handler, logs it with its stack,
+// reports it and tries to tell the client before the connection closes.
+// It must be deferred directly.
+func (s *session) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	err, ok := r.(error)
+	if !ok {
+		err = fmt.Errorf("%v", r)
+	}
+	s.logger.Error("panic in session", "err", err, "stack", string(debug.Stack()))
+	s.reportError(OpPanic, err)
+	s.reply(smtp.ReplyServiceNotAvailable, smtp.EnhancedCodeTempSystem, "Internal server error, closing connection")
+}
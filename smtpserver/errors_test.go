@@ -0,0 +1,102 @@
+package smtpserver
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// errorRecorder collects the errors passed to an error handler.
+type errorRecorder struct {
+	mu   sync.Mutex
+	errs []*SessionError
+	info []SessionSummary
+}
+
+func (r *errorRecorder) handle(_ context.Context, err error, info SessionSummary) {
+	var serr *SessionError
+	if !errors.As(err, &serr) {
+		panic("error is not a *SessionError")
+	}
+	r.mu.Lock()
+	r.errs = append(r.errs, serr)
+	r.info = append(r.info, info)
+	r.mu.Unlock()
+}
+
+// wait returns the recorded errors once there are n of them.
+func (r *errorRecorder) wait(t *testing.T, n int) []*SessionError {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r.mu.Lock()
+		errs := slices.Clone(r.errs)
+		r.mu.Unlock()
+		if len(errs) >= n {
+			return errs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d errors, want %d: %v", len(errs), n, errs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// panicMailHandler panics on every MAIL FROM.
+type panicMailHandler struct{}
+
+func (panicMailHandler) OnMail(context.Context, smtp.ReversePath) error {
+	panic("boom")
+}
+
+func TestErrorHandler(t *testing.T) {
+	rec := &errorRecorder{}
+	clientConn, _ := startTestServer(t,
+		WithErrorHandler(rec.handle),
+		WithMailHandler(panicMailHandler{}),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("FROB")
+	c.expectCode(500)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(421)
+
+	errs := rec.wait(t, 2)
+	if errs[0].Op != OpInput || !strings.Contains(errs[0].Error(), `"FROB"`) {
+		t.Errorf("first error = %v, want unrecognized command input error", errs[0])
+	}
+	if errs[1].Op != OpPanic || errs[1].Err.Error() != "boom" {
+		t.Errorf("second error = %v, want the handler panic", errs[1])
+	}
+	rec.mu.Lock()
+	if rec.info[1].Hostname != "client.example.com" || rec.info[1].ID == "" {
+		t.Errorf("info = %+v, want the session summary", rec.info[1])
+	}
+	rec.mu.Unlock()
+}
+
+func TestErrorHandler_LineTooLong(t *testing.T) {
+	rec := &errorRecorder{}
+	clientConn, _ := startTestServer(t, WithErrorHandler(rec.handle))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("NOOP " + strings.Repeat("x", 600))
+
+	errs := rec.wait(t, 1)
+	if errs[0].Op != OpInput {
+		t.Errorf("error = %v, want input error", errs[0])
+	}
+}
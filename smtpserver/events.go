@@ -0,0 +1,109 @@
+package smtpserver
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// EventType identifies the kind of session Event.
+type EventType int
+
+// Session event types.
+const (
+	EventConnect         EventType = iota + 1 // Connection accepted.
+	EventHelo                                 // EHLO or HELO accepted.
+	EventAuthSuccess                          // AUTH succeeded.
+	EventAuthFailure                          // AUTH rejected by the AuthHandler.
+	EventMessageAccepted                      // Message accepted with 250.
+	EventMessageRejected                      // Message refused after DATA/BDAT.
+	EventDisconnect                           // Session ended.
+	EventSlowCommand                          // Command exceeded the slow-command threshold.
+	EventTransferStalled                      // DATA/BDAT transfer aborted by the stall timeout.
+	EventConnectionLimit                      // Connection refused by WithMaxConnections.
+)
+
+// String returns the event type name, e.g. "message_accepted".
+func (t EventType) String() string {
+	switch t {
+	case EventConnect:
+		return "connect"
+	case EventHelo:
+		return "helo"
+	case EventAuthSuccess:
+		return "auth_success"
+	case EventAuthFailure:
+		return "auth_failure"
+	case EventMessageAccepted:
+		return "message_accepted"
+	case EventMessageRejected:
+		return "message_rejected"
+	case EventDisconnect:
+		return "disconnect"
+	case EventSlowCommand:
+		return "slow_command"
+	case EventTransferStalled:
+		return "transfer_stalled"
+	case EventConnectionLimit:
+		return "connection_limit"
+	}
+	return "unknown"
+}
+
+// Event describes something that happened in a session. Fields that do
+// not apply to the event type are left at their zero value.
+// EventConnectionLimit precedes any session, so it has no SessionID.
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	SessionID  string // See SessionID.
+	RemoteAddr net.Addr
+	Hostname   string // Client EHLO/HELO identity, once known.
+
+	Mechanism string // SASL mechanism (auth events).
+	Username  string // Authentication identity (auth events).
+
+	MessageID string             // Transaction ID (message events); see MessageID.
+	From      smtp.ReversePath   // Envelope sender (message events).
+	To        []smtp.ForwardPath // Envelope recipients (message events).
+	Size      int64              // Message size in bytes (message events).
+
+	Command  string        // Command verb (slow-command events).
+	Duration time.Duration // Handling time (slow-command events) or stall timeout.
+	Handler  string        // Handler type that served the command (slow-command events).
+
+	Err error // Rejection or failure reason, if any.
+}
+
+// EventHandler receives session events. OnEvent is called synchronously
+// from the session goroutine, or for EventConnectionLimit from the accept
+// loop, so implementations must return quickly; forward events to a
+// buffered channel or queue for slow consumers.
+type EventHandler interface {
+	OnEvent(ctx context.Context, ev Event)
+}
+
+// emit fills in the session fields of ev and delivers it to the event
+// handler, if one is configured.
+func (s *session) emit(ev Event) {
+	if s.server.eventHandler == nil {
+		return
+	}
+	ev.Time = time.Now()
+	ev.SessionID = s.id
+	ev.RemoteAddr = s.conn.NetConn().RemoteAddr()
+	ev.Hostname = s.clientHostname
+	s.server.eventHandler.OnEvent(s.context(), ev)
+}
+
+// emit delivers a server event that belongs to no session to the event
+// handler, if one is configured.
+func (s *Server) emit(ev Event) {
+	if s.eventHandler == nil {
+		return
+	}
+	ev.Time = time.Now()
+	s.eventHandler.OnEvent(context.Background(), ev)
+}
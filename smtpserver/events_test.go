@@ -0,0 +1,172 @@
+package smtpserver
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+type testEventHandler struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (h *testEventHandler) OnEvent(_ context.Context, ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, ev)
+}
+
+func (h *testEventHandler) types() []EventType {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var types []EventType
+	for _, ev := range h.events {
+		types = append(types, ev.Type)
+	}
+	return types
+}
+
+func (h *testEventHandler) find(typ EventType) (Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ev := range h.events {
+		if ev.Type == typ {
+			return ev, true
+		}
+	}
+	return Event{}, false
+}
+
+func TestEvents(t *testing.T) {
+	events := &testEventHandler{}
+	clientConn, _ := startTestServer(t,
+		WithEventHandler(events),
+		WithAuthHandler(&testAuthHandler{}),
+		WithDataHandler(&testDataHandler{}),
+		WithMaxRecipients(1),
+	)
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("AUTH PLAIN AGJhZHVzZXIAYmFkcGFzcw==") // \x00baduser\x00badpass
+	c.expectCode(535)
+	c.send("AUTH PLAIN AHRlc3R1c2VyAHRlc3RwYXNz") // \x00testuser\x00testpass
+	c.expectCode(235)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Hello")
+	c.expectCode(250)
+	c.send("QUIT")
+	c.expectCode(221)
+	clientConn.Close()
+
+	want := []EventType{
+		EventConnect, EventHelo, EventAuthFailure, EventAuthSuccess,
+		EventMessageAccepted, EventDisconnect,
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !slices.Equal(events.types(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("events = %v, want %v", events.types(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	failure, _ := events.find(EventAuthFailure)
+	if failure.Mechanism != "PLAIN" || failure.Username != "baduser" || failure.Err == nil {
+		t.Errorf("auth failure event = %+v", failure)
+	}
+	msg, _ := events.find(EventMessageAccepted)
+	if msg.Hostname != "client.example.com" {
+		t.Errorf("Hostname = %q, want %q", msg.Hostname, "client.example.com")
+	}
+	if msg.From.Mailbox.String() != "sender@example.com" || len(msg.To) != 1 {
+		t.Errorf("envelope = %v -> %v", msg.From, msg.To)
+	}
+	if msg.Size != int64(len("Hello\r\n")) {
+		t.Errorf("Size = %d, want %d", msg.Size, len("Hello\r\n"))
+	}
+}
+
+func TestEvents_MessageRejected(t *testing.T) {
+	events := &testEventHandler{}
+	clientConn, _ := startTestServer(t,
+		WithEventHandler(events),
+		WithRejectNUL(true),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Hello\x00")
+	c.expectCode(554)
+
+	ev, ok := events.find(EventMessageRejected)
+	if !ok {
+		t.Fatal("no message_rejected event")
+	}
+	if ev.Err == nil {
+		t.Error("rejected event has nil Err")
+	}
+}
+
+type slowMailHandler struct{ delay time.Duration }
+
+func (h slowMailHandler) OnMail(context.Context, smtp.ReversePath) error {
+	time.Sleep(h.delay)
+	return nil
+}
+
+func TestSlowCommandEvent(t *testing.T) {
+	events := &testEventHandler{}
+	clientConn, _ := startTestServer(t,
+		WithEventHandler(events),
+		WithMailHandler(slowMailHandler{delay: 50 * time.Millisecond}),
+		WithSlowCommandThreshold(20*time.Millisecond),
+	)
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("NOOP") // The event is emitted after the MAIL reply.
+	c.expectCode(250)
+
+	ev, ok := events.find(EventSlowCommand)
+	if !ok {
+		t.Fatalf("no slow_command event in %v", events.types())
+	}
+	if ev.Command != "MAIL" || ev.Duration < 50*time.Millisecond || ev.Handler != "smtpserver.slowMailHandler" {
+		t.Errorf("event = command %q, duration %v, handler %q", ev.Command, ev.Duration, ev.Handler)
+	}
+	n := 0
+	for _, typ := range events.types() {
+		if typ == EventSlowCommand {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("got %d slow_command events, want 1 (MAIL only)", n)
+	}
+}
@@ -0,0 +1,96 @@
+package smtpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// ExtensionFunc handles a command of an extension added with
+// RegisterExtension. args is the rest of the command line after the verb.
+// On success the client gets 250 with the returned text; return an
+// *smtp.SMTPError to choose the reply, as with the other handlers.
+type ExtensionFunc func(ctx context.Context, args string) (string, error)
+
+// extension is a registered extension.
+type extension struct {
+	keyword string // Upper-cased EHLO keyword and command verb.
+	param   string // EHLO parameters, or "".
+	fn      ExtensionFunc
+}
+
+// builtinKeywords are the verbs and EHLO keywords the server implements
+// itself, which cannot be registered.
+var builtinKeywords = []string{
+	"EHLO", "HELO", "MAIL", "RCPT", "DATA", "RSET", "NOOP", "QUIT", "VRFY", "EXPN",
+	"STARTTLS", "AUTH", "BDAT", "SIZE", "PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES",
+	"DSN", "SMTPUTF8", "CHUNKING",
+}
+
+// RegisterExtension adds a site-specific extension, such as an X-command,
+// without changes to the session loop. EHLO advertises keyword, followed
+// by param if it is not empty, and commands whose verb is keyword are
+// passed to fn. A nil fn only advertises the keyword, for an extension
+// that changes how existing commands behave, which handlers then check
+// with Negotiated and CommandLine. A PolicyHandler can withhold the
+// extension from a connection with ConnectionPolicy.DisabledExtensions.
+//
+// keyword must be a valid EHLO keyword (RFC 5321 §4.1.1.1) and not one the
+// server implements. Registering a keyword again replaces it. Extensions
+// may be registered while the server runs; sessions see them from their
+// next command.
+func (s *Server) RegisterExtension(keyword, param string, fn ExtensionFunc) error {
+	if !validParamKeyword(keyword) {
+		return fmt.Errorf("smtp: invalid extension keyword %q", keyword)
+	}
+	keyword = strings.ToUpper(keyword)
+	if slices.Contains(builtinKeywords, keyword) {
+		return fmt.Errorf("smtp: extension %s is built in", keyword)
+	}
+	if strings.ContainsAny(param, "\r\n") {
+		return errors.New("smtp: extension parameters must be on one line")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.extensions = slices.DeleteFunc(slices.Clone(s.extensions), func(e extension) bool {
+		return e.keyword == keyword
+	})
+	s.extensions = append(s.extensions, extension{keyword, param, fn})
+	return nil
+}
+
+// registeredExtensions returns the extensions added with
+// RegisterExtension, in order.
+func (s *Server) registeredExtensions() []extension {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.extensions
+}
+
+// handleExtension runs the registered extension command verb and reports
+// whether there was one.
+func (s *session) handleExtension(verb, args string) bool {
+	exts := s.server.registeredExtensions()
+	i := slices.IndexFunc(exts, func(e extension) bool {
+		return e.keyword == verb && e.fn != nil
+	})
+	if i < 0 || s.disabled(smtp.Extension(verb)) {
+		return false
+	}
+	result, err := exts[i].fn(s.context(), args)
+	if err != nil {
+		if smtpErr, ok := err.(*smtp.SMTPError); ok {
+			s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+		} else {
+			s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeTempSystem, "Internal error")
+		}
+		return true
+	}
+	s.reply(smtp.ReplyOK, smtp.EnhancedCodeOK, result)
+	return true
+}
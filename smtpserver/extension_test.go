@@ -0,0 +1,66 @@
+package smtpserver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+func TestRegisterExtension(t *testing.T) {
+	clientConn, srv := startTestServer(t)
+	defer clientConn.Close()
+
+	xstatus := func(ctx context.Context, args string) (string, error) {
+		if args == "" {
+			return "", smtp.Errorf(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "Syntax: XSTATUS <queue>")
+		}
+		return "Queue " + args + " idle, session " + SessionID(ctx), nil
+	}
+	if err := srv.RegisterExtension("XSTATUS", "QUEUE", xstatus); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.RegisterExtension("x-marker", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, keyword := range []string{"MAIL", "chunking", "", "-X", "X_Y"} {
+		if err := srv.RegisterExtension(keyword, "", xstatus); err == nil {
+			t.Errorf("RegisterExtension(%q) succeeded", keyword)
+		}
+	}
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	ehlo := c.expectCode(250)
+	if got := strings.Join(ehlo[len(ehlo)-2:], ","); got != "XSTATUS QUEUE,X-MARKER" {
+		t.Errorf("EHLO ends with %q", got)
+	}
+
+	c.send("xstatus outbound")
+	if lines := c.expectCode(250); !strings.HasPrefix(lines[0], "2.0.0 Queue outbound idle, session ") || strings.HasSuffix(lines[0], " ") {
+		t.Errorf("reply = %q", lines[0])
+	}
+	c.send("XSTATUS")
+	c.expectCode(501)
+	c.send("X-MARKER")
+	c.expectCode(500) // Advertised only.
+}
+
+func TestRegisterExtensionDisabledByPolicy(t *testing.T) {
+	clientConn, srv := startTestServer(t, WithPolicyHandler(staticPolicy{
+		DisabledExtensions: []smtp.Extension{"XSTATUS"},
+	}))
+	defer clientConn.Close()
+	srv.RegisterExtension("XSTATUS", "", func(context.Context, string) (string, error) { return "Ok", nil })
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	if ehlo := strings.Join(c.expectCode(250), "\n"); strings.Contains(ehlo, "XSTATUS") {
+		t.Errorf("disabled extension advertised:\n%s", ehlo)
+	}
+	c.send("XSTATUS")
+	c.expectCode(500)
+}
@@ -3,6 +3,7 @@ package smtpserver
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 
@@ -10,12 +11,26 @@ import (
 )
 
 // ConnectionHandler is called when a new client connects. Return a non-nil
-// error to reject the connection (e.g., for IP-based filtering).
+// error to reject the connection (e.g., for IP-based filtering), or
+// ErrRejectSession to greet it with 554 and hold it open.
 type ConnectionHandler interface {
 	OnConnect(ctx context.Context, conn net.Addr) error
 }
 
-// HeloHandler is called when the client sends EHLO or HELO.
+// CommandHandler is called for every command line before the server acts
+// on it, with line exactly as the client sent it minus the trailing CRLF:
+// original casing, spacing and parameters, including invalid commands and
+// lines containing NUL. Return a non-nil error to refuse the command; an
+// *smtp.SMTPError is sent as the reply, any other error as 451. It is not
+// called for message data or AUTH continuation lines, but note that line
+// contains the credentials of an AUTH command with an initial response.
+type CommandHandler interface {
+	OnCommand(ctx context.Context, line string) error
+}
+
+// HeloHandler is called when the client sends EHLO or HELO. Use
+// RemoteAddr(ctx) to check the hostname against the connecting address and
+// Helo(ctx) to tell EHLO from HELO.
 type HeloHandler interface {
 	OnHelo(ctx context.Context, hostname string) error
 }
@@ -30,14 +45,42 @@ type RcptHandler interface {
 	OnRcpt(ctx context.Context, to smtp.ForwardPath) error
 }
 
+// RcptParamsHandler is an optional extension of RcptHandler for relays
+// that honor DSN requests downstream. When the RcptHandler implements it,
+// OnRcptParams is called instead of OnRcpt, with the RCPT TO parameters.
+type RcptParamsHandler interface {
+	OnRcptParams(ctx context.Context, to smtp.ForwardPath, params RcptParams) error
+}
+
+// ErrRecipientDeferred, returned by RcptHandler.OnRcpt on its own or
+// wrapped, defers the recipient: the server replies 452 4.2.1 to that RCPT
+// only, so the transaction goes on with the recipients already accepted
+// and the client retries this one later (RFC 5321 §4.5.3.1.10). Use it for
+// per-recipient rate limits and quotas. To choose the reply text, return an
+// *smtp.SMTPError with a 4xx code instead.
+var ErrRecipientDeferred = errors.New("smtp: recipient deferred")
+
+// SetReply sets the reply to the command that a MailHandler, RcptHandler
+// or DataHandler accepts, in place of the server's own 250, so that a
+// relay can pass on the reply of the server it relays to. code must be
+// 2xx; text may span several lines separated by "\n". A zero enhanced
+// code keeps the server's. SetReply has no effect if the handler returns
+// an error, and in other handlers.
+func SetReply(ctx context.Context, code smtp.ReplyCode, enhanced smtp.EnhancedCode, text string) {
+	if r, ok := ctx.Value(replyKey).(*smtp.SMTPError); ok && code.Class() == 2 {
+		*r = smtp.SMTPError{Code: code, EnhancedCode: enhanced, Message: text}
+	}
+}
+
 // DataHandler is called when the DATA body has been fully received.
 // The reader provides the de-stuffed message body.
 type DataHandler interface {
 	OnData(ctx context.Context, from smtp.ReversePath, to []smtp.ForwardPath, r io.Reader) error
 }
 
-// ResetHandler is called when the transaction state is reset (RSET command
-// or implicit reset via EHLO/HELO re-issue).
+// ResetHandler is called when the transaction state is reset (RSET command,
+// implicit reset via EHLO/HELO re-issue, or a session that ends with a
+// transaction still open, including one between BDAT chunks).
 type ResetHandler interface {
 	OnReset(ctx context.Context)
 }
@@ -48,10 +91,63 @@ type VrfyHandler interface {
 	OnVrfy(ctx context.Context, param string) (string, error)
 }
 
+// ExpnHandler is called for EXPN commands (RFC 5321 §3.5.2), for servers
+// that expand mailing lists. OnExpn returns the members of list, which the
+// server sends one per line of a 250 reply; an empty list is answered with
+// 550 5.1.1. If not set, the server responds with 502 "EXPN not
+// implemented".
+type ExpnHandler interface {
+	OnExpn(ctx context.Context, list string) ([]smtp.Mailbox, error)
+}
+
 // AuthHandler authenticates a client. The mechanism is the SASL mechanism
-// name (e.g., "PLAIN"), identity is the authorization identity, and
-// credentials holds the authentication data (password for PLAIN/LOGIN,
-// challenge-response for CRAM-MD5).
+// name (e.g., "PLAIN"), username is the authentication identity, and
+// password is the password sent by the client for PLAIN and LOGIN.
+//
+// For CRAM-MD5 the client proves knowledge of the password without sending
+// it, so Authenticate can only check it by recomputing the digest. Unless
+// the AuthHandler implements ChallengeHandler or SecretHandler, password
+// then holds "challenge:digest" for the handler to verify; this form is
+// deprecated.
 type AuthHandler interface {
 	Authenticate(ctx context.Context, mechanism string, username string, password string) error
 }
+
+// SecretHandler is an optional extension of AuthHandler for mechanisms
+// that never send the password. Secret returns the shared secret (the
+// plaintext password) of username, and the server verifies the client's
+// proof itself: the CRAM-MD5 digest, or the SCRAM-SHA-256 proof.
+// Implementing it advertises SCRAM-SHA-256. Return an error for an unknown
+// user; the exchange then fails with 535.
+type SecretHandler interface {
+	Secret(ctx context.Context, mechanism, username string) (string, error)
+}
+
+// SCRAMHandler is an optional extension of AuthHandler for backends that
+// store SCRAM-SHA-256 keys (RFC 5802 §3) instead of plaintext passwords.
+// It takes precedence over SecretHandler for SCRAM-SHA-256, and
+// implementing it advertises that mechanism. Use DeriveSCRAMCredentials to
+// compute the stored keys when a password is set.
+type SCRAMHandler interface {
+	SCRAMCredentials(ctx context.Context, username string) (SCRAMCredentials, error)
+}
+
+// ChallengeHandler is an optional extension of AuthHandler that delegates
+// the verification of challenge-response mechanisms, for backends that
+// check digests themselves, such as an external authentication service.
+// VerifyChallenge receives the challenge sent to the client and its
+// response (the hex digest for CRAM-MD5). It takes precedence over
+// SecretHandler.
+type ChallengeHandler interface {
+	VerifyChallenge(ctx context.Context, mechanism, username, challenge, response string) error
+}
+
+// AuthzHandler is an optional extension of AuthHandler for SASL
+// authorization identities. A PLAIN or SCRAM client may ask to act as a
+// different identity than the one it authenticates as (RFC 4616 §2), such
+// as an administrator acting for a user's mailbox. Authorize is then called
+// after the credentials are verified; return nil to let username act as authzid. If the
+// AuthHandler does not implement AuthzHandler, such requests fail with 535.
+type AuthzHandler interface {
+	Authorize(ctx context.Context, username, authzid string) error
+}
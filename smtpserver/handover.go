@@ -0,0 +1,133 @@
+package smtpserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ListenFDsEnv is the environment variable through which Handover tells
+// the new process which inherited file descriptors are listeners, as a
+// comma-separated list of "fd:smtp" (Serve) and "fd:smtps" (ServeTLS)
+// entries, such as "3:smtp,4:smtps".
+const ListenFDsEnv = "SMTP_LISTEN_FDS"
+
+// ErrNoInheritedListeners is returned by ServeInherited when the process
+// was not started by Handover.
+var ErrNoInheritedListeners = errors.New("smtp: no inherited listeners")
+
+// Handover starts cmd, typically a new version of the running binary,
+// with duplicates of the server's listening sockets, for a warm restart
+// without refusing connections. The new process serves them with
+// ServeInherited. Once cmd has started, both processes accept on the
+// sockets; call Shutdown to stop accepting and drain the open sessions.
+// Listeners that are not TCP or Unix sockets cannot be handed over.
+func (s *Server) Handover(cmd *exec.Cmd) error {
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+	if len(listeners) == 0 {
+		return errors.New("smtp: handover: not listening")
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var entries []string
+	for _, ln := range listeners {
+		filer, ok := ln.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("smtp: handover: cannot pass a %T to another process", ln.Listener)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return fmt.Errorf("smtp: handover: %w", err)
+		}
+		files = append(files, f)
+		kind := "smtp"
+		if ln.implicitTLS {
+			kind = "smtps"
+		}
+		// ExtraFiles entry i becomes descriptor 3+i in the new process.
+		entries = append(entries, fmt.Sprintf("%d:%s", 3+len(cmd.ExtraFiles), kind))
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, ListenFDsEnv+"="+strings.Join(entries, ","))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("smtp: handover: %w", err)
+	}
+	s.logger.Info("listeners handed over", "pid", cmd.Process.Pid, "listeners", len(files))
+	return nil
+}
+
+// ServeInherited serves the listeners passed by a parent process's
+// Handover: with Serve, or ServeTLS for those the parent served with
+// implicit TLS. It blocks until all of them stop and returns the first
+// error. If the process inherited no listeners it returns
+// ErrNoInheritedListeners at once, so that a program can fall back to
+// listening itself:
+//
+//	err := srv.ServeInherited()
+//	if errors.Is(err, smtpserver.ErrNoInheritedListeners) {
+//		err = srv.ListenAndServe()
+//	}
+func (s *Server) ServeInherited() error {
+	value, ok := os.LookupEnv(ListenFDsEnv)
+	if !ok || value == "" {
+		return ErrNoInheritedListeners
+	}
+	os.Unsetenv(ListenFDsEnv) // Not for this process's own children.
+
+	type inherited struct {
+		ln  net.Listener
+		tls bool
+	}
+	var listeners []inherited
+	for entry := range strings.SplitSeq(value, ",") {
+		fdText, kind, _ := strings.Cut(entry, ":")
+		fd, err := strconv.ParseUint(fdText, 10, 0)
+		if err != nil || (kind != "smtp" && kind != "smtps") {
+			return fmt.Errorf("smtp: invalid %s entry %q", ListenFDsEnv, entry)
+		}
+		f := os.NewFile(uintptr(fd), kind)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.ln.Close()
+			}
+			return fmt.Errorf("smtp: inherited listener %d: %w", fd, err)
+		}
+		listeners = append(listeners, inherited{ln, kind == "smtps"})
+	}
+
+	errs := make([]error, len(listeners))
+	var wg sync.WaitGroup
+	for i, l := range listeners {
+		wg.Go(func() {
+			if l.tls {
+				errs[i] = s.ServeTLS(l.ln)
+			} else {
+				errs[i] = s.Serve(l.ln)
+			}
+		})
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package smtpserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// disconnectNotifier closes done when a session ends.
+type disconnectNotifier struct{ done chan struct{} }
+
+func (n disconnectNotifier) OnEvent(_ context.Context, ev Event) {
+	if ev.Type == EventDisconnect {
+		close(n.done)
+	}
+}
+
+// TestHandoverChild is the new process started by TestHandover. It serves
+// one session on the inherited listener and exits.
+func TestHandoverChild(t *testing.T) {
+	if os.Getenv("SMTPSERVER_HANDOVER_CHILD") == "" {
+		t.Skip("run by TestHandover")
+	}
+	done := make(chan struct{})
+	srv := NewServer(WithHostname("child.example.com"), WithEventHandler(disconnectNotifier{done}))
+	go func() {
+		<-done
+		srv.Close()
+	}()
+	if err := srv.ServeInherited(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandover(t *testing.T) {
+	if err := NewServer().ServeInherited(); !errors.Is(err, ErrNoInheritedListeners) {
+		t.Fatalf("ServeInherited without a parent: %v", err)
+	}
+	if err := NewServer().Handover(exec.Command("true")); err == nil {
+		t.Error("Handover without listeners succeeded")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(WithHostname("parent.example.com"))
+	go srv.Serve(ln)
+	for srv.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandoverChild$")
+	cmd.Env = append(os.Environ(), "SMTPSERVER_HANDOVER_CHILD=1")
+	cmd.Stderr = os.Stderr
+	if err := srv.Handover(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial after handover: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	c := newConversation(t, conn)
+	if lines := c.expectCode(220); !strings.HasPrefix(lines[0], "child.example.com ") {
+		t.Errorf("greeting = %q, want the new process", lines[0])
+	}
+	c.send("QUIT")
+	c.expectCode(221)
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("new process: %v", err)
+	}
+}
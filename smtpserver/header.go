@@ -0,0 +1,125 @@
+package smtpserver
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+// maxHeaderBytes bounds the header section read by ReadHeader.
+const maxHeaderBytes = 1 << 20
+
+// ErrHeaderTooLarge is returned by ReadHeader for a header section over
+// 1 MB.
+var ErrHeaderTooLarge = errors.New("smtp: message header too large")
+
+// HeaderField is one header field with its value unfolded.
+type HeaderField struct {
+	Name  string // Field name as sent, e.g. "Subject".
+	Value string // Unfolded value without leading and trailing whitespace.
+}
+
+// Header is a message header section in its original order. Unlike
+// net/mail.Header it keeps repeated fields in sequence, e.g. the Received
+// trace.
+type Header []HeaderField
+
+// Get returns the value of the first field named name, case-insensitively,
+// or "" if there is none.
+func (h Header) Get(name string) string {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Values returns the values of all fields named name, case-insensitively,
+// in order.
+func (h Header) Values(name string) []string {
+	var vals []string
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			vals = append(vals, f.Value)
+		}
+	}
+	return vals
+}
+
+// ReadHeader reads the header section from r, typically the reader passed
+// to DataHandler.OnData, and returns it together with a reader for the
+// body that follows the empty line. Only the header is buffered, so
+// handlers that decide on headers alone need not read the whole message;
+// they must still pass the body reader on or drain it.
+//
+// A line that is neither a field nor a continuation ends the header and
+// is returned as the start of the body, as is the case for a message with
+// no header at all.
+func ReadHeader(r io.Reader) (Header, io.Reader, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	var h Header
+	read := 0
+	for {
+		line, err := readHeaderLine(br, maxHeaderBytes-read)
+		read += len(line)
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		switch {
+		case trimmed == "" && line != "":
+			return h, br, nil // The empty line ending the header.
+		case line == "":
+			return h, br, nil // End of message.
+		case (trimmed[0] == ' ' || trimmed[0] == '\t') && len(h) > 0:
+			last := &h[len(h)-1]
+			last.Value = strings.TrimSpace(last.Value + " " + strings.TrimSpace(trimmed))
+		default:
+			name, value, ok := strings.Cut(trimmed, ":")
+			if !ok || !validFieldName(name) {
+				return h, io.MultiReader(strings.NewReader(line), br), nil
+			}
+			h = append(h, HeaderField{Name: name, Value: strings.TrimSpace(value)})
+		}
+		if err == io.EOF {
+			return h, br, nil
+		}
+	}
+}
+
+// readHeaderLine reads a line as br.ReadString('\n') does, but returns
+// ErrHeaderTooLarge as soon as it is longer than limit bytes, so that a
+// line without LF cannot be buffered whole.
+func readHeaderLine(br *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		frag, err := br.ReadSlice('\n')
+		if len(line)+len(frag) > limit {
+			return "", ErrHeaderTooLarge
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// validFieldName checks field-name = 1*ftext, printable ASCII except ':'
+// (RFC 5322 §3.6.8).
+func validFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 33 || c > 126 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package smtpserver
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadHeader(t *testing.T) {
+	msg := "Received: from a\r\n\tby b\r\n" +
+		"Received: from c\r\n" +
+		"Subject:  Hello\r\n  world \r\n" +
+		"X-Empty:\r\n" +
+		"\r\n" +
+		"Body line 1\r\n" +
+		"Subject: not a header\r\n"
+
+	h, body, err := ReadHeader(iotest.HalfReader(strings.NewReader(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Header{
+		{"Received", "from a by b"},
+		{"Received", "from c"},
+		{"Subject", "Hello world"},
+		{"X-Empty", ""},
+	}
+	if !slices.Equal(h, want) {
+		t.Errorf("header = %q, want %q", h, want)
+	}
+	if got := h.Get("subject"); got != "Hello world" {
+		t.Errorf("Get = %q", got)
+	}
+	if got := h.Values("RECEIVED"); !slices.Equal(got, []string{"from a by b", "from c"}) {
+		t.Errorf("Values = %q", got)
+	}
+
+	rest, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Body line 1\r\nSubject: not a header\r\n"; string(rest) != want {
+		t.Errorf("body = %q, want %q", rest, want)
+	}
+}
+
+func TestReadHeader_NoHeader(t *testing.T) {
+	tests := []struct {
+		name, msg, wantBody string
+		wantFields          int
+	}{
+		{"body only", "Hello\r\nWorld\r\n", "Hello\r\nWorld\r\n", 0},
+		{"empty", "", "", 0},
+		{"header without body", "Subject: x", "", 1},
+		{"field then text", "Subject: x\r\nnot a field\r\n", "not a field\r\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, body, err := ReadHeader(strings.NewReader(tt.msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rest, _ := io.ReadAll(body)
+			if len(h) != tt.wantFields || string(rest) != tt.wantBody {
+				t.Errorf("got %d fields, body %q; want %d, %q", len(h), rest, tt.wantFields, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestReadHeader_TooLarge(t *testing.T) {
+	msg := strings.Repeat("X-Filler: "+strings.Repeat("x", 100)+"\r\n", 11000)
+	if _, _, err := ReadHeader(strings.NewReader(msg)); err != ErrHeaderTooLarge {
+		t.Errorf("err = %v, want ErrHeaderTooLarge", err)
+	}
+}
+
+// endlessLine is a header line that never ends, counting the bytes read.
+type endlessLine struct{ n int }
+
+func (r *endlessLine) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.n += len(p)
+	return len(p), nil
+}
+
+func TestReadHeader_LongLine(t *testing.T) {
+	r := &endlessLine{}
+	if _, _, err := ReadHeader(r); err != ErrHeaderTooLarge {
+		t.Errorf("err = %v, want ErrHeaderTooLarge", err)
+	}
+	if r.n > 2*maxHeaderBytes {
+		t.Errorf("read %d bytes of one line, limit %d", r.n, maxHeaderBytes)
+	}
+}
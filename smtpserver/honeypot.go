@@ -0,0 +1,217 @@
+package smtpserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// Honeypot is a Backend for SMTP honeypots and credential-stuffing
+// research: it accepts every AUTH attempt, sender, recipient and message,
+// delivers nothing, and hands a Transcript of each connection to Record
+// when it ends. Install it with WithHoneypot.
+//
+// Each transcript is bounded by MaxCommands, MaxMessageBytes and
+// MaxSessionBytes. The server's options still apply, so also bound what a
+// client can make it hold with WithMaxMessageSize, WithMaxRecipients,
+// WithMaxSessionDuration and WithMaxConnections. Do not set
+// WithLocalDomains, which refuses relaying, or a real AuthHandler.
+type Honeypot struct {
+	// Record receives the transcript of each connection when it ends. It
+	// is called from the connection's goroutine, so slow storage should be
+	// written to in the background.
+	Record func(ctx context.Context, t *Transcript)
+
+	// ReplyDelay is waited before every reply after the greeting, to slow
+	// down scanners and credential stuffing. Zero replies at once.
+	ReplyDelay time.Duration
+
+	// MaxCommands, MaxMessageBytes and MaxSessionBytes bound what one
+	// transcript holds: the command lines recorded, the bytes kept of
+	// each message, and the bytes of command lines, credentials and
+	// messages together. Zero means 1000 commands, 1 MB and 10 MB. What
+	// does not fit is left out and the transcript marked Truncated; the
+	// client is not told.
+	MaxCommands     int
+	MaxMessageBytes int64
+	MaxSessionBytes int64
+
+	sessions sync.Map // Session ID to *honeypotSession.
+}
+
+// Transcript records what a client did on one honeypot connection.
+type Transcript struct {
+	SessionID   string
+	RemoteAddr  net.Addr
+	Start, End  time.Time
+	Commands    []TranscriptCommand // Command lines, in order.
+	Credentials []Credentials       // AUTH attempts, in order.
+	Messages    []TranscriptMessage // Messages sent, in order.
+	Truncated   bool                // Something was left out, see Honeypot.MaxCommands.
+}
+
+// TranscriptCommand is a command line as the client sent it, minus the
+// CRLF. AUTH continuation lines are not included; see Credentials.
+type TranscriptCommand struct {
+	Time time.Time
+	Line string
+}
+
+// Credentials are the decoded credentials of an AUTH attempt. For
+// CRAM-MD5 the client never sends the password, and Password holds the
+// challenge and the client's digest separated by a colon, as passed to
+// AuthHandler.
+type Credentials struct {
+	Time      time.Time
+	Mechanism string
+	Username  string
+	Password  string
+}
+
+// TranscriptMessage is a message the client sent, with its envelope.
+type TranscriptMessage struct {
+	Time      time.Time
+	MessageID string // See MessageID.
+	From      smtp.ReversePath
+	To        []smtp.ForwardPath
+	Data      []byte // The first MaxMessageBytes of the message.
+	Size      int64  // Size of the whole message.
+}
+
+// WithHoneypot makes the server a honeypot: h handles every connection as
+// its Backend, CommandHandler and PolicyHandler, replacing any set with
+// WithBackend, WithCommandHandler and WithPolicyHandler.
+func WithHoneypot(h *Honeypot) Option {
+	return func(s *Server) {
+		s.backend = h
+		s.cmdHandler = h
+		s.policyHandler = h
+	}
+}
+
+// NewSession implements Backend.
+func (h *Honeypot) NewSession(ctx context.Context, remoteAddr net.Addr) (Session, error) {
+	hs := &honeypotSession{honeypot: h, transcript: Transcript{
+		SessionID:  SessionID(ctx),
+		RemoteAddr: remoteAddr,
+		Start:      time.Now(),
+	}}
+	h.sessions.Store(hs.transcript.SessionID, hs)
+	return hs, nil
+}
+
+// OnCommand implements CommandHandler by adding line to the transcript.
+func (h *Honeypot) OnCommand(ctx context.Context, line string) error {
+	if v, ok := h.sessions.Load(SessionID(ctx)); ok {
+		hs := v.(*honeypotSession)
+		limit := h.MaxCommands
+		if limit == 0 {
+			limit = 1000
+		}
+		if len(hs.transcript.Commands) >= limit {
+			hs.transcript.Truncated = true
+		} else if hs.fits(int64(len(line))) {
+			hs.transcript.Commands = append(hs.transcript.Commands, TranscriptCommand{time.Now(), line})
+		}
+	}
+	return nil
+}
+
+// ConnectionPolicy implements PolicyHandler, applying ReplyDelay.
+func (h *Honeypot) ConnectionPolicy(context.Context, net.Addr) (ConnectionPolicy, error) {
+	return ConnectionPolicy{ReplyDelay: h.ReplyDelay}, nil
+}
+
+// honeypotSession records one honeypot connection. OnCommand reaches it
+// through Honeypot.sessions, from the same goroutine as its methods.
+type honeypotSession struct {
+	honeypot   *Honeypot
+	transcript Transcript
+	size       int64 // Bytes counted against MaxSessionBytes.
+}
+
+// room returns the bytes left in the transcript for the session.
+func (hs *honeypotSession) room() int64 {
+	limit := hs.honeypot.MaxSessionBytes
+	if limit == 0 {
+		limit = 10 << 20
+	}
+	return max(limit-hs.size, 0)
+}
+
+// fits counts n more bytes against the session limit and reports whether
+// they fit, marking the transcript truncated if not.
+func (hs *honeypotSession) fits(n int64) bool {
+	if n > hs.room() {
+		hs.transcript.Truncated = true
+		return false
+	}
+	hs.size += n
+	return true
+}
+
+func (hs *honeypotSession) OnHelo(context.Context, string) error { return nil }
+
+func (hs *honeypotSession) OnMail(context.Context, smtp.ReversePath) error { return nil }
+
+func (hs *honeypotSession) OnRcpt(context.Context, smtp.ForwardPath) error { return nil }
+
+func (hs *honeypotSession) OnReset(context.Context) {}
+
+// Authenticate implements AuthHandler, accepting any credentials.
+func (hs *honeypotSession) Authenticate(_ context.Context, mechanism, username, password string) error {
+	if hs.fits(int64(len(mechanism) + len(username) + len(password))) {
+		hs.transcript.Credentials = append(hs.transcript.Credentials, Credentials{time.Now(), mechanism, username, password})
+	}
+	return nil
+}
+
+func (hs *honeypotSession) OnData(ctx context.Context, from smtp.ReversePath, to []smtp.ForwardPath, r io.Reader) error {
+	envelope := int64(len(from.String()))
+	for _, fp := range to {
+		envelope += int64(len(fp.String()))
+	}
+	if !hs.fits(envelope) {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+	limit := hs.honeypot.MaxMessageBytes
+	if limit == 0 {
+		limit = 1 << 20
+	}
+	limit = min(limit, hs.room())
+	data, err := io.ReadAll(io.LimitReader(r, limit))
+	if err != nil {
+		return err
+	}
+	rest, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return err
+	}
+	hs.size += int64(len(data))
+	if rest > 0 {
+		hs.transcript.Truncated = true
+	}
+	hs.transcript.Messages = append(hs.transcript.Messages, TranscriptMessage{
+		Time:      time.Now(),
+		MessageID: MessageID(ctx),
+		From:      from,
+		To:        slices.Clone(to),
+		Data:      data,
+		Size:      int64(len(data)) + rest,
+	})
+	return nil
+}
+
+func (hs *honeypotSession) Logout(ctx context.Context) {
+	hs.honeypot.sessions.Delete(hs.transcript.SessionID)
+	hs.transcript.End = time.Now()
+	if hs.honeypot.Record != nil {
+		hs.honeypot.Record(ctx, &hs.transcript)
+	}
+}
@@ -0,0 +1,122 @@
+package smtpserver
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHoneypot(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	transcripts := make(chan *Transcript, 1)
+	hp := &Honeypot{
+		Record:     func(_ context.Context, tr *Transcript) { transcripts <- tr },
+		ReplyDelay: delay,
+	}
+	clientConn, _ := startTestServer(t, WithHoneypot(hp))
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO scanner.example.net")
+	c.expectCode(250)
+	start := time.Now()
+	c.send("AUTH PLAIN AGFkbWluAGh1bnRlcjI=") // admin / hunter2
+	c.expectCode(235)
+	if d := time.Since(start); d < delay {
+		t.Errorf("reply after %v, want at least %v", d, delay)
+	}
+	c.send("MAIL FROM:<spam@example.net>")
+	c.expectCode(250)
+	c.send("RCPT TO:<victim@elsewhere.example>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Subject: offer\r\n\r\nBuy now")
+	c.expectCode(250)
+	c.send("QUIT")
+	c.expectCode(221)
+	clientConn.Close()
+
+	tr := <-transcripts
+	var lines []string
+	for _, cmd := range tr.Commands {
+		lines = append(lines, cmd.Line)
+	}
+	want := []string{
+		"EHLO scanner.example.net",
+		"AUTH PLAIN AGFkbWluAGh1bnRlcjI=",
+		"MAIL FROM:<spam@example.net>",
+		"RCPT TO:<victim@elsewhere.example>",
+		"DATA",
+		"QUIT",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("commands = %q, want %q", lines, want)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("command %d = %q, want %q", i, lines[i], want[i])
+		}
+	}
+	if len(tr.Credentials) != 1 {
+		t.Fatalf("credentials = %+v", tr.Credentials)
+	}
+	if cred := tr.Credentials[0]; cred.Mechanism != "PLAIN" || cred.Username != "admin" || cred.Password != "hunter2" {
+		t.Errorf("credentials = %+v", cred)
+	}
+	if len(tr.Messages) != 1 {
+		t.Fatalf("messages = %+v", tr.Messages)
+	}
+	msg := tr.Messages[0]
+	if msg.From.Mailbox.String() != "spam@example.net" || len(msg.To) != 1 || msg.To[0].Mailbox.String() != "victim@elsewhere.example" {
+		t.Errorf("envelope = %v -> %v", msg.From, msg.To)
+	}
+	if string(msg.Data) != "Subject: offer\r\n\r\nBuy now\r\n" || msg.Size != int64(len(msg.Data)) {
+		t.Errorf("data = %q, size %d", msg.Data, msg.Size)
+	}
+	if tr.SessionID == "" || tr.End.Before(tr.Start) || tr.Truncated {
+		t.Errorf("transcript = %+v", tr)
+	}
+}
+
+func TestHoneypotLimits(t *testing.T) {
+	transcripts := make(chan *Transcript, 1)
+	hp := &Honeypot{
+		Record:          func(_ context.Context, tr *Transcript) { transcripts <- tr },
+		MaxCommands:     5,
+		MaxMessageBytes: 10,
+	}
+	clientConn, _ := startTestServer(t, WithHoneypot(hp))
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO scanner.example.net")
+	c.expectCode(250)
+	c.send("MAIL FROM:<spam@example.net>")
+	c.expectCode(250)
+	c.send("RCPT TO:<victim@elsewhere.example>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Subject: a long offer")
+	c.expectCode(250)
+	for range 3 {
+		c.send("NOOP")
+		c.expectCode(250)
+	}
+	clientConn.Close()
+
+	tr := <-transcripts
+	if !tr.Truncated {
+		t.Error("Truncated = false")
+	}
+	if len(tr.Commands) != 5 {
+		t.Errorf("%d commands recorded, want 5", len(tr.Commands))
+	}
+	if len(tr.Messages) != 1 {
+		t.Fatalf("messages = %+v", tr.Messages)
+	}
+	if msg := tr.Messages[0]; string(msg.Data) != "Subject: a" || msg.Size != 23 {
+		t.Errorf("data = %q, size %d", msg.Data, msg.Size)
+	}
+}
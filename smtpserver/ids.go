@@ -0,0 +1,227 @@
+package smtpserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"net"
+	"slices"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+type contextKey int
+
+const (
+	sessionIDKey contextKey = iota
+	messageIDKey
+	commandLineKey
+	remoteAddrKey
+	heloKey
+	negotiationKey
+	rejectedKey
+	authKey
+	hostnameKey
+	rcptParamsKey
+	senderKey
+	replyKey
+)
+
+// idEncoding produces IDs made of uppercase letters and digits.
+var idEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newID returns a random 16-character identifier.
+func newID() string {
+	var b [10]byte
+	rand.Read(b[:])
+	return idEncoding.EncodeToString(b[:])
+}
+
+// SessionID returns the ID of the session a handler is called for, or ""
+// if ctx does not come from the server. The ID is assigned when the
+// connection is accepted and appears in the session's log records.
+func SessionID(ctx context.Context) string {
+	id, _ := ctx.Value(sessionIDKey).(string)
+	return id
+}
+
+// MessageID returns the ID of the current mail transaction, or "" outside
+// a transaction. The ID is assigned when MAIL FROM is received and is
+// returned to the client as "queued as <id>" when the message is accepted.
+// It is unrelated to the Message-ID header.
+func MessageID(ctx context.Context) string {
+	id, _ := ctx.Value(messageIDKey).(string)
+	return id
+}
+
+// CommandLine returns the command line being processed when a handler is
+// called, exactly as the client sent it minus the trailing CRLF, or "" if
+// ctx does not come from a command. A DataHandler sees the DATA or final
+// BDAT line.
+func CommandLine(ctx context.Context) string {
+	line, _ := ctx.Value(commandLineKey).(string)
+	return line
+}
+
+// RemoteAddr returns the address of the client a handler is called for,
+// or nil if ctx does not come from the server.
+func RemoteAddr(ctx context.Context) net.Addr {
+	addr, _ := ctx.Value(remoteAddrKey).(net.Addr)
+	return addr
+}
+
+// ServerHostname returns the hostname the server announces to the client
+// a handler is called for: the WithHostname value, or the one WithSNIHostname
+// chose for the client's TLS server name. Use it in Received header fields.
+// It is "" if ctx does not come from the server.
+func ServerHostname(ctx context.Context) string {
+	h, _ := ctx.Value(hostnameKey).(string)
+	return h
+}
+
+// heloInfo is the value stored under heloKey.
+type heloInfo struct {
+	name  string
+	esmtp bool
+}
+
+// Helo returns the client's EHLO or HELO argument and whether it used
+// EHLO. Within HeloHandler.OnHelo it describes the greeting being
+// checked; later handlers see the accepted one. name is "" before the
+// client has greeted.
+func Helo(ctx context.Context) (name string, esmtp bool) {
+	h, _ := ctx.Value(heloKey).(heloInfo)
+	return h.name, h.esmtp
+}
+
+// Negotiation describes what the client negotiated on the connection and
+// for the current transaction, for handlers whose decisions, such as
+// relaying, depend on what the origin asked for.
+type Negotiation struct {
+	ESMTP    bool   // The client greeted with EHLO rather than HELO.
+	TLS      bool   // The connection is encrypted.
+	SNI      string // Server name the client sent in the TLS handshake, or "".
+	SMTPUTF8 bool   // MAIL FROM carried SMTPUTF8 (RFC 6531).
+	Body     string // MAIL FROM BODY value ("7BIT", "8BITMIME", "BINARYMIME"), or "".
+	Chunking bool   // The message is being sent with BDAT (RFC 3030).
+}
+
+// Negotiated returns what the client negotiated as of the handler call.
+// The transaction fields are set from MAIL FROM on, and Chunking once the
+// first BDAT chunk arrives; all are cleared when the transaction ends.
+func Negotiated(ctx context.Context) Negotiation {
+	n, _ := ctx.Value(negotiationKey).(Negotiation)
+	return n
+}
+
+// authInfo is the value stored under authKey.
+type authInfo struct {
+	username  string
+	authzid   string
+	mechanism string
+}
+
+// AuthIdentity returns the username the client authenticated as and the
+// SASL mechanism it used, or empty strings if it has not authenticated.
+func AuthIdentity(ctx context.Context) (username, mechanism string) {
+	a, _ := ctx.Value(authKey).(authInfo)
+	return a.username, a.mechanism
+}
+
+// AuthorizationIdentity returns the identity the client acts as: the
+// authorization identity it was permitted by an AuthzHandler, or else the
+// username it authenticated as. It is "" if the client has not
+// authenticated.
+func AuthorizationIdentity(ctx context.Context) string {
+	a, _ := ctx.Value(authKey).(authInfo)
+	if a.authzid != "" {
+		return a.authzid
+	}
+	return a.username
+}
+
+// RejectedRecipient is a recipient refused during the current transaction.
+type RejectedRecipient struct {
+	Path string          // Forward path as sent, e.g. "<user@example.com>".
+	Err  *smtp.SMTPError // Reply the RCPT command was refused with.
+}
+
+// RejectedRecipients returns the recipients refused so far in the current
+// transaction, in order, with the replies they got. At DATA time it
+// complements the accepted recipients passed to OnData: many unknown
+// recipients suggest a dictionary attack. Deferred recipients are included
+// with a 4xx Err.
+func RejectedRecipients(ctx context.Context) []RejectedRecipient {
+	r, _ := ctx.Value(rejectedKey).([]RejectedRecipient)
+	return r
+}
+
+// RecipientParams returns the RCPT TO parameters of the recipients
+// accepted so far in the current transaction, in the order of the
+// recipients passed to OnData, so that a relay can pass DSN requests on.
+func RecipientParams(ctx context.Context) []RcptParams {
+	p, _ := ctx.Value(rcptParamsKey).([]RcptParams)
+	return p
+}
+
+// Sender returns the reverse-path of the current transaction, from the
+// RCPT handler on, and whether there is one. Handlers that are not passed
+// the sender use it to treat bounces apart; see IsBounce.
+func Sender(ctx context.Context) (smtp.ReversePath, bool) {
+	from, ok := ctx.Value(senderKey).(smtp.ReversePath)
+	return from, ok
+}
+
+// IsBounce reports whether the current transaction has the null
+// reverse-path (MAIL FROM:<>), as bounces and other delivery
+// notifications do. A RcptHandler can then require, for example, that
+// the recipient carries a valid BATV tag, since a genuine bounce answers
+// a message this system sent.
+func IsBounce(ctx context.Context) bool {
+	from, ok := Sender(ctx)
+	return ok && from.Null
+}
+
+// context returns the context passed to handlers, derived from the
+// session's context so that it is canceled when the session ends or the
+// server shuts down. It carries the session and message IDs, the client
+// address, greeting, announced hostname, negotiated extensions and AUTH
+// identity, the sender, the rejected recipients and accepted recipients'
+// parameters, the current command line, and where SetReply stores the
+// reply.
+func (s *session) context() context.Context {
+	ctx := context.WithValue(s.ctx, sessionIDKey, s.id)
+	ctx = context.WithValue(ctx, remoteAddrKey, s.conn.NetConn().RemoteAddr())
+	ctx = context.WithValue(ctx, negotiationKey, Negotiation{
+		ESMTP:    s.esmtp,
+		TLS:      s.tls,
+		SNI:      s.serverName,
+		SMTPUTF8: s.smtpUTF8,
+		Body:     s.body,
+		Chunking: s.bdat,
+	})
+	ctx = context.WithValue(ctx, hostnameKey, s.hostname)
+	if s.clientHostname != "" {
+		ctx = context.WithValue(ctx, heloKey, heloInfo{s.clientHostname, s.esmtp})
+	}
+	if s.msgID != "" {
+		ctx = context.WithValue(ctx, messageIDKey, s.msgID)
+	}
+	if s.authenticated {
+		ctx = context.WithValue(ctx, authKey, authInfo{s.authUser, s.authzid, s.authMechanism})
+	}
+	if s.state >= stateMail {
+		ctx = context.WithValue(ctx, senderKey, s.reversePath)
+	}
+	if len(s.rejected) > 0 {
+		ctx = context.WithValue(ctx, rejectedKey, slices.Clone(s.rejected))
+	}
+	if len(s.rcptParams) > 0 {
+		ctx = context.WithValue(ctx, rcptParamsKey, slices.Clone(s.rcptParams))
+	}
+	if s.cmdLine != "" {
+		ctx = context.WithValue(ctx, commandLineKey, s.cmdLine)
+	}
+	ctx = context.WithValue(ctx, replyKey, &s.handlerReply)
+	return ctx
+}
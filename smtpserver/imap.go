@@ -0,0 +1,222 @@
+package smtpserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// IMAPAppender is a DataHandler that delivers accepted messages into an
+// IMAP store with the APPEND command (RFC 9051 §6.3.12), so the server can
+// act as an ingestion frontend for an existing IMAP server. Each message
+// is appended once per distinct target mailbox, with the time of receipt
+// as its internal date. Any IMAP failure is returned as a plain error, so
+// the client gets a temporary 451 reply and retries the whole message.
+//
+// A new IMAP connection is made for every message.
+type IMAPAppender struct {
+	Addr      string      // IMAP server host:port.
+	TLSConfig *tls.Config // Non-nil uses implicit TLS (port 993).
+	Username  string
+	Password  string
+	Flags     []string      // Flags set on appended messages, e.g. `\Seen`; must be IMAP atoms.
+	Timeout   time.Duration // Zero means 30 seconds.
+
+	// MailboxFor returns the mailbox a recipient's copy goes to. Nil means
+	// every message goes to "INBOX".
+	MailboxFor func(to smtp.ForwardPath) string
+}
+
+// OnData implements DataHandler.
+func (a *IMAPAppender) OnData(ctx context.Context, _ smtp.ReversePath, to []smtp.ForwardPath, r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	received := time.Now()
+
+	var mailboxes []string
+	seen := make(map[string]bool)
+	for _, rcpt := range to {
+		mbox := "INBOX"
+		if a.MailboxFor != nil {
+			mbox = a.MailboxFor(rcpt)
+		}
+		if !seen[mbox] {
+			seen[mbox] = true
+			mailboxes = append(mailboxes, mbox)
+		}
+	}
+
+	return a.append(ctx, mailboxes, body, received)
+}
+
+// append logs in and appends body to each mailbox.
+func (a *IMAPAppender) append(ctx context.Context, mailboxes []string, body []byte, received time.Time) error {
+	timeout := a.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	flags, err := imapFlagList(a.Flags)
+	if err != nil {
+		return fmt.Errorf("smtp: IMAP append: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var conn net.Conn
+	if a.TLSConfig != nil {
+		d := tls.Dialer{Config: a.TLSConfig}
+		conn, err = d.DialContext(ctx, "tcp", a.Addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", a.Addr)
+	}
+	if err != nil {
+		return fmt.Errorf("smtp: IMAP append: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c := &imapConn{conn: conn, r: bufio.NewReader(conn)}
+	if _, err := c.readLine(); err != nil { // Greeting.
+		return fmt.Errorf("smtp: IMAP append: %w", err)
+	}
+
+	user, err := imapQuote(a.Username)
+	if err != nil {
+		return fmt.Errorf("smtp: IMAP append: username: %w", err)
+	}
+	pass, err := imapQuote(a.Password)
+	if err != nil {
+		return fmt.Errorf("smtp: IMAP append: password: %w", err)
+	}
+	if err := c.command("LOGIN "+user+" "+pass, nil); err != nil {
+		return fmt.Errorf("smtp: IMAP append: LOGIN: %w", err)
+	}
+
+	date := `"` + received.Format("02-Jan-2006 15:04:05 -0700") + `"`
+	for _, mbox := range mailboxes {
+		name, err := imapQuote(mbox)
+		if err != nil {
+			return fmt.Errorf("smtp: IMAP append: mailbox: %w", err)
+		}
+		cmd := fmt.Sprintf("APPEND %s %s %s {%d}", name, flags, date, len(body))
+		if err := c.command(cmd, body); err != nil {
+			return fmt.Errorf("smtp: IMAP append: APPEND %s: %w", mbox, err)
+		}
+	}
+
+	c.command("LOGOUT", nil)
+	return nil
+}
+
+// imapConn is the minimal IMAP client used by IMAPAppender.
+type imapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// command sends a tagged command and waits for its completion. If the
+// command ends with a literal, the literal is sent after the server's
+// continuation request.
+func (c *imapConn) command(cmd string, literal []byte) error {
+	c.tag++
+	tag := "A" + strconv.Itoa(c.tag)
+	if _, err := io.WriteString(c.conn, tag+" "+cmd+"\r\n"); err != nil {
+		return err
+	}
+	if literal != nil {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "+") {
+			return fmt.Errorf("literal refused: %s", line)
+		}
+		if _, err := c.conn.Write(literal); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(c.conn, "\r\n"); err != nil {
+			return err
+		}
+	}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		rest, ok := strings.CutPrefix(line, tag+" ")
+		if !ok {
+			continue // Untagged data.
+		}
+		if status, _, _ := strings.Cut(rest, " "); !strings.EqualFold(status, "OK") {
+			return errors.New(rest)
+		}
+		return nil
+	}
+}
+
+// readLine reads one response line, skipping over any literals it
+// contains.
+func (c *imapConn) readLine() (string, error) {
+	var b strings.Builder
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		b.WriteString(line)
+
+		// A line ending in {n} is followed by n octets of literal data.
+		open := strings.LastIndexByte(line, '{')
+		if open < 0 || !strings.HasSuffix(line, "}") {
+			return b.String(), nil
+		}
+		n, err := strconv.Atoi(line[open+1 : len(line)-1])
+		if err != nil {
+			return b.String(), nil
+		}
+		if _, err := io.CopyN(io.Discard, c.r, int64(n)); err != nil {
+			return "", err
+		}
+	}
+}
+
+// imapQuote returns s as an IMAP quoted string.
+func imapQuote(s string) (string, error) {
+	if strings.ContainsAny(s, "\r\n\x00") {
+		return "", errors.New("contains CR, LF or NUL")
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`, nil
+}
+
+// imapFlagList returns flags as an IMAP flag list, checking that each is
+// an atom, optionally preceded by a backslash as system flags are (RFC
+// 3501 §9), so that no flag can end the list or the command early.
+func imapFlagList(flags []string) (string, error) {
+	for _, f := range flags {
+		atom := strings.TrimPrefix(f, `\`)
+		if atom == "" || strings.ContainsFunc(atom, func(c rune) bool {
+			return c <= ' ' || c >= 0x7f || strings.ContainsRune(`(){%*"\]`, c)
+		}) {
+			return "", fmt.Errorf("invalid flag %q", f)
+		}
+	}
+	return "(" + strings.Join(flags, " ") + ")", nil
+}
@@ -0,0 +1,135 @@
+package smtpserver
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+type appendedMessage struct {
+	cmd  string
+	body string
+}
+
+// fakeIMAPServer accepts one connection and records its APPENDs. Appends
+// to a mailbox named "Refused" get a NO.
+func fakeIMAPServer(t *testing.T) (addr string, appended <-chan []appendedMessage) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan []appendedMessage, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var msgs []appendedMessage
+		defer func() { ch <- msgs }()
+
+		r := bufio.NewReader(conn)
+		io.WriteString(conn, "* OK IMAP4rev2 ready\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			tag, cmd, _ := strings.Cut(line, " ")
+			switch verb, _, _ := strings.Cut(cmd, " "); verb {
+			case "LOGIN":
+				if cmd != `LOGIN "user" "p\"w"` {
+					io.WriteString(conn, tag+" NO [AUTHENTICATIONFAILED] bad\r\n")
+					continue
+				}
+				io.WriteString(conn, "* CAPABILITY IMAP4rev2 {4}\r\nxxxx\r\n")
+				io.WriteString(conn, tag+" OK LOGIN completed\r\n")
+			case "APPEND":
+				open := strings.LastIndexByte(cmd, '{')
+				n, _ := strconv.Atoi(cmd[open+1 : len(cmd)-1])
+				io.WriteString(conn, "+ Ready\r\n")
+				body := make([]byte, n+2)
+				io.ReadFull(r, body)
+				if strings.Contains(cmd, `"Refused"`) {
+					io.WriteString(conn, tag+" NO [TRYCREATE] no such mailbox\r\n")
+					continue
+				}
+				msgs = append(msgs, appendedMessage{cmd: cmd[:open], body: string(body[:n])})
+				io.WriteString(conn, tag+" OK APPEND completed\r\n")
+			case "LOGOUT":
+				io.WriteString(conn, "* BYE\r\n"+tag+" OK LOGOUT completed\r\n")
+				return
+			}
+		}
+	}()
+	return ln.Addr().String(), ch
+}
+
+func TestIMAPAppender(t *testing.T) {
+	addr, appended := fakeIMAPServer(t)
+	a := &IMAPAppender{
+		Addr:     addr,
+		Username: "user",
+		Password: `p"w`,
+		Flags:    []string{`\Seen`},
+		MailboxFor: func(to smtp.ForwardPath) string {
+			if to.Mailbox.LocalPart == "sales" {
+				return "Sales"
+			}
+			return "INBOX"
+		},
+	}
+
+	msg := "Subject: hi\r\n\r\nbody\r\n"
+	err := a.OnData(context.Background(), smtp.ReversePath{Null: true},
+		rcpts("a@example.com", "sales@example.com", "b@example.com"), strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("OnData: %v", err)
+	}
+
+	msgs := <-appended
+	if len(msgs) != 2 {
+		t.Fatalf("appended %d messages, want 2: %v", len(msgs), msgs)
+	}
+	if !strings.HasPrefix(msgs[0].cmd, `APPEND "INBOX" (\Seen) "`) || !strings.HasPrefix(msgs[1].cmd, `APPEND "Sales" `) {
+		t.Errorf("APPEND commands = %q, %q", msgs[0].cmd, msgs[1].cmd)
+	}
+	if msgs[0].body != msg {
+		t.Errorf("body = %q, want %q", msgs[0].body, msg)
+	}
+}
+
+func TestIMAPAppenderFailure(t *testing.T) {
+	addr, _ := fakeIMAPServer(t)
+	a := &IMAPAppender{
+		Addr:       addr,
+		Username:   "user",
+		Password:   `p"w`,
+		MailboxFor: func(smtp.ForwardPath) string { return "Refused" },
+	}
+	err := a.OnData(context.Background(), smtp.ReversePath{Null: true}, rcpts("a@example.com"), strings.NewReader("x\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "TRYCREATE") {
+		t.Errorf("OnData error = %v, want APPEND failure", err)
+	}
+}
+
+func TestIMAPFlagList(t *testing.T) {
+	if got, err := imapFlagList([]string{`\Seen`, "$Junk"}); err != nil || got != `(\Seen $Junk)` {
+		t.Errorf("imapFlagList = %q, %v", got, err)
+	}
+	for _, flag := range []string{"", `\`, "two words", `\Seen)`, "x\r\nA9 DELETE INBOX", `"quoted"`, `\\Seen`} {
+		if _, err := imapFlagList([]string{flag}); err == nil {
+			t.Errorf("imapFlagList accepted %q", flag)
+		}
+	}
+}
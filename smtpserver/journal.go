@@ -0,0 +1,74 @@
+package smtpserver
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// Journal receives a copy of every message the server accepts, for
+// compliance archiving. Every MessageStore is a Journal; to journal to an
+// archival mailbox instead, implement Save by submitting body to it, with
+// the envelope in the message or in a header field. Implementations must
+// be safe for concurrent use.
+type Journal interface {
+	// Save records the message with its original envelope: the sender,
+	// all accepted recipients, including Bcc recipients absent from the
+	// header, their DSN parameters, the MAIL FROM parameters and the
+	// client. The returned ID is only logged.
+	Save(ctx context.Context, env *smtp.Envelope, body io.Reader) (string, error)
+}
+
+// errJournalFailed is the reply to a message the DataHandler accepted but
+// that could not be journaled.
+var errJournalFailed = smtp.Errorf(smtp.ReplyLocalError, smtp.EnhancedCodeTempSystem, "Message could not be archived, try again later")
+
+// WithJournal saves a copy of every accepted message, with the envelope
+// the client sent, to j once the DataHandler has accepted it, without
+// wrapping the handler. A message that cannot be journaled is answered
+// with 451 4.3.0 rather than accepted unrecorded, even though the
+// DataHandler already took it, so the client's retry may deliver it
+// twice. Bodies are received in full before OnData, as with WithSpool,
+// and held in memory unless WithSpool is also set.
+func WithJournal(j Journal) Option {
+	return func(s *Server) { s.journal = j }
+}
+
+// journalMessage saves the accepted message in sp to the journal, with
+// the transaction's parameters in its envelope.
+func (s *session) journalMessage(sp *spool) error {
+	env := &smtp.Envelope{
+		ID:       s.msgID,
+		From:     s.reversePath,
+		Size:     sp.Len(),
+		Body:     s.body,
+		SMTPUTF8: s.smtpUTF8,
+		DSNRet:   s.dsnRet,
+		DSNEnvID: s.dsnEnvID,
+		Client: smtp.ClientInfo{
+			RemoteAddr: s.conn.NetConn().RemoteAddr().String(),
+			Helo:       s.clientHostname,
+			TLS:        s.tls,
+			AuthUser:   s.authUser,
+			SessionID:  s.id,
+		},
+		Received: time.Now(),
+	}
+	for i, to := range s.forwardPaths {
+		rcpt := smtp.Recipient{Address: to}
+		if i < len(s.rcptParams) {
+			rcpt.Notify = s.rcptParams[i].Notify
+			rcpt.ORcpt = s.rcptParams[i].ORCPT
+		}
+		env.To = append(env.To, rcpt)
+	}
+	id, err := s.server.journal.Save(s.context(), env, sp.reader())
+	if err != nil {
+		s.logger.Error("journal error", "message", s.msgID, "err", err)
+		return errJournalFailed
+	}
+	s.logger.Debug("message journaled", "message", s.msgID, "journal_id", id)
+	return nil
+}
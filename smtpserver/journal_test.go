@@ -0,0 +1,117 @@
+package smtpserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// rejectBodyHandler rejects messages whose body contains "reject".
+type rejectBodyHandler struct{}
+
+func (rejectBodyHandler) OnData(_ context.Context, _ smtp.ReversePath, _ []smtp.ForwardPath, r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(body), "reject") {
+		return smtp.Errorf(smtp.ReplyTransactionFailed, smtp.EnhancedCodeInvalidContent, "Rejected")
+	}
+	return nil
+}
+
+// failingJournal fails every Save.
+type failingJournal struct{}
+
+func (failingJournal) Save(context.Context, *smtp.Envelope, io.Reader) (string, error) {
+	return "", errors.New("archive unavailable")
+}
+
+func TestJournal(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn, _ := startTestServer(t,
+		WithRcptHandler(&testRcptHandler{reject: "unknown@example.com"}),
+		WithDataHandler(rejectBodyHandler{}),
+		WithJournal(store))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+
+	c.send("MAIL FROM:<sender@example.com> BODY=8BITMIME RET=HDRS ENVID=QQ+2B1")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com> NOTIFY=FAILURE,DELAY ORCPT=rfc822;user@example.com")
+	c.expectCode(250)
+	c.send("RCPT TO:<unknown@example.com>")
+	c.expectCode(550)
+	c.send("RCPT TO:<bcc@example.org>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("To: user@example.com\r\nSubject: journaled\r\n\r\nhello")
+	c.expectCode(250)
+
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.sendChunk("Subject: reject\r\n\r\n", true)
+	c.expectCode(554)
+
+	ctx := context.Background()
+	ids, err := store.List(ctx)
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("journal holds %v (%v), want one message", ids, err)
+	}
+	env, body, err := store.Open(ctx, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	data, _ := io.ReadAll(body)
+	if !strings.Contains(string(data), "Subject: journaled") {
+		t.Errorf("journaled body = %q", data)
+	}
+	if env.From.String() != "<sender@example.com>" || len(env.To) != 2 || env.To[1].Address.String() != "<bcc@example.org>" {
+		t.Errorf("journaled envelope = %+v", env)
+	}
+	if env.Client.Helo != "client.example.com" || env.Client.SessionID == "" {
+		t.Errorf("journaled client = %+v", env.Client)
+	}
+	if env.Size != int64(len(data)) || env.Body != "8BITMIME" || env.DSNRet != "HDRS" || env.DSNEnvID != "QQ+1" {
+		t.Errorf("journaled parameters = size %d, body %q, ret %q, envid %q", env.Size, env.Body, env.DSNRet, env.DSNEnvID)
+	}
+	if rcpt := env.To[0]; len(rcpt.Notify) != 2 || rcpt.ORcpt != "rfc822;user@example.com" || env.To[1].Notify != nil {
+		t.Errorf("journaled recipients = %+v", env.To)
+	}
+}
+
+func TestJournalFailure(t *testing.T) {
+	h := &testDataHandler{}
+	clientConn, _ := startTestServer(t, WithDataHandler(h), WithJournal(failingJournal{}))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Subject: test\r\n\r\nhello")
+	if lines := c.expectCode(451); lines[0] != "4.3.0 Message could not be archived, try again later" {
+		t.Errorf("reply = %q", lines[0])
+	}
+}
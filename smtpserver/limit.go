@@ -0,0 +1,113 @@
+package smtpserver
+
+import (
+	"sync"
+	"time"
+)
+
+// throughputLimiter caps the number of messages and bytes the server
+// accepts per interval, across all connections. It uses fixed windows:
+// counters reset when the current interval has elapsed.
+type throughputLimiter struct {
+	maxMessages int   // Zero means no message limit.
+	maxBytes    int64 // Zero means no byte limit.
+	interval    time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	messages    int
+	bytes       int64
+}
+
+func newThroughputLimiter(maxMessages int, maxBytes int64, interval time.Duration) *throughputLimiter {
+	return &throughputLimiter{
+		maxMessages: maxMessages,
+		maxBytes:    maxBytes,
+		interval:    interval,
+		windowStart: time.Now(),
+	}
+}
+
+// rollLocked starts a new window if the current one has expired.
+// The caller must hold l.mu.
+func (l *throughputLimiter) rollLocked(now time.Time) {
+	if now.Sub(l.windowStart) >= l.interval {
+		l.windowStart = now
+		l.messages = 0
+		l.bytes = 0
+	}
+}
+
+// saturated reports whether the current window has used up its budget.
+func (l *throughputLimiter) saturated() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollLocked(time.Now())
+	if l.maxMessages > 0 && l.messages >= l.maxMessages {
+		return true
+	}
+	if l.maxBytes > 0 && l.bytes >= l.maxBytes {
+		return true
+	}
+	return false
+}
+
+// record counts an accepted message of the given size.
+func (l *throughputLimiter) record(size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollLocked(time.Now())
+	l.messages++
+	l.bytes += size
+}
+
+// acceptLimiter paces accepted connections with a token bucket of burst
+// tokens refilled at rate per second. Reservations may take the bucket
+// below zero, so that concurrent waiters queue behind one another.
+type acceptLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newAcceptLimiter(rate float64, burst int) *acceptLimiter {
+	return &acceptLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes a token and returns how long to wait before using it.
+func (l *acceptLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// throttleAccept waits for the accept rate limit, if one is set. It
+// returns false if the server shuts down meanwhile.
+func (s *Server) throttleAccept() bool {
+	if s.acceptRate == nil {
+		return true
+	}
+	d := s.acceptRate.reserve()
+	if d <= 0 {
+		return true
+	}
+	s.stats.acceptsThrottled.Add(1)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-s.quit:
+		return false
+	}
+}
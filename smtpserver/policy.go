@@ -0,0 +1,144 @@
+package smtpserver
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// ConnectionPolicy restricts a single connection beyond the server-wide
+// settings. The zero value imposes no restrictions.
+type ConnectionPolicy struct {
+	// MaxMessageSize lowers the message size limit for this connection; it
+	// is advertised in EHLO. Zero keeps the server's limit.
+	MaxMessageSize int64
+
+	// MaxRecipients lowers the recipient limit for this connection. Zero
+	// keeps the server's limit.
+	MaxRecipients int
+
+	// RequireAuth refuses MAIL FROM with 530 until the client has
+	// authenticated, as in submission mode.
+	RequireAuth bool
+
+	// DisabledExtensions are not advertised in EHLO, and their commands
+	// (STARTTLS, AUTH, BDAT) and MAIL/RCPT parameters are refused.
+	DisabledExtensions []smtp.Extension
+
+	// ReplyDelay is waited before every reply after the greeting, slowing
+	// down suspected spam sources (tarpitting).
+	ReplyDelay time.Duration
+}
+
+// PolicyHandler assigns a ConnectionPolicy to each accepted connection,
+// for graduated restrictions based on IP reputation rather than a binary
+// block. It is called after the ConnectionHandler; return an error to
+// reject the connection instead.
+type PolicyHandler interface {
+	ConnectionPolicy(ctx context.Context, addr net.Addr) (ConnectionPolicy, error)
+}
+
+// WithPolicyHandler sets the handler that assigns per-connection policies.
+func WithPolicyHandler(h PolicyHandler) Option {
+	return func(s *Server) { s.policyHandler = h }
+}
+
+// paramExtensions maps the MAIL and RCPT parameters the server
+// implements to the command that takes them and the extension that
+// defines them. Parameters of a disabled extension are refused, and
+// strict syntax accepts a parameter only on its command and only while
+// its extension is offered.
+var paramExtensions = map[string]paramSpec{
+	"SIZE":     {"MAIL", smtp.ExtSIZE},
+	"BODY":     {"MAIL", smtp.Ext8BITMIME},
+	"SMTPUTF8": {"MAIL", smtp.ExtSMTPUTF8},
+	"RET":      {"MAIL", smtp.ExtDSN},
+	"ENVID":    {"MAIL", smtp.ExtDSN},
+	"AUTH":     {"MAIL", smtp.ExtAUTH},
+	"NOTIFY":   {"RCPT", smtp.ExtDSN},
+	"ORCPT":    {"RCPT", smtp.ExtDSN},
+}
+
+// paramSpec is the command and extension of a parameter.
+type paramSpec struct {
+	verb string
+	ext  smtp.Extension
+}
+
+// offers reports whether the session offers ext, as EHLO advertises it:
+// SIZE only with a message size limit, AUTH only with an AuthHandler,
+// and no extension the connection policy disables.
+func (s *session) offers(ext smtp.Extension) bool {
+	switch ext {
+	case smtp.ExtSIZE:
+		if s.maxMessageSize() <= 0 {
+			return false
+		}
+	case smtp.ExtAUTH:
+		if s.authHandler == nil {
+			return false
+		}
+	}
+	return !s.disabled(ext)
+}
+
+// disabled reports whether the connection policy disables ext.
+func (s *session) disabled(ext smtp.Extension) bool {
+	return slices.ContainsFunc(s.policy.DisabledExtensions, func(e smtp.Extension) bool {
+		return strings.EqualFold(string(e), string(ext))
+	})
+}
+
+// rejectDisabledParams replies 555 and returns true if params contain a
+// parameter of a disabled extension.
+func (s *session) rejectDisabledParams(params string) bool {
+	if len(s.policy.DisabledExtensions) == 0 {
+		return false
+	}
+	for _, param := range strings.Fields(params) {
+		keyword, _, _ := strings.Cut(param, "=")
+		keyword = strings.ToUpper(keyword)
+		if spec, ok := paramExtensions[keyword]; ok && s.disabled(spec.ext) {
+			s.reply(smtp.ReplyMailRcptParamError, smtp.EnhancedCodeInvalidParams, "Unsupported parameter "+keyword)
+			return true
+		}
+	}
+	return false
+}
+
+// maxMessageSize returns the message size limit of the connection, or 0
+// for none.
+func (s *session) maxMessageSize() int64 {
+	limit := s.cfg.maxMessageSize
+	if p := s.policy.MaxMessageSize; p > 0 && (limit <= 0 || p < limit) {
+		limit = p
+	}
+	return limit
+}
+
+// maxRecipients returns the recipient limit of the connection.
+func (s *session) maxRecipients() int {
+	limit := s.cfg.maxRecipients
+	if p := s.policy.MaxRecipients; p > 0 && p < limit {
+		limit = p
+	}
+	return limit
+}
+
+// tarpit waits for the policy's reply delay, returning early if the
+// server shuts down.
+func (s *session) tarpit() {
+	if s.policy.ReplyDelay <= 0 {
+		return
+	}
+	t := time.NewTimer(s.policy.ReplyDelay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.server.quit:
+	}
+}
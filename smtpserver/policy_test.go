@@ -0,0 +1,90 @@
+package smtpserver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// staticPolicy assigns the same policy to every connection.
+type staticPolicy ConnectionPolicy
+
+func (p staticPolicy) ConnectionPolicy(context.Context, net.Addr) (ConnectionPolicy, error) {
+	return ConnectionPolicy(p), nil
+}
+
+func TestConnectionPolicy(t *testing.T) {
+	handler := &testDataHandler{}
+	clientConn, _ := startTestServer(t,
+		WithDataHandler(handler),
+		WithPolicyHandler(staticPolicy{
+			MaxMessageSize:     64,
+			MaxRecipients:      1,
+			DisabledExtensions: []smtp.Extension{smtp.ExtCHUNKING, smtp.ExtSMTPUTF8},
+		}),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	ehlo := strings.Join(c.expectCode(250), "\n")
+	if !strings.Contains(ehlo, "SIZE 64") || strings.Contains(ehlo, "CHUNKING") || strings.Contains(ehlo, "SMTPUTF8") {
+		t.Errorf("EHLO reply ignores the policy:\n%s", ehlo)
+	}
+
+	c.send("MAIL FROM:<sender@example.com> SMTPUTF8")
+	c.expectCode(555)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<one@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<two@example.com>")
+	c.expectCode(452)
+
+	c.sendChunk("chunk", true)
+	c.expectCode(502)
+
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData(strings.Repeat("x", 100))
+	lines := c.expectCode(552)
+	if !strings.HasPrefix(lines[0], "5.3.4 ") {
+		t.Errorf("reply = %q, want enhanced code 5.3.4", lines[0])
+	}
+
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<one@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("small")
+	c.expectCode(250)
+	if n := len(handler.messages); n != 1 {
+		t.Errorf("delivered %d messages, want only the small one", n)
+	}
+}
+
+func TestConnectionPolicy_RequireAuthAndTarpit(t *testing.T) {
+	clientConn, _ := startTestServer(t, WithPolicyHandler(staticPolicy{
+		RequireAuth: true,
+		ReplyDelay:  30 * time.Millisecond,
+	}))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	start := time.Now()
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("EHLO reply after %v, want the 30ms tarpit delay", d)
+	}
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(530)
+}
@@ -0,0 +1,221 @@
+package smtpserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrProxyHeader is the error a connection fails with when it should start
+// with a PROXY protocol header but does not start with a valid one.
+var ErrProxyHeader = errors.New("smtp: invalid PROXY protocol header")
+
+// WithProxyProtocol makes the server read a HAProxy PROXY protocol header
+// (version 1 or 2) at the start of each connection, as sent by HAProxy,
+// AWS NLB and similar load balancers, and take the client address from it.
+// All address checks, handlers, logs and events then see the real client
+// instead of the load balancer.
+//
+// Headers are only accepted from the given proxy networks; connections
+// from other addresses are served under their own address. With no
+// prefixes, every connection must start with a header. A connection
+// without a valid header is closed without a reply. Headers with the
+// LOCAL command, such as load balancer health checks, keep the proxy's
+// address.
+func WithProxyProtocol(proxies ...netip.Prefix) Option {
+	return func(s *Server) {
+		s.proxyProtocol = true
+		s.proxyNets = append(s.proxyNets, proxies...)
+	}
+}
+
+// proxyListener wraps the connections from trusted proxies in proxyConns.
+type proxyListener struct {
+	net.Listener
+	proxies []netip.Prefix
+	server  *Server
+}
+
+// withProxyProtocol wraps ln for the PROXY protocol if it is enabled.
+func (s *Server) withProxyProtocol(ln net.Listener) net.Listener {
+	if !s.proxyProtocol {
+		return ln
+	}
+	return &proxyListener{Listener: ln, proxies: s.proxyNets, server: s}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if len(l.proxies) > 0 {
+		if ip, ok := clientIP(conn.RemoteAddr()); !ok || !containsAddr(l.proxies, ip) {
+			return conn, nil
+		}
+	}
+	return &proxyConn{Conn: conn, timeout: l.server.cfg.Load().readTimeout}, nil
+}
+
+// proxyConn is a connection from a proxy. The header is read on first
+// use, so that a slow proxy does not hold up the accept loop.
+type proxyConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr // Client address from the header; nil to keep the proxy's.
+	err    error
+}
+
+// readHeader reads the PROXY header once, within the read timeout.
+func (c *proxyConn) readHeader() error {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.remote, c.err = readProxyHeader(c.Conn)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+	return c.err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the
+// proxy's address if the header has none or is invalid.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.readHeader() != nil || c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}
+
+// proxyHeaderError reads the PROXY header of nc, if it comes from a proxy,
+// and returns the error if the header is invalid.
+func proxyHeaderError(nc net.Conn) error {
+	if tc, ok := nc.(*tls.Conn); ok {
+		nc = tc.NetConn()
+	}
+	if pc, ok := nc.(*proxyConn); ok {
+		return pc.readHeader()
+	}
+	return nil
+}
+
+const (
+	proxyV1MaxLen = 107 // Longest version 1 header, CRLF included.
+	proxyV2MaxLen = 536 // Longest version 2 address block accepted.
+)
+
+// proxyV2Signature starts every version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a version 1 or 2 PROXY header from r without
+// reading past it, and returns the client address it names, or nil if it
+// names none (LOCAL and UNKNOWN headers).
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	// Both versions are at least as long as the version 2 signature:
+	// the shortest version 1 header is "PROXY UNKNOWN\r\n".
+	start := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(r, start)
+	}
+	return nil, fmt.Errorf("%w: no PROXY signature", ErrProxyHeader)
+}
+
+// readProxyV1 reads the rest of a version 1 header that begins with
+// start, one byte at a time so as not to consume the SMTP stream.
+func readProxyV1(r io.Reader, start []byte) (net.Addr, error) {
+	line := start
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, fmt.Errorf("%w: version 1 header too long", ErrProxyHeader)
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed version 1 header %q", ErrProxyHeader, strings.TrimSpace(string(line)))
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: bad source address %q", ErrProxyHeader, fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad source port %q", ErrProxyHeader, fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyV2 reads the rest of a version 2 header after its signature.
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+	verCmd, family := hdr[0], hdr[1]
+	n := binary.BigEndian.Uint16(hdr[2:])
+	if verCmd>>4 != 2 || verCmd&0xf > 1 {
+		return nil, fmt.Errorf("%w: unsupported version/command %#x", ErrProxyHeader, verCmd)
+	}
+	if n > proxyV2MaxLen {
+		return nil, fmt.Errorf("%w: %d-byte address block", ErrProxyHeader, n)
+	}
+	block := make([]byte, n)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+	if verCmd&0xf == 0 { // LOCAL
+		return nil, nil
+	}
+
+	// The address family is the high nibble; the block holds the source
+	// and destination addresses, then the source and destination ports,
+	// followed by optional TLVs, which are ignored.
+	var ip netip.Addr
+	var port uint16
+	switch family >> 4 {
+	case 1: // AF_INET
+		if n < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 address block", ErrProxyHeader)
+		}
+		ip = netip.AddrFrom4([4]byte(block[0:4]))
+		port = binary.BigEndian.Uint16(block[8:10])
+	case 2: // AF_INET6
+		if n < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 address block", ErrProxyHeader)
+		}
+		ip = netip.AddrFrom16([16]byte(block[0:16])).Unmap()
+		port = binary.BigEndian.Uint16(block[32:34])
+	default: // AF_UNSPEC, AF_UNIX
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+}
@@ -0,0 +1,191 @@
+package smtpserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a version 2 PROXY header for src, or a LOCAL
+// header if src is invalid.
+func proxyV2Header(src netip.AddrPort) []byte {
+	hdr := append([]byte{}, proxyV2Signature...)
+	if !src.IsValid() {
+		return append(hdr, 0x20, 0x00, 0, 0)
+	}
+	var block []byte
+	family := byte(0x11)
+	if src.Addr().Is4() {
+		a, d := src.Addr().As4(), [4]byte{192, 0, 2, 1}
+		block = append(append(block, a[:]...), d[:]...)
+	} else {
+		family = 0x21
+		a, d := src.Addr().As16(), netip.MustParseAddr("2001:db8::1").As16()
+		block = append(append(block, a[:]...), d[:]...)
+	}
+	block = binary.BigEndian.AppendUint16(block, src.Port())
+	block = binary.BigEndian.AppendUint16(block, 25)
+	block = append(block, 0x04, 0, 1, 'x') // A TLV, ignored.
+	hdr = append(hdr, 0x21, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(block)))
+	return append(hdr, block...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		header string
+		want   string // Client address; "" for none.
+		ok     bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 203.0.113.7 192.0.2.1 40000 25\r\n", "203.0.113.7:40000", true},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::7 2001:db8::1 40000 25\r\n", "[2001:db8::7]:40000", true},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", true},
+		{"v2 IPv4", string(proxyV2Header(netip.MustParseAddrPort("203.0.113.7:40000"))), "203.0.113.7:40000", true},
+		{"v2 IPv6", string(proxyV2Header(netip.MustParseAddrPort("[2001:db8::7]:40000"))), "[2001:db8::7]:40000", true},
+		{"v2 LOCAL", string(proxyV2Header(netip.AddrPort{})), "", true},
+		{"no header", "EHLO client.example.com\r\n", "", false},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::7 192.0.2.1 40000 25\r\n", "", false},
+		{"v1 bad port", "PROXY TCP4 203.0.113.7 192.0.2.1 70000 25\r\n", "", false},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", false},
+		{"truncated", "PROXY TCP4 203.0.113.7", "", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := strings.NewReader(tt.header + "EHLO")
+			addr, err := readProxyHeader(r)
+			if !tt.ok {
+				if !errors.Is(err, ErrProxyHeader) {
+					t.Errorf("err = %v, want ErrProxyHeader", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("address = %q, want %q", got, tt.want)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "EHLO" {
+				t.Errorf("read past the header: %q left", rest)
+			}
+		})
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	serve := func(t *testing.T, opts ...Option) (string, <-chan net.Addr) {
+		t.Helper()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs := make(chan net.Addr, 1)
+		srv := NewServer(append([]Option{
+			WithHostname("test.example.com"),
+			WithReadTimeout(2 * time.Second),
+			WithConnectionHandler(connHandlerFunc(func(_ context.Context, addr net.Addr) error {
+				addrs <- addr
+				return nil
+			})),
+		}, opts...)...)
+		go srv.Serve(ln)
+		t.Cleanup(func() { srv.Close() })
+		return ln.Addr().String(), addrs
+	}
+	dial := func(t *testing.T, addr, header string) *bufio.Reader {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, header)
+		return bufio.NewReader(conn)
+	}
+
+	t.Run("header", func(t *testing.T) {
+		addr, addrs := serve(t, WithProxyProtocol())
+		r := dial(t, addr, "PROXY TCP4 203.0.113.7 192.0.2.1 40000 25\r\n")
+		if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "220 ") {
+			t.Fatalf("greeting = %q", line)
+		}
+		if got := (<-addrs).String(); got != "203.0.113.7:40000" {
+			t.Errorf("ConnectionHandler saw %s, want the address from the header", got)
+		}
+	})
+
+	t.Run("missing header", func(t *testing.T) {
+		addr, addrs := serve(t, WithProxyProtocol())
+		r := dial(t, addr, "EHLO client.example.com\r\n")
+		if line, err := r.ReadString('\n'); err == nil {
+			t.Errorf("reply %q to a connection without a header", line)
+		}
+		select {
+		case a := <-addrs:
+			t.Errorf("ConnectionHandler called for %s", a)
+		default:
+		}
+	})
+
+	t.Run("untrusted peer", func(t *testing.T) {
+		addr, addrs := serve(t, WithProxyProtocol(netip.MustParsePrefix("10.0.0.0/8")))
+		r := dial(t, addr, "")
+		if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "220 ") {
+			t.Fatalf("greeting = %q", line)
+		}
+		if got := (<-addrs).String(); !strings.HasPrefix(got, "127.0.0.1:") {
+			t.Errorf("ConnectionHandler saw %s, want the peer address", got)
+		}
+	})
+}
+
+func TestProxyProtocolOverLimit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(
+		WithHostname("test.example.com"),
+		WithReadTimeout(time.Minute),
+		WithProxyProtocol(),
+		WithMaxConnections(1),
+	)
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	dial := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	session := dial()
+	session.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 40000 25\r\n"))
+	newConversation(t, session).expectCode(220)
+
+	// Refusals waiting for a PROXY header are bounded; past the bound,
+	// connections are closed at once.
+	for range maxPendingRefusals {
+		dial()
+	}
+	conn := dial()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from a connection over the limit: %v, want EOF", err)
+	}
+}
@@ -0,0 +1,108 @@
+package smtpserver
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// maxOrcptLen is the longest ORCPT parameter value allowed (RFC 3461 §4.2).
+const maxOrcptLen = 500
+
+// RcptParams are the DSN parameters of a RCPT TO command (RFC 3461 §4).
+type RcptParams struct {
+	// Notify lists the NOTIFY values, upper-cased: "NEVER" alone, or any
+	// of "SUCCESS", "FAILURE" and "DELAY". It is nil if the client sent
+	// no NOTIFY, leaving the conditions to the server.
+	Notify []string
+
+	// ORCPT is the original recipient as "addr-type;address", such as
+	// "rfc822;user@example.com", with the xtext encoding removed; it is
+	// "" if the client sent none. smtpclient.WithDSNOriginalRecipient
+	// takes the same form.
+	ORCPT string
+}
+
+var (
+	errInvalidNotify = smtp.Errorf(smtp.ReplySyntaxParamError, smtp.EnhancedCodeInvalidParams, "Invalid NOTIFY parameter")
+	errInvalidOrcpt  = smtp.Errorf(smtp.ReplySyntaxParamError, smtp.EnhancedCodeInvalidParams, "Invalid ORCPT parameter")
+)
+
+// parseRcptParams parses the NOTIFY and ORCPT parameters of RCPT TO,
+// returning the reply for a malformed one. Other parameters are ignored.
+func parseRcptParams(params string) (RcptParams, *smtp.SMTPError) {
+	var p RcptParams
+	var seenOrcpt bool
+	for _, param := range strings.Fields(params) {
+		keyword, value, _ := strings.Cut(param, "=")
+		switch strings.ToUpper(keyword) {
+		case "NOTIFY":
+			if p.Notify != nil {
+				return RcptParams{}, errInvalidNotify
+			}
+			notify, ok := parseNotify(value)
+			if !ok {
+				return RcptParams{}, errInvalidNotify
+			}
+			p.Notify = notify
+		case "ORCPT":
+			addrType, addr, ok := strings.Cut(value, ";")
+			if seenOrcpt || !ok || addrType == "" || len(value) > maxOrcptLen {
+				return RcptParams{}, errInvalidOrcpt
+			}
+			decoded, ok := decodeXtext(addr)
+			if !ok || decoded == "" {
+				return RcptParams{}, errInvalidOrcpt
+			}
+			p.ORCPT = addrType + ";" + decoded
+			seenOrcpt = true
+		}
+	}
+	return p, nil
+}
+
+// parseNotify parses a NOTIFY value: NEVER, or a comma-separated list of
+// SUCCESS, FAILURE and DELAY without repetitions.
+func parseNotify(value string) ([]string, bool) {
+	values := strings.Split(strings.ToUpper(value), ",")
+	if len(values) == 1 && values[0] == "NEVER" {
+		return values, true
+	}
+	for i, v := range values {
+		if v != "SUCCESS" && v != "FAILURE" && v != "DELAY" || slices.Contains(values[:i], v) {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+// decodeXtext decodes xtext (RFC 3461 §4): printable ASCII other than
+// "=", with "+XX" escapes in upper-case hexadecimal. It reports false for
+// malformed input.
+func decodeXtext(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(s) || !upperHex(s[i+1]) || !upperHex(s[i+2]) {
+				return "", false
+			}
+			n, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			b.WriteByte(byte(n))
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return "", false
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), true
+}
+
+// upperHex reports whether c is a hexchar digit: 0-9 or A-F.
+func upperHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'F'
+}
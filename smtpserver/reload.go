@@ -0,0 +1,64 @@
+package smtpserver
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"time"
+)
+
+// settings are the parts of the configuration that Reload may change.
+// Each session uses the settings current when it started throughout.
+type settings struct {
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	maxMessageSize  int64
+	maxRecipients   int
+	maxInvalidCmds  int
+	maxAuthFailures int
+	maxSessionTime  time.Duration
+	localDomains    map[string]bool
+	trustedNets     []netip.Prefix
+}
+
+func defaultSettings() settings {
+	return settings{
+		readTimeout:    5 * time.Minute,
+		writeTimeout:   5 * time.Minute,
+		maxMessageSize: 10 * 1024 * 1024, // 10 MB
+		maxRecipients:  100,
+		maxInvalidCmds: 10,
+	}
+}
+
+// Reload changes the configuration of a running server without a restart,
+// for config management tools that would otherwise bounce the daemon. It
+// accepts the options that can safely change at runtime:
+//
+//   - WithReadTimeout and WithWriteTimeout
+//   - WithMaxMessageSize and WithMaxRecipients
+//   - WithMaxInvalidCommands and WithMaxAuthFailures
+//   - WithMaxSessionDuration
+//   - WithLocalDomains and WithTrustedNetworks
+//
+// New sessions use the new settings; open sessions finish with the ones
+// they started with. Settings not given return to their defaults, so pass
+// the whole reloadable configuration each time, not just what changed.
+// Reload returns an error and changes nothing if any other option is
+// given. An AccessList reloads its own files; see AccessList.Reload.
+func (s *Server) Reload(opts ...Option) error {
+	scratch := &Server{settings: defaultSettings()}
+	for _, opt := range opts {
+		opt(scratch)
+	}
+	v := reflect.ValueOf(scratch).Elem()
+	for i := range v.NumField() {
+		if f := v.Type().Field(i); f.Name != "settings" && !v.Field(i).IsZero() {
+			return fmt.Errorf("smtp: reload: option sets %s, which cannot change at runtime", f.Name)
+		}
+	}
+	cfg := scratch.settings
+	s.cfg.Store(&cfg)
+	s.logger.Info("configuration reloaded")
+	return nil
+}
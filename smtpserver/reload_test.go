@@ -0,0 +1,64 @@
+package smtpserver
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	srv := NewServer(WithHostname("test.example.com"), WithReadTimeout(5*time.Second), WithMaxRecipients(1))
+	session := func() *smtpConversation {
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() { clientConn.Close() })
+		go srv.handleConn(serverConn)
+		c := newConversation(t, clientConn)
+		c.expectCode(220)
+		c.send("EHLO test")
+		c.expectCode(250)
+		c.send("MAIL FROM:<sender@example.com>")
+		c.expectCode(250)
+		return c
+	}
+
+	old := session()
+	old.send("RCPT TO:<a@example.com>")
+	old.expectCode(250)
+
+	if err := srv.Reload(WithReadTimeout(5*time.Second), WithMaxRecipients(2), WithLocalDomains("example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The open session keeps the settings it started with.
+	old.send("RCPT TO:<b@example.com>")
+	old.expectCode(452)
+	old.send("RCPT TO:<c@example.org>")
+	old.expectCode(452)
+
+	c := session()
+	c.send("RCPT TO:<a@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<b@example.org>")
+	c.expectCode(554)
+	c.send("RCPT TO:<b@example.com>")
+	c.expectCode(250)
+
+	if err := srv.Reload(WithMaxRecipients(5), WithLogger(slog.Default())); err == nil {
+		t.Error("Reload accepted WithLogger")
+	}
+	c = session()
+	for i, code := range []int{250, 250, 452} { // Still 2 after the failed reload.
+		c.send(fmt.Sprintf("RCPT TO:<user%d@example.com>", i))
+		c.expectCode(code)
+	}
+
+	// Settings not given return to their defaults.
+	if err := srv.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	c = session()
+	c.send("RCPT TO:<b@example.org>")
+	c.expectCode(250)
+}
@@ -0,0 +1,101 @@
+package smtpserver
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+	"github.com/alexisbouchez/smtp.go/internal/textproto"
+)
+
+// ErrRejectSession, returned by ConnectionHandler.OnConnect on its own or
+// wrapped, refuses the client the way RFC 5321 §3.1 describes: the server
+// greets it with "554 5.7.1 No SMTP service here" but keeps the connection
+// open, answering every command except QUIT with 503, until the client
+// quits or the read timeout expires. Scanners are thus kept busy instead
+// of being freed to retry at once. Held connections count against
+// WithMaxConnections.
+var ErrRejectSession = errors.New("smtp: session rejected")
+
+// Default replies refusing a connection before the session starts.
+var (
+	errTooManyConns = smtp.Errorf(smtp.ReplyServiceNotAvailable, smtp.EnhancedCodeTempAuthFailure, "Too many connections, try again later")
+	errServerBusy   = smtp.Errorf(smtp.ReplyServiceNotAvailable, smtp.EnhancedCodeNotAccepting, "Server busy, try again later")
+	errConnRefused  = smtp.Errorf(smtp.ReplyServiceNotAvailable, smtp.EnhancedCodeTempAuthFailure, "Connection refused")
+)
+
+// replyText builds the text of a single-line reply: the enhanced status
+// code followed by msg. The class of the enhanced code is matched to the
+// reply code (RFC 3463 §2), so that a handler returning, say, 452 with
+// 5.5.3 sends 4.5.3. A zero enhanced code is omitted; it is used for the
+// intermediate 334 and 354 replies, which carry none (RFC 2034 §3).
+func replyText(code smtp.ReplyCode, enhanced smtp.EnhancedCode, msg string) string {
+	if enhanced.IsZero() {
+		return msg
+	}
+	return alignClass(code, enhanced).String() + " " + msg
+}
+
+// alignClass returns enhanced with its class set to that of code.
+func alignClass(code smtp.ReplyCode, enhanced smtp.EnhancedCode) smtp.EnhancedCode {
+	if class := code.Class(); !enhanced.IsZero() && (class == 2 || class == 4 || class == 5) {
+		enhanced.Class = class
+	}
+	return enhanced
+}
+
+// writeReply writes a reply with an enhanced status code. A msg of
+// several lines separated by "\n" becomes a multi-line reply with the
+// code on each line (RFC 2034 §3).
+func writeReply(conn *textproto.Conn, code smtp.ReplyCode, enhanced smtp.EnhancedCode, msg string) error {
+	lines := strings.Split(msg, "\n")
+	for i, line := range lines {
+		lines[i] = replyText(code, enhanced, line)
+	}
+	return conn.WriteReply(int(code), lines...)
+}
+
+// rejectConn refuses a connection before the session starts with err if
+// it is an *smtp.SMTPError, or with fallback otherwise.
+func rejectConn(conn *textproto.Conn, err error, fallback *smtp.SMTPError) {
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		smtpErr = fallback
+	}
+	writeReply(conn, smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+	conn.Close()
+}
+
+// holdRejected greets a client refused with ErrRejectSession with 554 and
+// answers its commands with 503 until it sends QUIT, a read fails or
+// times out, or the session time limit is reached.
+func (s *Server) holdRejected(conn *textproto.Conn) {
+	defer conn.Close()
+	if writeReply(conn, smtp.ReplyTransactionFailed, smtp.EnhancedCodeNotAuthorized, "No SMTP service here") != nil {
+		return
+	}
+	cfg := s.cfg.Load()
+	var sessionEnd time.Time
+	if cfg.maxSessionTime > 0 {
+		sessionEnd = time.Now().Add(cfg.maxSessionTime)
+	}
+	for {
+		deadline := time.Now().Add(cfg.readTimeout)
+		if !sessionEnd.IsZero() && sessionEnd.Before(deadline) {
+			deadline = sessionEnd
+		}
+		conn.SetReadDeadline(deadline)
+		line, err := conn.ReadLine(s.maxLineLen)
+		if err != nil {
+			return
+		}
+		if verb, _ := parseCommand(line); verb == "QUIT" {
+			writeReply(conn, smtp.ReplyServiceClosing, smtp.EnhancedCodeOK, "Bye")
+			return
+		}
+		if writeReply(conn, smtp.ReplyBadSequence, smtp.EnhancedCodeInvalidCommand, "No SMTP service here, send QUIT") != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package smtpserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+func TestReplyText(t *testing.T) {
+	tests := []struct {
+		code     smtp.ReplyCode
+		enhanced smtp.EnhancedCode
+		want     string
+	}{
+		{smtp.ReplyOK, smtp.EnhancedCodeOK, "2.0.0 text"},
+		{smtp.ReplyInsufficientStorage, smtp.EnhancedCodeTooManyRecipients, "4.5.3 text"},
+		{smtp.ReplyTransactionFailed, smtp.EnhancedCodeTempAuthFailure, "5.7.0 text"},
+		{smtp.ReplyStartMailInput, smtp.EnhancedCode{}, "text"},
+		{smtp.ReplyAuthContinue, smtp.EnhancedCode{}, "text"},
+	}
+	for _, tt := range tests {
+		if got := replyText(tt.code, tt.enhanced, "text"); got != tt.want {
+			t.Errorf("replyText(%d, %s) = %q, want %q", tt.code, tt.enhanced, got, tt.want)
+		}
+	}
+}
+
+// multiLineRejecter rejects every sender with a two-line reply.
+type multiLineRejecter struct{}
+
+func (multiLineRejecter) OnMail(context.Context, smtp.ReversePath) error {
+	return smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeNotAuthorized, "Sender blocked\nSee https://example.com/policy")
+}
+
+func TestMultiLineReply(t *testing.T) {
+	clientConn, _ := startTestServer(t, WithMailHandler(multiLineRejecter{}))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	lines := c.expectCode(550)
+	if len(lines) != 2 || lines[0] != "5.7.1 Sender blocked" || lines[1] != "5.7.1 See https://example.com/policy" {
+		t.Errorf("reply lines = %q", lines)
+	}
+}
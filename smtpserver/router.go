@@ -0,0 +1,188 @@
+package smtpserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// Route is a rule of a Router. A recipient matches it when the message
+// meets every condition set; unset conditions match anything.
+type Route struct {
+	// Recipients lists addresses ("user@example.com") and domains
+	// ("example.com"), compared case-insensitively, that the route
+	// applies to.
+	Recipients []string
+
+	// Senders lists sender addresses and domains, as Recipients; "<>"
+	// matches the null reverse-path.
+	Senders []string
+
+	// Header maps header field names to text one of the field's values
+	// must contain, compared case-insensitively; every entry must match.
+	Header map[string]string
+
+	// MinSize and MaxSize bound the message size in bytes; zero means no
+	// bound.
+	MinSize, MaxSize int64
+
+	// Handler delivers the message to the recipients matching the route.
+	Handler DataHandler
+}
+
+// Router is a DataHandler that chooses among delivery handlers, such as a
+// maildir, a relay and a webhook, by simple rules. Each recipient goes to
+// the first Route it matches, or to Default if none does, and each
+// handler is called once per message with its own recipients, in route
+// order. Routing stops at the first handler error, which OnData returns;
+// recipients already delivered may then receive the message again when
+// the client retries, so put handlers that are likely to fail first.
+//
+// The body is replayed to each handler: it is buffered in memory unless
+// the reader is an io.ReadSeeker, as with WithSpool.
+//
+// If a recipient matches no route and Default is nil, the message is
+// rejected with 554 5.1.2 before any handler is called.
+type Router struct {
+	Routes  []Route
+	Default DataHandler
+}
+
+var errNoRoute = smtp.Errorf(smtp.ReplyTransactionFailed, smtp.EnhancedCodeBadDestSystem, "No route to recipient")
+
+// routeMessage is what a Router matches routes against.
+type routeMessage struct {
+	from   smtp.ReversePath
+	header Header
+	size   int64
+}
+
+// OnData implements DataHandler.
+func (rt *Router) OnData(ctx context.Context, from smtp.ReversePath, to []smtp.ForwardPath, r io.Reader) error {
+	body, ok := r.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	msg := routeMessage{from: from}
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	msg.size = size
+	if rt.matchesHeader() {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		msg.header, _, err = ReadHeader(body)
+		if err != nil && !errors.Is(err, ErrHeaderTooLarge) {
+			return err
+		}
+	}
+
+	// Group the recipients by route; index len(rt.Routes) is Default.
+	groups := make([][]smtp.ForwardPath, len(rt.Routes)+1)
+	for _, rcpt := range to {
+		i := rt.route(&msg, rcpt)
+		if i == len(rt.Routes) && rt.Default == nil {
+			return errNoRoute
+		}
+		groups[i] = append(groups[i], rcpt)
+	}
+
+	for i, rcpts := range groups {
+		if len(rcpts) == 0 {
+			continue
+		}
+		h := rt.Default
+		if i < len(rt.Routes) {
+			h = rt.Routes[i].Handler
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := h.OnData(ctx, from, rcpts, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchesHeader reports whether any route has header conditions.
+func (rt *Router) matchesHeader() bool {
+	for _, route := range rt.Routes {
+		if len(route.Header) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the index of the first route rcpt matches, or
+// len(rt.Routes) if none does.
+func (rt *Router) route(msg *routeMessage, rcpt smtp.ForwardPath) int {
+	for i, route := range rt.Routes {
+		if route.matches(msg, rcpt) {
+			return i
+		}
+	}
+	return len(rt.Routes)
+}
+
+func (route *Route) matches(msg *routeMessage, rcpt smtp.ForwardPath) bool {
+	if len(route.Recipients) > 0 && !matchAddress(route.Recipients, rcpt.Mailbox) {
+		return false
+	}
+	if len(route.Senders) > 0 {
+		if msg.from.Null {
+			if !containsFold(route.Senders, "<>") {
+				return false
+			}
+		} else if !matchAddress(route.Senders, msg.from.Mailbox) {
+			return false
+		}
+	}
+	if route.MinSize > 0 && msg.size < route.MinSize || route.MaxSize > 0 && msg.size > route.MaxSize {
+		return false
+	}
+	for name, want := range route.Header {
+		if !headerContains(msg.header.Values(name), want) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAddress reports whether m is one of patterns, which are addresses
+// and domains.
+func matchAddress(patterns []string, m smtp.Mailbox) bool {
+	return containsFold(patterns, m.String()) || containsFold(patterns, m.Domain)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerContains reports whether one of values contains want, ignoring
+// case.
+func headerContains(values []string, want string) bool {
+	want = strings.ToLower(want)
+	for _, v := range values {
+		if strings.Contains(strings.ToLower(v), want) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package smtpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+func TestRouter(t *testing.T) {
+	maildir, relay, tickets, fallback := &testDataHandler{}, &testDataHandler{}, &testDataHandler{}, &testDataHandler{}
+	rt := &Router{
+		Routes: []Route{
+			{Recipients: []string{"support@example.com"}, Header: map[string]string{"Subject": "[ticket"}, Handler: tickets},
+			{Recipients: []string{"example.com"}, MaxSize: 1000, Handler: maildir},
+			{Senders: []string{"<>", "partner.example"}, Handler: relay},
+		},
+		Default: fallback,
+	}
+	ctx := context.Background()
+	from := smtp.ReversePath{Mailbox: smtp.Mailbox{LocalPart: "a", Domain: "Partner.Example"}}
+	msg := "Subject: Re: [Ticket #12] broken\r\n\r\nbody\r\n"
+
+	to := rcpts("support@example.com", "USER@example.com", "x@elsewhere.example")
+	if err := rt.OnData(ctx, from, to, strings.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+	for name, h := range map[string]*testDataHandler{"tickets": tickets, "maildir": maildir, "relay": relay} {
+		if len(h.messages) != 1 || h.messages[0].Body != msg {
+			t.Fatalf("%s got %d messages, want the message once", name, len(h.messages))
+		}
+	}
+	if got := fmt.Sprint(tickets.messages[0].To, maildir.messages[0].To, relay.messages[0].To); got != "[<support@example.com>] [<USER@example.com>] [<x@elsewhere.example>]" {
+		t.Errorf("recipients = %s", got)
+	}
+
+	// Too large for the maildir route, from another sender: Default.
+	large := "Subject: big\r\n\r\n" + strings.Repeat("x", 2000)
+	other := smtp.ReversePath{Mailbox: smtp.Mailbox{LocalPart: "b", Domain: "example.org"}}
+	if err := rt.OnData(ctx, other, rcpts("support@example.com"), strings.NewReader(large)); err != nil {
+		t.Fatal(err)
+	}
+	if len(fallback.messages) != 1 || len(maildir.messages) != 1 {
+		t.Errorf("large message went to maildir %d, default %d times", len(maildir.messages)-1, len(fallback.messages))
+	}
+
+	// The null sender matches "<>".
+	if err := rt.OnData(ctx, smtp.ReversePath{Null: true}, rcpts("x@elsewhere.example"), strings.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if len(relay.messages) != 2 {
+		t.Errorf("bounce was not relayed")
+	}
+
+	// Without Default, an unrouted recipient rejects the message.
+	rt.Default = nil
+	err := rt.OnData(ctx, other, rcpts("USER@example.com", "x@elsewhere.example"), strings.NewReader(msg))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != smtp.ReplyTransactionFailed {
+		t.Errorf("unrouted recipient: %v", err)
+	}
+	if len(maildir.messages) != 1 {
+		t.Errorf("message delivered to maildir despite the rejection")
+	}
+}
@@ -0,0 +1,242 @@
+package smtpserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+var errBadCredentials = smtp.Errorf(smtp.ReplyAuthFailed, smtp.EnhancedCodeAuthCredentials, "Bad credentials")
+
+// secretAuthHandler hands the server plaintext secrets.
+type secretAuthHandler map[string]string
+
+func (h secretAuthHandler) Authenticate(_ context.Context, _, username, password string) error {
+	if secret, ok := h[username]; ok && secret == password {
+		return nil
+	}
+	return errBadCredentials
+}
+
+func (h secretAuthHandler) Secret(_ context.Context, _, username string) (string, error) {
+	if secret, ok := h[username]; ok {
+		return secret, nil
+	}
+	return "", errBadCredentials
+}
+
+// scramStoreHandler stores SCRAM keys only.
+type scramStoreHandler map[string]SCRAMCredentials
+
+func (h scramStoreHandler) Authenticate(context.Context, string, string, string) error {
+	return errBadCredentials
+}
+
+func (h scramStoreHandler) SCRAMCredentials(_ context.Context, username string) (SCRAMCredentials, error) {
+	if creds, ok := h[username]; ok {
+		return creds, nil
+	}
+	return SCRAMCredentials{}, errBadCredentials
+}
+
+// challengeAuthHandler verifies CRAM-MD5 digests itself.
+type challengeAuthHandler struct{ secret string }
+
+func (h challengeAuthHandler) Authenticate(context.Context, string, string, string) error {
+	return errBadCredentials
+}
+
+func (h challengeAuthHandler) VerifyChallenge(_ context.Context, _, _, challenge, response string) error {
+	if response != cramDigest(h.secret, challenge) {
+		return errBadCredentials
+	}
+	return nil
+}
+
+func cramDigest(secret, challenge string) string {
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write([]byte(challenge))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func b64(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+func unb64(t *testing.T, s string) string {
+	t.Helper()
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatalf("decode %q: %v", s, err)
+	}
+	return string(b)
+}
+
+// cramExchange runs AUTH CRAM-MD5 for username with secret.
+func cramExchange(t *testing.T, c *smtpConversation, username, secret string) {
+	t.Helper()
+	c.send("AUTH CRAM-MD5")
+	challenge := unb64(t, c.expectCode(334)[0])
+	c.send(b64(username + " " + cramDigest(secret, challenge)))
+}
+
+func TestAUTH_CRAMMD5_Secret(t *testing.T) {
+	for name, h := range map[string]AuthHandler{
+		"SecretHandler":    secretAuthHandler{"testuser": "secret"},
+		"ChallengeHandler": challengeAuthHandler{secret: "secret"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			clientConn, _ := startTestServer(t, WithAuthHandler(h))
+			defer clientConn.Close()
+
+			c := newConversation(t, clientConn)
+			c.expectCode(220)
+			c.send("EHLO test")
+			c.expectCode(250)
+
+			cramExchange(t, c, "testuser", "wrong")
+			c.expectCode(535)
+			cramExchange(t, c, "testuser", "secret")
+			c.expectCode(235)
+		})
+	}
+}
+
+func TestCRAMMD5Challenge(t *testing.T) {
+	clientConn, _ := startTestServer(t, WithAuthHandler(secretAuthHandler{"testuser": "secret"}))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO test")
+	c.expectCode(250)
+
+	format := regexp.MustCompile(`^<[A-Z2-7]{26}\.[0-9]+@test\.example\.com>$`)
+	seen := make(map[string]bool)
+	for range 3 {
+		c.send("AUTH CRAM-MD5")
+		challenge := unb64(t, c.expectCode(334)[0])
+		if !format.MatchString(challenge) || seen[challenge] {
+			t.Errorf("challenge %q is malformed or repeated", challenge)
+		}
+		seen[challenge] = true
+		c.send("*")
+		c.expectCode(501)
+	}
+
+	clientConn, _ = startTestServer(t,
+		WithAuthHandler(challengeAuthHandler{secret: "secret"}),
+		WithCRAMMD5Challenge(func() string { return "<custom@example.com>" }),
+	)
+	defer clientConn.Close()
+	c = newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO test")
+	c.expectCode(250)
+	c.send("AUTH CRAM-MD5")
+	if challenge := unb64(t, c.expectCode(334)[0]); challenge != "<custom@example.com>" {
+		t.Errorf("challenge = %q, want the custom one", challenge)
+	}
+	c.send(b64("testuser " + cramDigest("secret", "<custom@example.com>")))
+	c.expectCode(235)
+}
+
+// scramExchange runs AUTH SCRAM-SHA-256 as a client would, checking the
+// server's proof, and returns the final reply code.
+func scramExchange(t *testing.T, c *smtpConversation, authzid, username, password string) int {
+	t.Helper()
+	gs2 := "n,,"
+	if authzid != "" {
+		gs2 = "n,a=" + authzid + ","
+	}
+	bare := "n=" + username + ",r=clientnonce"
+	c.send("AUTH SCRAM-SHA-256 " + b64(gs2+bare))
+	serverFirst := unb64(t, c.expectCode(334)[0])
+
+	attrs := scramAttrs(serverFirst)
+	salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+	iterations, _ := strconv.Atoi(attrs["i"])
+	if !strings.HasPrefix(attrs["r"], "clientnonce") || len(attrs["r"]) == len("clientnonce") || len(salt) == 0 || iterations < 4096 {
+		t.Fatalf("server-first-message = %q", serverFirst)
+	}
+	salted, _ := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=" + b64(gs2) + ",r=" + attrs["r"]
+	authMessage := bare + "," + serverFirst + "," + withoutProof
+	proof := make([]byte, len(clientKey))
+	subtle.XORBytes(proof, clientKey, hmacSHA256(storedKey[:], authMessage))
+	c.send(b64(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+
+	code, lines := c.readReply()
+	if code != 334 {
+		return code
+	}
+	want := "v=" + base64.StdEncoding.EncodeToString(hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage))
+	if got := unb64(t, lines[0]); got != want {
+		t.Errorf("server-final-message = %q, want %q", got, want)
+	}
+	c.send("")
+	code, _ = c.readReply()
+	return code
+}
+
+func TestAUTH_SCRAM(t *testing.T) {
+	stored, err := DeriveSCRAMCredentials("pencil", []byte("saltsaltsalt"), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, h := range map[string]AuthHandler{
+		"SecretHandler": secretAuthHandler{"user": "pencil"},
+		"SCRAMHandler":  scramStoreHandler{"user": stored},
+	} {
+		t.Run(name, func(t *testing.T) {
+			clientConn, _ := startTestServer(t, WithAuthHandler(h))
+			defer clientConn.Close()
+
+			c := newConversation(t, clientConn)
+			c.expectCode(220)
+			c.send("EHLO test")
+			if ehlo := c.expectCode(250); !slices.Contains(ehlo, "AUTH PLAIN LOGIN CRAM-MD5 SCRAM-SHA-256") {
+				t.Errorf("EHLO does not advertise SCRAM-SHA-256: %v", ehlo)
+			}
+
+			if code := scramExchange(t, c, "", "user", "wrong"); code != 535 {
+				t.Errorf("wrong password: reply %d, want 535", code)
+			}
+			if code := scramExchange(t, c, "", "nobody", "pencil"); code != 535 {
+				t.Errorf("unknown user: reply %d, want 535", code)
+			}
+			if code := scramExchange(t, c, "admin", "user", "pencil"); code != 535 {
+				t.Errorf("authzid without AuthzHandler: reply %d, want 535", code)
+			}
+			if code := scramExchange(t, c, "", "user", "pencil"); code != 235 {
+				t.Errorf("valid credentials: reply %d, want 235", code)
+			}
+		})
+	}
+}
+
+func TestAUTH_SCRAM_NotAdvertised(t *testing.T) {
+	clientConn, _ := startTestServer(t, WithAuthHandler(&testAuthHandler{}))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO test")
+	if ehlo := strings.Join(c.expectCode(250), "\n"); strings.Contains(ehlo, "SCRAM") {
+		t.Errorf("EHLO advertises SCRAM without a SecretHandler:\n%s", ehlo)
+	}
+	c.send("AUTH SCRAM-SHA-256 " + b64("n,,n=user,r=abc"))
+	c.expectCode(501)
+}
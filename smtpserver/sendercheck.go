@@ -0,0 +1,133 @@
+package smtpserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+	"github.com/alexisbouchez/smtp.go/internal/ttlcache"
+)
+
+// DefaultBogusTLDs lists top-level domains that never resolve on the
+// public Internet and are rejected by SenderDomainCheck.
+var DefaultBogusTLDs = []string{
+	"example", "home", "internal", "invalid", "lan", "local",
+	"localdomain", "localhost", "test",
+}
+
+// Resolver performs the DNS lookups of SenderDomainCheck. *net.Resolver
+// satisfies it.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// SenderDomainCheck is a MailHandler that rejects senders whose domain
+// cannot receive mail: the domain must have an MX record, or failing that
+// an A or AAAA record, and must not be in a bogus TLD. Missing domains get
+// 550 5.1.8, DNS failures 450 4.1.8. Results are cached per domain. The
+// null sender and address literals are always accepted.
+//
+// The zero value is ready to use. Set Next to run another MailHandler for
+// senders that pass.
+type SenderDomainCheck struct {
+	Resolver  Resolver      // Nil means net.DefaultResolver.
+	BogusTLDs []string      // Nil means DefaultBogusTLDs.
+	CacheTTL  time.Duration // Zero means 10 minutes; negative disables caching.
+	Next      MailHandler
+
+	cache ttlcache.Cache[*smtp.SMTPError] // Nil for a valid domain.
+}
+
+var (
+	errSenderDomainInvalid = smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeBadSenderSystem, "Sender domain does not exist")
+	errSenderDomainNullMX  = smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeBadSenderSystem, "Sender domain does not accept mail")
+	errSenderDomainTemp    = smtp.Errorf(smtp.ReplyMailboxBusy, smtp.EnhancedCodeTempSenderSystem, "Sender domain lookup failed, try again later")
+)
+
+// OnMail implements MailHandler.
+func (c *SenderDomainCheck) OnMail(ctx context.Context, from smtp.ReversePath) error {
+	if !from.Null {
+		if err := c.check(ctx, strings.ToLower(from.Mailbox.Domain)); err != nil {
+			return err
+		}
+	}
+	if c.Next != nil {
+		return c.Next.OnMail(ctx, from)
+	}
+	return nil
+}
+
+// check returns the rejection for domain, or nil if it is valid.
+func (c *SenderDomainCheck) check(ctx context.Context, domain string) *smtp.SMTPError {
+	if strings.HasPrefix(domain, "[") {
+		return nil // Address literal.
+	}
+	domain = strings.TrimSuffix(domain, ".")
+
+	bogus := c.BogusTLDs
+	if bogus == nil {
+		bogus = DefaultBogusTLDs
+	}
+	tld := domain[strings.LastIndexByte(domain, '.')+1:]
+	for _, b := range bogus {
+		if tld == b {
+			return errSenderDomainInvalid
+		}
+	}
+
+	ttl := c.CacheTTL
+	if ttl == 0 {
+		ttl = 10 * time.Minute
+	}
+	if ttl > 0 {
+		if err, ok := c.cache.Get(domain, time.Now()); ok {
+			return err
+		}
+	}
+
+	err := c.lookup(ctx, domain)
+	if ttl > 0 && err != errSenderDomainTemp {
+		c.cache.Set(domain, err, time.Now(), ttl)
+	}
+	return err
+}
+
+// lookup resolves the MX records of domain, falling back to address
+// records as RFC 5321 §5.1 does for delivery.
+func (c *SenderDomainCheck) lookup(ctx context.Context, domain string) *smtp.SMTPError {
+	var resolver Resolver = net.DefaultResolver
+	if c.Resolver != nil {
+		resolver = c.Resolver
+	}
+
+	mxs, err := resolver.LookupMX(ctx, domain)
+	if err == nil && len(mxs) > 0 {
+		if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+			return errSenderDomainNullMX // RFC 7505 null MX.
+		}
+		return nil
+	}
+	if err != nil && !isNotFound(err) {
+		return errSenderDomainTemp
+	}
+
+	addrs, err := resolver.LookupHost(ctx, domain)
+	switch {
+	case err == nil && len(addrs) > 0:
+		return nil
+	case err == nil || isNotFound(err):
+		return errSenderDomainInvalid
+	}
+	return errSenderDomainTemp
+}
+
+// isNotFound reports whether err is an authoritative "no such name or
+// record" DNS answer.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,148 @@
+package smtpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+type fakeResolver struct {
+	mx      map[string][]*net.MX
+	hosts   map[string][]string
+	fail    map[string]bool // Domains whose lookups time out.
+	lookups int
+}
+
+func (r *fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	r.lookups++
+	if r.fail[name] {
+		return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true, IsTemporary: true}
+	}
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestSenderDomainCheck(t *testing.T) {
+	resolver := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com":        {{Host: "mx.example.com.", Pref: 10}},
+			"nomail.example.org": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{"a-only.example.net": {"192.0.2.1"}},
+		fail:  map[string]bool{"flaky.example.com": true},
+	}
+	check := &SenderDomainCheck{Resolver: resolver}
+
+	tests := []struct {
+		from string
+		code smtp.ReplyCode // Zero means accepted.
+	}{
+		{"user@example.com", 0},
+		{"user@EXAMPLE.com", 0},
+		{"user@a-only.example.net", 0},
+		{"", 0}, // Null sender.
+		{"user@missing.example.com", smtp.ReplyMailboxNotFound},
+		{"user@nomail.example.org", smtp.ReplyMailboxNotFound},
+		{"user@printer.local", smtp.ReplyMailboxNotFound},
+		{"user@flaky.example.com", smtp.ReplyMailboxBusy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from, func(t *testing.T) {
+			from, err := smtp.ParseReversePath("<" + tt.from + ">")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = check.OnMail(context.Background(), from)
+			if tt.code == 0 {
+				if err != nil {
+					t.Fatalf("OnMail = %v, want nil", err)
+				}
+				return
+			}
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != tt.code {
+				t.Fatalf("OnMail = %v, want code %d", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestSenderDomainCheck_Cache(t *testing.T) {
+	resolver := &fakeResolver{
+		mx:   map[string][]*net.MX{"example.com": {{Host: "mx.example.com.", Pref: 10}}},
+		fail: map[string]bool{"flaky.example.com": true},
+	}
+	check := &SenderDomainCheck{Resolver: resolver}
+	ctx := context.Background()
+	valid, _ := smtp.ParseReversePath("<a@example.com>")
+	flaky, _ := smtp.ParseReversePath("<a@flaky.example.com>")
+
+	check.OnMail(ctx, valid)
+	check.OnMail(ctx, valid)
+	if resolver.lookups != 1 {
+		t.Errorf("lookups = %d, want 1 (cached)", resolver.lookups)
+	}
+
+	// Temporary failures are not cached.
+	check.OnMail(ctx, flaky)
+	check.OnMail(ctx, flaky)
+	if resolver.lookups != 3 {
+		t.Errorf("lookups = %d, want 3", resolver.lookups)
+	}
+}
+
+func TestSenderDomainCheck_CacheSweep(t *testing.T) {
+	check := &SenderDomainCheck{Resolver: &fakeResolver{}, CacheTTL: time.Nanosecond}
+	for i := range 2048 {
+		check.check(context.Background(), fmt.Sprintf("d%d.example.com", i))
+	}
+	if n := check.cache.Len(); n >= 1024 {
+		t.Errorf("cache holds %d entries after they expired", n)
+	}
+}
+
+func TestSenderDomainCheck_Next(t *testing.T) {
+	next := &recordingMailHandler{}
+	check := &SenderDomainCheck{
+		Resolver: &fakeResolver{mx: map[string][]*net.MX{"example.com": {{Host: "mx.example.com."}}}},
+		Next:     next,
+	}
+	clientConn, _ := startTestServer(t, WithMailHandler(check))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<user@missing.example.com>")
+	c.expectCode(550)
+	c.send("MAIL FROM:<user@example.com>")
+	c.expectCode(250)
+
+	if next.calls != 1 {
+		t.Errorf("Next called %d times, want 1", next.calls)
+	}
+}
+
+type recordingMailHandler struct {
+	calls int
+}
+
+func (h *recordingMailHandler) OnMail(context.Context, smtp.ReversePath) error {
+	h.calls++
+	return nil
+}
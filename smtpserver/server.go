@@ -3,45 +3,95 @@ package smtpserver
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"log/slog"
 	"net"
+	"net/netip"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/alexisbouchez/smtp.go"
 	"github.com/alexisbouchez/smtp.go/internal/textproto"
 )
 
 // Server is an SMTP server that listens for incoming connections and
 // dispatches them to handler interfaces.
 type Server struct {
-	addr           string
-	hostname       string
-	readTimeout    time.Duration
-	writeTimeout   time.Duration
-	maxMessageSize int64
-	maxRecipients  int
-	tlsConfig      *tls.Config
-	logger         *slog.Logger
-
-	connHandler  ConnectionHandler
-	heloHandler  HeloHandler
-	mailHandler  MailHandler
-	rcptHandler  RcptHandler
-	dataHandler  DataHandler
-	resetHandler ResetHandler
-	vrfyHandler  VrfyHandler
+	settings // Reloadable settings, as given to NewServer; see Reload.
+
+	addr             string
+	hostname         string
+	sniHostname      func(serverName string) string
+	maxBdatChunkSize int64
+	maxBdatChunks    int
+	maxLineLen       int
+	readBufSize      int
+	writeBufSize     int
+	spooling         bool   // Receive bodies whole before OnData; see WithSpool.
+	spoolDir         string // Directory for spool files; "" for os.TempDir.
+	spoolMemory      int64  // Body bytes kept in memory before spooling to a file.
+	tlsConfig        *tls.Config
+	certs            *certReloader
+	certManager      CertificateManager
+	acmeAddr         string
+	logger           *slog.Logger
+
+	connHandler    ConnectionHandler
+	policyHandler  PolicyHandler
+	cmdHandler     CommandHandler
+	heloHandler    HeloHandler
+	mailHandler    MailHandler
+	rcptHandler    RcptHandler
+	dataHandler    DataHandler
+	resetHandler   ResetHandler
+	vrfyHandler    VrfyHandler
+	expnHandler    ExpnHandler
 	authHandler    AuthHandler
+	eventHandler   EventHandler
+	journal        Journal
+	backend        Backend
+	loadChecker    func() error
+	errorHandler   func(ctx context.Context, err error, info SessionSummary)
+	sessionLogger  func(ctx context.Context, remoteAddr net.Addr) *slog.Logger
+	accessList     *AccessList
+	proxyProtocol  bool           // Read a PROXY header from proxyNets.
+	proxyNets      []netip.Prefix // Proxies trusted for PROXY headers; empty for any.
 	submissionMode bool
-
-	maxConnections   int
-	maxInvalidCmds   int
-
-	listener net.Listener
-	wg       sync.WaitGroup
-	quit     chan struct{}
-	mu       sync.Mutex
-	connSem  chan struct{} // Semaphore for limiting concurrent connections.
+	allowReauth    bool
+	disableVRFY    bool
+	strictSyntax   bool
+	singleBounce   bool // Limit MAIL FROM:<> to one recipient.
+
+	maxConnections int
+	maxBandwidth   int64 // Bytes per second for DATA/BDAT reads; 0 = unlimited.
+	throughput     *throughputLimiter
+	acceptRate     *acceptLimiter
+	slowCommand    time.Duration
+	stallTimeout   time.Duration
+	handlerBudget  time.Duration
+
+	authFailureDelay   time.Duration
+	authFailureHandler func(ctx context.Context, f AuthFailure)
+	cramChallengeFunc  func() string
+	saltKey            [32]byte // Keys fakeSalt; set once on first use.
+	saltKeyOnce        sync.Once
+
+	rejectNUL          bool
+	rejectControlChars bool
+	validateUTF8       bool
+
+	listeners   []servedListener
+	extensions  []extension // Added with RegisterExtension; replaced, never modified.
+	acmeStarted bool
+	wg          sync.WaitGroup
+	quit        chan struct{}
+	mu          sync.Mutex
+	connSem     chan struct{} // Semaphore for limiting concurrent connections.
+	refuseSem   chan struct{} // Semaphore for refusals over the limit that need a goroutine.
+	sessions    map[*session]struct{}
+	stats       serverStats
+	cfg         atomic.Pointer[settings] // Settings for new sessions.
 }
 
 // Option configures a Server.
@@ -50,19 +100,20 @@ type Option func(*Server)
 // NewServer creates a new SMTP server with the given options.
 func NewServer(opts ...Option) *Server {
 	s := &Server{
-		addr:           ":25",
-		hostname:       "localhost",
-		readTimeout:    5 * time.Minute,
-		writeTimeout:   5 * time.Minute,
-		maxMessageSize: 10 * 1024 * 1024, // 10 MB
-		maxRecipients:  100,
-		maxInvalidCmds: 10,
-		logger:         slog.Default(),
-		quit:           make(chan struct{}),
+		settings:      defaultSettings(),
+		addr:          ":25",
+		hostname:      "localhost",
+		maxBdatChunks: 10000,
+		maxLineLen:    textproto.MaxCommandLineLen,
+		logger:        slog.Default(),
+		quit:          make(chan struct{}),
 	}
 	for _, opt := range opts {
 		opt(s)
 	}
+	cfg := s.settings
+	s.cfg.Store(&cfg)
+	s.setupCertificates()
 	return s
 }
 
@@ -76,6 +127,17 @@ func WithHostname(hostname string) Option {
 	return func(s *Server) { s.hostname = hostname }
 }
 
+// WithSNIHostname sets a function mapping the server name a client asks
+// for in the TLS handshake (SNI) to the hostname used in the EHLO, HELO and
+// QUIT replies and returned by ServerHostname, for hosting several mail
+// domains on one server. An empty result keeps the WithHostname value.
+// With implicit TLS the greeting banner uses it too; with STARTTLS the
+// greeting has been sent before the client names a server. Pick the
+// matching certificate with tls.Config.GetCertificate.
+func WithSNIHostname(fn func(serverName string) string) Option {
+	return func(s *Server) { s.sniHostname = fn }
+}
+
 // WithReadTimeout sets the timeout for reading client commands.
 func WithReadTimeout(d time.Duration) Option {
 	return func(s *Server) { s.readTimeout = d }
@@ -91,11 +153,42 @@ func WithMaxMessageSize(n int64) Option {
 	return func(s *Server) { s.maxMessageSize = n }
 }
 
+// WithMaxBdatChunkSize sets the largest BDAT chunk accepted, in bytes.
+// Larger chunks are read and discarded, and the transaction fails with 552.
+// Zero, the default, leaves chunks bounded only by the message size limit.
+func WithMaxBdatChunkSize(n int64) Option {
+	return func(s *Server) { s.maxBdatChunkSize = n }
+}
+
+// WithMaxBdatChunks sets the number of BDAT chunks accepted per message;
+// further chunks are discarded, and the transaction fails with 552. This
+// bounds the per-command work a client can cause with many tiny chunks,
+// which the message size limit does not. Default is 10000; zero means no
+// limit.
+func WithMaxBdatChunks(n int) Option {
+	return func(s *Server) { s.maxBdatChunks = n }
+}
+
 // WithMaxRecipients sets the maximum number of recipients per transaction.
 func WithMaxRecipients(n int) Option {
 	return func(s *Server) { s.maxRecipients = n }
 }
 
+// WithMaxLineLength sets the longest command line accepted, including
+// CRLF. The default is 512, the minimum RFC 5321 §4.5.3.1.4 requires;
+// longer lines end the session.
+func WithMaxLineLength(n int) Option {
+	return func(s *Server) { s.maxLineLen = n }
+}
+
+// WithBufferSizes sets the per-connection read and write buffer sizes.
+// The default is 4096 bytes each: high-throughput relays benefit from
+// 64 KB, while small deployments with many idle connections can use less.
+// Zero keeps the default.
+func WithBufferSizes(read, write int) Option {
+	return func(s *Server) { s.readBufSize, s.writeBufSize = read, write }
+}
+
 // WithTLSConfig sets the TLS configuration for STARTTLS support.
 func WithTLSConfig(c *tls.Config) Option {
 	return func(s *Server) { s.tlsConfig = c }
@@ -106,11 +199,25 @@ func WithLogger(l *slog.Logger) Option {
 	return func(s *Server) { s.logger = l }
 }
 
+// WithSessionLogger sets a function that supplies the logger for each
+// connection, e.g. one tagged with a tenant looked up from the address.
+// It is called when the connection is accepted, with a context carrying
+// the SessionID; the session then logs only through the returned logger,
+// adding its "session" attribute. A nil result means the server logger.
+func WithSessionLogger(fn func(ctx context.Context, remoteAddr net.Addr) *slog.Logger) Option {
+	return func(s *Server) { s.sessionLogger = fn }
+}
+
 // WithConnectionHandler sets the handler called on new connections.
 func WithConnectionHandler(h ConnectionHandler) Option {
 	return func(s *Server) { s.connHandler = h }
 }
 
+// WithCommandHandler sets the handler called with each raw command line.
+func WithCommandHandler(h CommandHandler) Option {
+	return func(s *Server) { s.cmdHandler = h }
+}
+
 // WithHeloHandler sets the handler called on EHLO/HELO.
 func WithHeloHandler(h HeloHandler) Option {
 	return func(s *Server) { s.heloHandler = h }
@@ -141,12 +248,42 @@ func WithVrfyHandler(h VrfyHandler) Option {
 	return func(s *Server) { s.vrfyHandler = h }
 }
 
+// WithExpnHandler sets the handler called on EXPN.
+func WithExpnHandler(h ExpnHandler) Option {
+	return func(s *Server) { s.expnHandler = h }
+}
+
 // WithAuthHandler sets the handler called for SMTP AUTH.
-// When set, the server advertises AUTH with PLAIN, LOGIN, and CRAM-MD5 mechanisms.
+// When set, the server advertises AUTH with PLAIN, LOGIN, and CRAM-MD5 mechanisms,
+// and SCRAM-SHA-256 if h implements SecretHandler or SCRAMHandler.
 func WithAuthHandler(h AuthHandler) Option {
 	return func(s *Server) { s.authHandler = h }
 }
 
+// WithEventHandler sets the handler that receives session events
+// (connect, EHLO, AUTH results, accepted and rejected messages, disconnect).
+func WithEventHandler(h EventHandler) Option {
+	return func(s *Server) { s.eventHandler = h }
+}
+
+// WithDisableVRFY makes the server answer every VRFY with 502 5.5.1, even
+// when a VrfyHandler is set, for security baselines (such as CIS) that
+// require VRFY to be disabled rather than answered with 252.
+func WithDisableVRFY(disabled bool) Option {
+	return func(s *Server) { s.disableVRFY = disabled }
+}
+
+// WithSingleRecipientBounces limits transactions with the null
+// reverse-path (MAIL FROM:<>), which carry bounces and other delivery
+// notifications, to one recipient: a notification goes back to the
+// sender of one message, so a null-sender message for many recipients is
+// almost always spam. Further RCPT commands get 452 4.5.3, which a
+// legitimate MTA answers by sending the notification to each of them in
+// a separate transaction.
+func WithSingleRecipientBounces(enabled bool) Option {
+	return func(s *Server) { s.singleBounce = enabled }
+}
+
 // WithSubmissionMode enables message submission semantics (RFC 6409).
 // In submission mode, clients must authenticate before sending MAIL FROM.
 // Unauthenticated MAIL FROM commands receive a 530 reply.
@@ -154,18 +291,137 @@ func WithSubmissionMode(enabled bool) Option {
 	return func(s *Server) { s.submissionMode = enabled }
 }
 
+// WithAllowReauth lets an authenticated client issue AUTH again to switch
+// identity. A successful AUTH replaces the identity; a failed one leaves
+// the session unauthenticated. By default a second AUTH gets 503, as RFC
+// 4954 §4 requires.
+func WithAllowReauth(allowed bool) Option {
+	return func(s *Server) { s.allowReauth = allowed }
+}
+
 // WithMaxConnections sets the maximum number of concurrent connections.
 // Zero means unlimited.
 func WithMaxConnections(n int) Option {
 	return func(s *Server) { s.maxConnections = n }
 }
 
+// WithLoadChecker sets a function consulted for every new connection
+// before the greeting and before any ConnectionHandler. A non-nil error
+// sheds the connection with 421 (or the code of a returned *smtp.SMTPError)
+// and is counted in Stats.ConnectionsShed rather than ConnectionsRejected.
+// Use it to turn away clients on external signals such as CPU load, queue
+// depth or downstream health. The function must be fast and safe for
+// concurrent use.
+func WithLoadChecker(fn func() error) Option {
+	return func(s *Server) { s.loadChecker = fn }
+}
+
+// WithLocalDomains makes the server an inbound MX for the given domains:
+// RCPT TO for any other domain is rejected with 554 5.7.1 "Relay access
+// denied" unless the session is authenticated or the client is in a
+// network set with WithTrustedNetworks. Domains match case-insensitively
+// and do not include subdomains.
+func WithLocalDomains(domains ...string) Option {
+	return func(s *Server) {
+		if s.localDomains == nil {
+			s.localDomains = make(map[string]bool, len(domains))
+		}
+		for _, d := range domains {
+			s.localDomains[strings.ToLower(d)] = true
+		}
+	}
+}
+
+// WithTrustedNetworks sets client networks that may relay to any domain
+// despite WithLocalDomains, such as an internal application subnet.
+func WithTrustedNetworks(prefixes ...netip.Prefix) Option {
+	return func(s *Server) { s.trustedNets = append(s.trustedNets, prefixes...) }
+}
+
 // WithMaxInvalidCommands sets the maximum number of invalid commands per
 // session before the server disconnects the client. Default is 10.
 func WithMaxInvalidCommands(n int) Option {
 	return func(s *Server) { s.maxInvalidCmds = n }
 }
 
+// WithMaxAuthFailures sets the number of failed AUTH attempts (535
+// replies) after which the server answers "421 4.7.0 Too many
+// authentication failures" instead and closes the connection, as Postfix
+// and Dovecot do. Failed attempts do not count as invalid commands. Zero,
+// the default, allows any number.
+func WithMaxAuthFailures(n int) Option {
+	return func(s *Server) { s.maxAuthFailures = n }
+}
+
+// WithMaxBandwidthPerConn limits how fast a single connection may upload
+// message data via DATA or BDAT, in bytes per second. Command lines are not
+// throttled. Zero means unlimited.
+func WithMaxBandwidthPerConn(bytesPerSec int64) Option {
+	return func(s *Server) { s.maxBandwidth = bytesPerSec }
+}
+
+// WithAcceptRate caps the rate at which the server accepts connections,
+// across all listeners, at perSecond on average with bursts of up to burst
+// connections. Beyond the rate the server delays accepting, so clients
+// queue in the listen backlog rather than all opening sessions at once,
+// as after an outage when every sender retries together. Delays are
+// counted in Stats.AcceptsThrottled. A rate of zero, the default,
+// disables the limit.
+func WithAcceptRate(perSecond float64, burst int) Option {
+	return func(s *Server) {
+		if perSecond <= 0 {
+			s.acceptRate = nil
+			return
+		}
+		s.acceptRate = newAcceptLimiter(perSecond, max(burst, 1))
+	}
+}
+
+// WithThroughputLimit caps the number of messages and bytes the server
+// accepts per interval, across all connections. Once the budget for the
+// current interval is used up, MAIL FROM is answered with
+// 452 4.3.2 "System load too high" until the next interval begins; the
+// connection stays open so the client can retry. Zero disables either limit.
+func WithThroughputLimit(maxMessages int, maxBytes int64, interval time.Duration) Option {
+	return func(s *Server) {
+		if interval <= 0 || (maxMessages <= 0 && maxBytes <= 0) {
+			s.throughput = nil
+			return
+		}
+		s.throughput = newThroughputLimiter(maxMessages, maxBytes, interval)
+	}
+}
+
+// WithMaxSessionDuration caps the total lifetime of a session regardless of
+// activity. Once the limit is reached the server replies 421 and closes the
+// connection at the next command boundary; an in-progress DATA or BDAT
+// transfer is allowed to finish. Zero means unlimited.
+func WithMaxSessionDuration(d time.Duration) Option {
+	return func(s *Server) { s.maxSessionTime = d }
+}
+
+// WithRejectNUL rejects messages whose body contains NUL bytes with
+// 554 5.6.0. NUL bytes are always refused in command lines; this option
+// extends the check to DATA and BDAT content.
+func WithRejectNUL(enabled bool) Option {
+	return func(s *Server) { s.rejectNUL = enabled }
+}
+
+// WithRejectControlChars rejects messages whose body contains control
+// characters other than CR, LF and TAB (including NUL and DEL) with
+// 554 5.6.0.
+func WithRejectControlChars(enabled bool) Option {
+	return func(s *Server) { s.rejectControlChars = enabled }
+}
+
+// WithValidateUTF8Headers rejects messages sent with the SMTPUTF8 MAIL
+// parameter whose header section is not valid UTF-8 with 554 5.6.7, so
+// that downstream internationalized-mail processing never sees mixed
+// encodings. The body and transactions without SMTPUTF8 are not checked.
+func WithValidateUTF8Headers(enabled bool) Option {
+	return func(s *Server) { s.validateUTF8 = enabled }
+}
+
 // ListenAndServe starts listening on the configured address and serves
 // SMTP connections. It blocks until the server is shut down.
 func (s *Server) ListenAndServe() error {
@@ -176,18 +432,74 @@ func (s *Server) ListenAndServe() error {
 	return s.Serve(ln)
 }
 
-// Serve accepts connections on the given listener and serves them.
+// ListenAndServeTLS is like ListenAndServe but serves implicit TLS, as
+// ServeTLS does. Set the address with WithAddr, typically ":465".
+func (s *Server) ListenAndServeTLS() error {
+	if s.tlsConfig == nil {
+		return errNoTLSConfig
+	}
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(ln)
+}
+
+// errNoTLSConfig is returned by ServeTLS without a certificate source.
+var errNoTLSConfig = errors.New("smtp: implicit TLS needs WithTLSConfig, WithCertificateFiles or WithCertificateManager")
+
+// ServeTLS is like Serve but runs TLS from the start of every connection
+// (implicit TLS, RFC 8314), as on the submissions port 465, with the
+// configuration set by WithTLSConfig, WithCertificateFiles or
+// WithCertificateManager. The handshake completes before the greeting,
+// and STARTTLS is not offered. A server may serve several listeners at
+// once, such as port 587 with Serve and port 465 with ServeTLS.
+func (s *Server) ServeTLS(ln net.Listener) error {
+	if s.tlsConfig == nil {
+		ln.Close()
+		return errNoTLSConfig
+	}
+	return s.serve(servedListener{ln, true}, tls.NewListener(s.withProxyProtocol(ln), s.tlsConfig))
+}
+
+// Serve accepts connections on the given listener and serves them. It
+// may be called for several listeners; the connection limit is shared.
 func (s *Server) Serve(ln net.Listener) error {
+	return s.serve(servedListener{ln, false}, s.withProxyProtocol(ln))
+}
+
+// servedListener is a listener as passed to Serve or ServeTLS.
+type servedListener struct {
+	net.Listener
+	implicitTLS bool
+}
+
+// serve runs the accept loop of Serve and ServeTLS on ln, which wraps
+// the listener sl.
+func (s *Server) serve(sl servedListener, ln net.Listener) error {
 	s.mu.Lock()
-	s.listener = ln
-	if s.maxConnections > 0 {
+	s.listeners = append(s.listeners, sl)
+	if s.maxConnections > 0 && s.connSem == nil {
 		s.connSem = make(chan struct{}, s.maxConnections)
+		s.refuseSem = make(chan struct{}, maxPendingRefusals)
 	}
+	startACME := !s.acmeStarted
+	s.acmeStarted = true
 	s.mu.Unlock()
 
+	if startACME {
+		if err := s.startACMEChallenges(); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+
 	s.logger.Info("smtp server listening", "addr", ln.Addr())
 
 	for {
+		if !s.throttleAccept() {
+			return nil
+		}
 		conn, err := ln.Accept()
 		if err != nil {
 			select {
@@ -206,9 +518,7 @@ func (s *Server) Serve(ln net.Listener) error {
 				// Acquired a slot.
 			default:
 				// At capacity — reject with 421.
-				tc := textproto.NewConn(conn)
-				tc.WriteReply(int(smtp.ReplyServiceNotAvailable), "4.7.0 Too many connections, try again later")
-				conn.Close()
+				s.rejectOverLimit(conn)
 				continue
 			}
 		}
@@ -224,14 +534,63 @@ func (s *Server) Serve(ln net.Listener) error {
 	}
 }
 
-// Addr returns the listener's address, or nil if not listening.
+const (
+	// refuseTimeout bounds the TLS handshake or PROXY header and the 421
+	// reply of a connection refused over WithMaxConnections.
+	refuseTimeout = 5 * time.Second
+
+	// maxPendingRefusals bounds the refusals of TLS and PROXY connections
+	// in progress. Beyond it, such connections are closed at once.
+	maxPendingRefusals = 32
+)
+
+// rejectOverLimit refuses a connection accepted while WithMaxConnections
+// sessions are open, counting, logging and reporting it so that operators
+// can tell when the server runs at its cap.
+func (s *Server) rejectOverLimit(conn net.Conn) {
+	switch conn.(type) {
+	case *tls.Conn, *proxyConn:
+		// The reply needs a handshake or the client address a PROXY
+		// header, neither of which may hold up the accept loop.
+		select {
+		case s.refuseSem <- struct{}{}:
+		default:
+			s.stats.connectionsOverLimit.Add(1)
+			conn.Close()
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() { <-s.refuseSem }()
+			conn.SetDeadline(time.Now().Add(refuseTimeout))
+			s.refuseOverLimit(conn)
+		}()
+	default:
+		s.refuseOverLimit(conn)
+	}
+}
+
+func (s *Server) refuseOverLimit(conn net.Conn) {
+	if proxyHeaderError(conn) != nil {
+		conn.Close()
+		return
+	}
+	s.stats.connectionsOverLimit.Add(1)
+	s.logger.Warn("connection limit reached", "remote", conn.RemoteAddr(), "limit", s.maxConnections)
+	s.emit(Event{Type: EventConnectionLimit, RemoteAddr: conn.RemoteAddr(), Err: errTooManyConns})
+	rejectConn(textproto.NewConn(conn), nil, errTooManyConns)
+}
+
+// Addr returns the address of the first listener served, or nil if not
+// listening.
 func (s *Server) Addr() net.Addr {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.listener == nil {
+	if len(s.listeners) == 0 {
 		return nil
 	}
-	return s.listener.Addr()
+	return s.listeners[0].Addr()
 }
 
 // Shutdown gracefully shuts down the server. It stops accepting new
@@ -239,14 +598,7 @@ func (s *Server) Addr() net.Addr {
 // the context deadline.
 func (s *Server) Shutdown(ctx context.Context) error {
 	close(s.quit)
-
-	s.mu.Lock()
-	ln := s.listener
-	s.mu.Unlock()
-
-	if ln != nil {
-		ln.Close()
-	}
+	s.closeListeners()
 
 	done := make(chan struct{})
 	go func() {
@@ -262,14 +614,22 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	}
 }
 
-// Close immediately closes the listener and all connections.
+// Close immediately closes the listeners and all connections.
 func (s *Server) Close() error {
 	close(s.quit)
+	return s.closeListeners()
+}
+
+// closeListeners closes every listener being served.
+func (s *Server) closeListeners() error {
 	s.mu.Lock()
-	ln := s.listener
+	listeners := s.listeners
 	s.mu.Unlock()
-	if ln != nil {
-		return ln.Close()
+	var errs []error
+	for _, ln := range listeners {
+		if err := ln.Close(); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
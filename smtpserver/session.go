@@ -2,13 +2,24 @@ package smtpserver
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/alexisbouchez/smtp.go"
 	"github.com/alexisbouchez/smtp.go/internal/textproto"
@@ -32,24 +43,97 @@ type session struct {
 	server *Server
 	conn   *textproto.Conn
 	state  sessionState
+	id     string
+	ctx    context.Context // Parent of handler contexts; canceled when the session ends or the server stops.
+	logger *slog.Logger    // Server logger tagged with the session ID.
 
 	clientHostname string
-	esmtp          bool // True if client used EHLO.
-	tls            bool // True if connection is TLS.
-	authenticated  bool // True if AUTH succeeded.
-	invalidCmds    int  // Count of unrecognized/rejected commands.
+	esmtp          bool           // True if client used EHLO.
+	tls            bool           // True if connection is TLS.
+	serverName     string         // SNI name the client sent in the TLS handshake.
+	hostname       string         // Hostname announced to the client.
+	authenticated  bool           // True if AUTH succeeded.
+	authUser       string         // Username of the successful AUTH.
+	authzid        string         // Authorization identity of the successful AUTH, if other than authUser.
+	authMechanism  string         // Mechanism of the successful AUTH.
+	authLineAt     time.Time      // When the last line of an AUTH exchange arrived.
+	trusted        bool           // True if the client is in a trusted network.
+	invalidCmds    int            // Count of unrecognized/rejected commands.
+	authFailures   int            // Count of AUTH attempts rejected with 535.
+	cmdLine        string         // Raw line of the command being processed.
+	writeFailed    bool           // True once a reply could not be sent.
+	lastReply      smtp.SMTPError // Last reply sent with reply.
+	handlerReply   smtp.SMTPError // Set by SetReply during the current command.
+	closing        bool           // True once the session must end after the current command.
 
 	reversePath  smtp.ReversePath
 	forwardPaths []smtp.ForwardPath
-	bdatBuffer   []byte // Accumulated BDAT chunks.
+	rcptParams   []RcptParams        // Parameters of each forward path.
+	msgID        string              // Transaction ID, assigned at MAIL FROM.
+	txStart      time.Time           // When MAIL FROM was accepted.
+	handlerTime  time.Duration       // Handler time charged to the transaction's budget.
+	abandoned    chan struct{}       // Closed when the handler callHandler gave up on returns.
+	smtpUTF8     bool                // True if MAIL FROM carried the SMTPUTF8 parameter.
+	body         string              // BODY parameter of MAIL FROM, upper-cased.
+	dsnRet       string              // DSN RET parameter of MAIL FROM, upper-cased.
+	dsnEnvID     string              // DSN ENVID parameter of MAIL FROM, xtext-decoded.
+	rejected     []RejectedRecipient // Recipients refused in this transaction.
+	bdatBody     *spool              // Accumulated BDAT chunks.
+	bdat         bool                // True once BDAT has been used in this transaction.
+	bdatFailed   bool                // True after a BDAT chunk was rejected mid-transaction.
+	bdatChunks   int                 // BDAT chunks received in this transaction.
+
+	// Handlers for this connection: the server's, or a Backend Session.
+	heloHandler  HeloHandler
+	mailHandler  MailHandler
+	rcptHandler  RcptHandler
+	dataHandler  DataHandler
+	resetHandler ResetHandler
+	vrfyHandler  VrfyHandler
+	expnHandler  ExpnHandler
+	authHandler  AuthHandler
+
+	cfg     *settings        // Settings current when the session started.
+	policy  ConnectionPolicy // Restrictions from the PolicyHandler.
+	started time.Time
+	summary atomic.Pointer[SessionSummary] // Published copy for debug output.
 }
 
 // handleConn is the entry point for a new client connection.
 func (s *Server) handleConn(nc net.Conn) {
-	conn := textproto.NewConn(nc)
+	cfg := s.cfg.Load()
+	conn := textproto.NewConnSize(nc, s.readBufSize, s.writeBufSize)
+	conn.SetReadRate(s.maxBandwidth)
 	remoteAddr := nc.RemoteAddr().String()
+	s.stats.connectionsTotal.Add(1)
+	id := newID()
+	logger := s.logger
+	if s.sessionLogger != nil {
+		ctx := context.WithValue(context.Background(), sessionIDKey, id)
+		if l := s.sessionLogger(ctx, nc.RemoteAddr()); l != nil {
+			logger = l
+		}
+	}
+	logger = logger.With("session", id)
+
+	if err := proxyHeaderError(nc); err != nil {
+		logger.Info("connection dropped", "remote", remoteAddr, "err", err)
+		s.stats.connectionsRejected.Add(1)
+		nc.Close()
+		return
+	}
+
+	// Load shedding check.
+	if s.loadChecker != nil {
+		if err := s.loadChecker(); err != nil {
+			logger.Info("connection shed", "remote", remoteAddr, "reason", err)
+			s.stats.connectionsShed.Add(1)
+			rejectConn(conn, err, errServerBusy)
+			return
+		}
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), sessionIDKey, id))
 	defer cancel()
 
 	// Watch for server shutdown — close the connection to unblock reads.
@@ -62,30 +146,111 @@ func (s *Server) handleConn(nc net.Conn) {
 		}
 	}()
 
+	// Access list check.
+	if s.accessList != nil {
+		if smtpErr := s.accessList.checkClient(nc.RemoteAddr()); smtpErr != nil {
+			logger.Info("connection blocked by access list", "remote", remoteAddr)
+			s.stats.connectionsRejected.Add(1)
+			rejectConn(conn, smtpErr, nil)
+			return
+		}
+	}
+
 	// Connection handler check.
 	if s.connHandler != nil {
 		if err := s.connHandler.OnConnect(ctx, nc.RemoteAddr()); err != nil {
-			if smtpErr, ok := err.(*smtp.SMTPError); ok {
-				conn.WriteReply(int(smtpErr.Code), smtpErr.Message)
-			} else {
-				conn.WriteReply(int(smtp.ReplyServiceNotAvailable), "Connection refused")
+			s.stats.connectionsRejected.Add(1)
+			if errors.Is(err, ErrRejectSession) {
+				logger.Info("connection held after 554 greeting", "remote", remoteAddr, "err", err)
+				s.holdRejected(conn)
+				return
 			}
-			conn.Close()
+			rejectConn(conn, err, errConnRefused)
 			return
 		}
 	}
 
+	// Per-connection policy.
+	var policy ConnectionPolicy
+	if s.policyHandler != nil {
+		p, err := s.policyHandler.ConnectionPolicy(ctx, nc.RemoteAddr())
+		if err != nil {
+			s.stats.connectionsRejected.Add(1)
+			rejectConn(conn, err, errConnRefused)
+			return
+		}
+		policy = p
+	}
+
 	sess := &session{
-		server: s,
-		conn:   conn,
-		state:  stateNew,
+		server:   s,
+		conn:     conn,
+		state:    stateNew,
+		id:       id,
+		ctx:      ctx,
+		logger:   logger,
+		started:  time.Now(),
+		cfg:      cfg,
+		policy:   policy,
+		hostname: s.hostname,
+
+		heloHandler:  s.heloHandler,
+		mailHandler:  s.mailHandler,
+		rcptHandler:  s.rcptHandler,
+		dataHandler:  s.dataHandler,
+		resetHandler: s.resetHandler,
+		vrfyHandler:  s.vrfyHandler,
+		expnHandler:  s.expnHandler,
+		authHandler:  s.authHandler,
 	}
+	// A listener wrapped with tls.NewListener hands over connections
+	// whose handshake has yet to run; complete it now so that the SNI
+	// name is known before the greeting.
+	if tc, ok := nc.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(cfg.readTimeout))
+		err := tc.Handshake()
+		tc.SetDeadline(time.Time{})
+		if err != nil {
+			logger.Info("TLS handshake failed", "remote", remoteAddr, "err", err)
+			sess.reportError(OpTLS, err)
+			return
+		}
+		sess.tlsEstablished(tc.ConnectionState())
+	}
+	if s.backend != nil {
+		bs, err := s.backend.NewSession(sess.context(), nc.RemoteAddr())
+		if err != nil {
+			s.stats.connectionsRejected.Add(1)
+			rejectConn(conn, err, errConnRefused)
+			return
+		}
+		sess.useSession(bs)
+		// Logout may clean up after a shutdown canceled the session.
+		defer func() {
+			sess.awaitAbandoned()
+			bs.Logout(context.WithoutCancel(sess.context()))
+		}()
+	}
+	if ip, ok := clientIP(nc.RemoteAddr()); ok {
+		sess.trusted = containsAddr(cfg.trustedNets, ip)
+	}
+	sess.publish()
+	s.trackSession(sess, true)
+	defer s.trackSession(sess, false)
+	sess.emit(Event{Type: EventConnect})
+	defer func() { sess.emit(Event{Type: EventDisconnect}) }()
 
+	defer sess.abortTransaction()
 	defer conn.Close()
+	defer sess.recoverPanic()
+
+	sessionEnd := time.Now().Add(cfg.maxSessionTime)
 
 	// Send greeting banner (RFC 5321 §4.3.1).
-	if err := conn.WriteReply(int(smtp.ReplyServiceReady), fmt.Sprintf("%s ESMTP ready", s.hostname)); err != nil {
-		s.logger.Error("failed to send greeting", "err", err, "remote", remoteAddr)
+	sess.setWriteDeadline()
+	if err := conn.WriteReply(int(smtp.ReplyServiceReady), fmt.Sprintf("%s ESMTP ready", sess.hostname)); err != nil {
+		logger.Error("failed to send greeting", "err", err, "remote", remoteAddr)
+		sess.reportError(OpWrite, err)
 		return
 	}
 
@@ -93,23 +258,54 @@ func (s *Server) handleConn(nc net.Conn) {
 	for {
 		select {
 		case <-ctx.Done():
-			conn.WriteReply(int(smtp.ReplyServiceNotAvailable), "Server shutting down")
+			sess.setWriteDeadline()
+			writeReply(conn, smtp.ReplyServiceNotAvailable, smtp.EnhancedCodeNotAccepting, "Server shutting down")
 			return
 		default:
 		}
 
-		conn.SetReadDeadline(time.Now().Add(s.readTimeout))
-		line, err := conn.ReadLine(textproto.MaxCommandLineLen)
+		if sess.expired(sessionEnd) {
+			sess.reply(smtp.ReplyServiceNotAvailable, smtp.EnhancedCodeBadConnection, "Session time limit exceeded, closing connection")
+			return
+		}
+
+		deadline := time.Now().Add(cfg.readTimeout)
+		if cfg.maxSessionTime > 0 && sessionEnd.Before(deadline) {
+			deadline = sessionEnd
+		}
+		conn.SetReadDeadline(deadline)
+		line, err := conn.ReadLine(s.maxLineLen)
+		if sess.expired(sessionEnd) {
+			sess.reply(smtp.ReplyServiceNotAvailable, smtp.EnhancedCodeBadConnection, "Session time limit exceeded, closing connection")
+			return
+		}
 		if err != nil {
+			sess.reportReadError(err)
 			return // Connection closed or error.
 		}
+		sess.cmdLine = line
+		start := time.Now()
+		sess.awaitAbandoned()
+		sess.handlerReply = smtp.SMTPError{}
+
+		if s.cmdHandler != nil {
+			if err := s.cmdHandler.OnCommand(sess.context(), line); err != nil {
+				if smtpErr, ok := err.(*smtp.SMTPError); ok {
+					sess.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+				} else {
+					sess.reply(smtp.ReplyLocalError, smtp.EnhancedCodeTempSystem, "Internal error")
+				}
+				continue
+			}
+		}
 
 		// Reject NUL bytes in commands.
 		if strings.ContainsRune(line, 0) {
+			sess.reportError(OpInput, errors.New("NUL in command"))
 			sess.reply(smtp.ReplySyntaxError, smtp.EnhancedCodeInvalidCommand, "NUL not allowed in commands")
 			sess.invalidCmds++
-			if s.maxInvalidCmds > 0 && sess.invalidCmds >= s.maxInvalidCmds {
-				sess.reply(smtp.ReplyServiceNotAvailable, smtp.EnhancedCodeOtherNetwork, "Too many errors, closing connection")
+			if cfg.maxInvalidCmds > 0 && sess.invalidCmds >= cfg.maxInvalidCmds {
+				sess.reply(smtp.ReplyServiceNotAvailable, smtp.EnhancedCodeTempAuthFailure, "Too many errors, closing connection")
 				return
 			}
 			continue
@@ -127,19 +323,28 @@ func (s *Server) handleConn(nc net.Conn) {
 		case "RCPT":
 			sess.handleRCPT(args)
 		case "DATA":
-			sess.handleDATA()
+			if !sess.rejectArgs(verb, args) {
+				sess.handleDATA()
+			}
 		case "RSET":
-			sess.handleRSET()
+			if !sess.rejectArgs(verb, args) {
+				sess.handleRSET()
+			}
 		case "NOOP":
 			sess.handleNOOP()
 		case "QUIT":
-			sess.handleQUIT()
-			return
+			if !sess.rejectArgs(verb, args) {
+				sess.handleQUIT()
+				return
+			}
 		case "VRFY":
 			sess.handleVRFY(args)
 		case "EXPN":
-			sess.reply(smtp.ReplyCommandNotImpl, smtp.EnhancedCodeInvalidCommand, "EXPN not implemented")
+			sess.handleEXPN(args)
 		case "STARTTLS":
+			if sess.rejectArgs(verb, args) {
+				continue
+			}
 			if sess.handleSTARTTLS() {
 				// Connection upgraded — must re-issue EHLO. State reset handled inside.
 			}
@@ -148,14 +353,51 @@ func (s *Server) handleConn(nc net.Conn) {
 		case "BDAT":
 			sess.handleBDAT(args)
 		default:
+			if sess.handleExtension(verb, args) {
+				break
+			}
+			sess.reportError(OpInput, fmt.Errorf("unrecognized command %q", verb))
 			sess.reply(smtp.ReplySyntaxError, smtp.EnhancedCodeInvalidCommand, "Command not recognized")
 			sess.invalidCmds++
-			if s.maxInvalidCmds > 0 && sess.invalidCmds >= s.maxInvalidCmds {
-				sess.reply(smtp.ReplyServiceNotAvailable, smtp.EnhancedCodeOtherNetwork, "Too many errors, closing connection")
+			if cfg.maxInvalidCmds > 0 && sess.invalidCmds >= cfg.maxInvalidCmds {
+				sess.reply(smtp.ReplyServiceNotAvailable, smtp.EnhancedCodeTempAuthFailure, "Too many errors, closing connection")
 				return
 			}
 		}
+		s.stats.observeCommand(verb, time.Since(start))
+		sess.checkSlow(verb, start)
+		if sess.closing {
+			return
+		}
+	}
+}
+
+// setState moves the session to st, keeping the per-state gauges current.
+func (s *session) setState(st sessionState) {
+	if st != s.state {
+		s.server.stats.states[s.state].Add(-1)
+		s.server.stats.states[st].Add(1)
+		s.state = st
 	}
+	s.publish()
+}
+
+// publish stores a copy of the session's debug summary for readers on
+// other goroutines.
+func (s *session) publish() {
+	s.summary.Store(&SessionSummary{
+		ID:         s.id,
+		RemoteAddr: s.conn.NetConn().RemoteAddr().String(),
+		Started:    s.started,
+		State:      s.state.String(),
+		Hostname:   s.clientHostname,
+	})
+}
+
+// expired reports whether the session has outlived the configured maximum
+// session duration.
+func (s *session) expired(end time.Time) bool {
+	return s.cfg.maxSessionTime > 0 && !time.Now().Before(end)
 }
 
 // parseCommand splits an SMTP command line into verb and argument string.
@@ -167,18 +409,41 @@ func parseCommand(line string) (verb string, args string) {
 
 // reply sends a single-line reply with optional enhanced status code.
 func (s *session) reply(code smtp.ReplyCode, enhanced smtp.EnhancedCode, msg string) {
-	var line string
-	if !enhanced.IsZero() {
-		line = fmt.Sprintf("%s %s", enhanced, msg)
-	} else {
-		line = msg
+	s.tarpit()
+	s.lastReply = smtp.SMTPError{Code: code, EnhancedCode: alignClass(code, enhanced), Message: msg}
+	s.setWriteDeadline()
+	if err := writeReply(s.conn, code, enhanced, msg); err != nil {
+		s.reportError(OpWrite, err)
 	}
-	s.conn.WriteReply(int(code), line)
+}
+
+// replyAccepted sends the reply a handler set with SetReply for the
+// command, or else 250 with enhanced and msg.
+func (s *session) replyAccepted(enhanced smtp.EnhancedCode, msg string) {
+	r := s.handlerReply
+	if r.Code == 0 {
+		s.reply(smtp.ReplyOK, enhanced, msg)
+		return
+	}
+	if r.EnhancedCode == (smtp.EnhancedCode{}) {
+		r.EnhancedCode = enhanced
+	}
+	s.reply(r.Code, r.EnhancedCode, r.Message)
 }
 
 // replyMulti sends a multi-line reply.
 func (s *session) replyMulti(code smtp.ReplyCode, lines ...string) {
-	s.conn.WriteReply(int(code), lines...)
+	s.tarpit()
+	s.setWriteDeadline()
+	if err := s.conn.WriteReply(int(code), lines...); err != nil {
+		s.reportError(OpWrite, err)
+	}
+}
+
+// setWriteDeadline gives the next reply the write timeout, so that a
+// client that stops reading cannot hold the session.
+func (s *session) setWriteDeadline() {
+	s.conn.SetWriteDeadline(time.Now().Add(s.cfg.writeTimeout))
 }
 
 // handleEHLO processes the EHLO command (RFC 5321 §4.1.1.1).
@@ -187,13 +452,17 @@ func (s *session) handleEHLO(args string) {
 		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "EHLO requires a hostname")
 		return
 	}
+	if s.rejectHeloArgs("EHLO", args) {
+		return
+	}
 
-	if s.server.heloHandler != nil {
-		if err := s.server.heloHandler.OnHelo(context.Background(), args); err != nil {
+	if s.heloHandler != nil {
+		ctx := context.WithValue(s.context(), heloKey, heloInfo{args, true})
+		if err := s.heloHandler.OnHelo(ctx, args); err != nil {
 			if smtpErr, ok := err.(*smtp.SMTPError); ok {
 				s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
 			} else {
-				s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeOtherNetwork, "Internal error")
+				s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeTempSystem, "Internal error")
 			}
 			return
 		}
@@ -203,16 +472,16 @@ func (s *session) handleEHLO(args string) {
 	s.resetTransaction()
 	s.clientHostname = args
 	s.esmtp = true
-	s.state = stateGreeted
+	s.setState(stateGreeted)
 
 	// Build EHLO response lines.
 	lines := []string{
-		fmt.Sprintf("%s Hello %s", s.server.hostname, args),
+		fmt.Sprintf("%s Hello %s", s.hostname, args),
 	}
 
 	// Advertise extensions.
-	if s.server.maxMessageSize > 0 {
-		lines = append(lines, fmt.Sprintf("SIZE %d", s.server.maxMessageSize))
+	if limit := s.maxMessageSize(); limit > 0 {
+		lines = append(lines, fmt.Sprintf("SIZE %d", limit))
 	}
 	lines = append(lines, "PIPELINING")
 	lines = append(lines, "8BITMIME")
@@ -225,10 +494,18 @@ func (s *session) handleEHLO(args string) {
 		lines = append(lines, "STARTTLS")
 	}
 
-	if s.server.authHandler != nil && !s.authenticated {
-		lines = append(lines, "AUTH PLAIN LOGIN CRAM-MD5")
+	if s.authHandler != nil && (!s.authenticated || s.server.allowReauth) {
+		lines = append(lines, "AUTH "+s.authMechanisms())
+	}
+	for _, ext := range s.server.registeredExtensions() {
+		lines = append(lines, strings.TrimSpace(ext.keyword+" "+ext.param))
 	}
+	lines = slices.DeleteFunc(lines, func(line string) bool {
+		keyword, _, _ := strings.Cut(line, " ")
+		return s.disabled(smtp.Extension(keyword))
+	})
 
+	s.emit(Event{Type: EventHelo})
 	s.replyMulti(smtp.ReplyOK, lines...)
 }
 
@@ -238,13 +515,17 @@ func (s *session) handleHELO(args string) {
 		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "HELO requires a hostname")
 		return
 	}
+	if s.rejectHeloArgs("HELO", args) {
+		return
+	}
 
-	if s.server.heloHandler != nil {
-		if err := s.server.heloHandler.OnHelo(context.Background(), args); err != nil {
+	if s.heloHandler != nil {
+		ctx := context.WithValue(s.context(), heloKey, heloInfo{args, false})
+		if err := s.heloHandler.OnHelo(ctx, args); err != nil {
 			if smtpErr, ok := err.(*smtp.SMTPError); ok {
 				s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
 			} else {
-				s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeOtherNetwork, "Internal error")
+				s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeTempSystem, "Internal error")
 			}
 			return
 		}
@@ -253,9 +534,10 @@ func (s *session) handleHELO(args string) {
 	s.resetTransaction()
 	s.clientHostname = args
 	s.esmtp = false
-	s.state = stateGreeted
+	s.setState(stateGreeted)
 
-	s.reply(smtp.ReplyOK, smtp.EnhancedCodeOK, fmt.Sprintf("%s Hello %s", s.server.hostname, args))
+	s.emit(Event{Type: EventHelo})
+	s.reply(smtp.ReplyOK, smtp.EnhancedCodeOK, fmt.Sprintf("%s Hello %s", s.hostname, args))
 }
 
 // handleMAIL processes the MAIL FROM command (RFC 5321 §4.1.1.2).
@@ -270,11 +552,18 @@ func (s *session) handleMAIL(args string) {
 	}
 
 	// Submission mode requires authentication (RFC 6409 §4.1).
-	if s.server.submissionMode && !s.authenticated {
+	if (s.server.submissionMode || s.policy.RequireAuth) && !s.authenticated {
 		s.reply(smtp.ReplyAuthRequired, smtp.EnhancedCodeAuthRequired, "Authentication required")
 		return
 	}
 
+	// Load shedding: refuse new transactions while the server-wide
+	// throughput budget is exhausted.
+	if s.server.throughput != nil && s.server.throughput.saturated() {
+		s.reply(smtp.ReplyInsufficientStorage, smtp.EnhancedCodeNotAccepting, "System load too high, try again later")
+		return
+	}
+
 	// Parse "FROM:<path> [params]".
 	upper := strings.ToUpper(args)
 	if !strings.HasPrefix(upper, "FROM:") {
@@ -283,8 +572,14 @@ func (s *session) handleMAIL(args string) {
 	}
 
 	pathAndParams := args[5:] // Skip "FROM:"
-	pathStr, _, _ := strings.Cut(pathAndParams, " ")
+	if !s.checkStrictPath("MAIL", pathAndParams) {
+		return
+	}
+	pathStr, params, _ := strings.Cut(strings.TrimLeft(pathAndParams, " "), " ")
 	pathStr = strings.TrimSpace(pathStr)
+	if s.rejectDisabledParams(params) || s.rejectDeclaredSize(params) {
+		return
+	}
 
 	reversePath, err := smtp.ParseReversePath(pathStr)
 	if err != nil {
@@ -292,12 +587,41 @@ func (s *session) handleMAIL(args string) {
 		return
 	}
 
-	if s.server.mailHandler != nil {
-		if err := s.server.mailHandler.OnMail(context.Background(), reversePath); err != nil {
+	if s.server.accessList != nil {
+		if smtpErr := s.server.accessList.checkSender(reversePath); smtpErr != nil {
+			s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			return
+		}
+	}
+
+	s.msgID = newID()
+	s.txStart = time.Now()
+	s.handlerTime = 0
+	for _, p := range strings.Fields(params) {
+		keyword, value, _ := strings.Cut(p, "=")
+		switch strings.ToUpper(keyword) {
+		case "SMTPUTF8":
+			s.smtpUTF8 = true
+		case "BODY":
+			s.body = strings.ToUpper(value)
+		case "RET":
+			s.dsnRet = strings.ToUpper(value)
+		case "ENVID":
+			s.dsnEnvID, _ = decodeXtext(value)
+		}
+	}
+	if s.mailHandler != nil {
+		err := s.callHandler(func(ctx context.Context) error {
+			return s.mailHandler.OnMail(ctx, reversePath)
+		}, nil)
+		if err != nil {
+			s.msgID = ""
+			s.smtpUTF8, s.body = false, ""
+			s.dsnRet, s.dsnEnvID = "", ""
 			if smtpErr, ok := err.(*smtp.SMTPError); ok {
 				s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
 			} else {
-				s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeOtherNetwork, "Internal error")
+				s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeTempSystem, "Internal error")
 			}
 			return
 		}
@@ -305,9 +629,32 @@ func (s *session) handleMAIL(args string) {
 
 	s.reversePath = reversePath
 	s.forwardPaths = nil
-	s.state = stateMail
+	s.rcptParams = nil
+	s.setState(stateMail)
 
-	s.reply(smtp.ReplyOK, smtp.EnhancedCodeOtherAddress, "Originator ok")
+	s.replyAccepted(smtp.EnhancedCodeOtherAddress, "Originator ok")
+}
+
+// rejectDeclaredSize replies and returns true if the SIZE parameter of
+// MAIL FROM is malformed or exceeds the message size limit, so an
+// oversized message is refused before its body is sent (RFC 1870 §6.1).
+func (s *session) rejectDeclaredSize(params string) bool {
+	for _, param := range strings.Fields(params) {
+		keyword, value, _ := strings.Cut(param, "=")
+		if !strings.EqualFold(keyword, "SIZE") {
+			continue
+		}
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeInvalidParams, "Invalid SIZE parameter")
+			return true
+		}
+		if limit := s.maxMessageSize(); limit > 0 && size > limit {
+			s.reply(smtp.ReplyExceededStorage, smtp.EnhancedCodeMsgTooLarge, "Message size exceeds fixed maximum message size")
+			return true
+		}
+	}
+	return false
 }
 
 // handleRCPT processes the RCPT TO command (RFC 5321 §4.1.1.3).
@@ -317,8 +664,14 @@ func (s *session) handleRCPT(args string) {
 		return
 	}
 
-	if len(s.forwardPaths) >= s.server.maxRecipients {
-		s.reply(smtp.ReplyInsufficientStorage, smtp.EnhancedCodeTooManyRecipients, "Too many recipients")
+	defer s.recordRejection(args)
+
+	if len(s.forwardPaths) >= s.maxRecipients() {
+		s.reply(smtp.ReplyInsufficientStorage, smtp.EnhancedCodeTempTooManyRecipients, "Too many recipients")
+		return
+	}
+	if s.server.singleBounce && s.reversePath.Null && len(s.forwardPaths) > 0 {
+		s.reply(smtp.ReplyInsufficientStorage, smtp.EnhancedCodeTempTooManyRecipients, "Bounces must have a single recipient")
 		return
 	}
 
@@ -330,32 +683,92 @@ func (s *session) handleRCPT(args string) {
 	}
 
 	pathAndParams := args[3:] // Skip "TO:"
-	pathStr, _, _ := strings.Cut(pathAndParams, " ")
+	if !s.checkStrictPath("RCPT", pathAndParams) {
+		return
+	}
+	pathStr, params, _ := strings.Cut(strings.TrimLeft(pathAndParams, " "), " ")
 	pathStr = strings.TrimSpace(pathStr)
+	if s.rejectDisabledParams(params) {
+		return
+	}
 
 	forwardPath, err := smtp.ParseForwardPath(pathStr)
 	if err != nil {
 		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeBadDestSyntax, "Invalid recipient address")
 		return
 	}
+	rcptParams, smtpErr := parseRcptParams(params)
+	if smtpErr != nil {
+		s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+		return
+	}
+
+	if len(s.cfg.localDomains) > 0 && !s.authenticated && !s.trusted &&
+		!s.cfg.localDomains[strings.ToLower(forwardPath.Mailbox.Domain)] {
+		s.reply(smtp.ReplyTransactionFailed, smtp.EnhancedCodeNotAuthorized, "Relay access denied")
+		return
+	}
 
-	if s.server.rcptHandler != nil {
-		if err := s.server.rcptHandler.OnRcpt(context.Background(), forwardPath); err != nil {
+	if s.server.accessList != nil {
+		if smtpErr := s.server.accessList.checkRecipient(forwardPath); smtpErr != nil {
+			s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			return
+		}
+	}
+
+	if s.rcptHandler != nil {
+		err := s.callHandler(func(ctx context.Context) error {
+			if h, ok := s.rcptHandler.(RcptParamsHandler); ok {
+				return h.OnRcptParams(ctx, forwardPath, rcptParams)
+			}
+			return s.rcptHandler.OnRcpt(ctx, forwardPath)
+		}, nil)
+		if err == errHandlerBudget {
+			s.reply(errHandlerBudget.Code, errHandlerBudget.EnhancedCode, errHandlerBudget.Message)
+			s.resetTransaction()
+			s.setState(stateGreeted)
+			return
+		}
+		if err != nil {
 			if smtpErr, ok := err.(*smtp.SMTPError); ok {
 				s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			} else if errors.Is(err, ErrRecipientDeferred) {
+				s.logger.Info("recipient deferred", "message", s.msgID, "to", forwardPath.String(), "err", err)
+				s.reply(smtp.ReplyInsufficientStorage, smtp.EnhancedCodeTempMailbox, "Recipient deferred, try again later")
 			} else {
-				s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeOtherNetwork, "Internal error")
+				s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeTempSystem, "Internal error")
 			}
 			return
 		}
 	}
 
 	s.forwardPaths = append(s.forwardPaths, forwardPath)
+	s.rcptParams = append(s.rcptParams, rcptParams)
 	if s.state < stateRcpt {
-		s.state = stateRcpt
+		s.setState(stateRcpt)
 	}
 
-	s.reply(smtp.ReplyOK, smtp.EnhancedCodeDestValid, "Recipient ok")
+	s.replyAccepted(smtp.EnhancedCodeDestValid, "Recipient ok")
+}
+
+// recordRejection adds the recipient of a RCPT command to the rejected
+// list if the command was refused.
+func (s *session) recordRejection(args string) {
+	if s.lastReply.Code.Class() == 2 {
+		return
+	}
+	if s.lastReply.Temporary() {
+		s.server.stats.recipientsDeferred.Add(1)
+	}
+	if s.state < stateMail {
+		return // The transaction was reset.
+	}
+	path := args
+	if len(args) >= 3 && strings.EqualFold(args[:3], "TO:") {
+		path, _, _ = strings.Cut(strings.TrimLeft(args[3:], " "), " ")
+	}
+	smtpErr := s.lastReply
+	s.rejected = append(s.rejected, RejectedRecipient{Path: path, Err: &smtpErr})
 }
 
 // handleDATA processes the DATA command (RFC 5321 §4.1.1.4).
@@ -364,48 +777,127 @@ func (s *session) handleDATA() {
 		s.reply(smtp.ReplyBadSequence, smtp.EnhancedCodeInvalidCommand, "Send RCPT first")
 		return
 	}
+	// DATA and BDAT cannot be mixed in one transaction (RFC 3030 §2).
+	if s.bdat || s.bdatFailed {
+		s.reply(smtp.ReplyBadSequence, smtp.EnhancedCodeInvalidCommand, "DATA not allowed after BDAT, send RSET")
+		return
+	}
 
 	// Send 354 to start data transfer.
 	s.reply(smtp.ReplyStartMailInput, smtp.EnhancedCode{}, "Start mail input; end with <CRLF>.<CRLF>")
-	s.state = stateData
+	s.setState(stateData)
+
+	// Read the dot-stuffed body. The transfer gets a fresh read timeout so
+	// a session lifetime limit never cuts a message off mid-stream.
+	s.conn.SetReadDeadline(time.Now().Add(s.cfg.readTimeout))
+	s.conn.SetStallTimeout(s.server.stallTimeout)
+	defer s.conn.SetStallTimeout(0)
+	s.conn.ThrottleReads(true)
+	defer s.conn.ThrottleReads(false)
+	limit := s.maxMessageSize()
+	reader := &countingReader{r: s.conn.DotReader(), limit: limit}
+	body := s.newContentChecker(reader)
 
-	// Read the dot-stuffed body.
-	reader := s.conn.DotReader()
+	var err error
+	var sp *spool
+	switch {
+	case s.server.spoolBodies():
+		sp = s.server.newSpool()
+		defer sp.close()
+		io.Copy(sp, body)
+	case s.dataHandler != nil:
+		hb := &handlerBody{r: body}
+		err = s.callHandler(func(ctx context.Context) error {
+			return s.dataHandler.OnData(ctx, s.reversePath, s.forwardPaths, hb)
+		}, hb)
+	}
 
-	if s.server.dataHandler != nil {
-		err := s.server.dataHandler.OnData(context.Background(), s.reversePath, s.forwardPaths, reader)
+	// Drain any unread data (in case handler didn't read it all). The rest
+	// of the body is still checked so the content policy holds even when
+	// the handler stopped early.
+	io.Copy(io.Discard, body)
+	reader.limit = 0 // Consume an oversized message to stay in sync.
+	io.Copy(io.Discard, reader)
+	if errors.Is(reader.err, textproto.ErrStalled) {
+		s.abortStalled(reader.n)
+		return
+	}
+	if reader.err != nil {
+		s.reportReadError(reader.err)
+	}
+
+	if body.invalid {
+		err = body.rejection()
+	}
+	if limit > 0 && reader.n > limit {
+		err = smtp.Errorf(smtp.ReplyExceededStorage, smtp.EnhancedCodeMsgTooLarge, "Message size exceeds fixed maximum message size")
+	}
+	if sp != nil && err == nil {
+		err = s.deliverSpooled(sp)
+	}
+	s.completeMessage(err, reader.n)
+}
+
+// deliverSpooled calls the DataHandler with a complete spooled body and
+// journals the body if the handler accepts it. It returns errSpoolFailed
+// if the body could not be spooled.
+func (s *session) deliverSpooled(sp *spool) error {
+	if sp.err != nil {
+		s.logger.Error("spool write error", "message", s.msgID, "err", sp.err)
+		return errSpoolFailed
+	}
+	if s.dataHandler != nil {
+		err := s.callHandler(func(ctx context.Context) error {
+			return s.dataHandler.OnData(ctx, s.reversePath, s.forwardPaths, sp.reader())
+		}, nil)
 		if err != nil {
-			// Drain any unread data.
-			io.Copy(io.Discard, reader)
-			if smtpErr, ok := err.(*smtp.SMTPError); ok {
-				s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
-			} else {
-				s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeOtherNetwork, "Internal error")
-			}
-			s.resetTransaction()
-			s.state = stateGreeted
-			return
+			return err
 		}
 	}
+	if s.server.journal != nil {
+		return s.journalMessage(sp)
+	}
+	return nil
+}
 
-	// Drain any unread data (in case handler didn't read it all).
-	io.Copy(io.Discard, reader)
-
-	s.reply(smtp.ReplyOK, smtp.EnhancedCodeOK, "Message accepted")
+// completeMessage sends the final reply for a DATA or BDAT transaction,
+// updates the counters and resets the transaction. err is the delivery
+// result; size is the message size in bytes.
+func (s *session) completeMessage(err error, size int64) {
+	s.server.stats.transactions.observe(time.Since(s.txStart))
+	ev := Event{MessageID: s.msgID, From: s.reversePath, To: s.forwardPaths, Size: size, Err: err}
+	if err != nil {
+		ev.Type = EventMessageRejected
+		s.emit(ev)
+		s.logger.Info("message rejected", "message", s.msgID, "size", size, "err", err)
+		s.server.stats.messagesRejected.Add(1)
+		if smtpErr, ok := err.(*smtp.SMTPError); ok {
+			s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+		} else {
+			s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeTempSystem, "Internal error")
+		}
+	} else {
+		ev.Type = EventMessageAccepted
+		s.emit(ev)
+		s.logger.Info("message accepted", "message", s.msgID, "from", s.reversePath.String(), "recipients", len(s.forwardPaths), "size", size)
+		s.server.stats.messagesAccepted.Add(1)
+		s.server.stats.bytesReceived.Add(size)
+		if s.server.throughput != nil {
+			s.server.throughput.record(size)
+		}
+		s.replyAccepted(smtp.EnhancedCodeOK, "Ok: queued as "+s.msgID)
+	}
 	s.resetTransaction()
-	s.state = stateGreeted
+	s.setState(stateGreeted)
 }
 
 // handleBDAT processes the BDAT command (RFC 3030).
 func (s *session) handleBDAT(args string) {
-	if s.state < stateRcpt {
-		s.reply(smtp.ReplyBadSequence, smtp.EnhancedCodeInvalidCommand, "Send RCPT first")
-		return
-	}
-
-	// Parse "SIZE [LAST]".
+	// Parse "SIZE [LAST]". The size is parsed before any state checks so
+	// that the chunk data can be read and discarded on every error path,
+	// keeping the command stream synchronized (RFC 3030 §2).
 	parts := strings.Fields(args)
-	if len(parts) < 1 {
+	if len(parts) < 1 || len(parts) > 2 {
 		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "Syntax: BDAT <size> [LAST]")
 		return
 	}
@@ -416,49 +908,178 @@ func (s *session) handleBDAT(args string) {
 		return
 	}
 
-	last := len(parts) >= 2 && strings.ToUpper(parts[1]) == "LAST"
+	last := false
+	if len(parts) == 2 {
+		if strings.ToUpper(parts[1]) != "LAST" {
+			if s.discardChunk(size) {
+				s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeInvalidParams, "Syntax: BDAT <size> [LAST]")
+			}
+			return
+		}
+		last = true
+	}
+
+	if s.disabled(smtp.ExtCHUNKING) {
+		if s.discardChunk(size) {
+			s.reply(smtp.ReplyCommandNotImpl, smtp.EnhancedCodeInvalidCommand, "BDAT not available")
+		}
+		return
+	}
+
+	if s.state < stateRcpt {
+		if s.discardChunk(size) {
+			s.reply(smtp.ReplyBadSequence, smtp.EnhancedCodeInvalidCommand, "Send RCPT first")
+		}
+		return
+	}
+
+	// A previous chunk of this transaction failed: chunks that were already
+	// pipelined are accepted and discarded until the client resets.
+	if s.bdatFailed {
+		if !s.discardChunk(size) {
+			return
+		}
+		s.reply(smtp.ReplyBadSequence, smtp.EnhancedCodeInvalidCommand, "Previous BDAT failed, send RSET")
+		if last {
+			s.resetTransaction()
+			s.setState(stateGreeted)
+		}
+		return
+	}
+
+	// BDAT bytes count toward the message size limit (RFC 1870).
+	if limit := s.maxMessageSize(); limit > 0 && s.bdatBody.Len()+size > limit {
+		s.rejectChunk(size, last, "Message size exceeds fixed maximum message size")
+		return
+	}
+	if limit := s.server.maxBdatChunkSize; limit > 0 && size > limit {
+		s.rejectChunk(size, last, "BDAT chunk exceeds maximum chunk size")
+		return
+	}
+	s.bdatChunks++
+	if limit := s.server.maxBdatChunks; limit > 0 && s.bdatChunks > limit {
+		s.rejectChunk(size, last, "Too many BDAT chunks")
+		return
+	}
 
 	// Read exactly size bytes.
-	chunk := make([]byte, size)
+	s.bdat = true
+	if s.bdatBody == nil {
+		s.bdatBody = s.server.newSpool()
+	}
 	if size > 0 {
-		br := s.conn.BufReader()
-		if _, err := io.ReadFull(br, chunk); err != nil {
-			s.server.logger.Error("BDAT read error", "err", err)
+		start := s.bdatBody.Len()
+		s.conn.SetReadDeadline(time.Now().Add(s.cfg.readTimeout))
+		s.conn.SetStallTimeout(s.server.stallTimeout)
+		s.conn.ThrottleReads(true)
+		n, err := s.bdatBody.readChunk(s.conn.BufReader(), size)
+		s.conn.ThrottleReads(false)
+		s.conn.SetStallTimeout(0)
+		if errors.Is(err, textproto.ErrStalled) {
+			s.abortStalled(start + n)
+			return
+		}
+		if s.bdatBody.err != nil {
+			// The chunk could not be stored; the client is still owed the
+			// rest of it.
+			s.logger.Error("spool write error", "message", s.msgID, "err", s.bdatBody.err)
+			s.failChunk(size-n, last, errSpoolFailed)
+			return
+		}
+		if err != nil {
+			s.logger.Error("BDAT read error", "err", err)
+			s.reportReadError(err)
 			return
 		}
 	}
 
-	s.bdatBuffer = append(s.bdatBuffer, chunk...)
-
 	if last {
 		// Deliver the accumulated message.
-		if s.server.dataHandler != nil {
-			r := strings.NewReader(string(s.bdatBuffer))
-			err := s.server.dataHandler.OnData(context.Background(), s.reversePath, s.forwardPaths, r)
-			if err != nil {
-				if smtpErr, ok := err.(*smtp.SMTPError); ok {
-					s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
-				} else {
-					s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeOtherNetwork, "Internal error")
-				}
-				s.resetTransaction()
-				s.state = stateGreeted
-				return
+		size := s.bdatBody.Len()
+		body := s.newContentChecker(s.bdatBody.reader())
+		var err error
+		switch {
+		case s.server.spoolBodies():
+			// The handler gets the spool itself, once checked.
+			io.Copy(io.Discard, body)
+			if !body.invalid {
+				err = s.deliverSpooled(s.bdatBody)
 			}
+		case s.dataHandler != nil:
+			hb := &handlerBody{r: body}
+			err = s.callHandler(func(ctx context.Context) error {
+				return s.dataHandler.OnData(ctx, s.reversePath, s.forwardPaths, hb)
+			}, hb)
 		}
-		s.reply(smtp.ReplyOK, smtp.EnhancedCodeOK, "Message accepted")
-		s.resetTransaction()
-		s.state = stateGreeted
+		// The rest of the body is still checked so the content policy
+		// holds even when the handler stopped early, unless the handler
+		// was abandoned: the transaction fails anyway.
+		if !errors.Is(err, errHandlerBudget) {
+			io.Copy(io.Discard, body)
+			if body.invalid {
+				err = body.rejection()
+			}
+		}
+		s.completeMessage(err, size)
 	} else {
 		s.reply(smtp.ReplyOK, smtp.EnhancedCodeOK, fmt.Sprintf("%d bytes received", size))
 	}
 }
 
+// rejectChunk discards a BDAT chunk over a limit and replies 552 with msg.
+// The transaction fails: it ends with a LAST chunk, and otherwise later
+// chunks are discarded until the client resets.
+func (s *session) rejectChunk(size int64, last bool, msg string) {
+	s.failChunk(size, last, smtp.Errorf(smtp.ReplyExceededStorage, smtp.EnhancedCodeMsgTooLarge, "%s", msg))
+}
+
+// failChunk discards size bytes of a BDAT chunk that cannot be stored and
+// replies with smtpErr, failing the transaction as rejectChunk does.
+func (s *session) failChunk(size int64, last bool, smtpErr *smtp.SMTPError) {
+	if !s.discardChunk(size) {
+		return
+	}
+	s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+	if last {
+		s.resetTransaction()
+		s.setState(stateGreeted)
+	} else {
+		s.bdatBody.close()
+		s.bdatBody = nil
+		s.bdatFailed = true
+	}
+}
+
+// discardChunk reads and throws away size bytes of BDAT data that will not
+// be delivered. It reports whether the data was consumed; on failure the
+// connection is unusable and no reply should be sent.
+func (s *session) discardChunk(size int64) bool {
+	if size == 0 {
+		return true
+	}
+	s.conn.SetReadDeadline(time.Now().Add(s.cfg.readTimeout))
+	s.conn.SetStallTimeout(s.server.stallTimeout)
+	s.conn.ThrottleReads(true)
+	n, err := io.CopyN(io.Discard, s.conn.BufReader(), size)
+	s.conn.ThrottleReads(false)
+	s.conn.SetStallTimeout(0)
+	if errors.Is(err, textproto.ErrStalled) {
+		s.abortStalled(n)
+		return false
+	}
+	if err != nil {
+		s.logger.Error("BDAT read error", "err", err)
+		s.reportReadError(err)
+		return false
+	}
+	return true
+}
+
 // handleRSET processes the RSET command (RFC 5321 §4.1.1.5).
 func (s *session) handleRSET() {
 	s.resetTransaction()
 	if s.state > stateGreeted {
-		s.state = stateGreeted
+		s.setState(stateGreeted)
 	}
 	s.reply(smtp.ReplyOK, smtp.EnhancedCodeOK, "Reset ok")
 }
@@ -470,18 +1091,22 @@ func (s *session) handleNOOP() {
 
 // handleQUIT processes the QUIT command (RFC 5321 §4.1.1.10).
 func (s *session) handleQUIT() {
-	s.reply(smtp.ReplyServiceClosing, smtp.EnhancedCodeOK, fmt.Sprintf("%s closing connection", s.server.hostname))
+	s.reply(smtp.ReplyServiceClosing, smtp.EnhancedCodeOK, fmt.Sprintf("%s closing connection", s.hostname))
 }
 
 // handleVRFY processes the VRFY command (RFC 5321 §4.1.1.6).
 func (s *session) handleVRFY(args string) {
-	if s.server.vrfyHandler != nil {
-		result, err := s.server.vrfyHandler.OnVrfy(context.Background(), args)
+	if s.server.disableVRFY {
+		s.reply(smtp.ReplyCommandNotImpl, smtp.EnhancedCodeInvalidCommand, "VRFY disabled")
+		return
+	}
+	if s.vrfyHandler != nil {
+		result, err := s.vrfyHandler.OnVrfy(s.context(), args)
 		if err != nil {
 			if smtpErr, ok := err.(*smtp.SMTPError); ok {
 				s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
 			} else {
-				s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeOtherNetwork, "Internal error")
+				s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeTempSystem, "Internal error")
 			}
 			return
 		}
@@ -492,9 +1117,39 @@ func (s *session) handleVRFY(args string) {
 	s.reply(smtp.ReplyCannotVRFY, smtp.EnhancedCodeOK, "Cannot VRFY user, but will accept message")
 }
 
+// handleEXPN processes the EXPN command (RFC 5321 §4.1.1.7).
+func (s *session) handleEXPN(args string) {
+	if s.expnHandler == nil {
+		s.reply(smtp.ReplyCommandNotImpl, smtp.EnhancedCodeInvalidCommand, "EXPN not implemented")
+		return
+	}
+	if args == "" {
+		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "EXPN requires a mailing list")
+		return
+	}
+	members, err := s.expnHandler.OnExpn(s.context(), args)
+	if err != nil {
+		if smtpErr, ok := err.(*smtp.SMTPError); ok {
+			s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+		} else {
+			s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeTempSystem, "Internal error")
+		}
+		return
+	}
+	if len(members) == 0 {
+		s.reply(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeBadDest, "No such mailing list")
+		return
+	}
+	lines := make([]string, len(members))
+	for i, m := range members {
+		lines[i] = "<" + m.String() + ">"
+	}
+	s.reply(smtp.ReplyOK, smtp.EnhancedCodeOK, strings.Join(lines, "\n"))
+}
+
 // handleAUTH processes the AUTH command (RFC 4954).
 func (s *session) handleAUTH(args string) {
-	if s.server.authHandler == nil {
+	if s.authHandler == nil || s.disabled(smtp.ExtAUTH) {
 		s.reply(smtp.ReplyCommandNotImpl, smtp.EnhancedCodeInvalidCommand, "AUTH not available")
 		return
 	}
@@ -506,7 +1161,7 @@ func (s *session) handleAUTH(args string) {
 		s.reply(smtp.ReplyBadSequence, smtp.EnhancedCodeInvalidCommand, "AUTH not allowed during mail transaction")
 		return
 	}
-	if s.authenticated {
+	if s.authenticated && !s.server.allowReauth {
 		s.reply(smtp.ReplyBadSequence, smtp.EnhancedCodeInvalidCommand, "Already authenticated")
 		return
 	}
@@ -522,153 +1177,263 @@ func (s *session) handleAUTH(args string) {
 		s.authLOGIN()
 	case "CRAM-MD5":
 		s.authCRAMMD5()
+	case "SCRAM-SHA-256":
+		if !s.scramEnabled() {
+			s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeInvalidParams, "Unrecognized authentication mechanism")
+			return
+		}
+		s.authSCRAM(initialResp)
 	default:
 		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeInvalidParams, "Unrecognized authentication mechanism")
 	}
 }
 
-// authPLAIN handles SASL PLAIN authentication (RFC 4616).
-func (s *session) authPLAIN(initialResp string) {
-	var decoded []byte
-	var err error
+// authMechanisms returns the SASL mechanisms advertised in EHLO.
+func (s *session) authMechanisms() string {
+	if s.scramEnabled() {
+		return "PLAIN LOGIN CRAM-MD5 SCRAM-SHA-256"
+	}
+	return "PLAIN LOGIN CRAM-MD5"
+}
 
-	if initialResp != "" && initialResp != "=" {
-		decoded, err = base64Decode(initialResp)
-		if err != nil {
-			s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "Invalid base64")
-			return
-		}
-	} else {
-		// Request initial response.
+// Limits on SASL exchanges. RFC 4954 §4 has servers accept response lines
+// of at least 12288 octets; RFC 4616 §2 limits each PLAIN field to 255.
+const (
+	maxAuthLineLen  = 12288
+	maxSASLFieldLen = 255
+	maxPlainLen     = 3*maxSASLFieldLen + 2
+)
+
+// readAuthResponse reads the client's next base64 line of a SASL exchange,
+// which may decode to at most limit bytes. It returns false, after
+// replying if the connection still works, when the client cancels with
+// "*", sends invalid or oversized data, or the connection fails.
+func (s *session) readAuthResponse(limit int) ([]byte, bool) {
+	line, err := s.conn.ReadLine(max(s.server.maxLineLen, maxAuthLineLen))
+	if errors.Is(err, textproto.ErrLineTooLong) {
+		s.reply(smtp.ReplySyntaxError, smtp.EnhancedCodeAuthLineTooLong, "Authentication exchange line is too long")
+		return nil, false
+	}
+	if err != nil {
+		return nil, false
+	}
+	s.authLineAt = time.Now()
+	if line == "*" {
+		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeInvalidCommand, "Authentication cancelled")
+		return nil, false
+	}
+	return s.decodeAuthData(line, limit)
+}
+
+// readInitialResponse decodes the initial response given with the AUTH
+// command, or requests it with an empty 334 challenge if absent.
+func (s *session) readInitialResponse(initialResp string, limit int) ([]byte, bool) {
+	s.authLineAt = time.Now()
+	if initialResp == "=" {
+		return []byte{}, true
+	}
+	if initialResp == "" {
 		s.reply(smtp.ReplyAuthContinue, smtp.EnhancedCode{}, "")
-		line, readErr := s.conn.ReadLine(textproto.MaxCommandLineLen)
-		if readErr != nil {
-			return
-		}
-		if line == "*" {
-			s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeInvalidCommand, "Authentication cancelled")
-			return
-		}
-		decoded, err = base64Decode(line)
-		if err != nil {
-			s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "Invalid base64")
-			return
-		}
+		return s.readAuthResponse(limit)
+	}
+	return s.decodeAuthData(initialResp, limit)
+}
+
+// decodeAuthData decodes base64 SASL data of at most limit bytes, checking
+// the encoded length before decoding anything.
+func (s *session) decodeAuthData(encoded string, limit int) ([]byte, bool) {
+	if len(encoded) > base64Encoding.EncodedLen(limit) {
+		s.reply(smtp.ReplySyntaxError, smtp.EnhancedCodeAuthLineTooLong, "Authentication exchange line is too long")
+		return nil, false
+	}
+	decoded, err := base64Decode(encoded)
+	if err != nil {
+		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "Invalid base64")
+		return nil, false
+	}
+	if len(decoded) > limit { // The encoded bound is rounded up to 3 bytes.
+		clear(decoded)
+		s.reply(smtp.ReplySyntaxError, smtp.EnhancedCodeAuthLineTooLong, "Authentication exchange line is too long")
+		return nil, false
 	}
+	return decoded, true
+}
 
-	// PLAIN format: [authzid] NUL authcid NUL passwd
+// validSASLField reports whether a decoded user name or password is
+// acceptable: valid UTF-8 without NUL, and at most 255 bytes long.
+func validSASLField(field string) bool {
+	return len(field) <= maxSASLFieldLen && utf8.ValidString(field) && !strings.ContainsRune(field, 0)
+}
+
+// authPLAIN handles SASL PLAIN authentication (RFC 4616).
+func (s *session) authPLAIN(initialResp string) {
+	decoded, ok := s.readInitialResponse(initialResp, maxPlainLen)
+	if !ok {
+		return
+	}
+	defer clear(decoded)
+
+	// PLAIN format: [authzid] NUL authcid NUL passwd, where only authzid
+	// may be empty and no field may contain NUL (RFC 4616 §2).
 	parts := splitNull(decoded)
-	if len(parts) != 3 {
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" ||
+		!validSASLField(parts[0]) || !validSASLField(parts[1]) || !validSASLField(parts[2]) {
 		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "Invalid PLAIN data")
 		return
 	}
-	// parts[0] = authzid (identity), parts[1] = authcid (username), parts[2] = passwd
-	username := parts[1]
-	password := parts[2]
+	authzid, username, password := parts[0], parts[1], parts[2]
+	if authzid == username {
+		authzid = ""
+	}
 
-	if err := s.server.authHandler.Authenticate(context.Background(), "PLAIN", username, password); err != nil {
-		if smtpErr, ok := err.(*smtp.SMTPError); ok {
-			s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
-		} else {
-			s.reply(smtp.ReplyAuthFailed, smtp.EnhancedCodeAuthCredentials, "Authentication failed")
-		}
-		return
+	err := s.authHandler.Authenticate(s.context(), "PLAIN", username, password)
+	if err == nil && authzid != "" {
+		err = s.authorize(username, authzid)
 	}
-	s.authenticated = true
-	s.reply(smtp.ReplyAuthOK, smtp.EnhancedCodeOK, "Authentication successful")
+	s.finishAuth("PLAIN", username, authzid, err)
 }
 
 // authLOGIN handles SASL LOGIN authentication (draft-murchison-sasl-login).
 func (s *session) authLOGIN() {
-	// Challenge: Username:
 	s.reply(smtp.ReplyAuthContinue, smtp.EnhancedCode{}, base64Encode([]byte("Username:")))
-	userLine, err := s.conn.ReadLine(textproto.MaxCommandLineLen)
-	if err != nil {
+	userBytes, ok := s.readAuthResponse(maxSASLFieldLen)
+	if !ok {
 		return
 	}
-	if userLine == "*" {
-		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeInvalidCommand, "Authentication cancelled")
+	s.reply(smtp.ReplyAuthContinue, smtp.EnhancedCode{}, base64Encode([]byte("Password:")))
+	passBytes, ok := s.readAuthResponse(maxSASLFieldLen)
+	if !ok {
 		return
 	}
-	userBytes, err := base64Decode(userLine)
-	if err != nil {
-		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "Invalid base64")
+	defer clear(passBytes)
+	if !validSASLField(string(userBytes)) || !validSASLField(string(passBytes)) {
+		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "Invalid LOGIN data")
 		return
 	}
 
-	// Challenge: Password:
-	s.reply(smtp.ReplyAuthContinue, smtp.EnhancedCode{}, base64Encode([]byte("Password:")))
-	passLine, err := s.conn.ReadLine(textproto.MaxCommandLineLen)
-	if err != nil {
-		return
-	}
-	if passLine == "*" {
-		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeInvalidCommand, "Authentication cancelled")
+	err := s.authHandler.Authenticate(s.context(), "LOGIN", string(userBytes), string(passBytes))
+	s.finishAuth("LOGIN", string(userBytes), "", err)
+}
+
+// authCRAMMD5 handles SASL CRAM-MD5 authentication (RFC 2195).
+func (s *session) authCRAMMD5() {
+	const mechanism = "CRAM-MD5"
+	challenge := s.server.cramChallenge(s.hostname)
+	s.reply(smtp.ReplyAuthContinue, smtp.EnhancedCode{}, base64Encode([]byte(challenge)))
+	// Response format: "username digest", with a 32-digit hex digest.
+	decoded, ok := s.readAuthResponse(maxSASLFieldLen + len(" ") + 32)
+	if !ok {
 		return
 	}
-	passBytes, err := base64Decode(passLine)
-	if err != nil {
-		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "Invalid base64")
+	username, digest, found := cutLast(string(decoded), " ")
+	if !found || !validSASLField(username) {
+		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "Invalid CRAM-MD5 response")
 		return
 	}
 
-	if err := s.server.authHandler.Authenticate(context.Background(), "LOGIN", string(userBytes), string(passBytes)); err != nil {
-		if smtpErr, ok := err.(*smtp.SMTPError); ok {
-			s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
-		} else {
-			s.reply(smtp.ReplyAuthFailed, smtp.EnhancedCodeAuthCredentials, "Authentication failed")
+	var err error
+	switch h := s.authHandler.(type) {
+	case ChallengeHandler:
+		err = h.VerifyChallenge(s.context(), mechanism, username, challenge, digest)
+	case SecretHandler:
+		// An unknown user's digest is checked against a made-up secret, so
+		// that the reply takes as long as for a known user.
+		secret, lookupErr := h.Secret(s.context(), mechanism, username)
+		if lookupErr != nil {
+			secret = rand.Text()
 		}
-		return
+		key := []byte(secret)
+		mac := hmac.New(md5.New, key)
+		clear(key)
+		mac.Write([]byte(challenge))
+		want := hex.EncodeToString(mac.Sum(nil))
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(digest)), []byte(want)) != 1 {
+			err = errAuthFailed
+		}
+		if lookupErr != nil {
+			err = lookupErr
+		}
+	default:
+		// Deprecated: the handler verifies "challenge:digest" itself.
+		err = s.authHandler.Authenticate(s.context(), mechanism, username, challenge+":"+digest)
 	}
-	s.authenticated = true
-	s.reply(smtp.ReplyAuthOK, smtp.EnhancedCodeOK, "Authentication successful")
+	s.finishAuth(mechanism, username, "", err)
 }
 
-// authCRAMMD5 handles SASL CRAM-MD5 authentication (RFC 2195).
-func (s *session) authCRAMMD5() {
-	// Generate a challenge.
-	challenge := fmt.Sprintf("<%d.%d@%s>", time.Now().UnixNano(), time.Now().Unix(), s.server.hostname)
-	s.reply(smtp.ReplyAuthContinue, smtp.EnhancedCode{}, base64Encode([]byte(challenge)))
+// cutLast slices s around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
 
-	line, err := s.conn.ReadLine(textproto.MaxCommandLineLen)
-	if err != nil {
-		return
+// countingReader counts the bytes read through it and records the first
+// error other than io.EOF.
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	limit int64 // Reads fail with errMessageTooLarge past limit; 0 means none.
+	err   error
+}
+
+// errMessageTooLarge is returned to a DataHandler reading past the
+// message size limit.
+var errMessageTooLarge = errors.New("smtp: message exceeds maximum size")
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if c.limit > 0 && c.n > c.limit {
+		return 0, errMessageTooLarge
 	}
-	if line == "*" {
-		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeInvalidCommand, "Authentication cancelled")
-		return
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
 	}
-
-	decoded, err := base64Decode(line)
-	if err != nil {
-		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "Invalid base64")
-		return
+	if c.limit > 0 && c.n > c.limit {
+		return n, errMessageTooLarge
 	}
+	return n, err
+}
 
-	// Response format: "username digest"
-	resp := string(decoded)
-	spaceIdx := strings.LastIndex(resp, " ")
-	if spaceIdx < 0 {
-		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "Invalid CRAM-MD5 response")
-		return
+// authorize checks that username may act as authzid.
+func (s *session) authorize(username, authzid string) error {
+	if h, ok := s.authHandler.(AuthzHandler); ok {
+		return h.Authorize(s.context(), username, authzid)
 	}
-	username := resp[:spaceIdx]
-	// For CRAM-MD5, we pass the challenge as password so the handler can verify.
-	// The handler is expected to compute HMAC-MD5 itself.
-	// We pass "challenge:digest" as the password field for the handler to verify.
-	digest := resp[spaceIdx+1:]
-	password := challenge + ":" + digest
+	return smtp.Errorf(smtp.ReplyAuthFailed, smtp.EnhancedCodeAuthCredentials, "Authorization identity not permitted")
+}
 
-	if err := s.server.authHandler.Authenticate(context.Background(), "CRAM-MD5", username, password); err != nil {
-		if smtpErr, ok := err.(*smtp.SMTPError); ok {
-			s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
-		} else {
-			s.reply(smtp.ReplyAuthFailed, smtp.EnhancedCodeAuthCredentials, "Authentication failed")
+// finishAuth sends the result of an AUTH exchange and records it.
+func (s *session) finishAuth(mechanism, username, authzid string, err error) {
+	ev := Event{Type: EventAuthSuccess, Mechanism: mechanism, Username: username, Err: err}
+	if err != nil {
+		s.authenticated, s.authUser, s.authzid, s.authMechanism = false, "", "", ""
+		ev.Type = EventAuthFailure
+		s.emit(ev)
+		s.server.stats.authFailures.Add(1)
+		s.delayAuthFailure(s.authLineAt)
+		// Only replies other than 535, such as 454 for a backend outage,
+		// are passed on as the handler wrote them; see errAuthFailed.
+		smtpErr, ok := err.(*smtp.SMTPError)
+		if !ok || smtpErr.Code == smtp.ReplyAuthFailed {
+			smtpErr = errAuthFailed
+			s.authFailures++
+			s.reportAuthFailure(mechanism, username, err)
+		}
+		if limit := s.cfg.maxAuthFailures; limit > 0 && s.authFailures >= limit {
+			s.logger.Warn("too many authentication failures", "remote", s.conn.NetConn().RemoteAddr(), "failures", s.authFailures)
+			s.reply(smtp.ReplyServiceNotAvailable, smtp.EnhancedCodeTempAuthFailure, "Too many authentication failures")
+			s.closing = true
+			return
 		}
+		s.reply(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
 		return
 	}
-	s.authenticated = true
-	s.reply(smtp.ReplyAuthOK, smtp.EnhancedCodeOK, "Authentication successful")
+	s.emit(ev)
+	s.server.stats.authSuccesses.Add(1)
+	s.authenticated, s.authUser, s.authzid, s.authMechanism = true, username, authzid, mechanism
+	s.reply(smtp.ReplyAuthOK, smtp.EnhancedCodeAuthOK, "Authentication successful")
 }
 
 // splitNull splits a byte slice on NUL bytes.
@@ -696,7 +1461,7 @@ func base64Decode(s string) ([]byte, error) {
 // handleSTARTTLS processes the STARTTLS command (RFC 3207).
 // Returns true if the TLS upgrade succeeded and the session should continue.
 func (s *session) handleSTARTTLS() bool {
-	if s.server.tlsConfig == nil {
+	if s.server.tlsConfig == nil || s.disabled(smtp.ExtSTARTTLS) {
 		s.reply(smtp.ReplyCommandNotImpl, smtp.EnhancedCodeInvalidCommand, "STARTTLS not available")
 		return false
 	}
@@ -705,35 +1470,71 @@ func (s *session) handleSTARTTLS() bool {
 		return false
 	}
 
-	s.reply(smtp.ReplyServiceReady, smtp.EnhancedCode{}, "Ready to start TLS")
+	s.reply(smtp.ReplyServiceReady, smtp.EnhancedCodeOK, "Ready to start TLS")
 
 	// Upgrade the connection.
 	tlsConn := tls.Server(s.conn.NetConn(), s.server.tlsConfig)
 	if err := tlsConn.Handshake(); err != nil {
-		s.server.logger.Error("TLS handshake failed", "err", err)
+		s.logger.Error("TLS handshake failed", "err", err)
+		s.reportError(OpTLS, err)
 		return false // Connection is likely dead; the main loop will exit on next read.
 	}
 
 	// Replace the underlying connection with the TLS connection.
 	s.conn.ReplaceConn(tlsConn)
-	s.tls = true
+	s.tlsEstablished(tlsConn.ConnectionState())
 
 	// Reset session state after TLS upgrade (RFC 3207 §4.2).
 	s.resetTransaction()
-	s.state = stateNew
 	s.clientHostname = ""
 	s.esmtp = false
+	s.setState(stateNew)
 
 	return true
 }
 
+// tlsEstablished records a completed TLS handshake and switches to the
+// hostname configured for the client's SNI name, if any.
+func (s *session) tlsEstablished(cs tls.ConnectionState) {
+	s.tls = true
+	s.serverName = cs.ServerName
+	if fn := s.server.sniHostname; fn != nil && cs.ServerName != "" {
+		if h := fn(cs.ServerName); h != "" {
+			s.hostname = h
+		}
+	}
+}
+
+// abortTransaction resets a transaction left open when the session ends,
+// by QUIT or a dropped connection, so partial BDAT data is released and
+// the ResetHandler can discard its per-transaction state.
+func (s *session) abortTransaction() {
+	if s.state > stateGreeted || s.bdat {
+		s.resetTransaction()
+	}
+}
+
 // resetTransaction clears the current mail transaction state.
 func (s *session) resetTransaction() {
+	// An abandoned DataHandler may still be reading the spooled body.
+	s.awaitAbandoned()
 	s.reversePath = smtp.ReversePath{}
 	s.forwardPaths = nil
-	s.bdatBuffer = nil
-
-	if s.server.resetHandler != nil {
-		s.server.resetHandler.OnReset(context.Background())
+	s.rcptParams = nil
+	s.handlerTime = 0
+	s.smtpUTF8 = false
+	s.body = ""
+	s.dsnRet = ""
+	s.dsnEnvID = ""
+	s.rejected = nil
+	s.bdatBody.close()
+	s.bdatBody = nil
+	s.bdat = false
+	s.bdatFailed = false
+	s.bdatChunks = 0
+
+	if s.resetHandler != nil {
+		s.resetHandler.OnReset(s.context())
 	}
+	s.msgID = ""
 }
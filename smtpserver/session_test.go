@@ -3,18 +3,25 @@ package smtpserver
 import (
 	"bufio"
 	"context"
+	"encoding/base64"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/big"
 	"net"
+	"net/netip"
+	"reflect"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -368,6 +375,73 @@ func TestVRFY(t *testing.T) {
 	c.expectCode(252)
 }
 
+// vrfyCounter answers VRFY and counts the calls.
+type vrfyCounter struct{ calls atomic.Int32 }
+
+func (h *vrfyCounter) OnVrfy(context.Context, string) (string, error) {
+	h.calls.Add(1)
+	return "User <user@example.com>", nil
+}
+
+func TestVRFY_Disabled(t *testing.T) {
+	h := &vrfyCounter{}
+	clientConn, _ := startTestServer(t, WithVrfyHandler(h), WithDisableVRFY(true))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+
+	c.send("VRFY user")
+	if lines := c.expectCode(502); !strings.HasPrefix(lines[0], "5.5.1 ") {
+		t.Errorf("reply = %q, want enhanced code 5.5.1", lines[0])
+	}
+	if n := h.calls.Load(); n != 0 {
+		t.Errorf("VrfyHandler called %d times, want 0", n)
+	}
+}
+
+// listExpander expands the mailing list "staff".
+type listExpander struct{}
+
+func (listExpander) OnExpn(_ context.Context, list string) ([]smtp.Mailbox, error) {
+	switch list {
+	case "staff":
+		return []smtp.Mailbox{{LocalPart: "alice", Domain: "example.com"}, {LocalPart: "bob", Domain: "example.com"}}, nil
+	case "private":
+		return nil, smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeNotAuthorized, "Access denied")
+	}
+	return nil, nil
+}
+
+func TestEXPN(t *testing.T) {
+	clientConn, _ := startTestServer(t)
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EXPN staff")
+	c.expectCode(502)
+	clientConn.Close()
+
+	clientConn, _ = startTestServer(t, WithExpnHandler(listExpander{}))
+	defer clientConn.Close()
+	c = newConversation(t, clientConn)
+	c.expectCode(220)
+
+	c.send("EXPN staff")
+	lines := c.expectCode(250)
+	want := []string{"2.0.0 <alice@example.com>", "2.0.0 <bob@example.com>"}
+	if !slices.Equal(lines, want) {
+		t.Errorf("reply = %q, want %q", lines, want)
+	}
+	c.send("EXPN private")
+	c.expectCode(550)
+	c.send("EXPN nobody")
+	if lines := c.expectCode(550); lines[0] != "5.1.1 No such mailing list" {
+		t.Errorf("reply = %q", lines[0])
+	}
+	c.send("EXPN")
+	c.expectCode(501)
+}
+
 func TestUnknownCommand(t *testing.T) {
 	clientConn, _ := startTestServer(t)
 	defer clientConn.Close()
@@ -402,6 +476,60 @@ func TestRcptHandlerReject(t *testing.T) {
 	c.expectCode(250)
 }
 
+// replySetter sets the replies to the commands it accepts, and refuses
+// recipients named "refused" after setting one.
+type replySetter struct{}
+
+func (replySetter) OnMail(ctx context.Context, _ smtp.ReversePath) error {
+	SetReply(ctx, smtp.ReplyOK, smtp.EnhancedCodeOK, "Sender ok\nSee you")
+	return nil
+}
+
+func (replySetter) OnRcpt(ctx context.Context, to smtp.ForwardPath) error {
+	SetReply(ctx, smtp.ReplyUserNotLocal, smtp.EnhancedCode{}, "User not local; will forward")
+	if to.Mailbox.LocalPart == "refused" {
+		return smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeBadDest, "No such user")
+	}
+	return nil
+}
+
+func (replySetter) OnData(ctx context.Context, _ smtp.ReversePath, _ []smtp.ForwardPath, r io.Reader) error {
+	io.Copy(io.Discard, r)
+	SetReply(ctx, smtp.ReplyMailboxNotFound, smtp.EnhancedCode{}, "Ignored: not 2xx")
+	return nil
+}
+
+func TestSetReply(t *testing.T) {
+	h := replySetter{}
+	clientConn, _ := startTestServer(t, WithMailHandler(h), WithRcptHandler(h), WithDataHandler(h))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO test")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	if lines := c.expectCode(250); len(lines) != 2 || lines[0] != "2.0.0 Sender ok" || lines[1] != "2.0.0 See you" {
+		t.Errorf("MAIL reply = %q", lines)
+	}
+	c.send("RCPT TO:<refused@example.com>")
+	c.expectCode(550)
+	c.send("RCPT TO:<user@example.com>")
+	if lines := c.expectCode(251); lines[0] != "2.1.5 User not local; will forward" {
+		t.Errorf("RCPT reply = %q", lines)
+	}
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Subject: test\r\n\r\nbody")
+	if lines := c.expectCode(250); !strings.HasPrefix(lines[0], "2.0.0 Ok: queued as ") {
+		t.Errorf("DATA reply = %q", lines)
+	}
+	c.send("NOOP")
+	if lines := c.expectCode(250); lines[0] != "2.0.0 OK" {
+		t.Errorf("NOOP reply = %q", lines)
+	}
+}
+
 func TestEHLO_ReissueClearsState(t *testing.T) {
 	clientConn, _ := startTestServer(t)
 	defer clientConn.Close()
@@ -663,11 +791,13 @@ func TestMaxConnections(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	events := &testEventHandler{}
 	srv := NewServer(
 		WithHostname("test.example.com"),
 		WithReadTimeout(5*time.Second),
 		WithWriteTimeout(5*time.Second),
 		WithMaxConnections(2),
+		WithEventHandler(events),
 	)
 
 	go srv.Serve(ln)
@@ -697,7 +827,15 @@ func TestMaxConnections(t *testing.T) {
 	}
 	defer conn3.Close()
 	c3 := newConversation(t, conn3)
-	c3.expectCode(421)
+	if lines := c3.expectCode(421); !strings.HasPrefix(lines[0], "4.7.0 ") {
+		t.Errorf("reply = %q, want enhanced code 4.7.0", lines[0])
+	}
+	if st := srv.Stats(); st.ConnectionsOverLimit != 1 || st.ConnectionsRejected != 0 {
+		t.Errorf("over limit/rejected = %d/%d, want 1/0", st.ConnectionsOverLimit, st.ConnectionsRejected)
+	}
+	if ev, ok := events.find(EventConnectionLimit); !ok || ev.RemoteAddr.String() != conn3.LocalAddr().String() || ev.SessionID != "" {
+		t.Errorf("connection limit event = %+v, %v", ev, ok)
+	}
 
 	// Close one connection, then a new one should succeed.
 	c1.send("QUIT")
@@ -716,6 +854,34 @@ func TestMaxConnections(t *testing.T) {
 	c4.expectCode(220)
 }
 
+func TestLoadChecker(t *testing.T) {
+	var overloaded atomic.Bool
+	overloaded.Store(true)
+	clientConn, srv := startTestServer(t, WithLoadChecker(func() error {
+		if overloaded.Load() {
+			return errors.New("cpu load 0.97")
+		}
+		return nil
+	}))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	if lines := c.expectCode(421); !strings.HasPrefix(lines[0], "4.3.2 ") {
+		t.Errorf("reply = %q, want enhanced code 4.3.2", lines[0])
+	}
+
+	st := srv.Stats()
+	if st.ConnectionsShed != 1 || st.ConnectionsRejected != 0 {
+		t.Errorf("shed/rejected = %d/%d, want 1/0", st.ConnectionsShed, st.ConnectionsRejected)
+	}
+
+	overloaded.Store(false)
+	clientConn2, serverConn2 := net.Pipe()
+	defer clientConn2.Close()
+	go srv.handleConn(serverConn2)
+	newConversation(t, clientConn2).expectCode(220)
+}
+
 func TestSubmissionMode_RejectsUnauthenticated(t *testing.T) {
 	clientConn, _ := startTestServer(t,
 		WithAuthHandler(&testAuthHandler{}),
@@ -915,6 +1081,123 @@ func TestAUTH_AlreadyAuthenticated(t *testing.T) {
 	c.expectCode(503)
 }
 
+// identityRecorder records AuthIdentity as seen by OnMail.
+type identityRecorder struct{ identities []string }
+
+func (h *identityRecorder) OnMail(ctx context.Context, _ smtp.ReversePath) error {
+	user, mechanism := AuthIdentity(ctx)
+	h.identities = append(h.identities, user+" "+mechanism)
+	return nil
+}
+
+func TestAUTH_Reauth(t *testing.T) {
+	h := &identityRecorder{}
+	clientConn, _ := startTestServer(t,
+		WithAuthHandler(&testAuthHandler{}),
+		WithAllowReauth(true),
+		WithSubmissionMode(true),
+		WithMailHandler(h),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO test")
+	c.expectCode(250)
+
+	c.send("AUTH PLAIN AHRlc3R1c2VyAHRlc3RwYXNz") // \x00testuser\x00testpass
+	c.expectCode(235)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RSET")
+	c.expectCode(250)
+
+	c.send("EHLO test")
+	if ehlo := strings.Join(c.expectCode(250), "\n"); !strings.Contains(ehlo, "AUTH ") {
+		t.Errorf("AUTH not advertised after authentication with re-auth allowed:\n%s", ehlo)
+	}
+	c.send("AUTH LOGIN")
+	c.expectCode(334)
+	c.send("dGVzdHVzZXI=") // testuser
+	c.expectCode(334)
+	c.send("dGVzdHBhc3M=") // testpass
+	c.expectCode(235)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RSET")
+	c.expectCode(250)
+
+	// A failed re-authentication drops the previous identity.
+	c.send("AUTH PLAIN AGJhZHVzZXIAYmFkcGFzcw==") // \x00baduser\x00badpass
+	c.expectCode(535)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(530)
+
+	want := []string{"testuser PLAIN", "testuser LOGIN"}
+	if !slices.Equal(h.identities, want) {
+		t.Errorf("AuthIdentity in OnMail = %q, want %q", h.identities, want)
+	}
+}
+
+// proxyAuthHandler lets admin authenticate and act for user@example.com,
+// and records AuthorizationIdentity as seen by OnMail.
+type proxyAuthHandler struct{ identities []string }
+
+func (h *proxyAuthHandler) Authenticate(_ context.Context, _, username, password string) error {
+	if username == "admin" && password == "adminpass" {
+		return nil
+	}
+	return smtp.Errorf(smtp.ReplyAuthFailed, smtp.EnhancedCodeAuthCredentials, "Bad credentials")
+}
+
+func (h *proxyAuthHandler) Authorize(_ context.Context, username, authzid string) error {
+	if username == "admin" && authzid == "user@example.com" {
+		return nil
+	}
+	return smtp.Errorf(smtp.ReplyAuthFailed, smtp.EnhancedCodeAuthCredentials, "Not permitted")
+}
+
+func (h *proxyAuthHandler) OnMail(ctx context.Context, from smtp.ReversePath) error {
+	h.identities = append(h.identities, AuthorizationIdentity(ctx))
+	return nil
+}
+
+func TestAUTH_Authzid(t *testing.T) {
+	plain := func(authzid, user, pass string) string {
+		return "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte(authzid+"\x00"+user+"\x00"+pass))
+	}
+	for _, tt := range []struct {
+		name     string
+		handler  AuthHandler
+		command  string
+		code     int
+		identity string
+	}{
+		{"proxy", &proxyAuthHandler{}, plain("user@example.com", "admin", "adminpass"), 235, "user@example.com"},
+		{"proxy refused", &proxyAuthHandler{}, plain("other@example.com", "admin", "adminpass"), 535, ""},
+		{"same identity", &proxyAuthHandler{}, plain("admin", "admin", "adminpass"), 235, "admin"},
+		{"no AuthzHandler", &testAuthHandler{}, plain("other", "testuser", "testpass"), 535, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &proxyAuthHandler{}
+			clientConn, _ := startTestServer(t, WithAuthHandler(tt.handler), WithMailHandler(h))
+			defer clientConn.Close()
+
+			c := newConversation(t, clientConn)
+			c.expectCode(220)
+			c.send("EHLO test")
+			c.expectCode(250)
+			c.send(tt.command)
+			c.expectCode(tt.code)
+			c.send("MAIL FROM:<sender@example.com>")
+			c.expectCode(250)
+			if len(h.identities) != 1 || h.identities[0] != tt.identity {
+				t.Errorf("AuthorizationIdentity = %q, want %q", h.identities, tt.identity)
+			}
+		})
+	}
+}
+
 func TestBDAT_ServerSide(t *testing.T) {
 	handler := &testDataHandler{}
 	clientConn, _ := startTestServer(t, WithDataHandler(handler))
@@ -995,8 +1278,15 @@ func TestBDAT_BeforeRcpt(t *testing.T) {
 	c.send("EHLO test")
 	c.expectCode(250)
 
+	// The chunk data is consumed even though the command is rejected.
 	c.send("BDAT 5 LAST")
+	c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	c.writer.WriteString("Hello")
+	c.writer.Flush()
 	c.expectCode(503) // Bad sequence.
+
+	c.send("NOOP")
+	c.expectCode(250)
 }
 
 func TestSTARTTLS_NotConfigured(t *testing.T) {
@@ -1096,6 +1386,152 @@ func TestSTARTTLS_ServerSide(t *testing.T) {
 	}
 }
 
+// hostnameRecorder records the SNI name and announced hostname seen by OnMail.
+type hostnameRecorder struct {
+	mu       sync.Mutex
+	sni      string
+	hostname string
+}
+
+func (h *hostnameRecorder) OnMail(ctx context.Context, _ smtp.ReversePath) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sni, h.hostname = Negotiated(ctx).SNI, ServerHostname(ctx)
+	return nil
+}
+
+func TestSNIHostname(t *testing.T) {
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{generateTestCertServer(t)}}
+	tenants := WithSNIHostname(func(serverName string) string {
+		if serverName == "mx.tenant.example" {
+			return "mx.tenant.example"
+		}
+		return ""
+	})
+
+	for _, tc := range []struct {
+		sni, hostname string
+	}{
+		{"mx.tenant.example", "mx.tenant.example"},
+		{"other.example", "test.example.com"},
+	} {
+		t.Run("STARTTLS/"+tc.sni, func(t *testing.T) {
+			h := &hostnameRecorder{}
+			clientConn, _ := startTestServer(t, WithTLSConfig(tlsConfig), WithMailHandler(h), tenants)
+			defer clientConn.Close()
+
+			c := newConversation(t, clientConn)
+			if lines := c.expectCode(220); !strings.HasPrefix(lines[0], "test.example.com ") {
+				t.Errorf("greeting = %q", lines[0])
+			}
+			c.send("STARTTLS")
+			c.expectCode(220)
+			tlsConn := tls.Client(clientConn, &tls.Config{ServerName: tc.sni, InsecureSkipVerify: true})
+			if err := tlsConn.Handshake(); err != nil {
+				t.Fatalf("TLS handshake: %v", err)
+			}
+			c = newConversation(t, tlsConn)
+			c.send("EHLO client.example.com")
+			if lines := c.expectCode(250); lines[0] != tc.hostname+" Hello client.example.com" {
+				t.Errorf("EHLO reply = %q, want hostname %s", lines[0], tc.hostname)
+			}
+			c.send("MAIL FROM:<sender@example.com>")
+			c.expectCode(250)
+
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			if h.sni != tc.sni || h.hostname != tc.hostname {
+				t.Errorf("SNI, ServerHostname = %q, %q; want %q, %q", h.sni, h.hostname, tc.sni, tc.hostname)
+			}
+		})
+	}
+
+	// With implicit TLS the name is known before the greeting.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(WithHostname("test.example.com"), WithTLSConfig(tlsConfig), tenants)
+	go srv.Serve(tls.NewListener(ln, tlsConfig))
+	defer srv.Close()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "mx.tenant.example", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := newConversation(t, conn)
+	if lines := c.expectCode(220); lines[0] != "mx.tenant.example ESMTP ready" {
+		t.Errorf("implicit TLS greeting = %q", lines[0])
+	}
+	c.send("EHLO client.example.com")
+	for _, line := range c.expectCode(250) {
+		if line == "STARTTLS" {
+			t.Error("STARTTLS advertised on an implicit TLS connection")
+		}
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewServer().ServeTLS(ln); err == nil {
+		t.Error("ServeTLS without certificates succeeded")
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{generateTestCertServer(t)}}
+	srv := NewServer(WithHostname("test.example.com"), WithTLSConfig(tlsConfig))
+	plainLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 2)
+	go func() { done <- srv.Serve(plainLn) }()
+	go func() { done <- srv.ServeTLS(tlsLn) }()
+
+	conn, err := tls.Dial("tcp", tlsLn.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newConversation(t, conn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	if ehlo := strings.Join(c.expectCode(250), "\n"); strings.Contains(ehlo, "STARTTLS") {
+		t.Errorf("STARTTLS offered over implicit TLS:\n%s", ehlo)
+	}
+	c.send("QUIT")
+	c.expectCode(221)
+	conn.Close()
+
+	plain, err := net.Dial("tcp", plainLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = newConversation(t, plain)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	if ehlo := c.expectCode(250); !slices.Contains(ehlo, "STARTTLS") {
+		t.Errorf("STARTTLS not offered on the plain listener: %v", ehlo)
+	}
+	plain.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	for range 2 {
+		if err := <-done; err != nil {
+			t.Errorf("Serve returned %v after Shutdown", err)
+		}
+	}
+}
+
 // generateTestCertServer creates a self-signed TLS certificate for testing.
 func generateTestCertServer(t *testing.T) tls.Certificate {
 	t.Helper()
@@ -1144,3 +1580,1155 @@ func TestDoubleMAIL(t *testing.T) {
 	c.send("MAIL FROM:<other@example.com>")
 	c.expectCode(503)
 }
+
+func TestMaxBandwidthPerConn(t *testing.T) {
+	handler := &testDataHandler{}
+	clientConn, _ := startTestServer(t,
+		WithDataHandler(handler),
+		WithMaxBandwidthPerConn(2000),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+
+	c.send("EHLO test")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+
+	body := strings.Repeat("0123456789", 300)
+	start := time.Now()
+	c.sendData(body)
+	c.expectCode(250)
+
+	// 3000+ bytes at 2000 B/s: the first second's burst is free, the rest is paced.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("DATA took %v, want throttling to slow it down", elapsed)
+	}
+	if got := handler.lastMessage().Body; !strings.HasPrefix(got, body) {
+		t.Errorf("Body corrupted by throttling: got %d bytes", len(got))
+	}
+}
+
+func TestThroughputLimit_MessagesPerInterval(t *testing.T) {
+	handler := &testDataHandler{}
+	clientConn, _ := startTestServer(t,
+		WithDataHandler(handler),
+		WithThroughputLimit(1, 0, time.Hour),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+
+	c.send("EHLO test")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("first")
+	c.expectCode(250)
+
+	// Budget exhausted: MAIL is deferred but the connection stays usable.
+	c.send("MAIL FROM:<sender@example.com>")
+	lines := c.expectCode(452)
+	if !strings.HasPrefix(lines[0], "4.3.2 ") {
+		t.Errorf("reply = %q, want enhanced code 4.3.2", lines[0])
+	}
+	c.send("NOOP")
+	c.expectCode(250)
+}
+
+func TestThroughputLimit_BytesPerInterval(t *testing.T) {
+	limiter := newThroughputLimiter(0, 100, 50*time.Millisecond)
+	if limiter.saturated() {
+		t.Fatal("new limiter should not be saturated")
+	}
+	limiter.record(150)
+	if !limiter.saturated() {
+		t.Fatal("limiter should be saturated after exceeding byte budget")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if limiter.saturated() {
+		t.Error("limiter should reset after the interval")
+	}
+}
+
+func TestAcceptRate(t *testing.T) {
+	limiter := newAcceptLimiter(20, 2)
+	for i, want := range []time.Duration{0, 0, 50 * time.Millisecond, 100 * time.Millisecond} {
+		if d := limiter.reserve(); d > want || d < want-5*time.Millisecond {
+			t.Errorf("reservation %d: wait %v, want %v", i, d, want)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(WithHostname("test.example.com"), WithAcceptRate(20, 2))
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	start := time.Now()
+	for range 4 {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		newConversation(t, conn).expectCode(220)
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("4 connections accepted in %v at 20/s with a burst of 2", d)
+	}
+	if n := srv.Stats().AcceptsThrottled; n < 2 {
+		t.Errorf("AcceptsThrottled = %d, want at least 2", n)
+	}
+}
+
+func TestMaxSessionDuration(t *testing.T) {
+	handler := &testDataHandler{}
+	clientConn, _ := startTestServer(t,
+		WithDataHandler(handler),
+		WithMaxSessionDuration(300*time.Millisecond),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+
+	c.send("EHLO test")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+
+	// The session expires mid-transfer; the message must still be accepted.
+	c.send("Subject: slow")
+	time.Sleep(400 * time.Millisecond)
+	c.sendData("")
+	c.expectCode(250)
+
+	// The session is closed at the next command boundary.
+	c.expectCode(421)
+}
+
+func TestMaxSessionDuration_Idle(t *testing.T) {
+	clientConn, _ := startTestServer(t, WithMaxSessionDuration(200*time.Millisecond))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+
+	// An idle client is disconnected when the session lifetime runs out,
+	// even though the read timeout is much longer.
+	c.expectCode(421)
+}
+
+func TestDATA_ContentChecks(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		body     string
+		wantCode int
+	}{
+		{"NUL allowed by default", nil, "Hello\x00World", 250},
+		{"NUL rejected", []Option{WithRejectNUL(true)}, "Hello\x00World", 554},
+		{"control char allowed with NUL check only", []Option{WithRejectNUL(true)}, "Bell\x07", 250},
+		{"control char rejected", []Option{WithRejectControlChars(true)}, "Bell\x07", 554},
+		{"DEL rejected", []Option{WithRejectControlChars(true)}, "Del\x7f", 554},
+		{"tab allowed", []Option{WithRejectControlChars(true)}, "Col1\tCol2", 250},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &testDataHandler{}
+			opts := append([]Option{WithDataHandler(handler)}, tt.opts...)
+			clientConn, _ := startTestServer(t, opts...)
+			defer clientConn.Close()
+
+			c := newConversation(t, clientConn)
+			c.expectCode(220)
+			c.send("EHLO test")
+			c.expectCode(250)
+			c.send("MAIL FROM:<sender@example.com>")
+			c.expectCode(250)
+			c.send("RCPT TO:<user@example.com>")
+			c.expectCode(250)
+			c.send("DATA")
+			c.expectCode(354)
+			c.sendData(tt.body)
+			lines := c.expectCode(tt.wantCode)
+
+			if tt.wantCode == 554 {
+				if !strings.HasPrefix(lines[0], "5.6.0 ") {
+					t.Errorf("reply = %q, want enhanced code 5.6.0", lines[0])
+				}
+				if len(handler.messages) != 0 {
+					t.Error("handler should not have stored the rejected message")
+				}
+			}
+
+			// The session stays synchronized after a rejection.
+			c.send("NOOP")
+			c.expectCode(250)
+		})
+	}
+}
+
+func TestDATA_UTF8Headers(t *testing.T) {
+	tests := []struct {
+		name     string
+		mail     string
+		body     string
+		wantCode int
+	}{
+		{"valid UTF-8", "MAIL FROM:<sender@example.com> SMTPUTF8", "Subject: Grüße\r\n\r\nBody", 250},
+		{"Latin-1 header", "MAIL FROM:<sender@example.com> SMTPUTF8", "Subject: Gr\xfc\xdfe\r\n\r\nBody", 554},
+		{"truncated sequence", "MAIL FROM:<sender@example.com> SMTPUTF8", "Subject: Gr\xc3", 554},
+		{"Latin-1 body", "MAIL FROM:<sender@example.com> SMTPUTF8", "Subject: Hi\r\n\r\nGr\xfc\xdfe", 250},
+		{"without SMTPUTF8", "MAIL FROM:<sender@example.com>", "Subject: Gr\xfc\xdfe\r\n\r\nBody", 250},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, _ := startTestServer(t, WithValidateUTF8Headers(true))
+			defer clientConn.Close()
+
+			c := newConversation(t, clientConn)
+			c.expectCode(220)
+			c.send("EHLO test")
+			c.expectCode(250)
+			c.send(tt.mail)
+			c.expectCode(250)
+			c.send("RCPT TO:<user@example.com>")
+			c.expectCode(250)
+			c.send("DATA")
+			c.expectCode(354)
+			c.sendData(tt.body)
+			lines := c.expectCode(tt.wantCode)
+			if tt.wantCode == 554 && !strings.HasPrefix(lines[0], "5.6.7 ") {
+				t.Errorf("reply = %q, want enhanced code 5.6.7", lines[0])
+			}
+		})
+	}
+}
+
+func TestBDAT_ContentChecks(t *testing.T) {
+	clientConn, _ := startTestServer(t, WithRejectNUL(true))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO test")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+
+	data := "Hello\x00World"
+	c.send(fmt.Sprintf("BDAT %d LAST", len(data)))
+	c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	c.writer.WriteString(data)
+	c.writer.Flush()
+	c.expectCode(554)
+}
+
+// sendChunk sends a BDAT command followed by its raw chunk data.
+func (c *smtpConversation) sendChunk(data string, last bool) {
+	c.t.Helper()
+	cmd := fmt.Sprintf("BDAT %d", len(data))
+	if last {
+		cmd += " LAST"
+	}
+	c.send(cmd)
+	c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	c.writer.WriteString(data)
+	c.writer.Flush()
+}
+
+func TestBDAT_ZeroLast(t *testing.T) {
+	handler := &testDataHandler{}
+	clientConn, _ := startTestServer(t, WithDataHandler(handler))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO test")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+
+	c.sendChunk("Whole message", false)
+	c.expectCode(250)
+	c.sendChunk("", true)
+	c.expectCode(250)
+
+	if got := handler.lastMessage().Body; got != "Whole message" {
+		t.Errorf("Body = %q, want %q", got, "Whole message")
+	}
+}
+
+func TestBDAT_DataAfterBdat(t *testing.T) {
+	clientConn, _ := startTestServer(t)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO test")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+
+	c.sendChunk("Part one", false)
+	c.expectCode(250)
+
+	c.send("DATA")
+	c.expectCode(503)
+
+	c.send("RSET")
+	c.expectCode(250)
+}
+
+// resetCounter counts OnReset calls.
+type resetCounter struct{ n atomic.Int32 }
+
+func (h *resetCounter) OnReset(context.Context) { h.n.Add(1) }
+
+func TestBDAT_Interleaved(t *testing.T) {
+	handler := &testDataHandler{}
+	resets := &resetCounter{}
+	clientConn, _ := startTestServer(t, WithDataHandler(handler), WithResetHandler(resets))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO test")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+
+	// NOOP between chunks keeps the transaction.
+	c.sendChunk("Part one ", false)
+	c.expectCode(250)
+	c.send("NOOP")
+	c.expectCode(250)
+	c.sendChunk("part two", true)
+	c.expectCode(250)
+	if got := handler.lastMessage().Body; got != "Part one part two" {
+		t.Errorf("Body = %q, want %q", got, "Part one part two")
+	}
+
+	// RSET between chunks discards the partial message.
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.sendChunk("abandoned ", false)
+	c.expectCode(250)
+	c.send("RSET")
+	c.expectCode(250)
+	c.sendChunk("orphan", true)
+	c.expectCode(503)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.sendChunk("fresh", true)
+	c.expectCode(250)
+	if got := handler.lastMessage().Body; got != "fresh" {
+		t.Errorf("Body after RSET = %q, want %q", got, "fresh")
+	}
+
+	// QUIT between chunks abandons the transaction.
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.sendChunk("unfinished", false)
+	c.expectCode(250)
+	before := resets.n.Load()
+	c.send("QUIT")
+	c.expectCode(221)
+	deadline := time.Now().Add(2 * time.Second)
+	for resets.n.Load() == before && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if resets.n.Load() == before {
+		t.Error("QUIT between BDAT chunks did not reset the transaction")
+	}
+	if n := len(handler.messages); n != 2 {
+		t.Errorf("delivered %d messages, want 2", n)
+	}
+}
+
+func TestMAIL_DeclaredSize(t *testing.T) {
+	clientConn, _ := startTestServer(t, WithMaxMessageSize(1000))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com> SIZE=1001")
+	if lines := c.expectCode(552); !strings.HasPrefix(lines[0], "5.3.4 ") {
+		t.Errorf("reply = %q, want enhanced code 5.3.4", lines[0])
+	}
+	c.send("MAIL FROM:<sender@example.com> size=lots")
+	c.expectCode(501)
+	c.send("MAIL FROM:<sender@example.com> SIZE=1000")
+	c.expectCode(250)
+}
+
+func TestBDAT_SizeLimit(t *testing.T) {
+	handler := &testDataHandler{}
+	clientConn, _ := startTestServer(t,
+		WithDataHandler(handler),
+		WithMaxMessageSize(10),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO test")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+
+	c.sendChunk("123456", false)
+	c.expectCode(250)
+
+	// Second chunk pushes the total past the limit.
+	c.sendChunk("7890AB", false)
+	lines := c.expectCode(552)
+	if !strings.HasPrefix(lines[0], "5.3.4 ") {
+		t.Errorf("reply = %q, want enhanced code 5.3.4", lines[0])
+	}
+
+	// A chunk already in the pipeline is discarded, not parsed as commands.
+	c.sendChunk("NOOP\r\n", true)
+	c.expectCode(503)
+
+	// The connection is still synchronized for a new transaction.
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.sendChunk("small", true)
+	c.expectCode(250)
+
+	if len(handler.messages) != 1 || handler.lastMessage().Body != "small" {
+		t.Errorf("messages = %+v, want only the small message", handler.messages)
+	}
+}
+
+func TestBDAT_ChunkLimits(t *testing.T) {
+	handler := &testDataHandler{}
+	clientConn, _ := startTestServer(t,
+		WithDataHandler(handler),
+		WithMaxBdatChunkSize(8),
+		WithMaxBdatChunks(3),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO test")
+	c.expectCode(250)
+	transaction := func() {
+		c.send("MAIL FROM:<sender@example.com>")
+		c.expectCode(250)
+		c.send("RCPT TO:<user@example.com>")
+		c.expectCode(250)
+	}
+
+	transaction()
+	c.sendChunk("123456789", true)
+	if lines := c.expectCode(552); lines[0] != "5.3.4 BDAT chunk exceeds maximum chunk size" {
+		t.Errorf("reply = %q", lines[0])
+	}
+
+	transaction()
+	for range 3 {
+		c.sendChunk("x", false)
+		c.expectCode(250)
+	}
+	c.sendChunk("x", false)
+	if lines := c.expectCode(552); lines[0] != "5.3.4 Too many BDAT chunks" {
+		t.Errorf("reply = %q", lines[0])
+	}
+	c.sendChunk("x", true)
+	c.expectCode(503)
+
+	// The count starts over with each transaction.
+	transaction()
+	c.sendChunk("ab", false)
+	c.expectCode(250)
+	c.sendChunk("cd", true)
+	c.expectCode(250)
+	if len(handler.messages) != 1 || handler.lastMessage().Body != "abcd" {
+		t.Errorf("messages = %+v, want only the last message", handler.messages)
+	}
+}
+
+// idDataHandler records the session and message IDs seen by OnData.
+type idDataHandler struct {
+	sessionID, messageID string
+}
+
+func (h *idDataHandler) OnData(ctx context.Context, _ smtp.ReversePath, _ []smtp.ForwardPath, r io.Reader) error {
+	h.sessionID, h.messageID = SessionID(ctx), MessageID(ctx)
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+// heloContextRecorder records the greeting and client address seen by
+// OnHelo and OnMail.
+type heloContextRecorder struct {
+	greetings []string
+	mailHelo  string
+	addr      net.Addr
+}
+
+func (h *heloContextRecorder) OnHelo(ctx context.Context, hostname string) error {
+	name, esmtp := Helo(ctx)
+	h.greetings = append(h.greetings, fmt.Sprintf("%s %v", name, esmtp))
+	h.addr = RemoteAddr(ctx)
+	return nil
+}
+
+func (h *heloContextRecorder) OnMail(ctx context.Context, _ smtp.ReversePath) error {
+	name, esmtp := Helo(ctx)
+	h.mailHelo = fmt.Sprintf("%s %v", name, esmtp)
+	return nil
+}
+
+func TestHeloContext(t *testing.T) {
+	h := &heloContextRecorder{}
+	clientConn, _ := startTestServer(t, WithHeloHandler(h), WithMailHandler(h))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO first.example.com")
+	c.expectCode(250)
+	c.send("HELO second.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+
+	want := []string{"first.example.com true", "second.example.com false"}
+	if !slices.Equal(h.greetings, want) {
+		t.Errorf("Helo in OnHelo = %q, want %q", h.greetings, want)
+	}
+	if h.mailHelo != "second.example.com false" {
+		t.Errorf("Helo in OnMail = %q, want the accepted HELO", h.mailHelo)
+	}
+	if h.addr == nil || h.addr.String() != clientConn.LocalAddr().String() {
+		t.Errorf("RemoteAddr = %v, want %v", h.addr, clientConn.LocalAddr())
+	}
+}
+
+// negotiationRecorder records Negotiated as seen by OnMail and OnData.
+type negotiationRecorder struct {
+	mu   sync.Mutex
+	mail []Negotiation
+	data []Negotiation
+}
+
+func (h *negotiationRecorder) OnMail(ctx context.Context, _ smtp.ReversePath) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.mail = append(h.mail, Negotiated(ctx))
+	return nil
+}
+
+func (h *negotiationRecorder) OnData(ctx context.Context, _ smtp.ReversePath, _ []smtp.ForwardPath, r io.Reader) error {
+	io.Copy(io.Discard, r)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.data = append(h.data, Negotiated(ctx))
+	return nil
+}
+
+func TestNegotiated(t *testing.T) {
+	h := &negotiationRecorder{}
+	clientConn, _ := startTestServer(t, WithMailHandler(h), WithDataHandler(h))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com> BODY=8bitmime SMTPUTF8")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.sendChunk("Subject: chunked\r\n\r\nbody\r\n", true)
+	c.expectCode(250)
+
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("plain")
+	c.expectCode(250)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	first := Negotiation{ESMTP: true, SMTPUTF8: true, Body: "8BITMIME"}
+	if len(h.mail) != 2 || h.mail[0] != first || h.mail[1] != (Negotiation{ESMTP: true}) {
+		t.Errorf("Negotiated in OnMail = %+v", h.mail)
+	}
+	first.Chunking = true
+	if len(h.data) != 2 || h.data[0] != first || h.data[1] != (Negotiation{ESMTP: true}) {
+		t.Errorf("Negotiated in OnData = %+v", h.data)
+	}
+}
+
+// rejectedRecorder records RejectedRecipients as seen by OnData.
+type rejectedRecorder struct {
+	mu       sync.Mutex
+	rejected [][]RejectedRecipient
+}
+
+func (h *rejectedRecorder) OnData(ctx context.Context, _ smtp.ReversePath, _ []smtp.ForwardPath, r io.Reader) error {
+	io.Copy(io.Discard, r)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rejected = append(h.rejected, RejectedRecipients(ctx))
+	return nil
+}
+
+func TestRejectedRecipients(t *testing.T) {
+	h := &rejectedRecorder{}
+	clientConn, _ := startTestServer(t,
+		WithDataHandler(h),
+		WithRcptHandler(&testRcptHandler{reject: "unknown@example.com"}),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<unknown@example.com>")
+	c.expectCode(550)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<not an address>")
+	c.expectCode(501)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Hello")
+	c.expectCode(250)
+
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Hello again")
+	c.expectCode(250)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.rejected) != 2 {
+		t.Fatalf("OnData called %d times, want 2", len(h.rejected))
+	}
+	got := h.rejected[0]
+	if len(got) != 2 || got[0].Path != "<unknown@example.com>" || got[0].Err.Code != smtp.ReplyMailboxNotFound ||
+		got[0].Err.EnhancedCode != smtp.EnhancedCodeBadDest || got[1].Err.Code != smtp.ReplySyntaxParamError {
+		t.Errorf("RejectedRecipients = %+v", got)
+	}
+	if len(h.rejected[1]) != 0 {
+		t.Errorf("rejections leaked into the next transaction: %+v", h.rejected[1])
+	}
+}
+
+// quotaRcptHandler defers recipients that have used up their quota.
+type quotaRcptHandler map[string]bool
+
+func (h quotaRcptHandler) OnRcpt(_ context.Context, to smtp.ForwardPath) error {
+	if h[to.Mailbox.String()] {
+		return fmt.Errorf("quota exceeded for %s: %w", to.Mailbox, ErrRecipientDeferred)
+	}
+	return nil
+}
+
+func TestRecipientDeferred(t *testing.T) {
+	dh := &testDataHandler{}
+	clientConn, srv := startTestServer(t,
+		WithDataHandler(dh),
+		WithRcptHandler(quotaRcptHandler{"busy@example.com": true}),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<busy@example.com>")
+	if lines := c.expectCode(452); lines[0] != "4.2.1 Recipient deferred, try again later" {
+		t.Errorf("deferral reply = %q", lines[0])
+	}
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Hello")
+	c.expectCode(250)
+
+	if msg := dh.lastMessage(); len(msg.To) != 1 || msg.To[0].Mailbox.String() != "user@example.com" {
+		t.Errorf("message delivered to %v, want the accepted recipient only", msg.To)
+	}
+	if n := srv.Stats().RecipientsDeferred; n != 1 {
+		t.Errorf("RecipientsDeferred = %d, want 1", n)
+	}
+}
+
+// dsnRelayHandler records the RCPT TO parameters seen by OnRcptParams and
+// by OnData through RecipientParams.
+type dsnRelayHandler struct {
+	rcpt []RcptParams
+	data []RcptParams
+}
+
+func (h *dsnRelayHandler) OnRcpt(context.Context, smtp.ForwardPath) error {
+	return errors.New("OnRcpt called instead of OnRcptParams")
+}
+
+func (h *dsnRelayHandler) OnRcptParams(_ context.Context, to smtp.ForwardPath, params RcptParams) error {
+	h.rcpt = append(h.rcpt, params)
+	if to.Mailbox.LocalPart == "nobody" {
+		return smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeBadDest, "No such user")
+	}
+	return nil
+}
+
+func (h *dsnRelayHandler) OnData(ctx context.Context, _ smtp.ReversePath, _ []smtp.ForwardPath, r io.Reader) error {
+	h.data = RecipientParams(ctx)
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+func TestRcptParams(t *testing.T) {
+	h := &dsnRelayHandler{}
+	clientConn, _ := startTestServer(t, WithRcptHandler(h), WithDataHandler(h))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<a@example.com> NOTIFY=success,Failure ORCPT=rfc822;a+2Bold@example.org")
+	c.expectCode(250)
+	c.send("RCPT TO:<nobody@example.com> NOTIFY=NEVER")
+	c.expectCode(550)
+	c.send("RCPT TO:<b@example.com>")
+	c.expectCode(250)
+	for _, params := range []string{"NOTIFY=NEVER,SUCCESS", "NOTIFY=DELAY,DELAY", "NOTIFY=", "ORCPT=a@example.com", "ORCPT=rfc822;a+2", "ORCPT=rfc822;a+2b", "ORCPT=rfc822;a=b", "ORCPT=rfc822;a\x01"} {
+		c.send("RCPT TO:<c@example.com> " + params)
+		if lines := c.expectCode(501); !strings.HasPrefix(lines[0], "5.5.4 ") {
+			t.Errorf("%s: reply %q", params, lines[0])
+		}
+	}
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Hello")
+	c.expectCode(250)
+
+	first := RcptParams{Notify: []string{"SUCCESS", "FAILURE"}, ORCPT: "rfc822;a+old@example.org"}
+	if len(h.rcpt) != 3 || !reflect.DeepEqual(h.rcpt[0], first) || !reflect.DeepEqual(h.rcpt[1].Notify, []string{"NEVER"}) || !reflect.DeepEqual(h.rcpt[2], RcptParams{}) {
+		t.Errorf("OnRcptParams got %+v", h.rcpt)
+	}
+	if want := []RcptParams{first, {}}; !reflect.DeepEqual(h.data, want) {
+		t.Errorf("RecipientParams in OnData = %+v, want %+v", h.data, want)
+	}
+}
+
+func TestSessionAndMessageIDs(t *testing.T) {
+	handler := &idDataHandler{}
+	clientConn, srv := startTestServer(t, WithDataHandler(handler))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+
+	sessions := srv.activeSessions()
+	if len(sessions) != 1 || sessions[0].ID == "" {
+		t.Fatalf("active sessions = %+v, want one with an ID", sessions)
+	}
+	sessionID := sessions[0].ID
+
+	var queued []string
+	for range 2 {
+		c.send("MAIL FROM:<sender@example.com>")
+		c.expectCode(250)
+		c.send("RCPT TO:<user@example.com>")
+		c.expectCode(250)
+		c.send("DATA")
+		c.expectCode(354)
+		c.sendData("Hello")
+		lines := c.expectCode(250)
+
+		if handler.sessionID != sessionID {
+			t.Errorf("SessionID = %q, want %q", handler.sessionID, sessionID)
+		}
+		if handler.messageID == "" {
+			t.Fatal("MessageID is empty in OnData")
+		}
+		if want := "2.0.0 Ok: queued as " + handler.messageID; lines[0] != want {
+			t.Errorf("reply = %q, want %q", lines[0], want)
+		}
+		queued = append(queued, handler.messageID)
+	}
+	if queued[0] == queued[1] {
+		t.Errorf("both messages got ID %q", queued[0])
+	}
+}
+
+func TestLocalDomains(t *testing.T) {
+	clientConn, _ := startTestServer(t,
+		WithLocalDomains("example.com", "Example.ORG"),
+		WithAuthHandler(&testAuthHandler{}),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@elsewhere.net>")
+	c.expectCode(250)
+
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@EXAMPLE.org>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@sub.example.com>")
+	c.expectCode(554)
+	c.send("RCPT TO:<victim@elsewhere.net>")
+	if lines := c.expectCode(554); lines[0] != "5.7.1 Relay access denied" {
+		t.Errorf("reply = %q, want relay denial", lines[0])
+	}
+
+	// Authenticated clients may relay.
+	c.send("AUTH PLAIN AHRlc3R1c2VyAHRlc3RwYXNz")
+	c.expectCode(503) // Not allowed mid-transaction.
+	c.send("RSET")
+	c.expectCode(250)
+	c.send("AUTH PLAIN AHRlc3R1c2VyAHRlc3RwYXNz")
+	c.expectCode(235)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<friend@elsewhere.net>")
+	c.expectCode(250)
+}
+
+func TestLocalDomains_TrustedNetwork(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(
+		WithHostname("test.example.com"),
+		WithLocalDomains("example.com"),
+		WithTrustedNetworks(netip.MustParsePrefix("127.0.0.0/8")),
+	)
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := newConversation(t, conn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<app@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<customer@elsewhere.net>")
+	c.expectCode(250)
+}
+
+// commandRecorder records raw command lines and refuses lines starting
+// with "X-BAD". As a MailHandler it records CommandLine(ctx).
+type commandRecorder struct {
+	lines    []string
+	mailLine string
+}
+
+func (h *commandRecorder) OnCommand(_ context.Context, line string) error {
+	h.lines = append(h.lines, line)
+	if strings.HasPrefix(line, "X-BAD") {
+		return smtp.Errorf(smtp.ReplyTransactionFailed, smtp.EnhancedCodeNotAuthorized, "Signature matched")
+	}
+	return nil
+}
+
+func (h *commandRecorder) OnMail(ctx context.Context, _ smtp.ReversePath) error {
+	h.mailLine = CommandLine(ctx)
+	return nil
+}
+
+func TestCommandHandler(t *testing.T) {
+	handler := &commandRecorder{}
+	clientConn, _ := startTestServer(t, WithCommandHandler(handler), WithMailHandler(handler))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("ehlo  Client.Example.COM")
+	c.expectCode(250)
+	c.send("Mail From:<Sender@Example.com>  SIZE=10")
+	c.expectCode(250)
+	c.send("X-BAD payload")
+	if lines := c.expectCode(554); lines[0] != "5.7.1 Signature matched" {
+		t.Errorf("reply = %q, want the handler's rejection", lines[0])
+	}
+
+	want := []string{"ehlo  Client.Example.COM", "Mail From:<Sender@Example.com>  SIZE=10", "X-BAD payload"}
+	if !slices.Equal(handler.lines, want) {
+		t.Errorf("lines = %q, want %q", handler.lines, want)
+	}
+	if handler.mailLine != want[1] {
+		t.Errorf("CommandLine in OnMail = %q, want %q", handler.mailLine, want[1])
+	}
+}
+
+// lockedBuffer collects log output written from the session goroutine.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestSessionLogger(t *testing.T) {
+	var buf lockedBuffer
+	var gotID string
+	clientConn, _ := startTestServer(t,
+		WithLogger(slog.New(slog.DiscardHandler)),
+		WithSessionLogger(func(ctx context.Context, _ net.Addr) *slog.Logger {
+			gotID = SessionID(ctx)
+			return slog.New(slog.NewJSONHandler(&buf, nil)).With("tenant", "acme")
+		}),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Hello")
+	c.expectCode(250)
+
+	out := buf.String()
+	if gotID == "" {
+		t.Error("SessionID is empty in the session logger context")
+	}
+	if !strings.Contains(out, `"msg":"message accepted"`) || !strings.Contains(out, `"tenant":"acme"`) ||
+		!strings.Contains(out, `"session":"`+gotID+`"`) {
+		t.Errorf("log output = %s, want the accepted message tagged with tenant and session", out)
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	clientConn, _ := startTestServer(t, WithMaxLineLength(2048), WithBufferSizes(1024, 1024))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("NOOP " + strings.Repeat("x", 1500))
+	c.expectCode(250)
+}
+
+// connHandlerFunc adapts a function to ConnectionHandler.
+type connHandlerFunc func(ctx context.Context, addr net.Addr) error
+
+func (f connHandlerFunc) OnConnect(ctx context.Context, addr net.Addr) error { return f(ctx, addr) }
+
+func TestRejectSession(t *testing.T) {
+	clientConn, srv := startTestServer(t, WithConnectionHandler(connHandlerFunc(func(context.Context, net.Addr) error {
+		return fmt.Errorf("listed on a blocklist: %w", ErrRejectSession)
+	})))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	if lines := c.expectCode(554); lines[0] != "5.7.1 No SMTP service here" {
+		t.Errorf("greeting = %q", lines[0])
+	}
+	for _, cmd := range []string{"EHLO scanner.example", "MAIL FROM:<a@example.com>", "AUTH PLAIN"} {
+		c.send(cmd)
+		c.expectCode(503)
+	}
+	c.send("QUIT")
+	c.expectCode(221)
+	if _, err := c.reader.ReadString('\n'); err == nil {
+		t.Error("connection still open after QUIT")
+	}
+	if n := srv.Stats().ConnectionsRejected; n != 1 {
+		t.Errorf("ConnectionsRejected = %d, want 1", n)
+	}
+}
+
+// bounceRcptHandler accepts bounces only for recipients with a BATV tag.
+type bounceRcptHandler struct{}
+
+func (bounceRcptHandler) OnRcpt(ctx context.Context, to smtp.ForwardPath) error {
+	if _, ok := Sender(ctx); !ok {
+		return errors.New("no sender in the RCPT context")
+	}
+	if IsBounce(ctx) && !strings.HasPrefix(to.Mailbox.LocalPart, "prvs=") {
+		return smtp.Errorf(smtp.ReplyMailboxNotFound, smtp.EnhancedCodeNotAuthorized, "Bounce to unsigned address")
+	}
+	return nil
+}
+
+func TestSingleRecipientBounces(t *testing.T) {
+	clientConn, _ := startTestServer(t, WithRcptHandler(bounceRcptHandler{}), WithSingleRecipientBounces(true))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+
+	c.send("MAIL FROM:<>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(550)
+	c.send("RCPT TO:<prvs=1234abcd=user@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<prvs=1234abcd=other@example.com>")
+	if lines := c.expectCode(452); lines[0] != "4.5.3 Bounces must have a single recipient" {
+		t.Errorf("reply = %q", lines[0])
+	}
+	c.send("RSET")
+	c.expectCode(250)
+
+	// Other senders are not limited.
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<other@example.com>")
+	c.expectCode(250)
+}
+
+// blockingDataHandler waits in OnData until its context is canceled.
+type blockingDataHandler struct {
+	started chan struct{}
+	err     chan error
+}
+
+func (h *blockingDataHandler) OnData(ctx context.Context, _ smtp.ReversePath, _ []smtp.ForwardPath, r io.Reader) error {
+	io.Copy(io.Discard, r)
+	close(h.started)
+	<-ctx.Done()
+	h.err <- ctx.Err()
+	if SessionID(ctx) == "" {
+		h.err <- errors.New("session ID missing from the handler context")
+	}
+	return ctx.Err()
+}
+
+func TestHandlerContextCanceledOnClose(t *testing.T) {
+	h := &blockingDataHandler{started: make(chan struct{}), err: make(chan error, 2)}
+	clientConn, srv := startTestServer(t, WithDataHandler(h))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Subject: test\r\n\r\nhello")
+	<-h.started
+
+	srv.Close()
+	select {
+	case err := <-h.err:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("handler context error = %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler context not canceled by Close")
+	}
+	select {
+	case err := <-h.err:
+		t.Error(err)
+	default:
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	clientConn, _ := startTestServer(t, WithWriteTimeout(50*time.Millisecond))
+	defer clientConn.Close()
+
+	// A client that does not read the greeting is dropped.
+	time.Sleep(200 * time.Millisecond)
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := clientConn.Read(make([]byte, 512)); err != io.EOF {
+		t.Errorf("Read = %d, %v; want the connection closed", n, err)
+	}
+}
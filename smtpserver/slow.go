@@ -0,0 +1,59 @@
+package smtpserver
+
+import (
+	"fmt"
+	"time"
+)
+
+// WithSlowCommandThreshold logs a warning and emits an EventSlowCommand
+// for every command whose handling takes longer than d, naming the verb,
+// the duration and the handler type that served it. The time runs from
+// reading the command line to writing the final reply, so for DATA and
+// BDAT it includes the message transfer. Zero, the default, disables it.
+func WithSlowCommandThreshold(d time.Duration) Option {
+	return func(s *Server) { s.slowCommand = d }
+}
+
+// checkSlow reports verb if it took longer than the slow-command
+// threshold since start.
+func (s *session) checkSlow(verb string, start time.Time) {
+	if s.server.slowCommand <= 0 {
+		return
+	}
+	d := time.Since(start)
+	if d <= s.server.slowCommand {
+		return
+	}
+	handler := s.handlerFor(verb)
+	s.logger.Warn("slow command", "command", verb, "duration", d,
+		"remote", s.conn.NetConn().RemoteAddr(), "handler", handler)
+	s.emit(Event{Type: EventSlowCommand, Command: verb, Duration: d, Handler: handler})
+}
+
+// handlerFor returns the type name of the handler that serves verb, or ""
+// if there is none.
+func (s *session) handlerFor(verb string) string {
+	var h any
+	switch verb {
+	case "EHLO", "HELO":
+		h = s.heloHandler
+	case "MAIL":
+		h = s.mailHandler
+	case "RCPT":
+		h = s.rcptHandler
+	case "DATA", "BDAT":
+		h = s.dataHandler
+	case "RSET":
+		h = s.resetHandler
+	case "VRFY":
+		h = s.vrfyHandler
+	case "EXPN":
+		h = s.expnHandler
+	case "AUTH":
+		h = s.authHandler
+	}
+	if h == nil {
+		return ""
+	}
+	return fmt.Sprintf("%T", h)
+}
@@ -0,0 +1,147 @@
+package smtpserver
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// errSpoolFailed is the reply to a message that could not be written to
+// the spool.
+var errSpoolFailed = smtp.Errorf(smtp.ReplyInsufficientStorage, smtp.EnhancedCodeSystemFull, "Insufficient system storage")
+
+// WithSpool makes the server receive each message body in full before
+// calling the DataHandler, keeping memory bounded on busy servers: bodies
+// up to memoryLimit bytes are held in memory, and larger ones are written
+// to a temporary file in dir ("" for os.TempDir), removed once OnData
+// returns. The reader passed to OnData then implements io.ReadSeeker and
+// io.ReaderAt, so a handler can make several passes over the message.
+// Messages over the size limit or rejected by a content check are refused
+// without calling OnData. If the spool file cannot be written, the message
+// is refused with 452 4.3.1.
+//
+// Without WithSpool, OnData streams DATA bodies from the connection and
+// BDAT chunks are accumulated in memory.
+func WithSpool(dir string, memoryLimit int64) Option {
+	return func(s *Server) {
+		s.spooling = true
+		s.spoolDir = dir
+		s.spoolMemory = max(memoryLimit, 0)
+	}
+}
+
+// spoolBodies reports whether message bodies are received whole before
+// OnData: with WithSpool, or to journal them.
+func (s *Server) spoolBodies() bool {
+	return s.spooling || s.journal != nil
+}
+
+// spool holds a message body: in memory up to a limit, then in a
+// temporary file.
+type spool struct {
+	dir    string
+	memory int64 // Bytes held in memory before moving to a file; -1 for no limit.
+	buf    []byte
+	file   *os.File
+	size   int64
+	err    error // First error writing the file.
+}
+
+// newSpool returns an empty spool for a message body. Without WithSpool,
+// it never moves to a file.
+func (s *Server) newSpool() *spool {
+	if !s.spooling {
+		return &spool{memory: -1}
+	}
+	return &spool{dir: s.spoolDir, memory: s.spoolMemory}
+}
+
+// Len returns the number of bytes spooled, or 0 for a nil spool.
+func (sp *spool) Len() int64 {
+	if sp == nil {
+		return 0
+	}
+	return sp.size
+}
+
+func (sp *spool) Write(p []byte) (int, error) {
+	if err := sp.reserve(int64(len(p))); err != nil {
+		return 0, err
+	}
+	if sp.file == nil {
+		sp.buf = append(sp.buf, p...)
+		sp.size += int64(len(p))
+		return len(p), nil
+	}
+	n, err := sp.file.Write(p)
+	sp.size += int64(n)
+	if err != nil && sp.err == nil {
+		sp.err = err
+	}
+	return n, err
+}
+
+// readChunk appends exactly n bytes read from r. A failure to write the
+// file is recorded in sp.err; any other error comes from r.
+func (sp *spool) readChunk(r io.Reader, n int64) (int64, error) {
+	if err := sp.reserve(n); err != nil {
+		return 0, err
+	}
+	if sp.file != nil {
+		return io.CopyN(sp, r, n)
+	}
+	start := len(sp.buf)
+	sp.buf = slices.Grow(sp.buf, int(n))[:start+int(n)]
+	m, err := io.ReadFull(r, sp.buf[start:])
+	sp.buf = sp.buf[:start+m]
+	sp.size += int64(m)
+	return int64(m), err
+}
+
+// reserve moves the body to a file if n more bytes would take it over the
+// memory limit.
+func (sp *spool) reserve(n int64) error {
+	if sp.err != nil {
+		return sp.err
+	}
+	if sp.file != nil || sp.memory < 0 || sp.size+n <= sp.memory {
+		return nil
+	}
+	f, err := os.CreateTemp(sp.dir, "smtp-spool-*")
+	if err != nil {
+		sp.err = err
+		return err
+	}
+	sp.file = f
+	if _, err := f.Write(sp.buf); err != nil {
+		sp.err = err
+		return err
+	}
+	sp.buf = nil
+	return nil
+}
+
+// reader returns a reader over the spooled body.
+func (sp *spool) reader() *io.SectionReader {
+	if sp.file != nil {
+		return io.NewSectionReader(sp.file, 0, sp.size)
+	}
+	return io.NewSectionReader(bytes.NewReader(sp.buf), 0, sp.size)
+}
+
+// close releases the body, removing its file if any. It accepts a nil
+// spool.
+func (sp *spool) close() {
+	if sp == nil {
+		return
+	}
+	if sp.file != nil {
+		sp.file.Close()
+		os.Remove(sp.file.Name())
+		sp.file = nil
+	}
+	sp.buf = nil
+}
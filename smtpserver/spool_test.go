@@ -0,0 +1,148 @@
+package smtpserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// spoolCheckHandler reads each message twice through io.Seeker and
+// records the body and the number of files in dir while OnData runs.
+type spoolCheckHandler struct {
+	dir    string
+	bodies []string
+	files  []int
+}
+
+func (h *spoolCheckHandler) OnData(_ context.Context, _ smtp.ReversePath, _ []smtp.ForwardPath, r io.Reader) error {
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		return fmt.Errorf("body is a %T, not an io.ReadSeeker", r)
+	}
+	first, err := io.ReadAll(rs)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	second, err := io.ReadAll(rs)
+	if err != nil {
+		return err
+	}
+	if string(first) != string(second) {
+		return fmt.Errorf("second pass read %q, first %q", second, first)
+	}
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return err
+	}
+	h.bodies = append(h.bodies, string(first))
+	h.files = append(h.files, len(entries))
+	return nil
+}
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	h := &spoolCheckHandler{dir: dir}
+	clientConn, _ := startTestServer(t, WithDataHandler(h), WithSpool(dir, 100), WithMaxMessageSize(1000), WithRejectNUL(true))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+
+	large := "Subject: large\r\n\r\n" + strings.Repeat("x", 200)
+	transaction := func() {
+		t.Helper()
+		c.send("MAIL FROM:<sender@example.com>")
+		c.expectCode(250)
+		c.send("RCPT TO:<user@example.com>")
+		c.expectCode(250)
+	}
+
+	transaction()
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Subject: small\r\n\r\nhi")
+	c.expectCode(250)
+
+	transaction()
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData(large)
+	c.expectCode(250)
+
+	transaction()
+	c.sendChunk(large[:150], false)
+	c.expectCode(250)
+	c.sendChunk(large[150:], true)
+	c.expectCode(250)
+
+	want := []string{"Subject: small\r\n\r\nhi\r\n", large + "\r\n", large}
+	if fmt.Sprint(h.bodies) != fmt.Sprint(want) {
+		t.Errorf("bodies = %q, want %q", h.bodies, want)
+	}
+	if fmt.Sprint(h.files) != "[0 1 1]" {
+		t.Errorf("spool files during OnData = %v, want [0 1 1]", h.files)
+	}
+
+	// Oversized and rejected bodies never reach the handler.
+	transaction()
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData(strings.Repeat("x", 2000))
+	c.expectCode(552)
+	transaction()
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData(large + "\x00")
+	c.expectCode(554)
+	if len(h.bodies) != 3 {
+		t.Errorf("handler called for %d messages, want 3", len(h.bodies))
+	}
+
+	c.send("QUIT")
+	c.expectCode(221)
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d spool files left behind", len(entries))
+	}
+}
+
+func TestSpoolWriteFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	clientConn, _ := startTestServer(t, WithDataHandler(&testDataHandler{}), WithSpool(dir, 10))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData(strings.Repeat("x", 100))
+	if lines := c.expectCode(452); lines[0] != "4.3.1 Insufficient system storage" {
+		t.Errorf("reply = %q", lines[0])
+	}
+
+	// A BDAT chunk that cannot be stored is still consumed.
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.sendChunk(strings.Repeat("x", 100), true)
+	c.expectCode(452)
+	c.send("NOOP")
+	c.expectCode(250)
+}
@@ -0,0 +1,31 @@
+package smtpserver
+
+import (
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// WithStallTimeout aborts a DATA or BDAT transfer during which no bytes
+// arrive for d, replying 451 and closing the connection. It is separate
+// from the read timeout, which bounds the whole transfer: a client
+// trickling a message byte by byte (slowloris) is dropped after d of
+// silence instead of holding its session and connection slot for the full
+// read timeout. Stalls are logged and emitted as EventTransferStalled.
+// Zero, the default, disables it.
+func WithStallTimeout(d time.Duration) Option {
+	return func(s *Server) { s.stallTimeout = d }
+}
+
+// abortStalled ends a transfer that stalled after received bytes. The
+// rest of the message can no longer be told apart from commands, so the
+// session ends after the reply.
+func (s *session) abortStalled(received int64) {
+	s.logger.Warn("data transfer stalled", "message", s.msgID, "received", received,
+		"remote", s.conn.NetConn().RemoteAddr(), "timeout", s.server.stallTimeout)
+	s.emit(Event{Type: EventTransferStalled, MessageID: s.msgID, Size: received, Duration: s.server.stallTimeout})
+	s.reply(smtp.ReplyLocalError, smtp.EnhancedCodeBadConnection, "Transfer stalled, closing connection")
+	s.resetTransaction()
+	s.setState(stateGreeted)
+	s.closing = true
+}
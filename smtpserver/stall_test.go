@@ -0,0 +1,65 @@
+package smtpserver
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStallTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		start func(c *smtpConversation)
+	}{
+		{"DATA", func(c *smtpConversation) {
+			c.send("DATA")
+			c.expectCode(354)
+			c.send("Subject: partial")
+		}},
+		{"BDAT", func(c *smtpConversation) {
+			c.send("BDAT 100 LAST")
+			c.send("only part of the chunk")
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			events := &testEventHandler{}
+			handler := &testDataHandler{}
+			clientConn, _ := startTestServer(t,
+				WithDataHandler(handler),
+				WithEventHandler(events),
+				WithStallTimeout(50*time.Millisecond),
+			)
+			defer clientConn.Close()
+
+			c := newConversation(t, clientConn)
+			c.expectCode(220)
+			c.send("EHLO client.example.com")
+			c.expectCode(250)
+			c.send("MAIL FROM:<sender@example.com>")
+			c.expectCode(250)
+			c.send("RCPT TO:<user@example.com>")
+			c.expectCode(250)
+			start := time.Now()
+			tt.start(c)
+
+			lines := c.expectCode(451)
+			if !strings.HasPrefix(lines[0], "4.4.2 ") {
+				t.Errorf("reply = %q, want enhanced code 4.4.2", lines[0])
+			}
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("stall detected after %v, want about 50ms", d)
+			}
+			if _, err := c.reader.ReadByte(); err != io.EOF {
+				t.Errorf("connection still open after stall: %v", err)
+			}
+			ev, ok := events.find(EventTransferStalled)
+			if !ok || ev.Size == 0 {
+				t.Errorf("stall event = %+v, %v; want one with the bytes received", ev, ok)
+			}
+			if len(handler.messages) != 0 {
+				t.Errorf("stalled message was delivered")
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package smtpserver
+
+import (
+	"encoding/json"
+	"expvar"
+	"math"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a point-in-time snapshot of server counters and gauges.
+// Counters are cumulative since the server was created.
+type Stats struct {
+	ConnectionsTotal     int64 // Connections accepted.
+	ConnectionsActive    int64 // Sessions currently open.
+	ConnectionsRejected  int64 // Connections refused by policy, e.g. the access list or ConnectionHandler.
+	ConnectionsShed      int64 // Connections refused by the load checker.
+	ConnectionsOverLimit int64 // Connections refused by WithMaxConnections.
+	AcceptsThrottled     int64 // Accepts delayed by WithAcceptRate.
+	MessagesAccepted     int64
+	MessagesRejected     int64 // Messages refused after DATA/BDAT.
+	RecipientsDeferred   int64 // RCPT commands refused with a 4xx reply.
+	BytesReceived        int64 // Message bytes of accepted messages.
+	AuthSuccesses        int64
+	AuthFailures         int64
+
+	// Sessions maps a session state name ("new", "greeted", "mail",
+	// "rcpt", "data") to the number of open sessions in that state.
+	Sessions map[string]int64
+
+	// Commands maps a command verb ("MAIL", "DATA", ...) to the time the
+	// server spent on it, from reading the command line to sending the
+	// final reply. For DATA and BDAT this includes receiving the message.
+	// Verbs never received are omitted.
+	Commands map[string]LatencyStats
+
+	// Transactions is the time from accepting MAIL FROM to the final
+	// reply to the message, including the client's round trips. Compared
+	// with Commands, it tells a slow network or client from slow handlers.
+	Transactions LatencyStats
+}
+
+// LatencyStats summarizes a latency distribution. The quantiles are
+// estimated from power-of-two buckets starting at 100µs, so they are
+// accurate to within a factor of two.
+type LatencyStats struct {
+	Count int64
+	Total time.Duration
+	P50   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// SessionSummary describes an active session in debug output.
+type SessionSummary struct {
+	ID         string    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Started    time.Time `json:"started"`
+	State      string    `json:"state"`
+	Hostname   string    `json:"hostname,omitempty"` // EHLO/HELO identity.
+}
+
+// serverStats holds the live counters behind Stats.
+type serverStats struct {
+	connectionsTotal     atomic.Int64
+	connectionsActive    atomic.Int64
+	connectionsRejected  atomic.Int64
+	connectionsShed      atomic.Int64
+	connectionsOverLimit atomic.Int64
+	acceptsThrottled     atomic.Int64
+	messagesAccepted     atomic.Int64
+	messagesRejected     atomic.Int64
+	recipientsDeferred   atomic.Int64
+	bytesReceived        atomic.Int64
+	authSuccesses        atomic.Int64
+	authFailures         atomic.Int64
+	states               [stateData + 1]atomic.Int64
+	commands             [len(statVerbs)]histogram
+	transactions         histogram
+}
+
+// statVerbs lists the commands whose latency is recorded. QUIT ends the
+// session before it is measured, and unknown verbs are not worth keeping.
+var statVerbs = [...]string{"EHLO", "HELO", "MAIL", "RCPT", "DATA", "BDAT", "RSET", "NOOP", "VRFY", "EXPN", "AUTH", "STARTTLS"}
+
+// observeCommand records the processing time of a command.
+func (st *serverStats) observeCommand(verb string, d time.Duration) {
+	for i, v := range statVerbs {
+		if v == verb {
+			st.commands[i].observe(d)
+			return
+		}
+	}
+}
+
+// histogramBase is the upper bound of the first histogram bucket; each
+// following bucket doubles it, up to about 14 minutes.
+const (
+	histogramBase    = 100 * time.Microsecond
+	histogramBuckets = 24
+)
+
+// histogram is a lock-free latency histogram. The zero value is ready to use.
+type histogram struct {
+	count   atomic.Int64
+	total   atomic.Int64
+	max     atomic.Int64
+	buckets [histogramBuckets + 1]atomic.Int64 // The last one is unbounded.
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < histogramBuckets && d >= histogramBase<<i {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.total.Add(int64(d))
+	for {
+		m := h.max.Load()
+		if int64(d) <= m || h.max.CompareAndSwap(m, int64(d)) {
+			break
+		}
+	}
+}
+
+// snapshot summarizes the histogram. Concurrent observations may make the
+// fields slightly inconsistent with each other.
+func (h *histogram) snapshot() LatencyStats {
+	var counts [histogramBuckets + 1]int64
+	var n int64
+	for i := range h.buckets {
+		counts[i] = h.buckets[i].Load()
+		n += counts[i]
+	}
+	ls := LatencyStats{
+		Count: h.count.Load(),
+		Total: time.Duration(h.total.Load()),
+		Max:   time.Duration(h.max.Load()),
+	}
+	ls.P50 = quantile(counts[:], n, 0.50, ls.Max)
+	ls.P99 = quantile(counts[:], n, 0.99, ls.Max)
+	return ls
+}
+
+// quantile returns the upper bound of the bucket holding the q-quantile of
+// n observations, capped at the largest one seen.
+func quantile(counts []int64, n int64, q float64, maxSeen time.Duration) time.Duration {
+	if n == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(n)))
+	var seen int64
+	for i, c := range counts {
+		seen += c
+		if seen >= rank && i < histogramBuckets {
+			return min(histogramBase<<i, maxSeen)
+		}
+	}
+	return maxSeen
+}
+
+// String returns the lowercase name of the state used in stats output.
+func (st sessionState) String() string {
+	switch st {
+	case stateNew:
+		return "new"
+	case stateGreeted:
+		return "greeted"
+	case stateMail:
+		return "mail"
+	case stateRcpt:
+		return "rcpt"
+	case stateData:
+		return "data"
+	}
+	return "unknown"
+}
+
+// Stats returns a snapshot of the server's counters and per-state gauges.
+func (s *Server) Stats() Stats {
+	st := Stats{
+		ConnectionsTotal:     s.stats.connectionsTotal.Load(),
+		ConnectionsActive:    s.stats.connectionsActive.Load(),
+		ConnectionsRejected:  s.stats.connectionsRejected.Load(),
+		ConnectionsShed:      s.stats.connectionsShed.Load(),
+		ConnectionsOverLimit: s.stats.connectionsOverLimit.Load(),
+		AcceptsThrottled:     s.stats.acceptsThrottled.Load(),
+		MessagesAccepted:     s.stats.messagesAccepted.Load(),
+		MessagesRejected:     s.stats.messagesRejected.Load(),
+		RecipientsDeferred:   s.stats.recipientsDeferred.Load(),
+		BytesReceived:        s.stats.bytesReceived.Load(),
+		AuthSuccesses:        s.stats.authSuccesses.Load(),
+		AuthFailures:         s.stats.authFailures.Load(),
+		Sessions:             make(map[string]int64, len(s.stats.states)),
+		Commands:             make(map[string]LatencyStats),
+		Transactions:         s.stats.transactions.snapshot(),
+	}
+	for i := range s.stats.states {
+		st.Sessions[sessionState(i).String()] = s.stats.states[i].Load()
+	}
+	for i, verb := range statVerbs {
+		if ls := s.stats.commands[i].snapshot(); ls.Count > 0 {
+			st.Commands[verb] = ls
+		}
+	}
+	return st
+}
+
+// PublishExpvar publishes the server's Stats under the given expvar name,
+// making them available at /debug/vars. Like expvar.Publish, it panics if
+// the name is already registered.
+func (s *Server) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any { return s.Stats() }))
+}
+
+// DebugHandler returns an http.Handler that dumps the server's Stats and
+// a summary of every active session as JSON. It exposes client addresses,
+// so mount it only on an internal listener.
+func (s *Server) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			Stats    Stats            `json:"stats"`
+			Sessions []SessionSummary `json:"sessions"`
+		}{s.Stats(), s.activeSessions()})
+	})
+}
+
+// activeSessions returns a summary of the open sessions, oldest first.
+func (s *Server) activeSessions() []SessionSummary {
+	s.mu.Lock()
+	list := make([]SessionSummary, 0, len(s.sessions))
+	for sess := range s.sessions {
+		list = append(list, *sess.summary.Load())
+	}
+	s.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+// trackSession registers or unregisters an active session.
+func (s *Server) trackSession(sess *session, active bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if active {
+		if s.sessions == nil {
+			s.sessions = make(map[*session]struct{})
+		}
+		s.sessions[sess] = struct{}{}
+		s.stats.connectionsActive.Add(1)
+		s.stats.states[sess.state].Add(1)
+	} else {
+		delete(s.sessions, sess)
+		s.stats.connectionsActive.Add(-1)
+		s.stats.states[sess.state].Add(-1)
+	}
+}
@@ -0,0 +1,139 @@
+package smtpserver
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	clientConn, srv := startTestServer(t,
+		WithDataHandler(&testDataHandler{}),
+		WithAuthHandler(&testAuthHandler{}),
+	)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+
+	// Bad credentials (user "baduser"), then good ones.
+	c.send("AUTH PLAIN AGJhZHVzZXIAYmFkcGFzcw==")
+	c.expectCode(535)
+	c.send("AUTH PLAIN AHRlc3R1c2VyAHRlc3RwYXNz")
+	c.expectCode(235)
+
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+	c.send("RCPT TO:<user@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Hello")
+	c.expectCode(250)
+
+	c.send("MAIL FROM:<sender@example.com>")
+	c.expectCode(250)
+
+	st := srv.Stats()
+	if st.ConnectionsTotal != 1 || st.ConnectionsActive != 1 {
+		t.Errorf("connections total/active = %d/%d, want 1/1", st.ConnectionsTotal, st.ConnectionsActive)
+	}
+	if st.MessagesAccepted != 1 {
+		t.Errorf("MessagesAccepted = %d, want 1", st.MessagesAccepted)
+	}
+	if st.BytesReceived != int64(len("Hello\r\n")) {
+		t.Errorf("BytesReceived = %d, want %d", st.BytesReceived, len("Hello\r\n"))
+	}
+	if st.AuthSuccesses != 1 || st.AuthFailures != 1 {
+		t.Errorf("auth successes/failures = %d/%d, want 1/1", st.AuthSuccesses, st.AuthFailures)
+	}
+	if st.Sessions["mail"] != 1 || st.Sessions["greeted"] != 0 {
+		t.Errorf("Sessions = %v, want one session in state mail", st.Sessions)
+	}
+	// The second MAIL is recorded after its reply, so it may not show yet.
+	for verb, want := range map[string]int64{"EHLO": 1, "AUTH": 2, "RCPT": 1, "DATA": 1} {
+		if got := st.Commands[verb].Count; got != want {
+			t.Errorf("Commands[%s].Count = %d, want %d", verb, got, want)
+		}
+	}
+	if _, ok := st.Commands["NOOP"]; ok {
+		t.Error("Commands lists a verb never received")
+	}
+	if tx := st.Transactions; tx.Count != 1 || tx.Total <= 0 || tx.P99 > tx.Max {
+		t.Errorf("Transactions = %+v, want one completed transaction", tx)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	if ls := h.snapshot(); ls != (LatencyStats{}) {
+		t.Errorf("empty histogram = %+v", ls)
+	}
+	for range 98 {
+		h.observe(time.Millisecond)
+	}
+	h.observe(50 * time.Millisecond)
+	h.observe(time.Hour)
+
+	ls := h.snapshot()
+	if ls.Count != 100 || ls.Max != time.Hour {
+		t.Errorf("count/max = %d/%v, want 100/1h", ls.Count, ls.Max)
+	}
+	if ls.P50 < time.Millisecond || ls.P50 > 2*time.Millisecond {
+		t.Errorf("P50 = %v, want within a factor of two of 1ms", ls.P50)
+	}
+	if ls.P99 < 50*time.Millisecond || ls.P99 > 100*time.Millisecond {
+		t.Errorf("P99 = %v, want within a factor of two of 50ms", ls.P99)
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	clientConn, srv := startTestServer(t)
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+
+	rec := httptest.NewRecorder()
+	srv.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/smtp", nil))
+
+	var dump struct {
+		Stats    Stats
+		Sessions []SessionSummary
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &dump); err != nil {
+		t.Fatalf("decoding debug output: %v\n%s", err, rec.Body.String())
+	}
+	if len(dump.Sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(dump.Sessions))
+	}
+	if s := dump.Sessions[0]; s.State != "greeted" || s.Hostname != "client.example.com" {
+		t.Errorf("session = %+v, want greeted client.example.com", s)
+	}
+	if dump.Stats.ConnectionsActive != 1 {
+		t.Errorf("ConnectionsActive = %d, want 1", dump.Stats.ConnectionsActive)
+	}
+}
+
+func TestPublishExpvar(t *testing.T) {
+	srv := NewServer()
+	srv.PublishExpvar("smtpserver_test")
+
+	v := expvar.Get("smtpserver_test")
+	if v == nil {
+		t.Fatal("expvar not published")
+	}
+	var st Stats
+	if err := json.Unmarshal([]byte(v.String()), &st); err != nil {
+		t.Fatalf("decoding expvar: %v", err)
+	}
+	if st.ConnectionsTotal != 0 {
+		t.Errorf("ConnectionsTotal = %d, want 0", st.ConnectionsTotal)
+	}
+}
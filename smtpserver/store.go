@@ -0,0 +1,139 @@
+package smtpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// ErrMessageNotFound is returned by a MessageStore for an unknown ID.
+var ErrMessageNotFound = errors.New("smtp: message not found")
+
+// MessageStore persists accepted messages for features that hold mail
+// after the SMTP transaction, such as quarantine and archiving, with
+// their envelope. The envelope's ID is the store ID. Implementations must
+// be safe for concurrent use.
+type MessageStore interface {
+	// Save stores the message and returns its ID: env.ID if set,
+	// otherwise a new one.
+	Save(ctx context.Context, env *smtp.Envelope, body io.Reader) (string, error)
+	// Open returns the envelope and body of a stored message. The caller
+	// must close the body.
+	Open(ctx context.Context, id string) (*smtp.Envelope, io.ReadCloser, error)
+	// Delete removes a stored message.
+	Delete(ctx context.Context, id string) error
+	// List returns the IDs of all stored messages in sorted order.
+	List(ctx context.Context) ([]string, error)
+}
+
+// FileStore is a MessageStore that keeps each message in a directory as
+// <id>.eml, with the envelope in a <id>.json sidecar. Files are written
+// to a temporary name and renamed, and the sidecar is written last, so a
+// message is listed only once it is complete.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a FileStore rooted at dir, creating the directory
+// if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("smtp: message store: %w", err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Save implements MessageStore.
+func (st *FileStore) Save(_ context.Context, env *smtp.Envelope, body io.Reader) (string, error) {
+	id := env.ID
+	if id == "" {
+		id = newID()
+	}
+	if !validStoreID(id) {
+		return "", fmt.Errorf("smtp: message store: invalid ID %q", id)
+	}
+
+	stored := *env
+	stored.ID = id
+	if err := WriteEML(st.path(id), &stored, body); err != nil {
+		return "", fmt.Errorf("smtp: message store: %w", err)
+	}
+	return id, nil
+}
+
+// Open implements MessageStore.
+func (st *FileStore) Open(_ context.Context, id string) (*smtp.Envelope, io.ReadCloser, error) {
+	if !validStoreID(id) {
+		return nil, nil, ErrMessageNotFound
+	}
+	env, body, err := ReadEML(st.path(id))
+	if err != nil {
+		return nil, nil, storeError(err)
+	}
+	env.ID = id
+	return env, body, nil
+}
+
+// path returns the message file path of id.
+func (st *FileStore) path(id string) string {
+	return filepath.Join(st.dir, id+".eml")
+}
+
+// Delete implements MessageStore. The sidecar is removed first so a
+// partially deleted message is no longer listed.
+func (st *FileStore) Delete(_ context.Context, id string) error {
+	if !validStoreID(id) {
+		return ErrMessageNotFound
+	}
+	if err := os.Remove(SidecarPath(st.path(id))); err != nil {
+		return storeError(err)
+	}
+	if err := os.Remove(st.path(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return storeError(err)
+	}
+	return nil
+}
+
+// List implements MessageStore.
+func (st *FileStore) List(_ context.Context) ([]string, error) {
+	entries, err := os.ReadDir(st.dir)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: message store: %w", err)
+	}
+	var ids []string
+	for _, e := range entries {
+		if id, ok := strings.CutSuffix(e.Name(), ".json"); ok && validStoreID(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func storeError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrMessageNotFound
+	}
+	return fmt.Errorf("smtp: message store: %w", err)
+}
+
+// validStoreID reports whether id is safe to use as a file name.
+func validStoreID(id string) bool {
+	if id == "" || id[0] == '.' || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
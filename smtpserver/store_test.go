@@ -0,0 +1,137 @@
+package smtpserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// recipients returns the envelope recipients for addrs, without DSN
+// parameters.
+func recipients(addrs ...string) []smtp.Recipient {
+	var to []smtp.Recipient
+	for _, fp := range rcpts(addrs...) {
+		to = append(to, smtp.Recipient{Address: fp})
+	}
+	return to
+}
+
+func TestFileStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	st, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	ctx := context.Background()
+
+	received := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	env := &smtp.Envelope{
+		From:     smtp.ReversePath{Mailbox: smtp.Mailbox{LocalPart: "a", Domain: "example.com"}},
+		To:       recipients("x@example.com", "y@example.org"),
+		Client:   smtp.ClientInfo{RemoteAddr: "192.0.2.1:4321", Helo: "client.example.com"},
+		Received: received,
+	}
+	id, err := st.Save(ctx, env, strings.NewReader("Subject: hi\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, id+".json")); err != nil {
+		t.Errorf("sidecar missing: %v", err)
+	}
+
+	null, err := st.Save(ctx, &smtp.Envelope{ID: "bounce-1", From: smtp.ReversePath{Null: true}, To: recipients("x@example.com")}, strings.NewReader("x"))
+	if err != nil || null != "bounce-1" {
+		t.Fatalf("Save with ID = %q, %v", null, err)
+	}
+
+	ids, err := st.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("List = %v, want 2 IDs", ids)
+	}
+
+	got, body, err := st.Open(ctx, id)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "Subject: hi\r\n\r\nbody\r\n" {
+		t.Errorf("body = %q", data)
+	}
+	if got.ID != id || got.From.Mailbox.String() != "a@example.com" || len(got.To) != 2 ||
+		got.To[1].Address.Mailbox.String() != "y@example.org" || !got.Received.Equal(received) ||
+		got.Client != env.Client {
+		t.Errorf("envelope = %+v", got)
+	}
+
+	got, body, err = st.Open(ctx, "bounce-1")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	body.Close()
+	if !got.From.Null {
+		t.Errorf("From = %v, want null sender", got.From)
+	}
+
+	if err := st.Delete(ctx, id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, err := st.Open(ctx, id); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("Open after Delete = %v, want ErrMessageNotFound", err)
+	}
+	if err := st.Delete(ctx, id); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("second Delete = %v, want ErrMessageNotFound", err)
+	}
+	if _, _, err := st.Open(ctx, "../etc/passwd"); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("Open with path = %v, want ErrMessageNotFound", err)
+	}
+	if _, err := st.Save(ctx, &smtp.Envelope{ID: "../x"}, strings.NewReader("")); err == nil {
+		t.Error("Save accepted an ID with a path separator")
+	}
+}
+
+func TestEMLRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixture.eml")
+	env := &smtp.Envelope{
+		ID:       "fixture",
+		From:     smtp.ReversePath{Mailbox: smtp.Mailbox{LocalPart: "a", Domain: "example.com"}},
+		To:       recipients("x@example.com"),
+		Client:   smtp.ClientInfo{SessionID: "S1"},
+		Received: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+	}
+	if err := WriteEML(path, env, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("WriteEML: %v", err)
+	}
+	if SidecarPath(path) != filepath.Join(filepath.Dir(path), "fixture.json") {
+		t.Errorf("SidecarPath = %q", SidecarPath(path))
+	}
+
+	got, body, err := ReadEML(path)
+	if err != nil {
+		t.Fatalf("ReadEML: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "Subject: hi\r\n\r\nbody\r\n" {
+		t.Errorf("body = %q", data)
+	}
+	if got.ID != "fixture" || got.From.String() != "<a@example.com>" || len(got.To) != 1 ||
+		!got.Received.Equal(env.Received) || got.Client.SessionID != "S1" {
+		t.Errorf("envelope = %+v, want %+v", got, env)
+	}
+
+	if _, _, err := ReadEML(filepath.Join(t.TempDir(), "missing.eml")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadEML(missing) = %v, want fs.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,106 @@
+package smtpserver
+
+import (
+	"strings"
+
+	"github.com/alexisbouchez/smtp.go"
+)
+
+// WithStrictSyntax enforces RFC 5321 command syntax exactly instead of
+// tolerating common client mistakes:
+//
+//   - DATA, RSET, QUIT and STARTTLS take no arguments (501 5.5.4);
+//   - HELO and EHLO take exactly one domain or address literal (501 5.5.4);
+//   - MAIL FROM: and RCPT TO: must be followed by the path with no
+//     space in between (501 5.5.2);
+//   - MAIL and RCPT parameters must be well formed (501 5.5.4) and
+//     belong to an advertised extension (555 5.5.4).
+//
+// It suits protocol test harnesses and hardened MX hosts.
+func WithStrictSyntax() Option {
+	return func(s *Server) { s.strictSyntax = true }
+}
+
+// rejectArgs replies 501 and returns true if strict syntax is enabled and
+// a command that takes no arguments has some.
+func (s *session) rejectArgs(verb, args string) bool {
+	if !s.server.strictSyntax || args == "" {
+		return false
+	}
+	s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeInvalidParams, "Syntax: "+verb+" takes no parameters")
+	return true
+}
+
+// rejectHeloArgs replies 501 and returns true if strict syntax is enabled
+// and the HELO/EHLO argument is not a single word.
+func (s *session) rejectHeloArgs(verb, args string) bool {
+	if !s.server.strictSyntax || !strings.ContainsAny(args, " \t") {
+		return false
+	}
+	s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeInvalidParams, "Syntax: "+verb+" <domain>")
+	return true
+}
+
+// checkStrictPath applies the strict rules to the text after "FROM:" or
+// "TO:": the path must follow the colon directly, and each parameter
+// must be well formed and one of verb's in paramExtensions, with its
+// extension offered. It replies and returns false on a violation.
+func (s *session) checkStrictPath(verb, pathAndParams string) bool {
+	if !s.server.strictSyntax {
+		return true
+	}
+	if strings.HasPrefix(pathAndParams, " ") || strings.HasPrefix(pathAndParams, "\t") {
+		s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeSyntaxError, "Syntax: no space allowed before the path")
+		return false
+	}
+	_, params, _ := strings.Cut(pathAndParams, " ")
+	for _, param := range strings.Split(params, " ") {
+		if param == "" {
+			if params != "" {
+				s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeInvalidParams, "Syntax: parameters must be separated by a single space")
+				return false
+			}
+			continue
+		}
+		keyword, value, hasValue := strings.Cut(param, "=")
+		if !validParamKeyword(keyword) || (hasValue && !validParamValue(value)) {
+			s.reply(smtp.ReplySyntaxParamError, smtp.EnhancedCodeInvalidParams, "Malformed parameter")
+			return false
+		}
+		keyword = strings.ToUpper(keyword)
+		if spec, ok := paramExtensions[keyword]; !ok || spec.verb != verb || !s.offers(spec.ext) {
+			s.reply(smtp.ReplyMailRcptParamError, smtp.EnhancedCodeInvalidParams, "Unsupported parameter "+keyword)
+			return false
+		}
+	}
+	return true
+}
+
+// validParamKeyword checks esmtp-keyword = (ALPHA / DIGIT) *(ALPHA / DIGIT / "-"),
+// which is also the grammar of ehlo-keyword.
+func validParamKeyword(k string) bool {
+	if k == "" || k[0] == '-' {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		c := k[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// validParamValue checks esmtp-value = 1*(%d33-60 / %d62-126), allowing
+// UTF-8 as RFC 6531 does.
+func validParamValue(v string) bool {
+	if v == "" {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; c < 33 || c == '=' || c == 127 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package smtpserver
+
+import "testing"
+
+func TestStrictSyntax(t *testing.T) {
+	handler := &testDataHandler{}
+	clientConn, _ := startTestServer(t, WithStrictSyntax(), WithDataHandler(handler))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client example")
+	c.expectCode(501)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+
+	c.send("MAIL FROM: <sender@example.com>")
+	c.expectCode(501)
+	c.send("MAIL FROM:<sender@example.com> X-FOO=1")
+	c.expectCode(555)
+	c.send("MAIL FROM:<sender@example.com> SIZE=")
+	c.expectCode(501)
+	c.send("MAIL FROM:<sender@example.com> AUTH=<>")
+	c.expectCode(555) // No AuthHandler, so AUTH is not advertised.
+	c.send("MAIL FROM:<sender@example.com> NOTIFY=NEVER")
+	c.expectCode(555) // A RCPT parameter.
+	c.send("MAIL FROM:<sender@example.com> SIZE=100 BODY=8BITMIME")
+	c.expectCode(250)
+
+	c.send("RCPT TO:<rcpt@example.com> NOTIFY=NEVER FOO")
+	c.expectCode(555)
+	c.send("RCPT TO:<rcpt@example.com>  NOTIFY=NEVER")
+	c.expectCode(501)
+	c.send("RCPT TO:<rcpt@example.com> NOTIFY=NEVER")
+	c.expectCode(250)
+
+	c.send("DATA now")
+	c.expectCode(501)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Subject: Strict\r\n\r\nBody")
+	c.expectCode(250)
+
+	c.send("RSET please")
+	c.expectCode(501)
+	c.send("QUIT now")
+	c.expectCode(501) // The session stays open.
+	c.send("NOOP")
+	c.expectCode(250)
+	c.send("QUIT")
+	c.expectCode(221)
+
+	if got := handler.lastMessage().From.Mailbox.String(); got != "sender@example.com" {
+		t.Errorf("From = %q, want sender@example.com", got)
+	}
+}
+
+func TestStrictSyntax_UnofferedExtension(t *testing.T) {
+	clientConn, _ := startTestServer(t, WithStrictSyntax(), WithMaxMessageSize(0))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM:<sender@example.com> SIZE=100")
+	c.expectCode(555) // No size limit, so SIZE is not advertised.
+	c.send("MAIL FROM:<sender@example.com> BODY=8BITMIME")
+	c.expectCode(250)
+}
+
+func TestLenientSyntax_SpaceBeforePath(t *testing.T) {
+	handler := &testDataHandler{}
+	clientConn, _ := startTestServer(t, WithDataHandler(handler))
+	defer clientConn.Close()
+
+	c := newConversation(t, clientConn)
+	c.expectCode(220)
+	c.send("EHLO client.example.com")
+	c.expectCode(250)
+	c.send("MAIL FROM: <sender@example.com> X-FOO=1")
+	c.expectCode(250)
+	c.send("RCPT TO: <rcpt@example.com>")
+	c.expectCode(250)
+	c.send("DATA")
+	c.expectCode(354)
+	c.sendData("Subject: Lenient\r\n\r\nBody")
+	c.expectCode(250)
+
+	msg := handler.lastMessage()
+	if got := msg.From.Mailbox.String(); got != "sender@example.com" {
+		t.Errorf("From = %q, want sender@example.com", got)
+	}
+	if len(msg.To) != 1 || msg.To[0].Mailbox.String() != "rcpt@example.com" {
+		t.Errorf("To = %v, want [rcpt@example.com]", msg.To)
+	}
+}